@@ -0,0 +1,39 @@
+package auth
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// DefaultTokenTTL is how long an issued token stays valid
+const DefaultTokenTTL = 24 * time.Hour
+
+type Config struct {
+	Secret   []byte        // Key that tokens are signed with
+	TokenTTL time.Duration // How long an issued token stays valid
+}
+
+// LoadConfig reads the signing key from AUTH_SECRET and the token lifetime from
+// AUTH_TOKEN_TTL. Without AUTH_SECRET a random key is used, so tokens do not survive a restart.
+func LoadConfig() (Config, error) {
+	config := Config{Secret: []byte(os.Getenv("AUTH_SECRET")), TokenTTL: DefaultTokenTTL}
+	if ttl := os.Getenv("AUTH_TOKEN_TTL"); ttl != "" {
+		var err error
+		config.TokenTTL, err = time.ParseDuration(ttl)
+		if err != nil || config.TokenTTL <= 0 {
+			return Config{}, fmt.Errorf("invalid AUTH_TOKEN_TTL %q, expected a positive duration such as 24h", ttl)
+		}
+	}
+	if len(config.Secret) == 0 {
+		log.Println("AUTH_SECRET is not set, tokens are signed with a random key and do not survive a restart")
+		config.Secret = make([]byte, 32)
+		_, err := rand.Read(config.Secret)
+		if err != nil {
+			return Config{}, err
+		}
+	}
+	return config, nil
+}
@@ -0,0 +1,32 @@
+package auth
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"concurrent_money_transfer_system/utils"
+)
+
+type AuthController struct {
+	authService AuthService
+}
+
+func (ac *AuthController) Login(c *gin.Context) {
+	var request LoginRequest
+	err := utils.BindAndValidateRequest(c, &request)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+
+	token, err := ac.authService.Login(c.Request.Context(), request.Email, request.Password)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+
+	utils.ResponseSuccess(c, token)
+}
+
+func NewAuthController(authService AuthService) *AuthController {
+	return &AuthController{authService: authService}
+}
@@ -0,0 +1,31 @@
+package auth
+
+import (
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"concurrent_money_transfer_system/internals/authz"
+	"concurrent_money_transfer_system/utils"
+)
+
+// Middleware rejects requests without a valid bearer token and puts the caller into the
+// request context, where authz finds it.
+func Middleware(service AuthService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		accessToken, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok || accessToken == "" {
+			utils.ResponseError(c, utils.NewErrorWithMessage(utils.ErrUnauthorized, "Authorization header with a bearer token is required"))
+			c.Abort()
+			return
+		}
+		caller, err := service.Authenticate(c.Request.Context(), accessToken)
+		if err != nil {
+			utils.ResponseError(c, err)
+			c.Abort()
+			return
+		}
+		c.Request = c.Request.WithContext(authz.WithCaller(c.Request.Context(), caller))
+		c.Next()
+	}
+}
@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"context"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"concurrent_money_transfer_system/internals/authz"
+	"concurrent_money_transfer_system/internals/users"
+	"concurrent_money_transfer_system/utils"
+)
+
+// dummyPasswordHash is compared against when no user has the email, so that a login takes
+// as long whether or not the email is registered.
+var dummyPasswordHash, _ = users.HashPassword("dummy-password")
+
+type AuthService interface {
+	// Login checks the user's password and issues a token for them.
+	Login(ctx context.Context, email string, password string) (Token, error)
+	// IssueToken issues a token for the user without checking any credentials.
+	IssueToken(ctx context.Context, userID string) (Token, error)
+	// Authenticate returns the user that the token was issued to with their current role,
+	// failing if the token is invalid or expired or the user has been deleted since.
+	Authenticate(ctx context.Context, accessToken string) (authz.Caller, error)
+}
+
+type authService struct {
+	userRepo users.UserRepo
+	secret   []byte
+	tokenTTL time.Duration
+}
+
+func (s *authService) Login(ctx context.Context, email string, password string) (Token, error) {
+	user, err := s.userRepo.GetUserByEmail(email)
+	if utils.IsError(err, utils.ErrUserNotFound) {
+		users.CheckPassword(dummyPasswordHash, password)
+		return Token{}, utils.NewError(utils.ErrInvalidCredentials)
+	}
+	if err != nil {
+		return Token{}, err
+	}
+	if !users.CheckPassword(user.Password, password) {
+		return Token{}, utils.NewError(utils.ErrInvalidCredentials)
+	}
+	return s.IssueToken(ctx, user.ID)
+}
+
+func (s *authService) IssueToken(ctx context.Context, userID string) (Token, error) {
+	now := time.Now()
+	expiresAt := now.Add(s.tokenTTL)
+	accessToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		Subject:   userID,
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(expiresAt),
+	}).SignedString(s.secret)
+	if err != nil {
+		return Token{}, utils.NewErrorWithMessage(utils.ErrInternalServerError, "Failed to sign token: "+err.Error())
+	}
+	return Token{AccessToken: accessToken, TokenType: "Bearer", ExpiresAt: expiresAt, UserID: userID}, nil
+}
+
+func (s *authService) Authenticate(ctx context.Context, accessToken string) (authz.Caller, error) {
+	claims := jwt.RegisteredClaims{}
+	_, err := jwt.ParseWithClaims(accessToken, &claims, func(token *jwt.Token) (any, error) {
+		return s.secret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithExpirationRequired())
+	if err != nil || claims.Subject == "" {
+		return authz.Caller{}, utils.NewErrorWithMessage(utils.ErrUnauthorized, "Invalid or expired token")
+	}
+	user, err := s.userRepo.GetUser(claims.Subject)
+	if utils.IsError(err, utils.ErrUserNotFound) {
+		return authz.Caller{}, utils.NewErrorWithMessage(utils.ErrUnauthorized, "User no longer exists")
+	}
+	if err != nil {
+		return authz.Caller{}, err
+	}
+	return authz.Caller{UserID: user.ID, Role: user.RoleOrDefault()}, nil
+}
+
+var authServiceInstance *authService
+
+func NewAuthService(userRepo users.UserRepo, config Config) AuthService {
+	if authServiceInstance == nil {
+		authServiceInstance = &authService{userRepo: userRepo, secret: config.Secret, tokenTTL: config.TokenTTL}
+	}
+	return authServiceInstance
+}
@@ -0,0 +1,63 @@
+package authz
+
+import (
+	"context"
+	"slices"
+
+	"concurrent_money_transfer_system/utils"
+)
+
+// Role decides what a user may do besides managing their own wallet
+type Role string
+
+const (
+	RoleUser    Role = "user"    // Can only see and move their own money
+	RoleSupport Role = "support" // Can also see every user's data and refund transfers
+	RoleAdmin   Role = "admin"   // Can also change every user's data and roles
+)
+
+func (r Role) IsValid() bool {
+	return r == RoleUser || r == RoleSupport || r == RoleAdmin
+}
+
+// Caller is the authenticated user that a request is made by
+type Caller struct {
+	UserID string
+	Role   Role
+}
+
+type callerKey struct{}
+
+// WithCaller returns a copy of ctx carrying the authenticated caller.
+func WithCaller(ctx context.Context, caller Caller) context.Context {
+	return context.WithValue(ctx, callerKey{}, caller)
+}
+
+// CallerFromContext returns the caller that the request of ctx was authenticated as.
+func CallerFromContext(ctx context.Context) (Caller, bool) {
+	caller, ok := ctx.Value(callerKey{}).(Caller)
+	return caller, ok
+}
+
+// AuthorizeOwner allows the caller if they are the owner of the data, or have one of the roles.
+func AuthorizeOwner(ctx context.Context, ownerID string, roles ...Role) error {
+	return AuthorizeAnyOwner(ctx, []string{ownerID}, roles...)
+}
+
+// AuthorizeAnyOwner allows the caller if they are one of the owners of the data, e.g. a party
+// of a transaction, or have one of the roles.
+func AuthorizeAnyOwner(ctx context.Context, ownerIDs []string, roles ...Role) error {
+	caller, ok := CallerFromContext(ctx)
+	if !ok {
+		return utils.NewError(utils.ErrUnauthorized)
+	}
+	if slices.Contains(ownerIDs, caller.UserID) || slices.Contains(roles, caller.Role) {
+		return nil
+	}
+	return utils.NewError(utils.ErrForbidden)
+}
+
+// AuthorizeRole allows the caller if they have one of the roles.
+func AuthorizeRole(ctx context.Context, roles ...Role) error {
+	return AuthorizeAnyOwner(ctx, nil, roles...)
+}
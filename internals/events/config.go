@@ -0,0 +1,23 @@
+package events
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// DefaultRelayInterval is how often the outbox is checked for events to publish
+const DefaultRelayInterval = time.Second
+
+// LoadRelayInterval reads how often the outbox is checked for events to publish from OUTBOX_RELAY_INTERVAL.
+func LoadRelayInterval() (time.Duration, error) {
+	value := os.Getenv("OUTBOX_RELAY_INTERVAL")
+	if value == "" {
+		return DefaultRelayInterval, nil
+	}
+	interval, err := time.ParseDuration(value)
+	if err != nil || interval <= 0 {
+		return 0, fmt.Errorf("invalid OUTBOX_RELAY_INTERVAL %q, expected a positive duration such as 1s", value)
+	}
+	return interval, nil
+}
@@ -0,0 +1,76 @@
+package events
+
+import (
+	"encoding/json"
+	"time"
+
+	"concurrent_money_transfer_system/utils"
+)
+
+type EventType string
+
+const (
+	TransferCreated   EventType = "transfer.created"   // A transaction was recorded, e.g. a transfer about to settle or a hold
+	TransferCompleted EventType = "transfer.completed" // A transaction moved its money
+	TransferFailed    EventType = "transfer.failed"    // A transaction was undone and recorded as failed
+	WalletDisabled    EventType = "wallet.disabled"
+	UserCreated       EventType = "user.created"
+)
+
+// Event is a change to a transaction, wallet or user, kept in the outbox until it is published.
+type Event struct {
+	ID          string          `json:"id"`
+	Type        EventType       `json:"type"`
+	AggregateID string          `json:"aggregate_id"` // ID of the transaction, wallet or user that changed
+	Payload     json.RawMessage `json:"payload"`      // One of the payloads below, depending on Type
+	CreatedAt   time.Time       `json:"created_at"`
+	PublishedAt *time.Time      `json:"published_at,omitempty"`
+}
+
+// Decode unmarshals the payload into the payload type of the event's type.
+func (e Event) Decode(payload any) error {
+	return json.Unmarshal(e.Payload, payload)
+}
+
+// TransferPayload is the payload of the transfer events: the transaction as it was when the
+// event was recorded.
+type TransferPayload struct {
+	TransactionID       string         `json:"transaction_id"`
+	TransactionType     string         `json:"transaction_type"`
+	Status              string         `json:"status"`
+	DebitUserID         string         `json:"debit_user_id,omitempty"`
+	CreditUserID        string         `json:"credit_user_id,omitempty"`
+	Amount              utils.Money    `json:"amount"`
+	Currency            utils.Currency `json:"currency"`
+	ParentTransactionID string         `json:"parent_transaction_id,omitempty"`
+	ErrorCode           string         `json:"error_code,omitempty"` // Why a TransferFailed transaction failed
+}
+
+// UnmarshalJSON binds the decoded amount to the payload currency once both fields are read.
+func (p *TransferPayload) UnmarshalJSON(data []byte) error {
+	type transferPayload TransferPayload // avoids recursing into this method
+	if err := json.Unmarshal(data, (*transferPayload)(p)); err != nil {
+		return err
+	}
+	if p.Currency == "" {
+		return nil
+	}
+	amount, err := p.Amount.WithCurrency(p.Currency)
+	if err != nil {
+		return err
+	}
+	p.Amount = amount
+	return nil
+}
+
+// WalletPayload is the payload of WalletDisabled.
+type WalletPayload struct {
+	WalletID string `json:"wallet_id"`
+	UserID   string `json:"user_id"`
+}
+
+// UserPayload is the payload of UserCreated.
+type UserPayload struct {
+	UserID string `json:"user_id"`
+	Email  string `json:"email"`
+}
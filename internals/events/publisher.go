@@ -0,0 +1,64 @@
+package events
+
+import (
+	"context"
+	"sync"
+)
+
+// Publisher delivers events to downstream systems. Events are published at least once: one
+// whose publication cannot be recorded is published again, so consumers must skip event IDs
+// they have already handled.
+type Publisher interface {
+	Publish(ctx context.Context, event Event) error
+}
+
+// Handler handles an event published in process.
+type Handler func(ctx context.Context, event Event) error
+
+// InProcessPublisher hands every event to the handlers subscribed in this process, in the
+// order they subscribed. It fails when any handler does, so the event is published again,
+// to every handler.
+type InProcessPublisher struct {
+	mu       sync.RWMutex
+	handlers map[int]Handler
+	nextID   int
+}
+
+func (p *InProcessPublisher) Publish(ctx context.Context, event Event) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for id := 0; id < p.nextID; id++ {
+		handler, ok := p.handlers[id]
+		if !ok {
+			continue
+		}
+		err := handler(ctx, event)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Subscribe makes handler receive every event published from now on, until unsubscribe is called.
+func (p *InProcessPublisher) Subscribe(handler Handler) (unsubscribe func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	id := p.nextID
+	p.handlers[id] = handler
+	p.nextID++
+	return func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		delete(p.handlers, id)
+	}
+}
+
+var inProcessPublisherInstance *InProcessPublisher
+
+func NewInProcessPublisher() *InProcessPublisher {
+	if inProcessPublisherInstance == nil {
+		inProcessPublisherInstance = &InProcessPublisher{handlers: make(map[int]Handler)}
+	}
+	return inProcessPublisherInstance
+}
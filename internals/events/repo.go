@@ -0,0 +1,184 @@
+package events
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"concurrent_money_transfer_system/internals/storage"
+	"concurrent_money_transfer_system/utils"
+)
+
+// eventRecord is the WAL record kind holding an event's post-image
+const eventRecord = "event"
+
+type OutboxRepo interface {
+	// AddEvent adds the event to the outbox in the unit of work in ctx.
+	AddEvent(ctx context.Context, event Event) (Event, error)
+	// GetUnpublishedEvents returns up to limit events not published yet, oldest first, after
+	// skipping the first offset of them.
+	GetUnpublishedEvents(ctx context.Context, offset int, limit int) ([]Event, error)
+	MarkEventPublished(ctx context.Context, id string, publishedAt time.Time) error
+	GetEventsByAggregateID(ctx context.Context, aggregateID string) ([]Event, error)
+}
+
+type outboxRepo struct {
+	events      sync.Map     // event ID -> Event, of committed units of work
+	pending     sync.Map     // event ID -> Event, of units of work that have not committed yet
+	mu          sync.Mutex   // Guards unpublished
+	unpublished []string     // IDs of the committed events not published yet, in the order they committed
+	wal         *storage.WAL // Writes are logged here first when set
+}
+
+// AddEvent keeps the event pending until its unit of work commits: memory writes are seen by
+// other goroutines before then, and an event must never be published for a change that is
+// rolled back.
+func (r *outboxRepo) AddEvent(ctx context.Context, event Event) (Event, error) {
+	if event.ID == "" {
+		event.ID = utils.GenerateUniqueEntityId()
+	}
+	event.CreatedAt = time.Now()
+	err := r.wal.Log(ctx, eventRecord, event, func() { r.pending.Store(event.ID, event) })
+	if err != nil {
+		return Event{}, err
+	}
+	storage.OnCommit(ctx, func() {
+		r.storeEvent(event)
+		r.pending.Delete(event.ID)
+	})
+	storage.OnRollback(ctx, func() { r.pending.Delete(event.ID) })
+	return event, nil
+}
+
+// GetUnpublishedEvents returns the events in the order their units of work committed, which
+// in memory is the order their changes became visible.
+func (r *outboxRepo) GetUnpublishedEvents(ctx context.Context, offset int, limit int) ([]Event, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	unpublished := r.unpublished[min(offset, len(r.unpublished)):]
+	events := make([]Event, 0, min(limit, len(unpublished)))
+	for _, id := range unpublished[:min(limit, len(unpublished))] {
+		event, _ := r.events.Load(id)
+		events = append(events, event.(Event))
+	}
+	return events, nil
+}
+
+func (r *outboxRepo) MarkEventPublished(ctx context.Context, id string, publishedAt time.Time) error {
+	value, ok := r.events.Load(id)
+	if !ok {
+		return utils.NewErrorWithMessage(utils.ErrInternalServerError, "Event not found for ID: "+id)
+	}
+	event := value.(Event)
+	event.PublishedAt = &publishedAt
+	return r.wal.Log(ctx, eventRecord, event, func() { r.storeEvent(event) })
+}
+
+// storeEvent stores the event and keeps the queue of unpublished events in step with it.
+// Storing an event again, e.g. when its record is replayed twice, leaves it in place.
+func (r *outboxRepo) storeEvent(event Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	previous, existed := r.events.Swap(event.ID, event)
+	wasUnpublished := existed && previous.(Event).PublishedAt == nil
+	if event.PublishedAt == nil && !wasUnpublished {
+		r.unpublished = append(r.unpublished, event.ID)
+	}
+	if event.PublishedAt != nil && wasUnpublished {
+		r.removeUnpublished(event.ID)
+	}
+}
+
+// removeUnpublished takes the ID off the queue. Events are published in order, so it is
+// almost always first, and is then dropped without copying the queue. r.mu must be held.
+func (r *outboxRepo) removeUnpublished(id string) {
+	if len(r.unpublished) > 0 && r.unpublished[0] == id {
+		r.unpublished = r.unpublished[1:]
+		return
+	}
+	for i, unpublished := range r.unpublished {
+		if unpublished == id {
+			r.unpublished = append(r.unpublished[:i], r.unpublished[i+1:]...)
+			return
+		}
+	}
+}
+
+func (r *outboxRepo) GetEventsByAggregateID(ctx context.Context, aggregateID string) ([]Event, error) {
+	events := make([]Event, 0)
+	r.events.Range(func(key, value any) bool {
+		if value.(Event).AggregateID == aggregateID {
+			events = append(events, value.(Event))
+		}
+		return true
+	})
+	sortEvents(events)
+	return events, nil
+}
+
+// sortEvents orders events by when they were recorded.
+func sortEvents(events []Event) {
+	sort.Slice(events, func(i, j int) bool {
+		if !events[i].CreatedAt.Equal(events[j].CreatedAt) {
+			return events[i].CreatedAt.Before(events[j].CreatedAt)
+		}
+		return events[i].ID < events[j].ID
+	})
+}
+
+func (r *outboxRepo) SetWAL(wal *storage.WAL) {
+	r.wal = wal
+}
+
+// ApplyRecord stores the event as committed: the records of a unit of work are only logged
+// once it commits.
+func (r *outboxRepo) ApplyRecord(record storage.Record) (bool, error) {
+	if record.Kind != eventRecord {
+		return false, nil
+	}
+	var event Event
+	err := record.Decode(&event)
+	if err != nil {
+		return true, err
+	}
+	r.storeEvent(event)
+	return true, nil
+}
+
+// SnapshotRecords leaves out the pending events: snapshots wait for the units of work in
+// flight to end, so the only pending events are of units that are rolling back.
+func (r *outboxRepo) SnapshotRecords() ([]storage.Record, error) {
+	records := make([]storage.Record, 0)
+	var err error
+	r.events.Range(func(key, value any) bool {
+		var record storage.Record
+		record, err = storage.NewRecord(eventRecord, value.(Event))
+		records = append(records, record)
+		return err == nil
+	})
+	return records, err
+}
+
+var outboxRepoInstance *outboxRepo
+
+func NewOutboxRepo() OutboxRepo {
+	if outboxRepoInstance == nil {
+		outboxRepoInstance = &outboxRepo{
+			events:  sync.Map{},
+			pending: sync.Map{},
+		}
+	}
+	return outboxRepoInstance
+}
+
+// Reset is just used for testing purposes
+func Reset() {
+	outboxRepoInstance.mu.Lock()
+	defer outboxRepoInstance.mu.Unlock()
+	outboxRepoInstance.events.Range(func(key, value any) bool {
+		outboxRepoInstance.events.Delete(key)
+		return true
+	})
+	outboxRepoInstance.unpublished = nil
+}
@@ -0,0 +1,114 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"concurrent_money_transfer_system/utils"
+)
+
+// relayBatchSize is how many events the relay reads from the outbox at a time.
+const relayBatchSize = 100
+
+type EventService interface {
+	// Record adds an event to the outbox. It must be called in the unit of work of the change
+	// the event describes, so the event is kept exactly when the change is.
+	Record(ctx context.Context, eventType EventType, aggregateID string, payload any) error
+	// PublishPending publishes the events of the outbox not published yet, oldest first, and
+	// returns how many it published with the first error met. An event that fails to publish
+	// holds back the later events of its aggregate, so they are not published before it, but
+	// not the events of other aggregates.
+	PublishPending(ctx context.Context) (int, error)
+	StartRelay(interval time.Duration, stop <-chan struct{})
+}
+
+type eventService struct {
+	repo      OutboxRepo
+	publisher Publisher
+	mu        sync.Mutex // Keeps two relays from publishing the same events at once
+}
+
+func (s *eventService) Record(ctx context.Context, eventType EventType, aggregateID string, payload any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return utils.NewErrorWithMessage(utils.ErrInternalServerError, "Failed to encode "+string(eventType)+" event: "+err.Error())
+	}
+	_, err = s.repo.AddEvent(ctx, Event{Type: eventType, AggregateID: aggregateID, Payload: data})
+	return err
+}
+
+func (s *eventService) PublishPending(ctx context.Context) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	published := 0
+	var firstErr error
+	held := make(map[string]bool) // Aggregates with an event left unpublished in this pass
+	skipped := 0                  // Events left unpublished, which stay ahead in the outbox
+	for {
+		events, err := s.repo.GetUnpublishedEvents(ctx, skipped, relayBatchSize)
+		if err != nil {
+			return published, err
+		}
+		for _, event := range events {
+			if held[event.AggregateID] {
+				skipped++
+				continue
+			}
+			err = s.publish(ctx, event)
+			if err != nil {
+				log.Printf("Failed to publish event %s of %s: %v", event.ID, event.AggregateID, err)
+				held[event.AggregateID] = true
+				skipped++
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			published++
+		}
+		if len(events) < relayBatchSize {
+			return published, firstErr
+		}
+	}
+}
+
+// publish publishes the event and records that it was. An event that is published but not
+// recorded is published again later.
+func (s *eventService) publish(ctx context.Context, event Event) error {
+	err := s.publisher.Publish(ctx, event)
+	if err != nil {
+		return err
+	}
+	return s.repo.MarkEventPublished(ctx, event.ID, time.Now())
+}
+
+// StartRelay publishes the pending events every interval until stop is closed.
+func (s *eventService) StartRelay(interval time.Duration, stop <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				_, err := s.PublishPending(context.Background())
+				if err != nil {
+					log.Printf("Failed to publish outbox events: %v", err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+var eventServiceInstance *eventService
+
+func NewEventService(repo OutboxRepo, publisher Publisher) EventService {
+	if eventServiceInstance == nil {
+		eventServiceInstance = &eventService{repo: repo, publisher: publisher}
+	}
+	return eventServiceInstance
+}
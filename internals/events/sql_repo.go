@@ -0,0 +1,86 @@
+package events
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"concurrent_money_transfer_system/internals/storage"
+	"concurrent_money_transfer_system/utils"
+)
+
+// sqlOutboxRepo keeps events in outbox_events, written in the database transaction of the
+// change they describe.
+type sqlOutboxRepo struct {
+	db *sql.DB
+}
+
+// NewSQLOutboxRepo returns an OutboxRepo backed by db, whose schema is created by storage.Migrate.
+func NewSQLOutboxRepo(db *sql.DB) OutboxRepo {
+	return &sqlOutboxRepo{db: db}
+}
+
+func (r *sqlOutboxRepo) AddEvent(ctx context.Context, event Event) (Event, error) {
+	if event.ID == "" {
+		event.ID = utils.GenerateUniqueEntityId()
+	}
+	event.CreatedAt = time.Now()
+	_, err := storage.Conn(ctx, r.db).ExecContext(ctx, `INSERT INTO outbox_events (id, event_type, aggregate_id, payload, created_at)
+		VALUES ($1, $2, $3, $4, $5)`,
+		event.ID, event.Type, event.AggregateID, string(event.Payload), event.CreatedAt)
+	if err != nil {
+		return Event{}, storage.DatabaseError(err)
+	}
+	return event, nil
+}
+
+func (r *sqlOutboxRepo) GetUnpublishedEvents(ctx context.Context, offset int, limit int) ([]Event, error) {
+	return r.queryEvents(ctx, `WHERE published_at IS NULL ORDER BY created_at, id LIMIT $1 OFFSET $2`, limit, offset)
+}
+
+func (r *sqlOutboxRepo) MarkEventPublished(ctx context.Context, id string, publishedAt time.Time) error {
+	result, err := storage.Conn(ctx, r.db).ExecContext(ctx, `UPDATE outbox_events SET published_at = $2 WHERE id = $1`, id, publishedAt)
+	if err != nil {
+		return storage.DatabaseError(err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return storage.DatabaseError(err)
+	}
+	if affected == 0 {
+		return utils.NewErrorWithMessage(utils.ErrInternalServerError, "Event not found for ID: "+id)
+	}
+	return nil
+}
+
+func (r *sqlOutboxRepo) GetEventsByAggregateID(ctx context.Context, aggregateID string) ([]Event, error) {
+	return r.queryEvents(ctx, `WHERE aggregate_id = $1 ORDER BY created_at, id`, aggregateID)
+}
+
+func (r *sqlOutboxRepo) queryEvents(ctx context.Context, condition string, args ...any) ([]Event, error) {
+	rows, err := storage.Conn(ctx, r.db).QueryContext(ctx, `SELECT id, event_type, aggregate_id, payload, created_at, published_at
+		FROM outbox_events `+condition, args...)
+	if err != nil {
+		return nil, storage.DatabaseError(err)
+	}
+	defer rows.Close()
+	events := make([]Event, 0)
+	for rows.Next() {
+		var event Event
+		var payload string
+		var publishedAt sql.NullTime
+		err = rows.Scan(&event.ID, &event.Type, &event.AggregateID, &payload, &event.CreatedAt, &publishedAt)
+		if err != nil {
+			return nil, storage.DatabaseError(err)
+		}
+		event.Payload = []byte(payload)
+		if publishedAt.Valid {
+			event.PublishedAt = &publishedAt.Time
+		}
+		events = append(events, event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, storage.DatabaseError(err)
+	}
+	return events, nil
+}
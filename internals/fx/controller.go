@@ -0,0 +1,42 @@
+package fx
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"concurrent_money_transfer_system/internals/authz"
+	"concurrent_money_transfer_system/utils"
+)
+
+type FXController interface {
+	CreateQuote(c *gin.Context)
+}
+
+type fxController struct {
+	service FXService
+}
+
+func NewFXController(service FXService) FXController {
+	return &fxController{service: service}
+}
+
+func (fc *fxController) CreateQuote(c *gin.Context) {
+	quoteRequest := QuoteRequest{}
+	err := utils.BindAndValidateRequest(c, &quoteRequest)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+	caller, ok := authz.CallerFromContext(c.Request.Context())
+	if !ok {
+		utils.ResponseError(c, utils.NewError(utils.ErrUnauthorized))
+		return
+	}
+	quote, err := fc.service.CreateQuote(c.Request.Context(), caller.UserID, quoteRequest.From, quoteRequest.To)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, quote)
+}
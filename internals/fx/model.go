@@ -0,0 +1,46 @@
+package fx
+
+import (
+	"math/big"
+	"time"
+
+	"concurrent_money_transfer_system/utils"
+)
+
+// Rate is the number of units of the target currency one unit of the source currency buys,
+// kept as an exact decimal string such as "0.92".
+type Rate string
+
+func (r Rate) rat() (*big.Rat, bool) {
+	rat, ok := new(big.Rat).SetString(string(r))
+	if !ok || rat.Sign() <= 0 {
+		return nil, false
+	}
+	return rat, true
+}
+
+// Quote is a rate offered to a user for converting From into To, valid until ExpiresAt for
+// one transfer of theirs.
+type Quote struct {
+	ID            string         `json:"id"`
+	UserID        string         `json:"user_id"` // The user the quote was made for
+	From          utils.Currency `json:"from"`
+	To            utils.Currency `json:"to"`
+	Rate          Rate           `json:"rate"`
+	TransactionID string         `json:"transaction_id,omitempty"` // The transfer that used the quote
+	CreatedAt     time.Time      `json:"created_at"`
+	ExpiresAt     time.Time      `json:"expires_at"`
+}
+
+func (q Quote) IsExpired(now time.Time) bool {
+	return !now.Before(q.ExpiresAt)
+}
+
+func (q Quote) IsUsed() bool {
+	return q.TransactionID != ""
+}
+
+type QuoteRequest struct {
+	From utils.Currency `json:"from" validate:"required"`
+	To   utils.Currency `json:"to" validate:"required,nefield=From"`
+}
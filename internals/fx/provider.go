@@ -0,0 +1,71 @@
+package fx
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+
+	"concurrent_money_transfer_system/utils"
+)
+
+// FXRateProvider supplies the current exchange rate between two currencies.
+type FXRateProvider interface {
+	GetRate(ctx context.Context, from utils.Currency, to utils.Currency) (Rate, error)
+}
+
+// DefaultRates are indicative rates used when no rates file is configured, keyed by "FROM/TO".
+var DefaultRates = map[string]Rate{
+	"USD/EUR": "0.92",
+	"EUR/USD": "1.087",
+	"USD/JPY": "150",
+	"JPY/USD": "0.0066",
+	"EUR/JPY": "163",
+	"JPY/EUR": "0.0061",
+}
+
+// staticRateProvider serves a fixed table of rates, for local use and tests.
+type staticRateProvider struct {
+	rates map[string]Rate
+}
+
+func NewStaticRateProvider(rates map[string]Rate) (FXRateProvider, error) {
+	for pair, rate := range rates {
+		from, to, ok := strings.Cut(pair, "/")
+		if !ok || from == "" || to == "" {
+			return nil, fmt.Errorf("invalid currency pair %q, expected FROM/TO", pair)
+		}
+		if _, ok := rate.rat(); !ok {
+			return nil, fmt.Errorf("invalid rate %q for %s", rate, pair)
+		}
+	}
+	return &staticRateProvider{rates: rates}, nil
+}
+
+// NewStaticRateProviderFromFile loads rates from a JSON file such as {"USD/EUR": "0.92"}.
+func NewStaticRateProviderFromFile(path string) (FXRateProvider, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rates := make(map[string]Rate)
+	err = json.Unmarshal(data, &rates)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse rates file %s: %w", path, err)
+	}
+	return NewStaticRateProvider(rates)
+}
+
+func (p *staticRateProvider) GetRate(ctx context.Context, from utils.Currency, to utils.Currency) (Rate, error) {
+	if rate, ok := p.rates[string(from)+"/"+string(to)]; ok {
+		return rate, nil
+	}
+	// Fall back to the inverse of the opposite pair
+	if inverse, ok := p.rates[string(to)+"/"+string(from)]; ok {
+		rat, _ := inverse.rat()
+		return Rate(new(big.Rat).Inv(rat).FloatString(8)), nil
+	}
+	return "", utils.NewErrorWithMessage(utils.ErrFXRateUnavailable, fmt.Sprintf("No exchange rate from %s to %s", from, to))
+}
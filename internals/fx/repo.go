@@ -0,0 +1,117 @@
+package fx
+
+import (
+	"context"
+	"sync"
+
+	"concurrent_money_transfer_system/internals/storage"
+	"concurrent_money_transfer_system/utils"
+)
+
+// quoteRecord is the WAL record kind holding a quote
+const quoteRecord = "quote"
+
+type QuoteRepo interface {
+	CreateQuote(ctx context.Context, quote Quote) (Quote, error)
+	GetQuote(ctx context.Context, id string) (Quote, error)
+	// UseQuote records that the transaction used the quote, failing with QUOTE_ALREADY_USED
+	// if another transaction used it first. It joins the unit of work in ctx.
+	UseQuote(ctx context.Context, id string, transactionID string) (Quote, error)
+}
+
+type quoteRepo struct {
+	quotes sync.Map
+	mu     sync.Mutex   // Keeps two transactions from using the same quote
+	wal    *storage.WAL // Writes are logged here first when set
+}
+
+func (r *quoteRepo) CreateQuote(ctx context.Context, quote Quote) (Quote, error) {
+	if quote.ID == "" {
+		quote.ID = utils.GenerateUniqueEntityId()
+	}
+	err := r.storeQuote(ctx, quote)
+	if err != nil {
+		return Quote{}, err
+	}
+	return quote, nil
+}
+
+func (r *quoteRepo) GetQuote(ctx context.Context, id string) (Quote, error) {
+	quote, ok := r.quotes.Load(id)
+	if !ok {
+		return Quote{}, utils.NewError(utils.ErrQuoteNotFound)
+	}
+	return quote.(Quote), nil
+}
+
+func (r *quoteRepo) UseQuote(ctx context.Context, id string, transactionID string) (Quote, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	quote, err := r.GetQuote(ctx, id)
+	if err != nil {
+		return Quote{}, err
+	}
+	if quote.IsUsed() {
+		return Quote{}, utils.NewError(utils.ErrQuoteUsed)
+	}
+	previous := quote
+	quote.TransactionID = transactionID
+	err = r.storeQuote(ctx, quote)
+	if err != nil {
+		return Quote{}, err
+	}
+	storage.OnRollback(ctx, func() { r.quotes.Store(previous.ID, previous) })
+	return quote, nil
+}
+
+func (r *quoteRepo) storeQuote(ctx context.Context, quote Quote) error {
+	return r.wal.Log(ctx, quoteRecord, quote, func() { r.quotes.Store(quote.ID, quote) })
+}
+
+func (r *quoteRepo) SetWAL(wal *storage.WAL) {
+	r.wal = wal
+}
+
+func (r *quoteRepo) ApplyRecord(record storage.Record) (bool, error) {
+	if record.Kind != quoteRecord {
+		return false, nil
+	}
+	var quote Quote
+	err := record.Decode(&quote)
+	if err != nil {
+		return true, err
+	}
+	r.quotes.Store(quote.ID, quote)
+	return true, nil
+}
+
+func (r *quoteRepo) SnapshotRecords() ([]storage.Record, error) {
+	records := make([]storage.Record, 0)
+	var err error
+	r.quotes.Range(func(key, value any) bool {
+		var record storage.Record
+		record, err = storage.NewRecord(quoteRecord, value.(Quote))
+		records = append(records, record)
+		return err == nil
+	})
+	return records, err
+}
+
+var quoteRepoInstance *quoteRepo
+
+func NewQuoteRepo() QuoteRepo {
+	if quoteRepoInstance == nil {
+		quoteRepoInstance = &quoteRepo{
+			quotes: sync.Map{},
+		}
+	}
+	return quoteRepoInstance
+}
+
+// Reset is just used for testing purposes
+func Reset() {
+	quoteRepoInstance.quotes.Range(func(key, value any) bool {
+		quoteRepoInstance.quotes.Delete(key)
+		return true
+	})
+}
@@ -0,0 +1,108 @@
+package fx
+
+import (
+	"context"
+	"math/big"
+	"time"
+
+	"concurrent_money_transfer_system/utils"
+)
+
+// DefaultQuoteTTL is how long a quoted rate can be used for a transfer
+const DefaultQuoteTTL = time.Minute
+
+type FXService interface {
+	// CreateQuote quotes the current rate to the user, for one transfer of theirs.
+	CreateQuote(ctx context.Context, userID string, from utils.Currency, to utils.Currency) (Quote, error)
+	// GetValidQuote returns the quote for a transfer by the user, failing if it does not exist,
+	// was made for another user, has expired or was used.
+	GetValidQuote(ctx context.Context, id string, userID string) (Quote, error)
+	// UseQuote records that the transaction used the quote, in the unit of work in ctx, so
+	// no other transaction can.
+	UseQuote(ctx context.Context, id string, transactionID string) error
+}
+
+type fxService struct {
+	repo         QuoteRepo
+	rateProvider FXRateProvider
+	quoteTTL     time.Duration
+}
+
+func (s *fxService) CreateQuote(ctx context.Context, userID string, from utils.Currency, to utils.Currency) (Quote, error) {
+	for _, currency := range []utils.Currency{from, to} {
+		if _, ok := currency.Exponent(); !ok {
+			return Quote{}, utils.NewErrorWithMessage(utils.ErrValidationError, "Currency "+string(currency)+" is not supported")
+		}
+	}
+	rate, err := s.rateProvider.GetRate(ctx, from, to)
+	if err != nil {
+		return Quote{}, err
+	}
+	now := time.Now()
+	return s.repo.CreateQuote(ctx, Quote{
+		UserID:    userID,
+		From:      from,
+		To:        to,
+		Rate:      rate,
+		CreatedAt: now,
+		ExpiresAt: now.Add(s.quoteTTL),
+	})
+}
+
+func (s *fxService) GetValidQuote(ctx context.Context, id string, userID string) (Quote, error) {
+	quote, err := s.repo.GetQuote(ctx, id)
+	if err != nil {
+		return Quote{}, err
+	}
+	if quote.UserID != userID {
+		return Quote{}, utils.NewErrorWithMessage(utils.ErrForbidden, "Quote was made for another user")
+	}
+	if quote.IsExpired(time.Now()) {
+		return Quote{}, utils.NewError(utils.ErrQuoteExpired)
+	}
+	if quote.IsUsed() {
+		return Quote{}, utils.NewError(utils.ErrQuoteUsed)
+	}
+	return quote, nil
+}
+
+func (s *fxService) UseQuote(ctx context.Context, id string, transactionID string) error {
+	_, err := s.repo.UseQuote(ctx, id, transactionID)
+	return err
+}
+
+// Convert applies the quote's rate to an amount in the quote's source currency. The result is
+// rounded down to the target currency's precision, so conversion never creates money.
+func Convert(amount utils.Money, quote Quote) (utils.Money, error) {
+	if amount.Currency != quote.From {
+		return utils.Money{}, utils.NewErrorWithMessage(utils.ErrValidationError, "Quote converts from "+string(quote.From)+", not "+string(amount.Currency))
+	}
+	rate, ok := quote.Rate.rat()
+	if !ok {
+		return utils.Money{}, utils.NewErrorWithMessage(utils.ErrInternalServerError, "Quote has an invalid rate: "+string(quote.Rate))
+	}
+	fromExponent, _ := quote.From.Exponent()
+	toExponent, _ := quote.To.Exponent()
+
+	// target minor units = source minor units * rate * 10^(target exponent - source exponent)
+	converted := new(big.Rat).Mul(new(big.Rat).SetInt64(amount.MinorUnits), rate)
+	scale := new(big.Rat).SetFrac(
+		new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(toExponent)), nil),
+		new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(fromExponent)), nil),
+	)
+	converted.Mul(converted, scale)
+	minorUnits := new(big.Int).Quo(converted.Num(), converted.Denom())
+	if !minorUnits.IsInt64() {
+		return utils.Money{}, utils.NewErrorWithMessage(utils.ErrValidationError, "Converted amount is out of range")
+	}
+	return utils.NewMoney(minorUnits.Int64(), quote.To), nil
+}
+
+var fxServiceInstance *fxService
+
+func NewFXService(repo QuoteRepo, rateProvider FXRateProvider, quoteTTL time.Duration) FXService {
+	if fxServiceInstance == nil {
+		fxServiceInstance = &fxService{repo: repo, rateProvider: rateProvider, quoteTTL: quoteTTL}
+	}
+	return fxServiceInstance
+}
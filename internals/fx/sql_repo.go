@@ -0,0 +1,70 @@
+package fx
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"concurrent_money_transfer_system/internals/storage"
+	"concurrent_money_transfer_system/utils"
+)
+
+// sqlQuoteRepo keeps quotes in the fx_quotes table, with an empty transaction_id until a
+// transaction uses them.
+type sqlQuoteRepo struct {
+	db *sql.DB
+}
+
+// NewSQLQuoteRepo returns a QuoteRepo backed by db, whose schema is created by storage.Migrate.
+func NewSQLQuoteRepo(db *sql.DB) QuoteRepo {
+	return &sqlQuoteRepo{db: db}
+}
+
+const quoteColumns = `id, user_id, from_currency, to_currency, rate, transaction_id, created_at, expires_at`
+
+func (r *sqlQuoteRepo) CreateQuote(ctx context.Context, quote Quote) (Quote, error) {
+	if quote.ID == "" {
+		quote.ID = utils.GenerateUniqueEntityId()
+	}
+	_, err := storage.Conn(ctx, r.db).ExecContext(ctx, `INSERT INTO fx_quotes (`+quoteColumns+`) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		quote.ID, quote.UserID, quote.From, quote.To, quote.Rate, quote.TransactionID, quote.CreatedAt, quote.ExpiresAt)
+	if err != nil {
+		return Quote{}, storage.DatabaseError(err)
+	}
+	return quote, nil
+}
+
+func (r *sqlQuoteRepo) GetQuote(ctx context.Context, id string) (Quote, error) {
+	var quote Quote
+	err := storage.Conn(ctx, r.db).QueryRowContext(ctx, `SELECT `+quoteColumns+` FROM fx_quotes WHERE id = $1`, id).
+		Scan(&quote.ID, &quote.UserID, &quote.From, &quote.To, &quote.Rate, &quote.TransactionID, &quote.CreatedAt, &quote.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Quote{}, utils.NewError(utils.ErrQuoteNotFound)
+	}
+	if err != nil {
+		return Quote{}, storage.DatabaseError(err)
+	}
+	return quote, nil
+}
+
+// UseQuote only updates a quote no transaction has used, so of two transactions racing for
+// the same quote one updates no row and fails.
+func (r *sqlQuoteRepo) UseQuote(ctx context.Context, id string, transactionID string) (Quote, error) {
+	result, err := storage.Conn(ctx, r.db).ExecContext(ctx, `UPDATE fx_quotes SET transaction_id = $1 WHERE id = $2 AND transaction_id = ''`,
+		transactionID, id)
+	if err != nil {
+		return Quote{}, storage.DatabaseError(err)
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return Quote{}, storage.DatabaseError(err)
+	}
+	quote, err := r.GetQuote(ctx, id)
+	if err != nil {
+		return Quote{}, err
+	}
+	if updated == 0 {
+		return Quote{}, utils.NewError(utils.ErrQuoteUsed)
+	}
+	return quote, nil
+}
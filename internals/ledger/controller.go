@@ -0,0 +1,72 @@
+package ledger
+
+import (
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"concurrent_money_transfer_system/internals/authz"
+	"concurrent_money_transfer_system/utils"
+)
+
+type LedgerController interface {
+	GetAccount(c *gin.Context)
+	GetEntriesByTransactionID(c *gin.Context)
+}
+
+type ledgerController struct {
+	service LedgerService
+}
+
+func NewLedgerController(service LedgerService) LedgerController {
+	return &ledgerController{service: service}
+}
+
+type accountResponse struct {
+	AccountBalance
+	Entries []Entry `json:"entries"`
+}
+
+func (lc *ledgerController) GetAccount(c *gin.Context) {
+	accountID := c.Param("account_id")
+	// Only a wallet's account has an owner, system accounts are for staff only
+	err := authz.AuthorizeRole(c.Request.Context(), authz.RoleSupport, authz.RoleAdmin)
+	if ownerID, ok := strings.CutPrefix(accountID, WalletAccountID("")); ok {
+		err = authz.AuthorizeOwner(c.Request.Context(), ownerID, authz.RoleSupport, authz.RoleAdmin)
+	}
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+	currency := utils.Currency(c.Query("currency"))
+	if currency == "" {
+		utils.ResponseError(c, utils.NewErrorWithMessage(utils.ErrInvalidRequest, "Currency is required"))
+		return
+	}
+	balance, err := lc.service.GetAccountBalance(c.Request.Context(), accountID, currency)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+	entries, err := lc.service.GetEntriesByAccountID(c.Request.Context(), accountID)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+	utils.ResponseSuccess(c, accountResponse{AccountBalance: balance, Entries: entries})
+}
+
+func (lc *ledgerController) GetEntriesByTransactionID(c *gin.Context) {
+	transactionID := c.Param("transaction_id")
+	err := authz.AuthorizeRole(c.Request.Context(), authz.RoleSupport, authz.RoleAdmin)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+	entries, err := lc.service.GetEntriesByTransactionID(c.Request.Context(), transactionID)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+	utils.ResponseSuccess(c, entries)
+}
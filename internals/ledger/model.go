@@ -0,0 +1,50 @@
+package ledger
+
+import (
+	"time"
+
+	"concurrent_money_transfer_system/utils"
+)
+
+type Direction string
+
+const (
+	Debit  Direction = "debit"
+	Credit Direction = "credit"
+)
+
+// System accounts are the counterparties for money entering or leaving the wallets
+const (
+	OpeningBalanceAccountID = "system:opening_balances"
+	ExternalFundsAccountID  = "system:external_funds" // Counterparty of deposits and withdrawals
+	FXAccountID             = "system:fx"             // Buys and sells currencies in converted transfers
+)
+
+// WalletAccountID returns the ledger account backing a wallet.
+func WalletAccountID(walletID string) string {
+	return "wallet:" + walletID
+}
+
+type Posting struct {
+	AccountID string         `json:"account_id"`
+	Direction Direction      `json:"direction"`
+	Amount    utils.Money    `json:"amount"`
+	Currency  utils.Currency `json:"currency"`
+}
+
+// Entry is a set of postings recorded together. The debits and credits of an entry
+// always sum to the same amount in every currency.
+type Entry struct {
+	ID            string    `json:"id"`
+	TransactionID string    `json:"transaction_id,omitempty"`
+	Description   string    `json:"description,omitempty"`
+	Postings      []Posting `json:"postings"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// AccountBalance is the balance of an account in one currency: its credits minus its debits.
+type AccountBalance struct {
+	AccountID string         `json:"account_id"`
+	Balance   utils.Money    `json:"balance"`
+	Currency  utils.Currency `json:"currency"`
+}
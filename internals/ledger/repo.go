@@ -0,0 +1,205 @@
+package ledger
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"concurrent_money_transfer_system/internals/storage"
+	"concurrent_money_transfer_system/utils"
+)
+
+// entryRecord is the WAL record kind holding an entry with its postings
+const entryRecord = "ledger.entry"
+
+type LedgerRepo interface {
+	CreateEntry(ctx context.Context, entry Entry) (Entry, error)
+	GetEntriesByTransactionID(ctx context.Context, transactionID string) ([]Entry, error)
+	GetEntriesByAccountID(ctx context.Context, accountID string) ([]Entry, error)
+	GetAccountBalance(ctx context.Context, accountID string, currency utils.Currency) (utils.Money, error)
+}
+
+type ledgerRepo struct {
+	entries  sync.Map     // entry ID -> Entry
+	balances sync.Map     // balanceKey -> utils.Money, kept in step with entries
+	mu       sync.Mutex   // Serializes entry writes so an entry and its balance changes are applied together
+	wal      *storage.WAL // Writes are logged here first when set
+}
+
+func balanceKey(accountID string, currency utils.Currency) string {
+	return accountID + "|" + string(currency)
+}
+
+func (r *ledgerRepo) CreateEntry(ctx context.Context, entry Entry) (Entry, error) {
+	if entry.ID == "" {
+		entry.ID = utils.GenerateUniqueEntityId()
+	}
+	entry.CreatedAt = time.Now()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, err := r.postedBalances(entry.Postings, false)
+	if err != nil {
+		return Entry{}, err
+	}
+	err = r.wal.Log(ctx, entryRecord, entry, func() { r.storeEntry(entry) })
+	if err != nil {
+		return Entry{}, err
+	}
+	storage.OnRollback(ctx, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.deleteEntry(entry)
+	})
+	return entry, nil
+}
+
+// storeEntry stores the entry and adds its postings to the balances, unless it is already
+// stored. r.mu must be held.
+func (r *ledgerRepo) storeEntry(entry Entry) {
+	if _, loaded := r.entries.LoadOrStore(entry.ID, entry); loaded {
+		return
+	}
+	r.applyPostings(entry.Postings, false)
+}
+
+// deleteEntry removes a stored entry and takes its postings off the balances. Other entries
+// may have moved the same balances since it was stored, so the postings are reversed rather
+// than the previous balances restored. r.mu must be held.
+func (r *ledgerRepo) deleteEntry(entry Entry) {
+	if _, loaded := r.entries.LoadAndDelete(entry.ID); !loaded {
+		return
+	}
+	r.applyPostings(entry.Postings, true)
+}
+
+// applyPostings adds the postings to the account balances, or takes them off when reverse is set.
+// Entries are checked not to overflow a balance when they are created. r.mu must be held.
+func (r *ledgerRepo) applyPostings(postings []Posting, reverse bool) {
+	balances, err := r.postedBalances(postings, reverse)
+	if err != nil {
+		panic(err)
+	}
+	for key, balance := range balances {
+		r.balances.Store(key, balance)
+	}
+}
+
+// postedBalances returns the balances of the postings' accounts with the postings applied,
+// failing with AMOUNT_OUT_OF_RANGE if one would overflow. r.mu must be held.
+func (r *ledgerRepo) postedBalances(postings []Posting, reverse bool) (map[string]utils.Money, error) {
+	balances := make(map[string]utils.Money)
+	for _, posting := range postings {
+		key := balanceKey(posting.AccountID, posting.Currency)
+		balance, ok := balances[key]
+		if !ok {
+			balance = utils.NewMoney(0, posting.Currency)
+			if current, ok := r.balances.Load(key); ok {
+				balance = current.(utils.Money)
+			}
+		}
+		var err error
+		if (posting.Direction == Credit) != reverse {
+			balance, err = balance.CheckedAdd(posting.Amount)
+		} else {
+			balance, err = balance.CheckedSub(posting.Amount)
+		}
+		if err != nil {
+			return nil, err
+		}
+		balances[key] = balance
+	}
+	return balances, nil
+}
+
+func (r *ledgerRepo) GetEntriesByTransactionID(ctx context.Context, transactionID string) ([]Entry, error) {
+	entries := make([]Entry, 0)
+	r.entries.Range(func(key, value any) bool {
+		if value.(Entry).TransactionID == transactionID {
+			entries = append(entries, value.(Entry))
+		}
+		return true
+	})
+	return entries, nil
+}
+
+func (r *ledgerRepo) GetEntriesByAccountID(ctx context.Context, accountID string) ([]Entry, error) {
+	entries := make([]Entry, 0)
+	r.entries.Range(func(key, value any) bool {
+		for _, posting := range value.(Entry).Postings {
+			if posting.AccountID == accountID {
+				entries = append(entries, value.(Entry))
+				break
+			}
+		}
+		return true
+	})
+	return entries, nil
+}
+
+func (r *ledgerRepo) GetAccountBalance(ctx context.Context, accountID string, currency utils.Currency) (utils.Money, error) {
+	balance, ok := r.balances.Load(balanceKey(accountID, currency))
+	if !ok {
+		return utils.NewMoney(0, currency), nil
+	}
+	return balance.(utils.Money), nil
+}
+
+func (r *ledgerRepo) SetWAL(wal *storage.WAL) {
+	r.wal = wal
+}
+
+// ApplyRecord rebuilds the balances from the entries, so replaying an entry already loaded
+// from the snapshot changes nothing.
+func (r *ledgerRepo) ApplyRecord(record storage.Record) (bool, error) {
+	if record.Kind != entryRecord {
+		return false, nil
+	}
+	var entry Entry
+	err := record.Decode(&entry)
+	if err != nil {
+		return true, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.storeEntry(entry)
+	return true, nil
+}
+
+func (r *ledgerRepo) SnapshotRecords() ([]storage.Record, error) {
+	records := make([]storage.Record, 0)
+	var err error
+	r.entries.Range(func(key, value any) bool {
+		var record storage.Record
+		record, err = storage.NewRecord(entryRecord, value.(Entry))
+		records = append(records, record)
+		return err == nil
+	})
+	return records, err
+}
+
+var ledgerRepoInstance *ledgerRepo
+
+func NewLedgerRepo() LedgerRepo {
+	if ledgerRepoInstance == nil {
+		ledgerRepoInstance = &ledgerRepo{
+			entries:  sync.Map{},
+			balances: sync.Map{},
+		}
+	}
+	return ledgerRepoInstance
+}
+
+// Reset is just used for testing purposes
+func Reset() {
+	ledgerRepoInstance.mu.Lock()
+	defer ledgerRepoInstance.mu.Unlock()
+	ledgerRepoInstance.entries.Range(func(key, value any) bool {
+		ledgerRepoInstance.entries.Delete(key)
+		return true
+	})
+	ledgerRepoInstance.balances.Range(func(key, value any) bool {
+		ledgerRepoInstance.balances.Delete(key)
+		return true
+	})
+}
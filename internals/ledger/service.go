@@ -0,0 +1,122 @@
+package ledger
+
+import (
+	"context"
+
+	"concurrent_money_transfer_system/utils"
+)
+
+type LedgerService interface {
+	PostEntry(ctx context.Context, entry Entry) (Entry, error)
+	RecordTransfer(ctx context.Context, transactionID string, fromAccountID string, toAccountID string, amount utils.Money, description string) (Entry, error)
+	RecordConversion(ctx context.Context, transactionID string, fromAccountID string, toAccountID string, sourceAmount utils.Money, targetAmount utils.Money, description string) (Entry, error)
+	GetEntriesByTransactionID(ctx context.Context, transactionID string) ([]Entry, error)
+	GetEntriesByAccountID(ctx context.Context, accountID string) ([]Entry, error)
+	GetAccountBalance(ctx context.Context, accountID string, currency utils.Currency) (AccountBalance, error)
+}
+
+type ledgerService struct {
+	repo LedgerRepo
+}
+
+// PostEntry validates that the entry is balanced and records it.
+func (s *ledgerService) PostEntry(ctx context.Context, entry Entry) (Entry, error) {
+	err := validateEntry(entry)
+	if err != nil {
+		return Entry{}, err
+	}
+	return s.repo.CreateEntry(ctx, entry)
+}
+
+// RecordTransfer posts an entry moving amount from one account to another: the source
+// account is debited and the destination account credited.
+func (s *ledgerService) RecordTransfer(ctx context.Context, transactionID string, fromAccountID string, toAccountID string, amount utils.Money, description string) (Entry, error) {
+	return s.PostEntry(ctx, Entry{
+		TransactionID: transactionID,
+		Description:   description,
+		Postings: []Posting{
+			{AccountID: fromAccountID, Direction: Debit, Amount: amount, Currency: amount.Currency},
+			{AccountID: toAccountID, Direction: Credit, Amount: amount, Currency: amount.Currency},
+		},
+	})
+}
+
+// RecordConversion posts an entry moving money between accounts in different currencies.
+// The FX account takes the source amount and pays out the target amount, which keeps the
+// entry balanced in each currency.
+func (s *ledgerService) RecordConversion(ctx context.Context, transactionID string, fromAccountID string, toAccountID string, sourceAmount utils.Money, targetAmount utils.Money, description string) (Entry, error) {
+	return s.PostEntry(ctx, Entry{
+		TransactionID: transactionID,
+		Description:   description,
+		Postings: []Posting{
+			{AccountID: fromAccountID, Direction: Debit, Amount: sourceAmount, Currency: sourceAmount.Currency},
+			{AccountID: FXAccountID, Direction: Credit, Amount: sourceAmount, Currency: sourceAmount.Currency},
+			{AccountID: FXAccountID, Direction: Debit, Amount: targetAmount, Currency: targetAmount.Currency},
+			{AccountID: toAccountID, Direction: Credit, Amount: targetAmount, Currency: targetAmount.Currency},
+		},
+	})
+}
+
+func (s *ledgerService) GetEntriesByTransactionID(ctx context.Context, transactionID string) ([]Entry, error) {
+	return s.repo.GetEntriesByTransactionID(ctx, transactionID)
+}
+
+func (s *ledgerService) GetEntriesByAccountID(ctx context.Context, accountID string) ([]Entry, error) {
+	return s.repo.GetEntriesByAccountID(ctx, accountID)
+}
+
+func (s *ledgerService) GetAccountBalance(ctx context.Context, accountID string, currency utils.Currency) (AccountBalance, error) {
+	balance, err := s.repo.GetAccountBalance(ctx, accountID, currency)
+	if err != nil {
+		return AccountBalance{}, err
+	}
+	return AccountBalance{AccountID: accountID, Balance: balance, Currency: currency}, nil
+}
+
+func validateEntry(entry Entry) error {
+	if len(entry.Postings) < 2 {
+		return utils.NewErrorWithMessage(utils.ErrLedgerEntryUnbalanced, "Ledger entry needs at least one debit and one credit")
+	}
+	// Debits minus credits per currency must net to zero
+	totals := make(map[utils.Currency]utils.Money)
+	for _, posting := range entry.Postings {
+		if posting.Amount.Currency != posting.Currency || !posting.Amount.IsBound() {
+			return utils.NewErrorWithMessage(utils.ErrLedgerEntryUnbalanced, "Posting amount does not match its currency for account: "+posting.AccountID)
+		}
+		if !posting.Amount.IsPositive() {
+			return utils.NewErrorWithMessage(utils.ErrLedgerEntryUnbalanced, "Posting amount must be positive for account: "+posting.AccountID)
+		}
+		total, ok := totals[posting.Currency]
+		if !ok {
+			total = utils.NewMoney(0, posting.Currency)
+		}
+		var err error
+		switch posting.Direction {
+		case Debit:
+			total, err = total.CheckedAdd(posting.Amount)
+		case Credit:
+			total, err = total.CheckedSub(posting.Amount)
+		default:
+			return utils.NewErrorWithMessage(utils.ErrLedgerEntryUnbalanced, "Unknown posting direction: "+string(posting.Direction))
+		}
+		if err != nil {
+			return err
+		}
+		totals[posting.Currency] = total
+	}
+	for currency, total := range totals {
+		if !total.IsZero() {
+			return utils.NewErrorWithMessage(utils.ErrLedgerEntryUnbalanced, "Ledger entry debits and credits differ in "+string(currency))
+		}
+	}
+	return nil
+}
+
+var ledgerServiceInstance *ledgerService
+
+func NewLedgerService(repo LedgerRepo) LedgerService {
+	if ledgerServiceInstance == nil {
+		ledgerServiceInstance = &ledgerService{repo: repo}
+	}
+	return ledgerServiceInstance
+}
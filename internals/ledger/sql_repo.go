@@ -0,0 +1,102 @@
+package ledger
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"concurrent_money_transfer_system/internals/storage"
+	"concurrent_money_transfer_system/utils"
+)
+
+// sqlLedgerRepo keeps entries in ledger_entries and their postings in ledger_postings.
+// Account balances are summed from the postings rather than stored.
+type sqlLedgerRepo struct {
+	db *sql.DB
+}
+
+// NewSQLLedgerRepo returns a LedgerRepo backed by db, whose schema is created by storage.Migrate.
+func NewSQLLedgerRepo(db *sql.DB) LedgerRepo {
+	return &sqlLedgerRepo{db: db}
+}
+
+func (r *sqlLedgerRepo) CreateEntry(ctx context.Context, entry Entry) (Entry, error) {
+	if entry.ID == "" {
+		entry.ID = utils.GenerateUniqueEntityId()
+	}
+	entry.CreatedAt = time.Now()
+
+	err := storage.RunInTx(ctx, r.db, func(ctx context.Context) error {
+		conn := storage.Conn(ctx, r.db)
+		_, err := conn.ExecContext(ctx, `INSERT INTO ledger_entries (id, transaction_id, description, created_at) VALUES ($1, $2, $3, $4)`,
+			entry.ID, entry.TransactionID, entry.Description, entry.CreatedAt)
+		if err != nil {
+			return storage.DatabaseError(err)
+		}
+		for position, posting := range entry.Postings {
+			_, err = conn.ExecContext(ctx, `INSERT INTO ledger_postings (entry_id, position, account_id, direction, amount, currency)
+				VALUES ($1, $2, $3, $4, $5, $6)`,
+				entry.ID, position, posting.AccountID, posting.Direction, posting.Amount.MinorUnits, posting.Currency)
+			if err != nil {
+				return storage.DatabaseError(err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return Entry{}, err
+	}
+	return entry, nil
+}
+
+func (r *sqlLedgerRepo) GetEntriesByTransactionID(ctx context.Context, transactionID string) ([]Entry, error) {
+	return r.queryEntries(ctx, `WHERE e.transaction_id = $1`, transactionID)
+}
+
+func (r *sqlLedgerRepo) GetEntriesByAccountID(ctx context.Context, accountID string) ([]Entry, error) {
+	return r.queryEntries(ctx, `WHERE e.id IN (SELECT entry_id FROM ledger_postings WHERE account_id = $1)`, accountID)
+}
+
+// queryEntries loads the entries matching condition together with all of their postings.
+func (r *sqlLedgerRepo) queryEntries(ctx context.Context, condition string, args ...any) ([]Entry, error) {
+	rows, err := storage.Conn(ctx, r.db).QueryContext(ctx, `SELECT e.id, e.transaction_id, e.description, e.created_at,
+			p.account_id, p.direction, p.amount, p.currency
+		FROM ledger_entries e JOIN ledger_postings p ON p.entry_id = e.id
+		`+condition+`
+		ORDER BY e.created_at, e.id, p.position`, args...)
+	if err != nil {
+		return nil, storage.DatabaseError(err)
+	}
+	defer rows.Close()
+	entries := make([]Entry, 0)
+	for rows.Next() {
+		var entry Entry
+		var posting Posting
+		err = rows.Scan(&entry.ID, &entry.TransactionID, &entry.Description, &entry.CreatedAt,
+			&posting.AccountID, &posting.Direction, &posting.Amount.MinorUnits, &posting.Currency)
+		if err != nil {
+			return nil, storage.DatabaseError(err)
+		}
+		posting.Amount.Currency = posting.Currency
+		// Rows of the same entry are adjacent, as they are ordered by entry
+		if len(entries) == 0 || entries[len(entries)-1].ID != entry.ID {
+			entries = append(entries, entry)
+		}
+		last := &entries[len(entries)-1]
+		last.Postings = append(last.Postings, posting)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, storage.DatabaseError(err)
+	}
+	return entries, nil
+}
+
+func (r *sqlLedgerRepo) GetAccountBalance(ctx context.Context, accountID string, currency utils.Currency) (utils.Money, error) {
+	var balance int64
+	err := storage.Conn(ctx, r.db).QueryRowContext(ctx, `SELECT COALESCE(SUM(CASE WHEN direction = $3 THEN amount ELSE -amount END), 0)
+		FROM ledger_postings WHERE account_id = $1 AND currency = $2`, accountID, currency, Credit).Scan(&balance)
+	if err != nil {
+		return utils.Money{}, storage.DatabaseError(err)
+	}
+	return utils.NewMoney(balance, currency), nil
+}
@@ -0,0 +1,57 @@
+package limits
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"concurrent_money_transfer_system/internals/authz"
+	"concurrent_money_transfer_system/utils"
+)
+
+type LimitsController interface {
+	GetLimits(c *gin.Context)
+	SetLimits(c *gin.Context)
+}
+
+type limitsController struct {
+	service LimitsService
+}
+
+func NewLimitsController(service LimitsService) LimitsController {
+	return &limitsController{service: service}
+}
+
+func (lc *limitsController) GetLimits(c *gin.Context) {
+	userID := c.Param("user_id")
+	err := authz.AuthorizeOwner(c.Request.Context(), userID, authz.RoleSupport, authz.RoleAdmin)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+	limits, err := lc.service.GetLimits(c.Request.Context(), userID)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+	utils.ResponseSuccess(c, limits)
+}
+
+func (lc *limitsController) SetLimits(c *gin.Context) {
+	userID := c.Param("user_id")
+	request := UserLimitsRequest{}
+	err := utils.BindAndValidateRequest(c, &request)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+	err = authz.AuthorizeRole(c.Request.Context(), authz.RoleAdmin)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+	limits, err := lc.service.SetLimits(c.Request.Context(), userID, request)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+	utils.ResponseSuccess(c, limits)
+}
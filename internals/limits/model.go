@@ -0,0 +1,58 @@
+package limits
+
+import (
+	"time"
+
+	"concurrent_money_transfer_system/utils"
+)
+
+// Tier groups users that share the same default limits
+type Tier string
+
+// DefaultTier is the tier of users whose limits have never been set
+const DefaultTier Tier = "standard"
+
+const (
+	DailyWindow   = 24 * time.Hour      // Window of the daily limit
+	MonthlyWindow = 30 * 24 * time.Hour // Window of the monthly limit
+)
+
+// Limits cap a user's outgoing transfers in one currency. A missing cap is not enforced.
+type Limits struct {
+	PerTransaction *utils.Money `json:"per_transaction,omitempty"`
+	Daily          *utils.Money `json:"daily,omitempty"`   // Total over the last 24 hours
+	Monthly        *utils.Money `json:"monthly,omitempty"` // Total over the last 30 days
+}
+
+// merge returns the limits with every cap missing from them taken from defaults.
+func (l Limits) merge(defaults Limits) Limits {
+	if l.PerTransaction == nil {
+		l.PerTransaction = defaults.PerTransaction
+	}
+	if l.Daily == nil {
+		l.Daily = defaults.Daily
+	}
+	if l.Monthly == nil {
+		l.Monthly = defaults.Monthly
+	}
+	return l
+}
+
+// UserLimits puts a user in a tier and overrides some of the tier's limits for them
+type UserLimits struct {
+	UserID    string                    `json:"user_id"`
+	Tier      Tier                      `json:"tier"`
+	Overrides map[utils.Currency]Limits `json:"overrides"`
+	UpdatedAt time.Time                 `json:"updated_at"`
+}
+
+// EffectiveLimits are the limits enforced for a user, i.e. their tier's with their overrides applied
+type EffectiveLimits struct {
+	UserLimits
+	Limits map[utils.Currency]Limits `json:"limits"`
+}
+
+type UserLimitsRequest struct {
+	Tier      Tier                      `json:"tier"` // DefaultTier when empty
+	Overrides map[utils.Currency]Limits `json:"overrides"`
+}
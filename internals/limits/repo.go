@@ -0,0 +1,87 @@
+package limits
+
+import (
+	"context"
+	"sync"
+
+	"concurrent_money_transfer_system/internals/storage"
+	"concurrent_money_transfer_system/utils"
+)
+
+// userLimitsRecord is the WAL record kind holding a user's limits
+const userLimitsRecord = "limits"
+
+type LimitsRepo interface {
+	// GetUserLimits fails with USER_NOT_FOUND if the user's limits have never been set.
+	GetUserLimits(ctx context.Context, userID string) (UserLimits, error)
+	SetUserLimits(ctx context.Context, userLimits UserLimits) (UserLimits, error)
+}
+
+type limitsRepo struct {
+	userLimits sync.Map
+	wal        *storage.WAL // Writes are logged here first when set
+}
+
+func (r *limitsRepo) GetUserLimits(ctx context.Context, userID string) (UserLimits, error) {
+	userLimits, ok := r.userLimits.Load(userID)
+	if !ok {
+		return UserLimits{}, utils.NewError(utils.ErrUserNotFound)
+	}
+	return userLimits.(UserLimits), nil
+}
+
+func (r *limitsRepo) SetUserLimits(ctx context.Context, userLimits UserLimits) (UserLimits, error) {
+	err := r.wal.Log(ctx, userLimitsRecord, userLimits, func() { r.userLimits.Store(userLimits.UserID, userLimits) })
+	if err != nil {
+		return UserLimits{}, err
+	}
+	return userLimits, nil
+}
+
+func (r *limitsRepo) SetWAL(wal *storage.WAL) {
+	r.wal = wal
+}
+
+func (r *limitsRepo) ApplyRecord(record storage.Record) (bool, error) {
+	if record.Kind != userLimitsRecord {
+		return false, nil
+	}
+	var userLimits UserLimits
+	err := record.Decode(&userLimits)
+	if err != nil {
+		return true, err
+	}
+	r.userLimits.Store(userLimits.UserID, userLimits)
+	return true, nil
+}
+
+func (r *limitsRepo) SnapshotRecords() ([]storage.Record, error) {
+	records := make([]storage.Record, 0)
+	var err error
+	r.userLimits.Range(func(key, value any) bool {
+		var record storage.Record
+		record, err = storage.NewRecord(userLimitsRecord, value.(UserLimits))
+		records = append(records, record)
+		return err == nil
+	})
+	return records, err
+}
+
+var limitsRepoInstance *limitsRepo
+
+func NewLimitsRepo() LimitsRepo {
+	if limitsRepoInstance == nil {
+		limitsRepoInstance = &limitsRepo{
+			userLimits: sync.Map{},
+		}
+	}
+	return limitsRepoInstance
+}
+
+// Reset is just used for testing purposes
+func Reset() {
+	limitsRepoInstance.userLimits.Range(func(key, value any) bool {
+		limitsRepoInstance.userLimits.Delete(key)
+		return true
+	})
+}
@@ -0,0 +1,131 @@
+package limits
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"concurrent_money_transfer_system/utils"
+)
+
+// TransferHistory totals a user's past transfers. It is implemented by transactions.TransactionRepo.
+type TransferHistory interface {
+	// GetOutgoingTransferTotal sums the transfers the user sent in the currency since the given
+	// time, including pending holds and transfers that were refunded or reversed later.
+	GetOutgoingTransferTotal(ctx context.Context, userID string, currency utils.Currency, since time.Time) (utils.Money, error)
+}
+
+type LimitsService interface {
+	// CheckTransfer fails with LIMIT_EXCEEDED if sending amount would exceed one of the user's
+	// limits. It must be called while the sender's wallet is locked, so that no other transfer
+	// of theirs completes between the check and the transfer.
+	CheckTransfer(ctx context.Context, userID string, amount utils.Money) error
+	GetLimits(ctx context.Context, userID string) (EffectiveLimits, error)
+	SetLimits(ctx context.Context, userID string, request UserLimitsRequest) (EffectiveLimits, error)
+}
+
+type limitsService struct {
+	repo    LimitsRepo
+	history TransferHistory
+	tiers   map[Tier]map[utils.Currency]Limits
+}
+
+func (s *limitsService) CheckTransfer(ctx context.Context, userID string, amount utils.Money) error {
+	effectiveLimits, err := s.GetLimits(ctx, userID)
+	if err != nil {
+		return err
+	}
+	limits := effectiveLimits.Limits[amount.Currency]
+	if limits.PerTransaction != nil && limits.PerTransaction.LessThan(amount) {
+		return utils.NewErrorWithMessage(utils.ErrLimitExceeded, fmt.Sprintf("Transfer of %s %s exceeds the per-transaction limit of %s %s",
+			amount, amount.Currency, limits.PerTransaction, amount.Currency))
+	}
+	now := time.Now()
+	windows := []struct {
+		name   string
+		cap    *utils.Money
+		window time.Duration
+		period string
+	}{
+		{"daily", limits.Daily, DailyWindow, "24 hours"},
+		{"monthly", limits.Monthly, MonthlyWindow, "30 days"},
+	}
+	for _, window := range windows {
+		if window.cap == nil {
+			continue
+		}
+		sent, err := s.history.GetOutgoingTransferTotal(ctx, userID, amount.Currency, now.Add(-window.window))
+		if err != nil {
+			return err
+		}
+		total, err := sent.CheckedAdd(amount)
+		if err != nil {
+			return err
+		}
+		if window.cap.LessThan(total) {
+			return utils.NewErrorWithMessage(utils.ErrLimitExceeded, fmt.Sprintf("Transfer of %s %s exceeds the %s limit of %s %s, %s %s was already sent in the last %s",
+				amount, amount.Currency, window.name, window.cap, amount.Currency, sent, amount.Currency, window.period))
+		}
+	}
+	return nil
+}
+
+func (s *limitsService) GetLimits(ctx context.Context, userID string) (EffectiveLimits, error) {
+	userLimits, err := s.repo.GetUserLimits(ctx, userID)
+	if utils.IsError(err, utils.ErrUserNotFound) {
+		userLimits = UserLimits{UserID: userID, Tier: DefaultTier}
+	} else if err != nil {
+		return EffectiveLimits{}, err
+	}
+	return s.effectiveLimits(userLimits), nil
+}
+
+func (s *limitsService) SetLimits(ctx context.Context, userID string, request UserLimitsRequest) (EffectiveLimits, error) {
+	if request.Tier == "" {
+		request.Tier = DefaultTier
+	}
+	if _, ok := s.tiers[request.Tier]; !ok {
+		return EffectiveLimits{}, utils.NewErrorWithMessage(utils.ErrValidationError, "Tier "+string(request.Tier)+" does not exist")
+	}
+	if request.Overrides == nil {
+		request.Overrides = make(map[utils.Currency]Limits)
+	}
+	err := bindLimits(request.Overrides)
+	if err != nil {
+		return EffectiveLimits{}, err
+	}
+	userLimits, err := s.repo.SetUserLimits(ctx, UserLimits{
+		UserID:    userID,
+		Tier:      request.Tier,
+		Overrides: request.Overrides,
+		UpdatedAt: time.Now(),
+	})
+	if err != nil {
+		return EffectiveLimits{}, err
+	}
+	return s.effectiveLimits(userLimits), nil
+}
+
+// effectiveLimits applies the user's overrides to their tier's limits.
+func (s *limitsService) effectiveLimits(userLimits UserLimits) EffectiveLimits {
+	limits := make(map[utils.Currency]Limits)
+	for currency, tierLimits := range s.tiers[userLimits.Tier] {
+		limits[currency] = tierLimits
+	}
+	for currency, overrides := range userLimits.Overrides {
+		limits[currency] = overrides.merge(limits[currency])
+	}
+	if userLimits.Overrides == nil {
+		userLimits.Overrides = make(map[utils.Currency]Limits)
+	}
+	return EffectiveLimits{UserLimits: userLimits, Limits: limits}
+}
+
+var limitsServiceInstance *limitsService
+
+func NewLimitsService(repo LimitsRepo, history TransferHistory, tiers map[Tier]map[utils.Currency]Limits) LimitsService {
+	if limitsServiceInstance == nil {
+		limitsServiceInstance = &limitsService{repo: repo, history: history, tiers: tiers}
+	}
+	return limitsServiceInstance
+}
@@ -0,0 +1,103 @@
+package limits
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"concurrent_money_transfer_system/internals/storage"
+	"concurrent_money_transfer_system/utils"
+)
+
+// sqlLimitsRepo keeps each user's tier in the user_limits table and their overrides in
+// user_limit_overrides, one row per currency with caps in minor units.
+type sqlLimitsRepo struct {
+	db *sql.DB
+}
+
+// NewSQLLimitsRepo returns a LimitsRepo backed by db, whose schema is created by storage.Migrate.
+func NewSQLLimitsRepo(db *sql.DB) LimitsRepo {
+	return &sqlLimitsRepo{db: db}
+}
+
+func (r *sqlLimitsRepo) GetUserLimits(ctx context.Context, userID string) (UserLimits, error) {
+	conn := storage.Conn(ctx, r.db)
+	userLimits := UserLimits{UserID: userID, Overrides: make(map[utils.Currency]Limits)}
+	err := conn.QueryRowContext(ctx, `SELECT tier, updated_at FROM user_limits WHERE user_id = $1`, userID).
+		Scan(&userLimits.Tier, &userLimits.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return UserLimits{}, utils.NewError(utils.ErrUserNotFound)
+	}
+	if err != nil {
+		return UserLimits{}, storage.DatabaseError(err)
+	}
+
+	rows, err := conn.QueryContext(ctx, `SELECT currency, per_transaction, daily, monthly
+		FROM user_limit_overrides WHERE user_id = $1`, userID)
+	if err != nil {
+		return UserLimits{}, storage.DatabaseError(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var currency utils.Currency
+		var perTransaction, daily, monthly sql.NullInt64
+		err = rows.Scan(&currency, &perTransaction, &daily, &monthly)
+		if err != nil {
+			return UserLimits{}, storage.DatabaseError(err)
+		}
+		userLimits.Overrides[currency] = Limits{
+			PerTransaction: nullableCap(perTransaction, currency),
+			Daily:          nullableCap(daily, currency),
+			Monthly:        nullableCap(monthly, currency),
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return UserLimits{}, storage.DatabaseError(err)
+	}
+	return userLimits, nil
+}
+
+func (r *sqlLimitsRepo) SetUserLimits(ctx context.Context, userLimits UserLimits) (UserLimits, error) {
+	err := storage.RunInTx(ctx, r.db, func(ctx context.Context) error {
+		conn := storage.Conn(ctx, r.db)
+		_, err := conn.ExecContext(ctx, `INSERT INTO user_limits (user_id, tier, updated_at) VALUES ($1, $2, $3)
+			ON CONFLICT (user_id) DO UPDATE SET tier = excluded.tier, updated_at = excluded.updated_at`,
+			userLimits.UserID, userLimits.Tier, userLimits.UpdatedAt)
+		if err != nil {
+			return storage.DatabaseError(err)
+		}
+		_, err = conn.ExecContext(ctx, `DELETE FROM user_limit_overrides WHERE user_id = $1`, userLimits.UserID)
+		if err != nil {
+			return storage.DatabaseError(err)
+		}
+		for currency, limits := range userLimits.Overrides {
+			_, err = conn.ExecContext(ctx, `INSERT INTO user_limit_overrides (user_id, currency, per_transaction, daily, monthly)
+				VALUES ($1, $2, $3, $4, $5)`,
+				userLimits.UserID, currency, nullableMinorUnits(limits.PerTransaction), nullableMinorUnits(limits.Daily), nullableMinorUnits(limits.Monthly))
+			if err != nil {
+				return storage.DatabaseError(err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return UserLimits{}, err
+	}
+	return userLimits, nil
+}
+
+// nullableMinorUnits stores a missing cap as NULL.
+func nullableMinorUnits(limitCap *utils.Money) sql.NullInt64 {
+	if limitCap == nil {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: limitCap.MinorUnits, Valid: true}
+}
+
+func nullableCap(minorUnits sql.NullInt64, currency utils.Currency) *utils.Money {
+	if !minorUnits.Valid {
+		return nil
+	}
+	limitCap := utils.NewMoney(minorUnits.Int64, currency)
+	return &limitCap
+}
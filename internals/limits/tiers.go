@@ -0,0 +1,60 @@
+package limits
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"concurrent_money_transfer_system/utils"
+)
+
+// DefaultTiers are used when no tiers file is configured. Standard users have no limits
+// until risk configures some.
+var DefaultTiers = map[Tier]map[utils.Currency]Limits{
+	DefaultTier: {},
+}
+
+// LoadTiers reads tiers from a JSON file such as
+// {"standard": {"USD": {"per_transaction": "1000", "daily": "2500", "monthly": "10000"}}}.
+func LoadTiers(path string) (map[Tier]map[utils.Currency]Limits, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	tiers := make(map[Tier]map[utils.Currency]Limits)
+	err = json.Unmarshal(data, &tiers)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse tiers file %s: %w", path, err)
+	}
+	if _, ok := tiers[DefaultTier]; !ok {
+		return nil, fmt.Errorf("tiers file %s has no %q tier", path, DefaultTier)
+	}
+	for tier, limits := range tiers {
+		err = bindLimits(limits)
+		if err != nil {
+			return nil, fmt.Errorf("invalid limits of tier %q: %w", tier, err)
+		}
+	}
+	return tiers, nil
+}
+
+// bindLimits binds the caps parsed from JSON to the currency they are keyed by, checking
+// they are positive amounts of it.
+func bindLimits(limits map[utils.Currency]Limits) error {
+	for currency, limit := range limits {
+		for _, limitCap := range []*utils.Money{limit.PerTransaction, limit.Daily, limit.Monthly} {
+			if limitCap == nil {
+				continue
+			}
+			bound, err := limitCap.WithCurrency(currency)
+			if err != nil {
+				return err
+			}
+			if !bound.IsPositive() {
+				return utils.NewErrorWithMessage(utils.ErrValidationError, "Limits must be positive")
+			}
+			*limitCap = bound
+		}
+	}
+	return nil
+}
@@ -0,0 +1,23 @@
+package scheduler
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// DefaultPollInterval is how often due schedules are looked for
+const DefaultPollInterval = time.Minute
+
+// LoadPollInterval reads how often due schedules are looked for from SCHEDULER_INTERVAL.
+func LoadPollInterval() (time.Duration, error) {
+	value := os.Getenv("SCHEDULER_INTERVAL")
+	if value == "" {
+		return DefaultPollInterval, nil
+	}
+	interval, err := time.ParseDuration(value)
+	if err != nil || interval <= 0 {
+		return 0, fmt.Errorf("invalid SCHEDULER_INTERVAL %q, expected a positive duration such as 1m", value)
+	}
+	return interval, nil
+}
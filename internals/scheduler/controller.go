@@ -0,0 +1,128 @@
+package scheduler
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"concurrent_money_transfer_system/internals/authz"
+	"concurrent_money_transfer_system/utils"
+)
+
+type SchedulerController interface {
+	CreateSchedule(c *gin.Context)
+	GetSchedule(c *gin.Context)
+	GetSchedulesByUserID(c *gin.Context)
+	UpdateSchedule(c *gin.Context)
+	DeleteSchedule(c *gin.Context)
+}
+
+type schedulerController struct {
+	service SchedulerService
+}
+
+func NewSchedulerController(service SchedulerService) SchedulerController {
+	return &schedulerController{service: service}
+}
+
+func (sc *schedulerController) CreateSchedule(c *gin.Context) {
+	request := ScheduleRequest{}
+	err := utils.BindAndValidateRequest(c, &request)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+	// Like transfers, only the sender can schedule money out of their wallet
+	err = authz.AuthorizeOwner(c.Request.Context(), request.SenderID)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+	schedule, err := sc.service.CreateSchedule(c.Request.Context(), &request)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, schedule)
+}
+
+func (sc *schedulerController) GetSchedule(c *gin.Context) {
+	schedule, ok := sc.getScheduleForSender(c, authz.RoleSupport, authz.RoleAdmin)
+	if !ok {
+		return
+	}
+	utils.ResponseSuccess(c, schedule)
+}
+
+func (sc *schedulerController) GetSchedulesByUserID(c *gin.Context) {
+	userID := c.Param("user_id")
+	if userID == "" {
+		utils.ResponseError(c, utils.NewErrorWithMessage(utils.ErrInvalidRequest, "User ID is required"))
+		return
+	}
+	err := authz.AuthorizeOwner(c.Request.Context(), userID, authz.RoleSupport, authz.RoleAdmin)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+	schedules, err := sc.service.GetSchedulesByUserID(c.Request.Context(), userID)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+	utils.ResponseSuccess(c, schedules)
+}
+
+func (sc *schedulerController) UpdateSchedule(c *gin.Context) {
+	request := ScheduleRequest{}
+	err := utils.BindAndValidateRequest(c, &request)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+	schedule, ok := sc.getScheduleForSender(c)
+	if !ok {
+		return
+	}
+	schedule, err = sc.service.UpdateSchedule(c.Request.Context(), schedule.ID, &request)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+	utils.ResponseSuccess(c, schedule)
+}
+
+// Admins can delete schedules, e.g. of a closed account, but not create or change them.
+func (sc *schedulerController) DeleteSchedule(c *gin.Context) {
+	schedule, ok := sc.getScheduleForSender(c, authz.RoleAdmin)
+	if !ok {
+		return
+	}
+	err := sc.service.DeleteSchedule(c.Request.Context(), schedule.ID)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+	utils.ResponseSuccess(c, gin.H{"message": "Schedule deleted successfully"})
+}
+
+// getScheduleForSender returns the schedule named by the id parameter if the caller is its
+// sender or has one of the roles, responding with the error otherwise.
+func (sc *schedulerController) getScheduleForSender(c *gin.Context, roles ...authz.Role) (Schedule, bool) {
+	id := c.Param("id")
+	if id == "" {
+		utils.ResponseError(c, utils.NewErrorWithMessage(utils.ErrInvalidRequest, "Schedule ID is required"))
+		return Schedule{}, false
+	}
+	schedule, err := sc.service.GetSchedule(c.Request.Context(), id)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return Schedule{}, false
+	}
+	err = authz.AuthorizeOwner(c.Request.Context(), schedule.SenderID, roles...)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return Schedule{}, false
+	}
+	return schedule, true
+}
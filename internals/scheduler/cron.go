@@ -0,0 +1,135 @@
+package scheduler
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"concurrent_money_transfer_system/utils"
+)
+
+// CronSchedule holds the times matched by a five-field cron expression
+// (minute, hour, day of month, month, day of week) as one bit per allowed value.
+type CronSchedule struct {
+	minute, hour, dayOfMonth, month, dayOfWeek uint64
+	// As in cron, a day matches either field when both are restricted, and both otherwise
+	dayOfMonthRestricted, dayOfWeekRestricted bool
+}
+
+// cronField is the range of values a cron field accepts
+type cronField struct {
+	name     string
+	min, max int
+}
+
+var cronFields = []cronField{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7}, // Both 0 and 7 are Sunday
+}
+
+// cronHorizon bounds the search for the next run of expressions that never match, such as "0 0 31 2 *"
+const cronHorizon = 30
+
+// ParseCron parses an expression of five space separated fields, each a list of values,
+// ranges such as 1-5 and steps such as */15 or 10-50/20, or * for any value.
+func ParseCron(expr string) (CronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != len(cronFields) {
+		return CronSchedule{}, utils.NewErrorWithMessage(utils.ErrValidationError, "Cron must have 5 fields: minute, hour, day of month, month and day of week")
+	}
+	bits := make([]uint64, len(fields))
+	for i, field := range fields {
+		var err error
+		bits[i], err = parseCronField(field, cronFields[i])
+		if err != nil {
+			return CronSchedule{}, err
+		}
+	}
+	if bits[4]&(1<<7) != 0 {
+		bits[4] = bits[4]&^(1<<7) | 1
+	}
+	return CronSchedule{
+		minute:               bits[0],
+		hour:                 bits[1],
+		dayOfMonth:           bits[2],
+		month:                bits[3],
+		dayOfWeek:            bits[4],
+		dayOfMonthRestricted: !strings.HasPrefix(fields[2], "*"),
+		dayOfWeekRestricted:  !strings.HasPrefix(fields[4], "*"),
+	}, nil
+}
+
+func parseCronField(field string, bounds cronField) (uint64, error) {
+	invalid := utils.NewErrorWithMessage(utils.ErrValidationError, "Cron "+bounds.name+" "+strconv.Quote(field)+" is invalid")
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		valueRange, stepText, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepText)
+			if err != nil || step <= 0 {
+				return 0, invalid
+			}
+		}
+		low, high := bounds.min, bounds.max
+		if valueRange != "*" {
+			lowText, highText, isRange := strings.Cut(valueRange, "-")
+			var err error
+			low, err = strconv.Atoi(lowText)
+			if err != nil {
+				return 0, invalid
+			}
+			high = low
+			if isRange {
+				high, err = strconv.Atoi(highText)
+				if err != nil {
+					return 0, invalid
+				}
+			} else if hasStep {
+				high = bounds.max // 10/20 means from 10 to the end every 20
+			}
+		}
+		if low < bounds.min || high > bounds.max || low > high {
+			return 0, invalid
+		}
+		for value := low; value <= high; value += step {
+			bits |= 1 << value
+		}
+	}
+	return bits, nil
+}
+
+// Next returns the first time matching the schedule strictly after the given time, in UTC,
+// or the zero time if there is none within the next 30 years.
+func (c CronSchedule) Next(after time.Time) time.Time {
+	t := after.UTC().Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(cronHorizon, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<int(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		case !c.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+		case c.hour&(1<<t.Hour()) == 0:
+			t = t.Truncate(time.Hour).Add(time.Hour)
+		case c.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (c CronSchedule) matchesDay(t time.Time) bool {
+	dayOfMonth := c.dayOfMonth&(1<<t.Day()) != 0
+	dayOfWeek := c.dayOfWeek&(1<<int(t.Weekday())) != 0
+	if c.dayOfMonthRestricted && c.dayOfWeekRestricted {
+		return dayOfMonth || dayOfWeek
+	}
+	return dayOfMonth && dayOfWeek
+}
@@ -0,0 +1,120 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"time"
+
+	"concurrent_money_transfer_system/utils"
+)
+
+type ScheduleStatus string
+
+const (
+	Active    ScheduleStatus = "active"
+	Completed ScheduleStatus = "completed" // No runs are left
+)
+
+type RunStatus string
+
+const (
+	RunCompleted RunStatus = "completed"
+	RunFailed    RunStatus = "failed"
+)
+
+// MinInterval is the shortest time allowed between the runs of an interval schedule
+const MinInterval = time.Minute
+
+// Schedule is an instruction to transfer an amount from the sender to the receiver once at
+// StartAt, or repeatedly from StartAt every Interval or at the times matching Cron.
+type Schedule struct {
+	ID          string         `json:"id"`
+	SenderID    string         `json:"sender_id"`
+	ReceiverID  string         `json:"receiver_id"`
+	Amount      utils.Money    `json:"amount"`
+	Currency    utils.Currency `json:"currency"`
+	Description string         `json:"description,omitempty"`
+	StartAt     time.Time      `json:"start_at"`
+	Interval    string         `json:"interval,omitempty"` // Time between runs as a duration such as 168h
+	Cron        string         `json:"cron,omitempty"`
+	EndAt       *time.Time     `json:"end_at,omitempty"`      // No runs are made after it
+	NextRunAt   *time.Time     `json:"next_run_at,omitempty"` // Unset once the schedule is completed
+	Status      ScheduleStatus `json:"status"`
+	Runs        []Run          `json:"runs"`
+	CreatedAt   time.Time      `json:"created_at"`
+	UpdatedAt   time.Time      `json:"updated_at"`
+}
+
+// Run is one execution of a schedule.
+type Run struct {
+	DueAt         time.Time       `json:"due_at"`
+	RanAt         time.Time       `json:"ran_at"`
+	Status        RunStatus       `json:"status"`
+	TransactionID string          `json:"transaction_id,omitempty"` // Transfer made by the run, if any
+	ErrorCode     utils.ErrorCode `json:"error_code,omitempty"`
+	Error         string          `json:"error,omitempty"`
+}
+
+// runAtOrAfter returns the schedule's first run at or after the time, and false when it has
+// no run left by then.
+func (s Schedule) runAtOrAfter(t time.Time) (time.Time, bool) {
+	if t.Before(s.StartAt) {
+		t = s.StartAt
+	}
+	var run time.Time
+	switch {
+	case s.Interval != "":
+		interval, err := time.ParseDuration(s.Interval)
+		if err != nil {
+			return time.Time{}, false
+		}
+		periods := (t.Sub(s.StartAt) + interval - 1) / interval
+		run = s.StartAt.Add(periods * interval)
+	case s.Cron != "":
+		cron, err := ParseCron(s.Cron)
+		if err != nil {
+			return time.Time{}, false
+		}
+		run = cron.Next(t.Add(-time.Nanosecond))
+		if run.IsZero() {
+			return time.Time{}, false
+		}
+	default:
+		if !s.StartAt.Equal(t) {
+			return time.Time{}, false
+		}
+		run = s.StartAt
+	}
+	if s.EndAt != nil && run.After(*s.EndAt) {
+		return time.Time{}, false
+	}
+	return run, true
+}
+
+type ScheduleRequest struct {
+	SenderID    string         `json:"sender_id" validate:"required"`
+	ReceiverID  string         `json:"receiver_id" validate:"required,nefield=SenderID"`
+	Amount      utils.Money    `json:"amount" validate:"required,min=0"`
+	Currency    utils.Currency `json:"currency" validate:"required"`
+	Description string         `json:"description"`
+	StartAt     *time.Time     `json:"start_at"` // First run; required unless Cron is set, which then starts from now
+	Interval    string         `json:"interval"`
+	Cron        string         `json:"cron"` // Five-field cron expression evaluated in UTC, e.g. "0 9 1 * *"
+	EndAt       *time.Time     `json:"end_at"`
+}
+
+// UnmarshalJSON binds the decoded amount to the request currency once both fields are read.
+func (r *ScheduleRequest) UnmarshalJSON(data []byte) error {
+	type scheduleRequest ScheduleRequest // avoids recursing into this method
+	if err := json.Unmarshal(data, (*scheduleRequest)(r)); err != nil {
+		return err
+	}
+	if r.Currency == "" {
+		return nil // reported by validation
+	}
+	amount, err := r.Amount.WithCurrency(r.Currency)
+	if err != nil {
+		return err
+	}
+	r.Amount = amount
+	return nil
+}
@@ -0,0 +1,178 @@
+package scheduler
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"concurrent_money_transfer_system/internals/storage"
+	"concurrent_money_transfer_system/utils"
+)
+
+// WAL record kinds of the schedule repo
+const (
+	scheduleRecord        = "schedule"         // Post-image of a schedule
+	scheduleDeletedRecord = "schedule.deleted" // Schedule deleted by its sender
+)
+
+type ScheduleRepo interface {
+	CreateSchedule(ctx context.Context, schedule Schedule) (Schedule, error)
+	GetSchedule(ctx context.Context, id string) (Schedule, error)
+	// GetSchedulesByUserID returns the schedules sent by the user, oldest first.
+	GetSchedulesByUserID(ctx context.Context, userID string) ([]Schedule, error)
+	// GetDueSchedules returns the active schedules whose next run is at or before now, earliest first.
+	GetDueSchedules(ctx context.Context, now time.Time) ([]Schedule, error)
+	// UpdateSchedule replaces the schedule's instruction, next run and status; its runs are kept.
+	UpdateSchedule(ctx context.Context, schedule Schedule) (Schedule, error)
+	DeleteSchedule(ctx context.Context, id string) error
+	// RecordRun appends the run to the schedule and saves the schedule's next run and status.
+	RecordRun(ctx context.Context, schedule Schedule, run Run) (Schedule, error)
+}
+
+type scheduleRepo struct {
+	schedules sync.Map
+	wal       *storage.WAL // Writes are logged here first when set
+}
+
+func (r *scheduleRepo) CreateSchedule(ctx context.Context, schedule Schedule) (Schedule, error) {
+	if schedule.ID == "" {
+		schedule.ID = utils.GenerateUniqueEntityId()
+	}
+	schedule.Runs = make([]Run, 0)
+	err := r.storeSchedule(ctx, schedule)
+	if err != nil {
+		return Schedule{}, err
+	}
+	return schedule, nil
+}
+
+func (r *scheduleRepo) GetSchedule(ctx context.Context, id string) (Schedule, error) {
+	schedule, ok := r.schedules.Load(id)
+	if !ok {
+		return Schedule{}, utils.NewError(utils.ErrScheduleNotFound)
+	}
+	return schedule.(Schedule), nil
+}
+
+func (r *scheduleRepo) GetSchedulesByUserID(ctx context.Context, userID string) ([]Schedule, error) {
+	return r.filterSchedules(func(schedule Schedule) bool {
+		return schedule.SenderID == userID
+	}, func(a, b Schedule) bool {
+		return a.CreatedAt.Before(b.CreatedAt) || a.CreatedAt.Equal(b.CreatedAt) && a.ID < b.ID
+	}), nil
+}
+
+func (r *scheduleRepo) GetDueSchedules(ctx context.Context, now time.Time) ([]Schedule, error) {
+	return r.filterSchedules(func(schedule Schedule) bool {
+		return schedule.Status == Active && schedule.NextRunAt != nil && !schedule.NextRunAt.After(now)
+	}, func(a, b Schedule) bool {
+		return a.NextRunAt.Before(*b.NextRunAt) || a.NextRunAt.Equal(*b.NextRunAt) && a.ID < b.ID
+	}), nil
+}
+
+func (r *scheduleRepo) UpdateSchedule(ctx context.Context, schedule Schedule) (Schedule, error) {
+	previous, err := r.GetSchedule(ctx, schedule.ID)
+	if err != nil {
+		return Schedule{}, err
+	}
+	schedule.Runs = previous.Runs
+	err = r.storeSchedule(ctx, schedule)
+	if err != nil {
+		return Schedule{}, err
+	}
+	return schedule, nil
+}
+
+func (r *scheduleRepo) DeleteSchedule(ctx context.Context, id string) error {
+	schedule, err := r.GetSchedule(ctx, id)
+	if err != nil {
+		return err
+	}
+	return r.wal.Log(ctx, scheduleDeletedRecord, schedule, func() { r.schedules.Delete(id) })
+}
+
+func (r *scheduleRepo) RecordRun(ctx context.Context, schedule Schedule, run Run) (Schedule, error) {
+	previous, err := r.GetSchedule(ctx, schedule.ID)
+	if err != nil {
+		return Schedule{}, err
+	}
+	// Clipping makes append copy the stored runs, so schedules handed out earlier never see the new run
+	schedule.Runs = append(slices.Clip(previous.Runs), run)
+	err = r.storeSchedule(ctx, schedule)
+	if err != nil {
+		return Schedule{}, err
+	}
+	return schedule, nil
+}
+
+// storeSchedule logs the schedule to the WAL and stores it.
+func (r *scheduleRepo) storeSchedule(ctx context.Context, schedule Schedule) error {
+	return r.wal.Log(ctx, scheduleRecord, schedule, func() { r.schedules.Store(schedule.ID, schedule) })
+}
+
+// filterSchedules returns the schedules matching keep, sorted by less.
+func (r *scheduleRepo) filterSchedules(keep func(Schedule) bool, less func(a, b Schedule) bool) []Schedule {
+	schedules := make([]Schedule, 0)
+	r.schedules.Range(func(key, value any) bool {
+		if keep(value.(Schedule)) {
+			schedules = append(schedules, value.(Schedule))
+		}
+		return true
+	})
+	sort.Slice(schedules, func(i, j int) bool { return less(schedules[i], schedules[j]) })
+	return schedules
+}
+
+func (r *scheduleRepo) SetWAL(wal *storage.WAL) {
+	r.wal = wal
+}
+
+func (r *scheduleRepo) ApplyRecord(record storage.Record) (bool, error) {
+	if record.Kind != scheduleRecord && record.Kind != scheduleDeletedRecord {
+		return false, nil
+	}
+	var schedule Schedule
+	err := record.Decode(&schedule)
+	if err != nil {
+		return true, err
+	}
+	if record.Kind == scheduleDeletedRecord {
+		r.schedules.Delete(schedule.ID)
+		return true, nil
+	}
+	r.schedules.Store(schedule.ID, schedule)
+	return true, nil
+}
+
+func (r *scheduleRepo) SnapshotRecords() ([]storage.Record, error) {
+	records := make([]storage.Record, 0)
+	var err error
+	r.schedules.Range(func(key, value any) bool {
+		var record storage.Record
+		record, err = storage.NewRecord(scheduleRecord, value.(Schedule))
+		records = append(records, record)
+		return err == nil
+	})
+	return records, err
+}
+
+var scheduleRepoInstance *scheduleRepo
+
+func NewScheduleRepo() ScheduleRepo {
+	if scheduleRepoInstance == nil {
+		scheduleRepoInstance = &scheduleRepo{
+			schedules: sync.Map{},
+		}
+	}
+	return scheduleRepoInstance
+}
+
+// Reset is just used for testing purposes
+func Reset() {
+	scheduleRepoInstance.schedules.Range(func(key, value any) bool {
+		scheduleRepoInstance.schedules.Delete(key)
+		return true
+	})
+}
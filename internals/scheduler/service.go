@@ -0,0 +1,223 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"concurrent_money_transfer_system/internals/transactions"
+	"concurrent_money_transfer_system/utils"
+)
+
+type SchedulerService interface {
+	CreateSchedule(ctx context.Context, request *ScheduleRequest) (Schedule, error)
+	GetSchedule(ctx context.Context, id string) (Schedule, error)
+	GetSchedulesByUserID(ctx context.Context, userID string) ([]Schedule, error)
+	// UpdateSchedule replaces the instruction of the schedule, which starts over from the
+	// request's start_at; the runs made so far are kept.
+	UpdateSchedule(ctx context.Context, id string, request *ScheduleRequest) (Schedule, error)
+	DeleteSchedule(ctx context.Context, id string) error
+	// RunDue makes the transfers of the schedules due by the clock's now and returns how many it made.
+	RunDue(ctx context.Context) (int, error)
+	Start(interval time.Duration, stop <-chan struct{})
+}
+
+type schedulerService struct {
+	repo               ScheduleRepo
+	transactionService transactions.TransactionService
+	clock              Clock
+	runMutex           sync.Mutex // Keeps schedules from being updated or deleted while they run
+}
+
+func (s *schedulerService) CreateSchedule(ctx context.Context, request *ScheduleRequest) (Schedule, error) {
+	now := s.clock.Now()
+	schedule, err := newSchedule(request, now)
+	if err != nil {
+		return Schedule{}, err
+	}
+	schedule.CreatedAt = now
+	return s.repo.CreateSchedule(ctx, schedule)
+}
+
+func (s *schedulerService) GetSchedule(ctx context.Context, id string) (Schedule, error) {
+	return s.repo.GetSchedule(ctx, id)
+}
+
+func (s *schedulerService) GetSchedulesByUserID(ctx context.Context, userID string) ([]Schedule, error) {
+	return s.repo.GetSchedulesByUserID(ctx, userID)
+}
+
+func (s *schedulerService) UpdateSchedule(ctx context.Context, id string, request *ScheduleRequest) (Schedule, error) {
+	s.runMutex.Lock()
+	defer s.runMutex.Unlock()
+	previous, err := s.repo.GetSchedule(ctx, id)
+	if err != nil {
+		return Schedule{}, err
+	}
+	if request.SenderID != previous.SenderID {
+		return Schedule{}, utils.NewErrorWithMessage(utils.ErrValidationError, "SenderID cannot be changed")
+	}
+	schedule, err := newSchedule(request, s.clock.Now())
+	if err != nil {
+		return Schedule{}, err
+	}
+	schedule.ID = previous.ID
+	schedule.CreatedAt = previous.CreatedAt
+	return s.repo.UpdateSchedule(ctx, schedule)
+}
+
+func (s *schedulerService) DeleteSchedule(ctx context.Context, id string) error {
+	s.runMutex.Lock()
+	defer s.runMutex.Unlock()
+	return s.repo.DeleteSchedule(ctx, id)
+}
+
+func (s *schedulerService) RunDue(ctx context.Context) (int, error) {
+	s.runMutex.Lock()
+	defer s.runMutex.Unlock()
+	now := s.clock.Now()
+	schedules, err := s.repo.GetDueSchedules(ctx, now)
+	if err != nil {
+		return 0, err
+	}
+	ran := 0
+	for _, schedule := range schedules {
+		_, err = s.run(ctx, schedule, now)
+		if err != nil {
+			return ran, err
+		}
+		ran++
+	}
+	return ran, nil
+}
+
+// run makes the transfer of the schedule's next run and records it. Failed transfers are
+// recorded as failed runs rather than returned, so one failing schedule does not hold up the others.
+func (s *schedulerService) run(ctx context.Context, schedule Schedule, now time.Time) (Schedule, error) {
+	dueAt := *schedule.NextRunAt
+	run := Run{DueAt: dueAt, RanAt: now, Status: RunCompleted}
+	transaction, err := s.transactionService.CreateTransaction(ctx, &transactions.TransferRequest{
+		SenderID:    schedule.SenderID,
+		ReceiverID:  schedule.ReceiverID,
+		Amount:      schedule.Amount,
+		Currency:    schedule.Currency,
+		Description: schedule.Description,
+		// A run whose recording failed is made again on the next tick; the key replays its
+		// transfer instead of sending the money twice
+		IdempotencyKey: fmt.Sprintf("schedule:%s:%d", schedule.ID, dueAt.Unix()),
+	})
+	switch {
+	case err != nil:
+		run.Status = RunFailed
+		run.Error = err.Error()
+		if scheduleErr, ok := err.(*utils.Error); ok {
+			run.ErrorCode = scheduleErr.Code
+		}
+	case transaction.Status != transactions.Completed:
+		run.Status = RunFailed
+		run.TransactionID = transaction.ID
+		run.Error = "Transaction is " + string(transaction.Status)
+	default:
+		run.TransactionID = transaction.ID
+	}
+
+	// Runs missed while the scheduler was down are skipped rather than made all at once
+	next, ok := schedule.runAtOrAfter(now.Add(time.Nanosecond))
+	schedule.NextRunAt = &next
+	if !ok {
+		schedule.NextRunAt = nil
+		schedule.Status = Completed
+	}
+	schedule.UpdatedAt = now
+	return s.repo.RecordRun(ctx, schedule, run)
+}
+
+// Start runs the due schedules every interval until stop is closed.
+func (s *schedulerService) Start(interval time.Duration, stop <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				ran, err := s.RunDue(context.Background())
+				if err != nil {
+					log.Printf("Failed to run due schedules: %v", err)
+				}
+				if ran > 0 {
+					log.Printf("Ran %d scheduled transfers", ran)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// newSchedule validates the request and returns the active schedule it describes, whose
+// next run is its first one at or after now.
+func newSchedule(request *ScheduleRequest, now time.Time) (Schedule, error) {
+	if request.Interval != "" && request.Cron != "" {
+		return Schedule{}, utils.NewErrorWithMessage(utils.ErrValidationError, "Only one of Interval and Cron can be set")
+	}
+	if request.Interval != "" {
+		interval, err := time.ParseDuration(request.Interval)
+		if err != nil || interval < MinInterval {
+			return Schedule{}, utils.NewErrorWithMessage(utils.ErrValidationError, "Interval must be a duration of at least "+MinInterval.String())
+		}
+	}
+	if request.Cron != "" {
+		_, err := ParseCron(request.Cron)
+		if err != nil {
+			return Schedule{}, err
+		}
+	}
+	startAt := now
+	if request.StartAt != nil {
+		startAt = *request.StartAt
+	} else if request.Cron == "" {
+		return Schedule{}, utils.NewErrorWithMessage(utils.ErrValidationError, "StartAt is required")
+	}
+	if request.EndAt != nil && request.EndAt.Before(startAt) {
+		return Schedule{}, utils.NewErrorWithMessage(utils.ErrValidationError, "EndAt must not be before StartAt")
+	}
+
+	schedule := Schedule{
+		SenderID:    request.SenderID,
+		ReceiverID:  request.ReceiverID,
+		Amount:      request.Amount,
+		Currency:    request.Currency,
+		Description: request.Description,
+		StartAt:     startAt.UTC(),
+		Interval:    request.Interval,
+		Cron:        request.Cron,
+		Status:      Active,
+		UpdatedAt:   now,
+	}
+	if request.EndAt != nil {
+		endAt := request.EndAt.UTC()
+		schedule.EndAt = &endAt
+	}
+	next, ok := schedule.runAtOrAfter(now)
+	if !ok {
+		return Schedule{}, utils.NewErrorWithMessage(utils.ErrValidationError, "Schedule has no run in the future")
+	}
+	schedule.NextRunAt = &next
+	return schedule, nil
+}
+
+var schedulerServiceInstance *schedulerService
+
+func NewSchedulerService(repo ScheduleRepo, transactionService transactions.TransactionService, clock Clock) SchedulerService {
+	if schedulerServiceInstance == nil {
+		schedulerServiceInstance = &schedulerService{repo: repo, transactionService: transactionService, clock: clock}
+	}
+	return schedulerServiceInstance
+}
+
+// SetClock is just used for testing purposes
+func SetClock(clock Clock) {
+	schedulerServiceInstance.clock = clock
+}
@@ -0,0 +1,213 @@
+package scheduler
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"concurrent_money_transfer_system/internals/storage"
+	"concurrent_money_transfer_system/utils"
+)
+
+// sqlScheduleRepo keeps schedules in the schedules table and their runs in schedule_runs,
+// numbered by position in the order they ran.
+type sqlScheduleRepo struct {
+	db *sql.DB
+}
+
+// NewSQLScheduleRepo returns a ScheduleRepo backed by db, whose schema is created by storage.Migrate.
+func NewSQLScheduleRepo(db *sql.DB) ScheduleRepo {
+	return &sqlScheduleRepo{db: db}
+}
+
+const scheduleColumns = `id, sender_id, receiver_id, amount, currency, description, start_at, run_interval, cron,
+	end_at, next_run_at, status, created_at, updated_at`
+
+func scanSchedule(row storage.Scanner) (Schedule, error) {
+	var schedule Schedule
+	var endAt, nextRunAt sql.NullTime
+	err := row.Scan(&schedule.ID, &schedule.SenderID, &schedule.ReceiverID, &schedule.Amount.MinorUnits, &schedule.Currency,
+		&schedule.Description, &schedule.StartAt, &schedule.Interval, &schedule.Cron, &endAt, &nextRunAt, &schedule.Status,
+		&schedule.CreatedAt, &schedule.UpdatedAt)
+	if err != nil {
+		return Schedule{}, err
+	}
+	schedule.Amount.Currency = schedule.Currency
+	if endAt.Valid {
+		schedule.EndAt = &endAt.Time
+	}
+	if nextRunAt.Valid {
+		schedule.NextRunAt = &nextRunAt.Time
+	}
+	return schedule, nil
+}
+
+func (r *sqlScheduleRepo) CreateSchedule(ctx context.Context, schedule Schedule) (Schedule, error) {
+	if schedule.ID == "" {
+		schedule.ID = utils.GenerateUniqueEntityId()
+	}
+	schedule.Runs = make([]Run, 0)
+	_, err := storage.Conn(ctx, r.db).ExecContext(ctx, `INSERT INTO schedules (`+scheduleColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)`,
+		schedule.ID, schedule.SenderID, schedule.ReceiverID, schedule.Amount.MinorUnits, schedule.Currency, schedule.Description,
+		schedule.StartAt, schedule.Interval, schedule.Cron, schedule.EndAt, schedule.NextRunAt, schedule.Status,
+		schedule.CreatedAt, schedule.UpdatedAt)
+	if err != nil {
+		return Schedule{}, storage.DatabaseError(err)
+	}
+	return schedule, nil
+}
+
+func (r *sqlScheduleRepo) GetSchedule(ctx context.Context, id string) (Schedule, error) {
+	conn := storage.Conn(ctx, r.db)
+	schedule, err := scanSchedule(conn.QueryRowContext(ctx, `SELECT `+scheduleColumns+` FROM schedules WHERE id = $1`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Schedule{}, utils.NewError(utils.ErrScheduleNotFound)
+	}
+	if err != nil {
+		return Schedule{}, storage.DatabaseError(err)
+	}
+	schedule.Runs, err = r.getRuns(ctx, schedule.ID)
+	if err != nil {
+		return Schedule{}, err
+	}
+	return schedule, nil
+}
+
+func (r *sqlScheduleRepo) GetSchedulesByUserID(ctx context.Context, userID string) ([]Schedule, error) {
+	return r.querySchedules(ctx, `SELECT `+scheduleColumns+` FROM schedules WHERE sender_id = $1 ORDER BY created_at, id`, userID)
+}
+
+func (r *sqlScheduleRepo) GetDueSchedules(ctx context.Context, now time.Time) ([]Schedule, error) {
+	return r.querySchedules(ctx, `SELECT `+scheduleColumns+` FROM schedules
+		WHERE status = $1 AND next_run_at <= $2 ORDER BY next_run_at, id`, Active, now)
+}
+
+func (r *sqlScheduleRepo) UpdateSchedule(ctx context.Context, schedule Schedule) (Schedule, error) {
+	result, err := storage.Conn(ctx, r.db).ExecContext(ctx, `UPDATE schedules
+		SET receiver_id = $2, amount = $3, currency = $4, description = $5, start_at = $6, run_interval = $7, cron = $8,
+			end_at = $9, next_run_at = $10, status = $11, updated_at = $12
+		WHERE id = $1`,
+		schedule.ID, schedule.ReceiverID, schedule.Amount.MinorUnits, schedule.Currency, schedule.Description, schedule.StartAt,
+		schedule.Interval, schedule.Cron, schedule.EndAt, schedule.NextRunAt, schedule.Status, schedule.UpdatedAt)
+	if err != nil {
+		return Schedule{}, storage.DatabaseError(err)
+	}
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		return Schedule{}, utils.NewError(utils.ErrScheduleNotFound)
+	}
+	schedule.Runs, err = r.getRuns(ctx, schedule.ID)
+	if err != nil {
+		return Schedule{}, err
+	}
+	return schedule, nil
+}
+
+func (r *sqlScheduleRepo) DeleteSchedule(ctx context.Context, id string) error {
+	var deleted int64
+	err := storage.RunInTx(ctx, r.db, func(ctx context.Context) error {
+		conn := storage.Conn(ctx, r.db)
+		_, err := conn.ExecContext(ctx, `DELETE FROM schedule_runs WHERE schedule_id = $1`, id)
+		if err != nil {
+			return storage.DatabaseError(err)
+		}
+		result, err := conn.ExecContext(ctx, `DELETE FROM schedules WHERE id = $1`, id)
+		if err != nil {
+			return storage.DatabaseError(err)
+		}
+		deleted, _ = result.RowsAffected()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return utils.NewError(utils.ErrScheduleNotFound)
+	}
+	return nil
+}
+
+func (r *sqlScheduleRepo) RecordRun(ctx context.Context, schedule Schedule, run Run) (Schedule, error) {
+	err := storage.RunInTx(ctx, r.db, func(ctx context.Context) error {
+		conn := storage.Conn(ctx, r.db)
+		result, err := conn.ExecContext(ctx, `UPDATE schedules SET next_run_at = $2, status = $3, updated_at = $4 WHERE id = $1`,
+			schedule.ID, schedule.NextRunAt, schedule.Status, schedule.UpdatedAt)
+		if err != nil {
+			return storage.DatabaseError(err)
+		}
+		if updated, _ := result.RowsAffected(); updated == 0 {
+			return utils.NewError(utils.ErrScheduleNotFound)
+		}
+		var position int
+		err = conn.QueryRowContext(ctx, `SELECT COUNT(*) FROM schedule_runs WHERE schedule_id = $1`, schedule.ID).Scan(&position)
+		if err != nil {
+			return storage.DatabaseError(err)
+		}
+		_, err = conn.ExecContext(ctx, `INSERT INTO schedule_runs (schedule_id, position, due_at, ran_at, status, transaction_id, error_code, error)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+			schedule.ID, position, run.DueAt, run.RanAt, run.Status, run.TransactionID, run.ErrorCode, run.Error)
+		if err != nil {
+			return storage.DatabaseError(err)
+		}
+		return nil
+	})
+	if err != nil {
+		return Schedule{}, err
+	}
+	schedule.Runs, err = r.getRuns(ctx, schedule.ID)
+	if err != nil {
+		return Schedule{}, err
+	}
+	return schedule, nil
+}
+
+// querySchedules returns the schedules selected by the query, each with its runs.
+func (r *sqlScheduleRepo) querySchedules(ctx context.Context, query string, args ...any) ([]Schedule, error) {
+	rows, err := storage.Conn(ctx, r.db).QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, storage.DatabaseError(err)
+	}
+	defer rows.Close()
+	schedules := make([]Schedule, 0)
+	for rows.Next() {
+		schedule, err := scanSchedule(rows)
+		if err != nil {
+			return nil, storage.DatabaseError(err)
+		}
+		schedules = append(schedules, schedule)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, storage.DatabaseError(err)
+	}
+	rows.Close() // frees the connection for the queries of the runs
+	for i := range schedules {
+		schedules[i].Runs, err = r.getRuns(ctx, schedules[i].ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return schedules, nil
+}
+
+func (r *sqlScheduleRepo) getRuns(ctx context.Context, scheduleID string) ([]Run, error) {
+	rows, err := storage.Conn(ctx, r.db).QueryContext(ctx, `SELECT due_at, ran_at, status, transaction_id, error_code, error
+		FROM schedule_runs WHERE schedule_id = $1 ORDER BY position`, scheduleID)
+	if err != nil {
+		return nil, storage.DatabaseError(err)
+	}
+	defer rows.Close()
+	runs := make([]Run, 0)
+	for rows.Next() {
+		var run Run
+		err = rows.Scan(&run.DueAt, &run.RanAt, &run.Status, &run.TransactionID, &run.ErrorCode, &run.Error)
+		if err != nil {
+			return nil, storage.DatabaseError(err)
+		}
+		runs = append(runs, run)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, storage.DatabaseError(err)
+	}
+	return runs, nil
+}
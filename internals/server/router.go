@@ -1,63 +1,310 @@
 package server
 
 import (
+	"log"
+	"os"
+
+	"concurrent_money_transfer_system/internals/auth"
+	"concurrent_money_transfer_system/internals/events"
+	"concurrent_money_transfer_system/internals/fx"
+	"concurrent_money_transfer_system/internals/ledger"
+	"concurrent_money_transfer_system/internals/limits"
+	"concurrent_money_transfer_system/internals/scheduler"
+	"concurrent_money_transfer_system/internals/statements"
+	"concurrent_money_transfer_system/internals/storage"
 	"concurrent_money_transfer_system/internals/transactions"
 	"concurrent_money_transfer_system/internals/users"
 	"concurrent_money_transfer_system/internals/wallet"
+	"concurrent_money_transfer_system/internals/webhooks"
 
 	"github.com/gin-gonic/gin"
 )
 
 func SetupRouter() *gin.Engine {
 	router := gin.Default()
+	repos := newRepos()
+	authService := newAuthService(repos)
+	authMiddleware := auth.Middleware(authService)
 
-	setupUserRoutes(router)
-	setupWalletRoutes(router)
-	setupTransactionRoutes(router)
+	setupUserRoutes(router, repos, authService, authMiddleware)
+	setupWalletRoutes(router, repos, authMiddleware)
+	setupTransactionRoutes(router, repos, authMiddleware)
+	setupLedgerRoutes(router, repos, authMiddleware)
+	setupFXRoutes(router, repos, authMiddleware)
+	setupLimitsRoutes(router, repos, authMiddleware)
+	setupScheduleRoutes(router, repos, authMiddleware)
+	setupWebhookRoutes(router, repos, authMiddleware)
+	startEventRelay(repos)
 
 	return router
 }
 
-func setupUserRoutes(router *gin.Engine) {
-	userRepo := users.NewUserRepo()
-	walletRepo := wallet.NewWalletRepo()
-	walletService := wallet.NewWalletService(walletRepo)
-	userService := users.NewUserService(userRepo, walletService)
+// repos are the repositories of the storage backend selected by storage.LoadConfig.
+type repos struct {
+	userRepo        users.UserRepo
+	walletRepo      wallet.WalletRepo
+	transactionRepo transactions.TransactionRepo
+	ledgerRepo      ledger.LedgerRepo
+	limitsRepo      limits.LimitsRepo
+	scheduleRepo    scheduler.ScheduleRepo
+	outboxRepo      events.OutboxRepo
+	webhookRepo     webhooks.WebhookRepo
+	quoteRepo       fx.QuoteRepo
+	unitOfWork      storage.UnitOfWork
+}
+
+func newRepos() repos {
+	config, err := storage.LoadConfig()
+	if err != nil {
+		log.Fatalf("Invalid storage configuration: %v", err)
+	}
+	if config.Backend == storage.Memory {
+		return repos{
+			userRepo:        users.NewUserRepo(),
+			walletRepo:      wallet.NewWalletRepo(),
+			transactionRepo: transactions.NewTransactionRepo(),
+			ledgerRepo:      ledger.NewLedgerRepo(),
+			limitsRepo:      limits.NewLimitsRepo(),
+			scheduleRepo:    scheduler.NewScheduleRepo(),
+			outboxRepo:      events.NewOutboxRepo(),
+			webhookRepo:     webhooks.NewWebhookRepo(),
+			quoteRepo:       fx.NewQuoteRepo(),
+			unitOfWork:      storage.NewMemoryUnitOfWork(),
+		}
+	}
+
+	db, err := storage.Open(config)
+	if err != nil {
+		log.Fatalf("Failed to open %s storage: %v", config.Backend, err)
+	}
+	log.Printf("Using %s storage at %s", config.Backend, config.DSN)
+	return repos{
+		userRepo:        users.NewSQLUserRepo(db),
+		walletRepo:      wallet.NewSQLWalletRepo(db),
+		transactionRepo: transactions.NewSQLTransactionRepo(db),
+		ledgerRepo:      ledger.NewSQLLedgerRepo(db),
+		limitsRepo:      limits.NewSQLLimitsRepo(db),
+		scheduleRepo:    scheduler.NewSQLScheduleRepo(db),
+		outboxRepo:      events.NewSQLOutboxRepo(db),
+		webhookRepo:     webhooks.NewSQLWebhookRepo(db),
+		quoteRepo:       fx.NewSQLQuoteRepo(db),
+		unitOfWork:      storage.NewSQLUnitOfWork(db),
+	}
+}
+
+// newAuthService signs tokens with the key configured by auth.LoadConfig.
+func newAuthService(repos repos) auth.AuthService {
+	config, err := auth.LoadConfig()
+	if err != nil {
+		log.Fatalf("Invalid auth configuration: %v", err)
+	}
+	return auth.NewAuthService(repos.userRepo, config)
+}
+
+// Only signing up and logging in are possible without a token.
+func setupUserRoutes(router *gin.Engine, repos repos, authService auth.AuthService, authMiddleware gin.HandlerFunc) {
+	ledgerService := ledger.NewLedgerService(repos.ledgerRepo)
+	walletService := newWalletService(repos, ledgerService)
+	userService := users.NewUserService(repos.userRepo, walletService, newEventService(repos), repos.unitOfWork)
 	userController := users.NewUserController(userService)
+	authController := auth.NewAuthController(authService)
 
 	userRouter := router.Group("api/user")
 	{
 		userRouter.POST("/signup", userController.CreateUser)
-		userRouter.GET("/:id", userController.GetUser)
-		userRouter.GET("/", userController.GetAllUsers)
-		userRouter.PUT("/:id", userController.UpdateUser)
-		userRouter.DELETE("/:id", userController.DeleteUser)
+		userRouter.POST("/login", authController.Login)
+		userRouter.GET("/:id", authMiddleware, userController.GetUser)
+		userRouter.GET("/", authMiddleware, userController.GetAllUsers)
+		userRouter.PUT("/:id", authMiddleware, userController.UpdateUser)
+		userRouter.DELETE("/:id", authMiddleware, userController.DeleteUser)
+		userRouter.PUT("/:id/role", authMiddleware, userController.SetRole)
 	}
 }
 
-func setupWalletRoutes(router *gin.Engine) {
-	walletRepo := wallet.NewWalletRepo()
-	walletService := wallet.NewWalletService(walletRepo)
+func setupWalletRoutes(router *gin.Engine, repos repos, authMiddleware gin.HandlerFunc) {
+	ledgerService := ledger.NewLedgerService(repos.ledgerRepo)
+	walletService := newWalletService(repos, ledgerService)
 	walletController := wallet.NewWalletController(walletService)
+	statementController := statements.NewStatementController(statements.NewStatementService(repos.transactionRepo, walletService))
 
-	walletRouter := router.Group("/wallets")
+	walletRouter := router.Group("/wallets", authMiddleware)
 	{
 		walletRouter.GET("", walletController.GetWallet)
 		walletRouter.PUT("/disable", walletController.DisableWallet)
+		walletRouter.GET("/reconcile", walletController.ReconcileWallet)
+		walletRouter.PUT("/currencies", walletController.AddCurrency)
+		walletRouter.GET("/statement", statementController.GetStatement)
 	}
 }
 
-func setupTransactionRoutes(router *gin.Engine) {
-	transactionRepo := transactions.NewTransactionRepo()
-	walletRepo := wallet.NewWalletRepo()
-	walletService := wallet.NewWalletService(walletRepo)
-	transactionService := transactions.NewTransactionService(transactionRepo, walletService)
+func setupTransactionRoutes(router *gin.Engine, repos repos, authMiddleware gin.HandlerFunc) {
+	holdConfig, err := transactions.LoadHoldConfig()
+	if err != nil {
+		log.Fatalf("Invalid hold configuration: %v", err)
+	}
+	transactionService := newTransactionService(repos, holdConfig)
+	transactionService.StartHoldSweeper(holdConfig.SweepInterval, nil)
 	transactionController := transactions.NewTransactionController(transactionService)
-	transactionRouter := router.Group("api/transaction")
+	transactionRouter := router.Group("api/transaction", authMiddleware)
 	{
 		transactionRouter.POST("/transfer", transactionController.CreateTransfer)
+		transactionRouter.POST("/batch", transactionController.CreateBatchTransfer)
+		transactionRouter.POST("/split", transactionController.CreateSplitTransfer)
+		transactionRouter.POST("/deposit", transactionController.CreateDeposit)
+		transactionRouter.POST("/withdraw", transactionController.CreateWithdrawal)
 		transactionRouter.GET("/:id", transactionController.GetTransaction)
+		transactionRouter.GET("/:id/split", transactionController.GetSplitTransfer)
+		transactionRouter.POST("/:id/reverse", transactionController.ReverseTransaction)
+		transactionRouter.POST("/:id/capture", transactionController.CaptureTransaction)
+		transactionRouter.POST("/:id/void", transactionController.VoidTransaction)
 		transactionRouter.GET("/user/:user_id", transactionController.GetTransactionsByUserID)
 		transactionRouter.GET("/", transactionController.GetAllTransactions)
 	}
 }
+
+// Schedules are managed by their sender; staff can read them and admins can delete them.
+func setupScheduleRoutes(router *gin.Engine, repos repos, authMiddleware gin.HandlerFunc) {
+	holdConfig, err := transactions.LoadHoldConfig()
+	if err != nil {
+		log.Fatalf("Invalid hold configuration: %v", err)
+	}
+	pollInterval, err := scheduler.LoadPollInterval()
+	if err != nil {
+		log.Fatalf("Invalid scheduler configuration: %v", err)
+	}
+	schedulerService := scheduler.NewSchedulerService(repos.scheduleRepo, newTransactionService(repos, holdConfig), scheduler.SystemClock{})
+	schedulerService.Start(pollInterval, nil)
+	schedulerController := scheduler.NewSchedulerController(schedulerService)
+
+	scheduleRouter := router.Group("api/schedule", authMiddleware)
+	{
+		scheduleRouter.POST("", schedulerController.CreateSchedule)
+		scheduleRouter.GET("/:id", schedulerController.GetSchedule)
+		scheduleRouter.PUT("/:id", schedulerController.UpdateSchedule)
+		scheduleRouter.DELETE("/:id", schedulerController.DeleteSchedule)
+		scheduleRouter.GET("/user/:user_id", schedulerController.GetSchedulesByUserID)
+	}
+}
+
+// Webhook endpoints are managed by their user; staff can read them and their deliveries, and
+// admins can delete them or redeliver.
+func setupWebhookRoutes(router *gin.Engine, repos repos, authMiddleware gin.HandlerFunc) {
+	dispatchInterval, err := webhooks.LoadDispatchInterval()
+	if err != nil {
+		log.Fatalf("Invalid webhook configuration: %v", err)
+	}
+	allowPrivateEndpoints, err := webhooks.LoadAllowPrivateEndpoints()
+	if err != nil {
+		log.Fatalf("Invalid webhook configuration: %v", err)
+	}
+	webhookService := webhooks.NewWebhookService(repos.webhookRepo, webhooks.SystemClock{}, allowPrivateEndpoints)
+	events.NewInProcessPublisher().Subscribe(webhookService.HandleEvent)
+	webhookService.Start(dispatchInterval, nil)
+	webhookController := webhooks.NewWebhookController(webhookService)
+
+	webhookRouter := router.Group("api/webhook", authMiddleware)
+	{
+		webhookRouter.POST("", webhookController.RegisterEndpoint)
+		webhookRouter.GET("/:id", webhookController.GetEndpoint)
+		webhookRouter.DELETE("/:id", webhookController.DeleteEndpoint)
+		webhookRouter.GET("/:id/deliveries", webhookController.GetDeliveries)
+		webhookRouter.POST("/:id/deliveries/:delivery_id/redeliver", webhookController.Redeliver)
+		webhookRouter.GET("/user/:user_id", webhookController.GetEndpointsByUserID)
+		webhookRouter.GET("/user/:user_id/dead-letters", webhookController.GetDeadDeliveries)
+	}
+}
+
+func setupLedgerRoutes(router *gin.Engine, repos repos, authMiddleware gin.HandlerFunc) {
+	ledgerService := ledger.NewLedgerService(repos.ledgerRepo)
+	ledgerController := ledger.NewLedgerController(ledgerService)
+
+	ledgerRouter := router.Group("api/ledger", authMiddleware)
+	{
+		ledgerRouter.GET("/accounts/:account_id", ledgerController.GetAccount)
+		ledgerRouter.GET("/transactions/:transaction_id", ledgerController.GetEntriesByTransactionID)
+	}
+}
+
+// Limits can be read by their user and staff, and only set by admins.
+func setupLimitsRoutes(router *gin.Engine, repos repos, authMiddleware gin.HandlerFunc) {
+	limitsController := limits.NewLimitsController(newLimitsService(repos))
+
+	limitsRouter := router.Group("api/limits", authMiddleware)
+	{
+		limitsRouter.GET("/:user_id", limitsController.GetLimits)
+		limitsRouter.PUT("/:user_id", limitsController.SetLimits)
+	}
+}
+
+func setupFXRoutes(router *gin.Engine, repos repos, authMiddleware gin.HandlerFunc) {
+	fxController := fx.NewFXController(newFXService(repos))
+
+	fxRouter := router.Group("api/fx", authMiddleware)
+	{
+		fxRouter.POST("/quotes", fxController.CreateQuote)
+	}
+}
+
+// newFXService quotes rates from the JSON file named by FX_RATES_FILE, or from fx.DefaultRates.
+func newFXService(repos repos) fx.FXService {
+	rateProvider, err := fx.NewStaticRateProvider(fx.DefaultRates)
+	if path := os.Getenv("FX_RATES_FILE"); path != "" {
+		rateProvider, err = fx.NewStaticRateProviderFromFile(path)
+	}
+	if err != nil {
+		log.Fatalf("Failed to load FX rates: %v", err)
+	}
+	return fx.NewFXService(repos.quoteRepo, rateProvider, fx.DefaultQuoteTTL)
+}
+
+// newTransactionService holds transfers for the TTL of holdConfig and locks wallets the way WALLET_LOCKING names.
+func newTransactionService(repos repos, holdConfig transactions.HoldConfig) transactions.TransactionService {
+	ledgerService := ledger.NewLedgerService(repos.ledgerRepo)
+	walletService := newWalletService(repos, ledgerService)
+	locking, err := transactions.LoadLockingStrategy()
+	if err != nil {
+		log.Fatalf("Invalid locking configuration: %v", err)
+	}
+	return transactions.NewTransactionService(repos.transactionRepo, walletService, ledgerService, newFXService(repos), newLimitsService(repos), newEventService(repos), repos.unitOfWork, holdConfig.TTL, locking)
+}
+
+// newWalletService waits for wallet locks for LOCK_TIMEOUT, or wallet.DefaultLockTimeout, and
+// shards the wallets across WALLET_SHARDS goroutines when it is set.
+func newWalletService(repos repos, ledgerService ledger.LedgerService) wallet.WalletService {
+	lockTimeout, err := wallet.LoadLockTimeout()
+	if err != nil {
+		log.Fatalf("Invalid lock configuration: %v", err)
+	}
+	shards, err := wallet.LoadShards()
+	if err != nil {
+		log.Fatalf("Invalid lock configuration: %v", err)
+	}
+	return wallet.NewWalletService(repos.walletRepo, ledgerService, newEventService(repos), repos.unitOfWork, lockTimeout, shards)
+}
+
+// newEventService publishes the outbox to the handlers subscribed to events.NewInProcessPublisher.
+func newEventService(repos repos) events.EventService {
+	return events.NewEventService(repos.outboxRepo, events.NewInProcessPublisher())
+}
+
+// startEventRelay publishes the outbox every OUTBOX_RELAY_INTERVAL, or events.DefaultRelayInterval.
+func startEventRelay(repos repos) {
+	interval, err := events.LoadRelayInterval()
+	if err != nil {
+		log.Fatalf("Invalid outbox configuration: %v", err)
+	}
+	newEventService(repos).StartRelay(interval, nil)
+}
+
+// newLimitsService enforces the tiers in the JSON file named by LIMIT_TIERS_FILE, or limits.DefaultTiers.
+func newLimitsService(repos repos) limits.LimitsService {
+	tiers := limits.DefaultTiers
+	if path := os.Getenv("LIMIT_TIERS_FILE"); path != "" {
+		var err error
+		tiers, err = limits.LoadTiers(path)
+		if err != nil {
+			log.Fatalf("Failed to load limit tiers: %v", err)
+		}
+	}
+	return limits.NewLimitsService(repos.limitsRepo, repos.transactionRepo, tiers)
+}
@@ -0,0 +1,147 @@
+package statements
+
+import (
+	"encoding/xml"
+	"strconv"
+	"strings"
+	"time"
+
+	"concurrent_money_transfer_system/utils"
+)
+
+const camt053Namespace = "urn:iso:std:iso:20022:tech:xsd:camt.053.001.08"
+
+type camtDocument struct {
+	XMLName   xml.Name      `xml:"Document"`
+	Namespace string        `xml:"xmlns,attr"`
+	Header    camtHeader    `xml:"BkToCstmrStmt>GrpHdr"`
+	Statement camtStatement `xml:"BkToCstmrStmt>Stmt"`
+}
+
+type camtHeader struct {
+	MessageID string `xml:"MsgId"`
+	CreatedAt string `xml:"CreDtTm"`
+}
+
+type camtStatement struct {
+	ID        string        `xml:"Id"`
+	CreatedAt string        `xml:"CreDtTm"`
+	From      string        `xml:"FrToDt>FrDtTm"`
+	To        string        `xml:"FrToDt>ToDtTm"`
+	AccountID string        `xml:"Acct>Id>Othr>Id"`
+	Currency  string        `xml:"Acct>Ccy"`
+	Balances  []camtBalance `xml:"Bal"`
+	Summary   camtSummary   `xml:"TxsSummry"`
+	Entries   []camtEntry   `xml:"Ntry"`
+}
+
+type camtAmount struct {
+	Currency string `xml:"Ccy,attr"`
+	Value    string `xml:",chardata"`
+}
+
+type camtBalance struct {
+	Type        string     `xml:"Tp>CdOrPrtry>Cd"` // OPBD for the opening balance, CLBD for the closing one
+	Amount      camtAmount `xml:"Amt"`
+	CreditDebit string     `xml:"CdtDbtInd"`
+	Date        string     `xml:"Dt>DtTm"`
+}
+
+type camtTotal struct {
+	Count int    `xml:"NbOfNtries"`
+	Sum   string `xml:"Sum"`
+}
+
+type camtSummary struct {
+	Count   int       `xml:"TtlNtries>NbOfNtries"`
+	Credits camtTotal `xml:"TtlCdtNtries"`
+	Debits  camtTotal `xml:"TtlDbtNtries"`
+}
+
+type camtEntry struct {
+	Reference   string     `xml:"NtryRef"`
+	Amount      camtAmount `xml:"Amt"`
+	CreditDebit string     `xml:"CdtDbtInd"`
+	Status      string     `xml:"Sts>Cd"`
+	BookedAt    string     `xml:"BookgDt>DtTm"`
+	ValueAt     string     `xml:"ValDt>DtTm"`
+	Code        string     `xml:"BkTxCd>Prtry>Cd"` // The transaction type
+	EndToEndID  string     `xml:"NtryDtls>TxDtls>Refs>EndToEndId"`
+	Information string     `xml:"AddtlNtryInf,omitempty"`
+}
+
+// renderCamt053 writes an ISO 20022 camt.053.001.08 bank to customer statement. Amounts are
+// unsigned, with CRDT or DBIT telling their direction.
+func renderCamt053(statement Statement) ([]byte, error) {
+	credits, creditSum, debits, debitSum, err := statement.Totals()
+	if err != nil {
+		return nil, err
+	}
+	document := camtDocument{
+		Namespace: camt053Namespace,
+		Header:    camtHeader{MessageID: statement.ID(), CreatedAt: camtTime(statement.CreatedAt)},
+		Statement: camtStatement{
+			ID:        statement.ID(),
+			CreatedAt: camtTime(statement.CreatedAt),
+			From:      camtTime(statement.From),
+			To:        camtTime(statement.To),
+			AccountID: camtReference(statement.WalletID),
+			Currency:  string(statement.Currency),
+			Balances: []camtBalance{
+				newCamtBalance("OPBD", statement.OpeningBalance, statement.From),
+				newCamtBalance("CLBD", statement.ClosingBalance, statement.To),
+			},
+			Summary: camtSummary{
+				Count:   len(statement.Entries),
+				Credits: camtTotal{Count: credits, Sum: creditSum.String()},
+				Debits:  camtTotal{Count: debits, Sum: debitSum.String()},
+			},
+			Entries: make([]camtEntry, 0, len(statement.Entries)),
+		},
+	}
+	for i, entry := range statement.Entries {
+		amount, creditDebit := camtSigned(entry.Amount)
+		document.Statement.Entries = append(document.Statement.Entries, camtEntry{
+			Reference:   strconv.Itoa(i + 1),
+			Amount:      amount,
+			CreditDebit: creditDebit,
+			Status:      "BOOK",
+			BookedAt:    camtTime(entry.BookedAt),
+			ValueAt:     camtTime(entry.BookedAt),
+			Code:        string(entry.TransactionType),
+			EndToEndID:  camtReference(entry.TransactionID),
+			Information: entry.Description,
+		})
+	}
+	body, err := xml.MarshalIndent(document, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), body...), nil
+}
+
+func newCamtBalance(balanceType string, balance utils.Money, at time.Time) camtBalance {
+	amount, creditDebit := camtSigned(balance)
+	return camtBalance{Type: balanceType, Amount: amount, CreditDebit: creditDebit, Date: camtTime(at)}
+}
+
+// camtSigned splits the amount into its absolute value and CRDT, or DBIT when it is negative.
+func camtSigned(money utils.Money) (camtAmount, string) {
+	if money.IsNegative() {
+		return camtAmount{Currency: string(money.Currency), Value: utils.NewMoney(-money.MinorUnits, money.Currency).String()}, "DBIT"
+	}
+	return camtAmount{Currency: string(money.Currency), Value: money.String()}, "CRDT"
+}
+
+// camtReference fits a transaction or wallet ID into an ISO 20022 reference or account ID,
+// which hold 35 and 34 characters, leaving out the hyphens of a UUID.
+func camtReference(id string) string {
+	if len(id) > 34 {
+		return strings.ReplaceAll(id, "-", "")
+	}
+	return id
+}
+
+func camtTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,75 @@
+package statements
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"concurrent_money_transfer_system/internals/authz"
+	"concurrent_money_transfer_system/utils"
+)
+
+type StatementController interface {
+	GetStatement(c *gin.Context)
+}
+
+type statementController struct {
+	service StatementService
+}
+
+func NewStatementController(service StatementService) StatementController {
+	return &statementController{service: service}
+}
+
+// formats maps each format to how it is rendered, its content type and its file extension.
+var formats = map[Format]struct {
+	render      func(Statement) ([]byte, error)
+	contentType string
+	extension   string
+}{
+	CSV:     {renderCSV, "text/csv; charset=utf-8", "csv"},
+	OFX:     {renderOFX, "application/x-ofx", "ofx"},
+	Camt053: {renderCamt053, "application/xml", "xml"},
+}
+
+// GetStatement responds with the statement as a file download in the requested format.
+func (sc *statementController) GetStatement(c *gin.Context) {
+	request := StatementRequest{}
+	err := c.ShouldBindQuery(&request)
+	if err != nil {
+		utils.ResponseError(c, utils.NewErrorWithMessage(utils.ErrInvalidRequest, err.Error()))
+		return
+	}
+	err = utils.ValidateStruct(&request)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+	err = authz.AuthorizeOwner(c.Request.Context(), request.UserID, authz.RoleSupport, authz.RoleAdmin)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+	from, to, err := request.Period()
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+	format := Format(request.Format)
+	if format == "" {
+		format = CSV
+	}
+
+	statement, err := sc.service.GetStatement(c.Request.Context(), request.UserID, utils.Currency(request.Currency), from, to)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+	body, err := formats[format].render(statement)
+	if err != nil {
+		utils.ResponseError(c, utils.NewErrorWithMessage(utils.ErrInternalServerError, "Failed to render the statement: "+err.Error()))
+		return
+	}
+	c.Header("Content-Disposition", `attachment; filename="statement-`+statement.ID()+"."+formats[format].extension+`"`)
+	c.Data(http.StatusOK, formats[format].contentType, body)
+}
@@ -0,0 +1,52 @@
+package statements
+
+import (
+	"bytes"
+	"encoding/csv"
+	"strings"
+	"time"
+)
+
+var csvHeader = []string{"booked_at", "transaction_id", "type", "counterparty_id", "description", "amount", "currency", "balance"}
+
+// renderCSV writes a row per entry between an opening_balance row at the start of the period
+// and a closing_balance row at its end.
+func renderCSV(statement Statement) ([]byte, error) {
+	var buffer bytes.Buffer
+	writer := csv.NewWriter(&buffer)
+	currency := string(statement.Currency)
+	rows := [][]string{
+		csvHeader,
+		{csvTime(statement.From), "", "opening_balance", "", "", "", currency, statement.OpeningBalance.String()},
+	}
+	for _, entry := range statement.Entries {
+		rows = append(rows, []string{
+			csvTime(entry.BookedAt),
+			entry.TransactionID,
+			string(entry.TransactionType),
+			csvText(entry.CounterpartyID),
+			csvText(entry.Description),
+			entry.Amount.String(),
+			currency,
+			entry.Balance.String(),
+		})
+	}
+	rows = append(rows, []string{csvTime(statement.To), "", "closing_balance", "", "", "", currency, statement.ClosingBalance.String()})
+	err := writer.WriteAll(rows)
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func csvTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// csvText keeps text written by users from being run as a formula by spreadsheets.
+func csvText(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
@@ -0,0 +1,109 @@
+package statements
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"concurrent_money_transfer_system/internals/transactions"
+	"concurrent_money_transfer_system/utils"
+)
+
+type Format string
+
+const (
+	CSV     Format = "csv"
+	OFX     Format = "ofx"     // OFX 2.2 bank statement
+	Camt053 Format = "camt053" // ISO 20022 camt.053.001.08 bank to customer statement
+)
+
+// Statement lists the transactions that moved money in or out of a wallet in one currency
+// over a period, between the wallet's balances at the start and at the end of the period.
+type Statement struct {
+	WalletID       string         `json:"wallet_id"`
+	Currency       utils.Currency `json:"currency"`
+	From           time.Time      `json:"from"` // Inclusive
+	To             time.Time      `json:"to"`   // Exclusive
+	OpeningBalance utils.Money    `json:"opening_balance"`
+	ClosingBalance utils.Money    `json:"closing_balance"`
+	Entries        []Entry        `json:"entries"`
+	CreatedAt      time.Time      `json:"created_at"`
+}
+
+// ID identifies the statement of the wallet's currency over the period, so the same statement
+// exported again carries the same ID. It is 32 characters long, which fits the 35 characters
+// ISO 20022 allows for references.
+func (s Statement) ID() string {
+	hash := sha256.Sum256([]byte(s.WalletID + "|" + string(s.Currency) + "|" + s.From.UTC().Format(time.RFC3339Nano) + "|" + s.To.UTC().Format(time.RFC3339Nano)))
+	return hex.EncodeToString(hash[:16])
+}
+
+// Totals returns the number and sum of the credit and of the debit entries.
+func (s Statement) Totals() (credits int, creditSum utils.Money, debits int, debitSum utils.Money, err error) {
+	creditSum, debitSum = utils.NewMoney(0, s.Currency), utils.NewMoney(0, s.Currency)
+	for _, entry := range s.Entries {
+		if entry.Amount.IsNegative() {
+			debits++
+			debitSum, err = debitSum.CheckedSub(entry.Amount)
+		} else {
+			credits++
+			creditSum, err = creditSum.CheckedAdd(entry.Amount)
+		}
+		if err != nil {
+			return 0, utils.Money{}, 0, utils.Money{}, err
+		}
+	}
+	return credits, creditSum, debits, debitSum, nil
+}
+
+// Entry is a transaction as booked on the statement. Amount is negative when money left
+// the wallet, and Balance is the wallet's balance right after the entry.
+type Entry struct {
+	TransactionID   string                       `json:"transaction_id"`
+	TransactionType transactions.TransactionType `json:"transaction_type"`
+	BookedAt        time.Time                    `json:"booked_at"`
+	CounterpartyID  string                       `json:"counterparty_id"`
+	Description     string                       `json:"description,omitempty"`
+	Amount          utils.Money                  `json:"amount"`
+	Balance         utils.Money                  `json:"balance"`
+}
+
+// StatementRequest holds the query parameters of GET /wallets/statement.
+type StatementRequest struct {
+	UserID   string `form:"user_id" validate:"required"`
+	Currency string `form:"currency"` // The wallet's primary currency when empty
+	From     string `form:"from" validate:"required"`
+	To       string `form:"to" validate:"required"`
+	Format   string `form:"format" validate:"omitempty,oneof=csv ofx camt053"` // csv when empty
+}
+
+// Period parses From and To, which are RFC 3339 times or dates. A date stands for the start
+// of its day in UTC, except that a To date includes its whole day.
+func (r *StatementRequest) Period() (time.Time, time.Time, error) {
+	from, err := parseTime("from", r.From, false)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	to, err := parseTime("to", r.To, true)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	if !from.Before(to) {
+		return time.Time{}, time.Time{}, utils.NewErrorWithMessage(utils.ErrValidationError, "from must be before to")
+	}
+	return from, to, nil
+}
+
+func parseTime(name string, value string, endOfDay bool) (time.Time, error) {
+	if date, err := time.Parse(time.DateOnly, value); err == nil {
+		if endOfDay {
+			return date.AddDate(0, 0, 1), nil
+		}
+		return date, nil
+	}
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, utils.NewErrorWithMessage(utils.ErrValidationError, name+" must be a date such as 2025-01-31 or an RFC 3339 time")
+	}
+	return parsed, nil
+}
@@ -0,0 +1,103 @@
+package statements
+
+import (
+	"encoding/xml"
+	"time"
+)
+
+// BankID names this system as the institution of the accounts in exported statements
+const BankID = "CMTS"
+
+const ofxHeader = `<?xml version="1.0" encoding="UTF-8"?>` + "\n" +
+	`<?OFX OFXHEADER="200" VERSION="220" SECURITY="NONE" OLDFILEUID="NONE" NEWFILEUID="NONE"?>` + "\n"
+
+type ofxDocument struct {
+	XMLName xml.Name    `xml:"OFX"`
+	SignOn  ofxSignOn   `xml:"SIGNONMSGSRSV1>SONRS"`
+	Bank    ofxResponse `xml:"BANKMSGSRSV1>STMTTRNRS"`
+}
+
+type ofxStatus struct {
+	Code     int    `xml:"CODE"`
+	Severity string `xml:"SEVERITY"`
+}
+
+type ofxSignOn struct {
+	Status   ofxStatus `xml:"STATUS"`
+	ServerAt string    `xml:"DTSERVER"`
+	Language string    `xml:"LANGUAGE"`
+}
+
+type ofxResponse struct {
+	TransactionUID string       `xml:"TRNUID"`
+	Status         ofxStatus    `xml:"STATUS"`
+	Statement      ofxStatement `xml:"STMTRS"`
+}
+
+type ofxStatement struct {
+	Currency     string           `xml:"CURDEF"`
+	BankID       string           `xml:"BANKACCTFROM>BANKID"`
+	AccountID    string           `xml:"BANKACCTFROM>ACCTID"`
+	AccountType  string           `xml:"BANKACCTFROM>ACCTTYPE"`
+	Start        string           `xml:"BANKTRANLIST>DTSTART"`
+	End          string           `xml:"BANKTRANLIST>DTEND"`
+	Transactions []ofxTransaction `xml:"BANKTRANLIST>STMTTRN"`
+	Balance      string           `xml:"LEDGERBAL>BALAMT"`
+	BalanceAt    string           `xml:"LEDGERBAL>DTASOF"`
+}
+
+type ofxTransaction struct {
+	Type     string `xml:"TRNTYPE"`
+	PostedAt string `xml:"DTPOSTED"`
+	Amount   string `xml:"TRNAMT"`
+	ID       string `xml:"FITID"`
+	Name     string `xml:"NAME,omitempty"`
+	Memo     string `xml:"MEMO,omitempty"`
+}
+
+// renderOFX writes an OFX 2.2 bank statement. OFX has no opening balance, so only the closing
+// balance is given, as the ledger balance at the end of the period.
+func renderOFX(statement Statement) ([]byte, error) {
+	ok := ofxStatus{Code: 0, Severity: "INFO"}
+	document := ofxDocument{
+		SignOn: ofxSignOn{Status: ok, ServerAt: ofxTime(statement.CreatedAt), Language: "ENG"},
+		Bank: ofxResponse{
+			TransactionUID: statement.ID(),
+			Status:         ok,
+			Statement: ofxStatement{
+				Currency:     string(statement.Currency),
+				BankID:       BankID,
+				AccountID:    statement.WalletID,
+				AccountType:  "CHECKING",
+				Start:        ofxTime(statement.From),
+				End:          ofxTime(statement.To),
+				Transactions: make([]ofxTransaction, 0, len(statement.Entries)),
+				Balance:      statement.ClosingBalance.String(),
+				BalanceAt:    ofxTime(statement.To),
+			},
+		},
+	}
+	for _, entry := range statement.Entries {
+		transactionType := "CREDIT"
+		if entry.Amount.IsNegative() {
+			transactionType = "DEBIT"
+		}
+		document.Bank.Statement.Transactions = append(document.Bank.Statement.Transactions, ofxTransaction{
+			Type:     transactionType,
+			PostedAt: ofxTime(entry.BookedAt),
+			Amount:   entry.Amount.String(),
+			ID:       entry.TransactionID,
+			Name:     entry.CounterpartyID,
+			Memo:     entry.Description,
+		})
+	}
+	body, err := xml.MarshalIndent(document, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(ofxHeader), body...), nil
+}
+
+func ofxTime(t time.Time) string {
+	return t.UTC().Format("20060102150405.000") + "[0:GMT]"
+}
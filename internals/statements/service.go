@@ -0,0 +1,130 @@
+package statements
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"concurrent_money_transfer_system/internals/transactions"
+	"concurrent_money_transfer_system/internals/wallet"
+	"concurrent_money_transfer_system/utils"
+)
+
+type StatementService interface {
+	// GetStatement builds the statement of the user's wallet in the currency, or its primary
+	// currency when empty, from from up to but not including to.
+	GetStatement(ctx context.Context, userID string, currency utils.Currency, from time.Time, to time.Time) (Statement, error)
+}
+
+type statementService struct {
+	transactionRepo transactions.TransactionRepo
+	walletService   wallet.WalletService
+}
+
+// GetStatement works back from the wallet's current balance: the closing balance is what the
+// wallet held before the transactions booked after the period, and the opening balance what
+// it held before the ones booked in it. Transactions are booked when their money moved, so a
+// hold is booked when it was captured.
+func (s *statementService) GetStatement(ctx context.Context, userID string, currency utils.Currency, from time.Time, to time.Time) (Statement, error) {
+	// The wallet is locked while its balance and history are read, so no transfer settles in between
+	w, err := s.walletService.GetWalletForUpdate(ctx, userID)
+	if err != nil {
+		return Statement{}, err
+	}
+	history, err := s.transactionRepo.GetTransactionsByUserID(ctx, userID)
+	s.walletService.ReleaseGetWalletForUpdateLock(ctx, userID)
+	if err != nil {
+		return Statement{}, err
+	}
+	if currency == "" {
+		currency = w.Currency
+	}
+	balance, ok := w.BalanceIn(currency)
+	if !ok {
+		return Statement{}, utils.NewErrorWithMessage(utils.ErrCurrencyMismatch, "Wallet does not hold "+string(currency))
+	}
+
+	statement := Statement{WalletID: w.ID, Currency: currency, From: from, To: to, Entries: make([]Entry, 0), CreatedAt: time.Now()}
+	closing := balance
+	for _, transaction := range history {
+		amount, ok := bookedAmount(userID, currency, transaction)
+		bookedAt := transaction.BookedAt()
+		if !ok || bookedAt.Before(from) {
+			continue
+		}
+		if !bookedAt.Before(to) {
+			closing, err = closing.CheckedSub(amount)
+			if err != nil {
+				return Statement{}, err
+			}
+			continue
+		}
+		counterpartyID := transaction.DebitUserID
+		if counterpartyID == userID {
+			counterpartyID = transaction.CreditUserID
+		}
+		statement.Entries = append(statement.Entries, Entry{
+			TransactionID:   transaction.ID,
+			TransactionType: transaction.TransactionType,
+			BookedAt:        bookedAt,
+			CounterpartyID:  counterpartyID,
+			Description:     transaction.Description,
+			Amount:          amount,
+		})
+	}
+	// The history is in creation order, which holds captured later break
+	sort.SliceStable(statement.Entries, func(i, j int) bool {
+		return statement.Entries[i].BookedAt.Before(statement.Entries[j].BookedAt)
+	})
+	statement.ClosingBalance = closing
+	statement.OpeningBalance = closing
+	for _, entry := range statement.Entries {
+		statement.OpeningBalance, err = statement.OpeningBalance.CheckedSub(entry.Amount)
+		if err != nil {
+			return Statement{}, err
+		}
+	}
+	running := statement.OpeningBalance
+	for i := range statement.Entries {
+		running, err = running.CheckedAdd(statement.Entries[i].Amount)
+		if err != nil {
+			return Statement{}, err
+		}
+		statement.Entries[i].Balance = running
+	}
+	return statement, nil
+}
+
+// bookedAmount returns the amount the transaction moved into the user's wallet in the currency,
+// negative when it moved out, and false when it moved nothing there. Pending holds are left
+// out, as held funds are still part of the balance.
+func bookedAmount(userID string, currency utils.Currency, transaction transactions.Transaction) (utils.Money, bool) {
+	if transaction.TransactionType == transactions.Split {
+		return utils.Money{}, false // Its legs move the money
+	}
+	switch transaction.Status {
+	case transactions.Completed, transactions.Refunded, transactions.Reversed:
+	default:
+		return utils.Money{}, false
+	}
+	amount := utils.NewMoney(0, currency)
+	moved := false
+	if transaction.DebitUserID == userID && transaction.Currency == currency {
+		amount = amount.Sub(transaction.Amount)
+		moved = true
+	}
+	if credit := transaction.CreditAmount(); transaction.CreditUserID == userID && credit.Currency == currency {
+		amount = amount.Add(credit)
+		moved = true
+	}
+	return amount, moved
+}
+
+var statementServiceInstance *statementService
+
+func NewStatementService(transactionRepo transactions.TransactionRepo, walletService wallet.WalletService) StatementService {
+	if statementServiceInstance == nil {
+		statementServiceInstance = &statementService{transactionRepo: transactionRepo, walletService: walletService}
+	}
+	return statementServiceInstance
+}
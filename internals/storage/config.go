@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+type Backend string
+
+const (
+	Memory Backend = "memory" // sync.Map repos, lost on restart
+	SQLite Backend = "sqlite" // Embedded SQLite database file
+)
+
+const (
+	defaultSQLitePath       = "money_transfer.db"
+	defaultSnapshotInterval = 5 * time.Minute
+)
+
+// Config selects where the repos keep their data.
+type Config struct {
+	Backend          Backend
+	DSN              string        // Data source name of SQL backends, e.g. the SQLite file path
+	WALDir           string        // Makes the memory backend durable with a WAL and snapshots kept in this directory
+	SnapshotInterval time.Duration // How often the WAL is compacted into a snapshot
+}
+
+// LoadConfig reads the storage configuration from the STORAGE_BACKEND, DATABASE_URL, WAL_DIR
+// and SNAPSHOT_INTERVAL environment variables. Without them data is kept in memory only.
+func LoadConfig() (Config, error) {
+	config := Config{
+		Backend:          Backend(os.Getenv("STORAGE_BACKEND")),
+		DSN:              os.Getenv("DATABASE_URL"),
+		WALDir:           os.Getenv("WAL_DIR"),
+		SnapshotInterval: defaultSnapshotInterval,
+	}
+	if interval := os.Getenv("SNAPSHOT_INTERVAL"); interval != "" {
+		var err error
+		config.SnapshotInterval, err = time.ParseDuration(interval)
+		if err != nil || config.SnapshotInterval <= 0 {
+			return Config{}, fmt.Errorf("invalid SNAPSHOT_INTERVAL %q, expected a positive duration such as 5m", interval)
+		}
+	}
+	switch config.Backend {
+	case "", Memory:
+		config.Backend = Memory
+	case SQLite:
+		if config.WALDir != "" {
+			return Config{}, fmt.Errorf("WAL_DIR only applies to the %q backend", Memory)
+		}
+		if config.DSN == "" {
+			config.DSN = defaultSQLitePath
+		}
+	default:
+		return Config{}, fmt.Errorf("unsupported STORAGE_BACKEND %q, expected %q or %q", config.Backend, Memory, SQLite)
+	}
+	return config, nil
+}
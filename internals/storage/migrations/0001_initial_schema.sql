@@ -0,0 +1,74 @@
+CREATE TABLE users (
+    id TEXT PRIMARY KEY,
+    first_name TEXT NOT NULL,
+    last_name TEXT NOT NULL DEFAULT '',
+    phone_number TEXT NOT NULL,
+    email TEXT NOT NULL,
+    password TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    deleted_at TIMESTAMP NULL
+);
+
+CREATE TABLE wallets (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL UNIQUE,
+    currency TEXT NOT NULL, -- Primary currency
+    status TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL
+);
+
+-- One row per currency a wallet holds; amounts are in minor units of the currency
+CREATE TABLE wallet_balances (
+    wallet_id TEXT NOT NULL REFERENCES wallets (id),
+    currency TEXT NOT NULL,
+    balance BIGINT NOT NULL,
+    PRIMARY KEY (wallet_id, currency)
+);
+
+CREATE TABLE transactions (
+    id TEXT PRIMARY KEY,
+    debit_user_id TEXT NOT NULL,
+    credit_user_id TEXT NOT NULL,
+    amount BIGINT NOT NULL,
+    currency TEXT NOT NULL,
+    status TEXT NOT NULL,
+    transaction_type TEXT NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    payment_details TEXT NOT NULL DEFAULT '',
+    idempotency_key TEXT NULL UNIQUE,
+    request_hash TEXT NOT NULL DEFAULT '',
+    original_transaction_id TEXT NOT NULL DEFAULT '',
+    refunded_amount BIGINT NULL, -- In the transaction currency
+    quote_id TEXT NOT NULL DEFAULT '',
+    target_amount BIGINT NULL, -- In target_currency
+    target_currency TEXT NOT NULL DEFAULT '',
+    fx_rate TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX transactions_debit_user_id ON transactions (debit_user_id);
+CREATE INDEX transactions_credit_user_id ON transactions (credit_user_id);
+
+CREATE TABLE ledger_entries (
+    id TEXT PRIMARY KEY,
+    transaction_id TEXT NOT NULL DEFAULT '',
+    description TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX ledger_entries_transaction_id ON ledger_entries (transaction_id);
+
+CREATE TABLE ledger_postings (
+    entry_id TEXT NOT NULL REFERENCES ledger_entries (id),
+    position INTEGER NOT NULL, -- Order of the posting within its entry
+    account_id TEXT NOT NULL,
+    direction TEXT NOT NULL,
+    amount BIGINT NOT NULL,
+    currency TEXT NOT NULL,
+    PRIMARY KEY (entry_id, position)
+);
+
+CREATE INDEX ledger_postings_account_id ON ledger_postings (account_id, currency);
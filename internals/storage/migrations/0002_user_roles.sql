@@ -0,0 +1,2 @@
+-- Users created before roles existed are regular users
+ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'user';
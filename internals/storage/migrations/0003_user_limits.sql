@@ -0,0 +1,15 @@
+CREATE TABLE user_limits (
+    user_id TEXT PRIMARY KEY,
+    tier TEXT NOT NULL,
+    updated_at TIMESTAMP NOT NULL
+);
+
+-- Caps in minor units of the currency; NULL caps fall back to the tier's
+CREATE TABLE user_limit_overrides (
+    user_id TEXT NOT NULL REFERENCES user_limits (user_id),
+    currency TEXT NOT NULL,
+    per_transaction BIGINT NULL,
+    daily BIGINT NULL,
+    monthly BIGINT NULL,
+    PRIMARY KEY (user_id, currency)
+);
@@ -0,0 +1,7 @@
+-- Funds reserved by pending holds, in minor units; they are still part of balance
+ALTER TABLE wallet_balances ADD COLUMN held BIGINT NOT NULL DEFAULT 0;
+
+-- When a pending hold is released if it has not been captured
+ALTER TABLE transactions ADD COLUMN expires_at TIMESTAMP NULL;
+
+CREATE INDEX transactions_expires_at ON transactions (status, expires_at);
@@ -0,0 +1,33 @@
+-- Future-dated and recurring transfer instructions; amounts in minor units of currency
+CREATE TABLE schedules (
+    id TEXT PRIMARY KEY,
+    sender_id TEXT NOT NULL,
+    receiver_id TEXT NOT NULL,
+    amount BIGINT NOT NULL,
+    currency TEXT NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    start_at TIMESTAMP NOT NULL,
+    run_interval TEXT NOT NULL DEFAULT '',
+    cron TEXT NOT NULL DEFAULT '',
+    end_at TIMESTAMP NULL,
+    next_run_at TIMESTAMP NULL,
+    status TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX schedules_sender_id ON schedules (sender_id);
+CREATE INDEX schedules_next_run_at ON schedules (status, next_run_at);
+
+-- Each execution of a schedule, in the order they ran
+CREATE TABLE schedule_runs (
+    schedule_id TEXT NOT NULL REFERENCES schedules (id),
+    position INTEGER NOT NULL,
+    due_at TIMESTAMP NOT NULL,
+    ran_at TIMESTAMP NOT NULL,
+    status TEXT NOT NULL,
+    transaction_id TEXT NOT NULL DEFAULT '',
+    error_code TEXT NOT NULL DEFAULT '',
+    error TEXT NOT NULL DEFAULT '',
+    PRIMARY KEY (schedule_id, position)
+);
@@ -0,0 +1,4 @@
+-- Split whose leg a transfer is; empty for every other transaction
+ALTER TABLE transactions ADD COLUMN parent_transaction_id TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX transactions_parent_transaction_id ON transactions (parent_transaction_id);
@@ -0,0 +1,2 @@
+-- Incremented by every write to the wallet or its balances, for compare-and-swap updates
+ALTER TABLE wallets ADD COLUMN version BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,11 @@
+-- Domain events written in the unit of work of the change they describe, until published
+CREATE TABLE outbox_events (
+    id TEXT PRIMARY KEY,
+    event_type TEXT NOT NULL,
+    aggregate_id TEXT NOT NULL,
+    payload TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    published_at TIMESTAMP NULL
+);
+
+CREATE INDEX outbox_events_unpublished ON outbox_events (published_at, created_at);
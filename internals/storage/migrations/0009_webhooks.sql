@@ -0,0 +1,40 @@
+-- URLs that users register to be sent the events of their transfers
+CREATE TABLE webhook_endpoints (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    url TEXT NOT NULL,
+    secret TEXT NOT NULL,
+    event_types TEXT NOT NULL, -- Comma separated
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX webhook_endpoints_user_id ON webhook_endpoints (user_id);
+
+-- Events to send to an endpoint, one per endpoint and event
+CREATE TABLE webhook_deliveries (
+    id TEXT PRIMARY KEY,
+    endpoint_id TEXT NOT NULL REFERENCES webhook_endpoints (id),
+    user_id TEXT NOT NULL,
+    event_id TEXT NOT NULL,
+    event_type TEXT NOT NULL,
+    body TEXT NOT NULL,
+    status TEXT NOT NULL,
+    next_attempt_at TIMESTAMP NULL,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX webhook_deliveries_endpoint_id ON webhook_deliveries (endpoint_id);
+CREATE INDEX webhook_deliveries_user_id ON webhook_deliveries (user_id, status);
+CREATE INDEX webhook_deliveries_next_attempt_at ON webhook_deliveries (status, next_attempt_at);
+
+-- Each try at sending a delivery, in the order they were made
+CREATE TABLE webhook_attempts (
+    delivery_id TEXT NOT NULL REFERENCES webhook_deliveries (id),
+    position INTEGER NOT NULL,
+    attempted_at TIMESTAMP NOT NULL,
+    status_code INTEGER NOT NULL DEFAULT 0,
+    error TEXT NOT NULL DEFAULT '',
+    manual BOOLEAN NOT NULL DEFAULT FALSE,
+    PRIMARY KEY (delivery_id, position)
+);
@@ -0,0 +1,6 @@
+-- Histories are read per user in creation order, on the debit and the credit side
+DROP INDEX transactions_debit_user_id;
+DROP INDEX transactions_credit_user_id;
+
+CREATE INDEX transactions_debit_user_id ON transactions (debit_user_id, created_at, id);
+CREATE INDEX transactions_credit_user_id ON transactions (credit_user_id, created_at, id);
@@ -0,0 +1,11 @@
+-- Quoted exchange rates, each for one transfer of the user it was made for
+CREATE TABLE fx_quotes (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    from_currency TEXT NOT NULL,
+    to_currency TEXT NOT NULL,
+    rate TEXT NOT NULL,
+    transaction_id TEXT NOT NULL DEFAULT '', -- Empty until a transfer uses the quote
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL
+);
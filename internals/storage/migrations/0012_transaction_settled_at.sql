@@ -0,0 +1,2 @@
+-- When the money of a completed transaction moved, which for a hold is when it was captured
+ALTER TABLE transactions ADD COLUMN settled_at TIMESTAMP NULL;
@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"concurrent_money_transfer_system/utils"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// Open connects to the configured SQL database and applies any pending migrations.
+func Open(config Config) (*sql.DB, error) {
+	if config.Backend != SQLite {
+		return nil, fmt.Errorf("storage backend %q is not a SQL database", config.Backend)
+	}
+	db := sql.OpenDB(sqliteConnector{dsn: sqliteDSN(config.DSN)})
+	err := Migrate(context.Background(), db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// sqliteDSN turns a file path into a SQLite DSN. Writers wait for each other instead of
+// failing with SQLITE_BUSY, and transactions take the write lock when they begin, so two
+// transactions never deadlock upgrading their read locks. Times are written as
+// "2006-01-02 15:04:05.999999999-07:00", which sqliteConn always gives in UTC, so that they
+// compare as text in the order of time.
+func sqliteDSN(path string) string {
+	separator := "?"
+	if strings.Contains(path, "?") {
+		separator = "&"
+	}
+	return "file:" + strings.TrimPrefix(path, "file:") + separator +
+		"_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)&_txlock=immediate&_time_format=sqlite"
+}
+
+// sqliteConnector opens connections that write and read every time in UTC.
+type sqliteConnector struct {
+	dsn string
+}
+
+func (c sqliteConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Driver().Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+	return sqliteConn{conn.(sqliteDriverConn)}, nil
+}
+
+func (c sqliteConnector) Driver() driver.Driver {
+	return &sqlite.Driver{}
+}
+
+// sqliteDriverConn is the part of a SQLite connection used by database/sql.
+type sqliteDriverConn interface {
+	driver.Conn
+	driver.ConnBeginTx
+	driver.ConnPrepareContext
+	driver.ExecerContext
+	driver.QueryerContext
+	driver.Pinger
+	driver.SessionResetter
+	driver.Validator
+}
+
+type sqliteConn struct {
+	sqliteDriverConn
+}
+
+// CheckNamedValue converts the arguments of queries as database/sql does, then moves times to
+// UTC. Times in another zone would not compare as text with the times stored.
+func (c sqliteConn) CheckNamedValue(arg *driver.NamedValue) error {
+	value, err := driver.DefaultParameterConverter.ConvertValue(arg.Value)
+	if err != nil {
+		return err
+	}
+	if t, ok := value.(time.Time); ok {
+		value = t.UTC()
+	}
+	arg.Value = value
+	return nil
+}
+
+func (c sqliteConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	rows, err := c.sqliteDriverConn.QueryContext(ctx, query, args)
+	if err != nil {
+		return nil, err
+	}
+	return sqliteRows{rows}, nil
+}
+
+// sqliteRows reads times in UTC, the zone they were written in, rather than the local zone
+// the driver gives times without a zone name.
+type sqliteRows struct {
+	driver.Rows
+}
+
+func (r sqliteRows) Next(dest []driver.Value) error {
+	err := r.Rows.Next(dest)
+	for i, value := range dest {
+		if t, ok := value.(time.Time); ok {
+			dest[i] = t.UTC()
+		}
+	}
+	return err
+}
+
+// Scanner is implemented by *sql.Row and *sql.Rows.
+type Scanner interface {
+	Scan(dest ...any) error
+}
+
+// IsUniqueViolation reports whether err is a primary key or unique constraint violation.
+func IsUniqueViolation(err error) bool {
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE || sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY
+	}
+	return false
+}
+
+// DatabaseError reports a failed query as an internal error, so callers can keep
+// handling every repo error as a *utils.Error.
+func DatabaseError(err error) error {
+	return utils.NewErrorWithMessage(utils.ErrInternalServerError, "Database error: "+err.Error())
+}
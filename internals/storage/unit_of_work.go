@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+)
+
+// UnitOfWork groups repo writes so they are committed together or not at all. Repos join
+// the unit of work through the context passed to fn, so every repo call inside fn must use it.
+// A RunInTx inside another joins the outer unit of work.
+type UnitOfWork interface {
+	RunInTx(ctx context.Context, fn func(ctx context.Context) error) error
+}
+
+type journalKey struct{}
+
+// journal holds the undo functions of the writes made in a memory unit of work, the WAL
+// records to log when it commits, and the functions to run once it has.
+type journal struct {
+	undos   []func()
+	commits []func()
+	wal     *WAL // Set by the first write logged in the unit of work
+	records []Record
+}
+
+func (j *journal) rollback() {
+	for i := len(j.undos) - 1; i >= 0; i-- {
+		j.undos[i]()
+	}
+}
+
+// memoryUnitOfWork rolls back the sync.Map repos by undoing their writes in reverse order.
+// Writes are visible to other goroutines before the unit of work ends, so callers must hold
+// the wallet locks that guard the data they change.
+type memoryUnitOfWork struct{}
+
+func NewMemoryUnitOfWork() UnitOfWork {
+	return memoryUnitOfWork{}
+}
+
+func (memoryUnitOfWork) RunInTx(ctx context.Context, fn func(ctx context.Context) error) error {
+	if _, ok := ctx.Value(journalKey{}).(*journal); ok {
+		return fn(ctx)
+	}
+	j := &journal{}
+	committed := false
+	defer func() {
+		// Also undoes the writes when fn panics
+		if !committed {
+			j.rollback()
+		}
+		j.wal.leave()
+	}()
+	err := fn(context.WithValue(ctx, journalKey{}, j))
+	if err != nil {
+		return err
+	}
+	// The writes are durable once their records are logged, and undone if they cannot be
+	err = j.wal.commit(j.records)
+	if err != nil {
+		return err
+	}
+	committed = true
+	for _, commit := range j.commits {
+		commit()
+	}
+	return nil
+}
+
+// OnRollback registers undo to run if the memory unit of work in ctx rolls back. The records
+// of the unit's writes are never logged then, so undo only has to restore memory.
+// Outside of a unit of work writes are final and undo is dropped.
+func OnRollback(ctx context.Context, undo func()) {
+	if j, ok := ctx.Value(journalKey{}).(*journal); ok {
+		j.undos = append(j.undos, undo)
+	}
+}
+
+// OnCommit registers commit to run once the memory unit of work in ctx commits, for writes
+// nothing may see before then. Outside of a unit of work commit runs at once.
+func OnCommit(ctx context.Context, commit func()) {
+	if j, ok := ctx.Value(journalKey{}).(*journal); ok {
+		j.commits = append(j.commits, commit)
+		return
+	}
+	commit()
+}
+
+type txKey struct{}
+
+// Querier is implemented by *sql.DB and *sql.Tx.
+type Querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// sqlUnitOfWork runs the unit of work in a database transaction.
+type sqlUnitOfWork struct {
+	db *sql.DB
+}
+
+func NewSQLUnitOfWork(db *sql.DB) UnitOfWork {
+	return &sqlUnitOfWork{db: db}
+}
+
+func (u *sqlUnitOfWork) RunInTx(ctx context.Context, fn func(ctx context.Context) error) error {
+	return RunInTx(ctx, u.db, fn)
+}
+
+// RunInTx runs fn in a database transaction carried by the context passed to fn, or in the
+// transaction already in ctx. SQL repos use it for writes spanning several statements.
+func RunInTx(ctx context.Context, db *sql.DB, fn func(ctx context.Context) error) error {
+	if _, ok := ctx.Value(txKey{}).(*sql.Tx); ok {
+		return fn(ctx)
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return DatabaseError(err)
+	}
+	defer tx.Rollback()
+	err = fn(context.WithValue(ctx, txKey{}, tx))
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return DatabaseError(err)
+	}
+	return nil
+}
+
+// Conn returns the database transaction in ctx, or db outside of a unit of work.
+func Conn(ctx context.Context, db *sql.DB) Querier {
+	if tx, ok := ctx.Value(txKey{}).(*sql.Tx); ok {
+		return tx
+	}
+	return db
+}
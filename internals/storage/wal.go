@@ -0,0 +1,412 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"concurrent_money_transfer_system/utils"
+)
+
+const (
+	walFileName      = "wal.log"
+	snapshotFileName = "snapshot.log"
+	frameHeaderSize  = 8 // Payload length and CRC32, both uint32
+	maxRecordSize    = 64 << 20
+	unitRecord       = "unit" // Frames the records of a unit of work, which are replayed all or none
+	// snapshotDrainTimeout bounds how long a snapshot waits for the units of work in flight,
+	// which may be blocked on locks held by writers waiting for the snapshot to end
+	snapshotDrainTimeout = time.Second
+)
+
+// Record is an entry of the write-ahead log: the post-image of a value written by a repo,
+// or the key of a value it deleted. Replaying records in order rebuilds the repo's data.
+type Record struct {
+	Kind string // Tells which repo wrote the record and how to apply it
+	Data []byte // gob encoding of the value
+}
+
+func NewRecord(kind string, value any) (Record, error) {
+	var data bytes.Buffer
+	err := gob.NewEncoder(&data).Encode(value)
+	if err != nil {
+		return Record{}, fmt.Errorf("failed to encode %s record: %w", kind, err)
+	}
+	return Record{Kind: kind, Data: data.Bytes()}, nil
+}
+
+func (r Record) Decode(value any) error {
+	return gob.NewDecoder(bytes.NewReader(r.Data)).Decode(value)
+}
+
+// Journaled is implemented by the in-memory repos, whose writes can be made durable in a WAL.
+type Journaled interface {
+	// SetWAL makes the repo log every write to wal before applying it.
+	SetWAL(wal *WAL)
+	// ApplyRecord applies a record written by the repo, reporting false for records of other repos.
+	// Applying a record more than once must leave the same data as applying it once.
+	ApplyRecord(record Record) (bool, error)
+	// SnapshotRecords returns records that rebuild the repo's current data.
+	SnapshotRecords() ([]Record, error)
+}
+
+// WAL is an append-only log of the writes of the in-memory repos. Each write is synced to
+// disk before it is acknowledged, so an acknowledged write survives a crash. The writes of a
+// unit of work are applied in memory as they are made and logged together as one record when
+// it commits, so a crash never replays half of one. Snapshots replace the log with the
+// records of the current data, so it does not grow forever.
+//
+// A nil *WAL logs nothing and only applies writes, which is how repos run without durability.
+type WAL struct {
+	dir      string
+	file     *os.File
+	mu       sync.Mutex // Orders writes in the log as in memory, and keeps snapshots from seeing half of a write
+	units    int        // Units of work with writes applied in memory but not logged yet
+	draining bool       // A snapshot is waiting for units to drop to zero, so no unit may start writing
+	idle     *sync.Cond // Broadcast when units drops to zero or draining ends
+}
+
+// OpenWAL opens the log in dir, creating the directory if needed. Call Recover before
+// attaching it to the repos.
+func OpenWAL(dir string) (*WAL, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(dir, walFileName), os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	w := &WAL{dir: dir, file: file}
+	w.idle = sync.NewCond(&w.mu)
+	return w, nil
+}
+
+func (w *WAL) Close() error {
+	return w.file.Close()
+}
+
+// Log records the value and calls apply to make the write in memory. Inside a memory unit of
+// work the record is kept until the unit commits, and is dropped with the write's undo if it
+// rolls back. Outside of one it is appended to the log first, and nothing is applied if it
+// cannot be written.
+func (w *WAL) Log(ctx context.Context, kind string, value any, apply func()) error {
+	if w == nil {
+		apply()
+		return nil
+	}
+	record, err := NewRecord(kind, value)
+	if err != nil {
+		return walError(kind, err)
+	}
+	if j, ok := ctx.Value(journalKey{}).(*journal); ok {
+		w.join(j)
+		j.records = append(j.records, record)
+		apply()
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	err = w.append(record)
+	if err != nil {
+		return walError(kind, err)
+	}
+	apply()
+	return nil
+}
+
+// join counts the unit of work as in flight until it leaves, waiting for a draining snapshot
+// before its first write.
+func (w *WAL) join(j *journal) {
+	if j.wal != nil {
+		return
+	}
+	w.mu.Lock()
+	for w.draining {
+		w.idle.Wait()
+	}
+	w.units++
+	w.mu.Unlock()
+	j.wal = w
+}
+
+// leave ends a unit of work that joined, once it is logged or rolled back.
+func (w *WAL) leave() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	w.units--
+	if w.units == 0 {
+		w.idle.Broadcast()
+	}
+	w.mu.Unlock()
+}
+
+// commit appends the records of a unit of work to the log as a single record.
+func (w *WAL) commit(records []Record) error {
+	if w == nil || len(records) == 0 {
+		return nil
+	}
+	record := records[0]
+	if len(records) > 1 {
+		var err error
+		record, err = NewRecord(unitRecord, records)
+		if err != nil {
+			return walError(unitRecord, err)
+		}
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	err := w.append(record)
+	if err != nil {
+		return walError(record.Kind, err)
+	}
+	return nil
+}
+
+// append writes the record at the end of the log and syncs it. A record that fails to be
+// written is cut off, so a later one does not follow a torn frame.
+func (w *WAL) append(record Record) error {
+	offset, err := w.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	err = writeFrame(w.file, record)
+	if err == nil {
+		err = w.file.Sync()
+	}
+	if err != nil {
+		w.file.Truncate(offset)
+		w.file.Seek(offset, io.SeekStart)
+	}
+	return err
+}
+
+func walError(kind string, err error) error {
+	return utils.NewErrorWithMessage(utils.ErrInternalServerError, "Failed to write "+kind+" to the WAL: "+err.Error())
+}
+
+// Recover loads the latest snapshot and replays the log into the repos, then attaches the
+// WAL to them. A record torn by a crash at the end of the log is dropped, since its write
+// was never acknowledged.
+func (w *WAL) Recover(repos ...Journaled) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	snapshot, err := os.Open(filepath.Join(w.dir, snapshotFileName))
+	if err == nil {
+		_, err = replay(snapshot, repos)
+		snapshot.Close()
+		if err != nil {
+			return fmt.Errorf("failed to load snapshot: %w", err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	_, err = w.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	validSize, err := replay(w.file, repos)
+	if err != nil {
+		return fmt.Errorf("failed to replay the WAL: %w", err)
+	}
+	err = w.file.Truncate(validSize)
+	if err != nil {
+		return err
+	}
+	_, err = w.file.Seek(validSize, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	for _, repo := range repos {
+		repo.SetWAL(w)
+	}
+	return nil
+}
+
+// Snapshot writes the records of the repos' current data to a new snapshot file and empties
+// the log. It first waits for the units of work in flight to end, so it only sees committed
+// writes, and gives up when they do not end in time. Writes wait until it is done.
+func (w *WAL) Snapshot(repos ...Journaled) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	err := w.drain()
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(w.dir, snapshotFileName)
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	writer := bufio.NewWriter(file)
+	for _, repo := range repos {
+		records, err := repo.SnapshotRecords()
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			err = writeFrame(writer, record)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err = writer.Flush()
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		return err
+	}
+	// Renaming replaces the previous snapshot atomically. Were the process to stop before the
+	// log is emptied, replaying the log over the new snapshot gives the same data again.
+	err = os.Rename(path+".tmp", path)
+	if err != nil {
+		return err
+	}
+	err = w.file.Truncate(0)
+	if err != nil {
+		return err
+	}
+	_, err = w.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	return w.file.Sync()
+}
+
+// drain waits, with w.mu held, until no unit of work is in flight. Units that have not made
+// a write yet wait for the snapshot, so a steady stream of them cannot starve it.
+func (w *WAL) drain() error {
+	if w.units == 0 {
+		return nil
+	}
+	w.draining = true
+	timedOut := false
+	timer := time.AfterFunc(snapshotDrainTimeout, func() {
+		w.mu.Lock()
+		timedOut = true
+		w.idle.Broadcast()
+		w.mu.Unlock()
+	})
+	for w.units > 0 && !timedOut {
+		w.idle.Wait()
+	}
+	timer.Stop()
+	w.draining = false
+	w.idle.Broadcast()
+	if w.units > 0 {
+		return fmt.Errorf("%d units of work still in flight after %s", w.units, snapshotDrainTimeout)
+	}
+	return nil
+}
+
+// StartSnapshots takes a snapshot every interval until stop is closed.
+func (w *WAL) StartSnapshots(interval time.Duration, stop <-chan struct{}, repos ...Journaled) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				err := w.Snapshot(repos...)
+				if err != nil {
+					log.Printf("Failed to snapshot the in-memory store: %v", err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// writeFrame writes the record prefixed with its length and checksum.
+func writeFrame(writer io.Writer, record Record) error {
+	var payload bytes.Buffer
+	err := gob.NewEncoder(&payload).Encode(record)
+	if err != nil {
+		return err
+	}
+	frame := make([]byte, frameHeaderSize, frameHeaderSize+payload.Len())
+	binary.BigEndian.PutUint32(frame[0:4], uint32(payload.Len()))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(payload.Bytes()))
+	frame = append(frame, payload.Bytes()...)
+	_, err = writer.Write(frame)
+	return err
+}
+
+// replay applies every complete frame of reader to the repos and returns the size of the
+// frames read, stopping at the first incomplete or corrupt frame.
+func replay(reader io.Reader, repos []Journaled) (int64, error) {
+	buffered := bufio.NewReader(reader)
+	var validSize int64
+	header := make([]byte, frameHeaderSize)
+	for {
+		_, err := io.ReadFull(buffered, header)
+		if err != nil {
+			return validSize, nil // End of the log, or a frame torn before its header was written
+		}
+		size := binary.BigEndian.Uint32(header[0:4])
+		if size > maxRecordSize {
+			return validSize, nil
+		}
+		payload := make([]byte, size)
+		_, err = io.ReadFull(buffered, payload)
+		if err != nil || crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+			return validSize, nil
+		}
+		var record Record
+		err = gob.NewDecoder(bytes.NewReader(payload)).Decode(&record)
+		if err != nil {
+			return validSize, err
+		}
+		err = applyRecord(record, repos)
+		if err != nil {
+			return validSize, err
+		}
+		validSize += int64(frameHeaderSize + len(payload))
+	}
+}
+
+func applyRecord(record Record, repos []Journaled) error {
+	if record.Kind == unitRecord {
+		var records []Record
+		err := record.Decode(&records)
+		if err != nil {
+			return fmt.Errorf("failed to decode %s record: %w", unitRecord, err)
+		}
+		for _, record := range records {
+			err = applyRecord(record, repos)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, repo := range repos {
+		applied, err := repo.ApplyRecord(record)
+		if err != nil {
+			return fmt.Errorf("failed to apply %s record: %w", record.Kind, err)
+		}
+		if applied {
+			return nil
+		}
+	}
+	return fmt.Errorf("no repo applies %s records", record.Kind)
+}
@@ -0,0 +1,158 @@
+package transactions
+
+import (
+	"context"
+
+	"concurrent_money_transfer_system/internals/wallet"
+	"concurrent_money_transfer_system/utils"
+)
+
+// CreateBatchTransfer makes the transfers of one sender while the sender's wallet, and those
+// of all receivers, stay locked for the whole batch. In all-or-nothing mode the total of the
+// batch is checked against the sender's balance up front and every transfer is made in one
+// unit of work; in best-effort mode each transfer is made on its own and failures are skipped.
+func (s *transactionService) CreateBatchTransfer(ctx context.Context, batchRequest *BatchTransferRequest) (BatchTransferResult, error) {
+	mode := batchRequest.Mode
+	if mode == "" {
+		mode = AllOrNothing
+	}
+	transfers := batchRequest.Transfers
+	senderID := transfers[0].SenderID
+	if senderID == "" {
+		return BatchTransferResult{}, utils.NewErrorWithMessage(utils.ErrValidationError, "SenderID is required")
+	}
+	result := BatchTransferResult{Mode: mode, Results: make([]BatchItemResult, len(transfers))}
+	userIDs := []string{senderID}
+	for i := range transfers {
+		result.Results[i].Index = i
+		if transfers[i].SenderID != senderID {
+			return BatchTransferResult{}, utils.NewErrorWithMessage(utils.ErrValidationError, "All transfers of a batch must have the same SenderID")
+		}
+		transfers[i].Hold = false // Batches only make plain transfers
+		err := utils.ValidateStruct(&transfers[i])
+		if err != nil {
+			result.fail(i, err)
+			continue
+		}
+		userIDs = append(userIDs, transfers[i].ReceiverID)
+	}
+
+	wallets, lockErrors := s.lockWallets(ctx, userIDs)
+	defer s.releaseWallets(ctx, wallets)
+	if err, ok := lockErrors[senderID]; ok {
+		return BatchTransferResult{}, err
+	}
+	for i, transfer := range transfers {
+		if err, ok := lockErrors[transfer.ReceiverID]; ok && result.Results[i].Status == "" {
+			result.fail(i, err)
+		}
+	}
+
+	if mode == BestEffort {
+		for i := range transfers {
+			if result.Results[i].Status != "" {
+				continue
+			}
+			transaction, err := s.makeLockedTransfer(ctx, &transfers[i], wallets, s.applyTransaction)
+			if err != nil {
+				result.fail(i, err)
+				continue
+			}
+			result.complete(i, transaction)
+		}
+		return result.finish(), nil
+	}
+
+	if result.Failed > 0 {
+		return result.finish(), nil
+	}
+	err := checkBatchTotal(transfers, wallets[senderID])
+	if err != nil {
+		return BatchTransferResult{}, err
+	}
+	failedIndex := -1
+	err = s.unitOfWork.RunInTx(ctx, func(ctx context.Context) error {
+		for i := range transfers {
+			transaction, err := s.makeLockedTransfer(ctx, &transfers[i], wallets, s.postTransaction)
+			if err != nil {
+				failedIndex = i
+				return err
+			}
+			result.complete(i, transaction)
+		}
+		return nil
+	})
+	if err != nil && failedIndex < 0 {
+		return BatchTransferResult{}, err
+	}
+	if err != nil {
+		// The transfers made before the failing one were rolled back with it
+		for i := range result.Results {
+			result.Results[i] = BatchItemResult{Index: i}
+		}
+		result.Completed = 0
+		result.fail(failedIndex, err)
+	}
+	return result.finish(), nil
+}
+
+// checkBatchTotal fails with INSUFFICIENT_BALANCE when the transfers add up to more than the
+// sender has available in one of their currencies. Currencies the sender does not hold are
+// reported by the transfers themselves.
+func checkBatchTotal(transfers []TransferRequest, senderWallet wallet.Wallet) error {
+	totals := make(map[utils.Currency]utils.Money)
+	currencies := make([]utils.Currency, 0)
+	for _, transfer := range transfers {
+		total, ok := totals[transfer.Currency]
+		if !ok {
+			total = utils.NewMoney(0, transfer.Currency)
+			currencies = append(currencies, transfer.Currency)
+		}
+		total, err := total.CheckedAdd(transfer.Amount)
+		if err != nil {
+			return err
+		}
+		totals[transfer.Currency] = total
+	}
+	for _, currency := range currencies {
+		available, ok := senderWallet.AvailableIn(currency)
+		if ok && available.LessThan(totals[currency]) {
+			return utils.NewErrorWithMessage(utils.ErrInsufficientBalance, "Batch total of "+totals[currency].String()+" "+string(currency)+
+				" exceeds the available balance of "+available.String()+" "+string(currency))
+		}
+	}
+	return nil
+}
+
+func (r *BatchTransferResult) complete(index int, transaction Transaction) {
+	r.Results[index].Status = ItemCompleted
+	r.Results[index].Transaction = &transaction
+	r.Completed++
+}
+
+func (r *BatchTransferResult) fail(index int, err error) {
+	r.Results[index].Status = ItemFailed
+	r.Results[index].Error = err.Error()
+	if itemErr, ok := err.(*utils.Error); ok {
+		r.Results[index].ErrorCode = itemErr.Code
+	}
+	r.Failed++
+}
+
+// finish marks the transfers that were not made as skipped and sets the batch status.
+func (r BatchTransferResult) finish() BatchTransferResult {
+	for i := range r.Results {
+		if r.Results[i].Status == "" {
+			r.Results[i].Status = ItemSkipped
+		}
+	}
+	switch {
+	case r.Completed == len(r.Results):
+		r.Status = BatchCompleted
+	case r.Completed == 0:
+		r.Status = BatchFailed
+	default:
+		r.Status = BatchPartiallyCompleted
+	}
+	return r
+}
@@ -0,0 +1,69 @@
+package transactions
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	DefaultHoldTTL           = 15 * time.Minute // How long a hold reserves funds before it expires
+	DefaultHoldSweepInterval = time.Minute      // How often expired holds are released
+)
+
+type HoldConfig struct {
+	TTL           time.Duration // How long a hold reserves funds before it expires
+	SweepInterval time.Duration // How often expired holds are released
+}
+
+// LoadHoldConfig reads the hold lifetime from HOLD_TTL and how often expired holds are
+// released from HOLD_SWEEP_INTERVAL.
+func LoadHoldConfig() (HoldConfig, error) {
+	config := HoldConfig{TTL: DefaultHoldTTL, SweepInterval: DefaultHoldSweepInterval}
+	for _, setting := range []struct {
+		name  string
+		value *time.Duration
+	}{
+		{"HOLD_TTL", &config.TTL},
+		{"HOLD_SWEEP_INTERVAL", &config.SweepInterval},
+	} {
+		value := os.Getenv(setting.name)
+		if value == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(value)
+		if err != nil || duration <= 0 {
+			return HoldConfig{}, fmt.Errorf("invalid %s %q, expected a positive duration such as 15m", setting.name, value)
+		}
+		*setting.value = duration
+	}
+	return config, nil
+}
+
+// LockingStrategy decides how transfers keep concurrent writes to a wallet from clashing.
+type LockingStrategy string
+
+const (
+	// Pessimistic locks both wallets for the whole transfer, checks included
+	Pessimistic LockingStrategy = "pessimistic"
+	// Optimistic checks the transfer against unlocked reads of the wallets and only locks them
+	// to compare-and-swap the balances, trying again when either wallet changed in between
+	Optimistic LockingStrategy = "optimistic"
+)
+
+// MaxOptimisticAttempts is how many times an optimistic transfer is checked and tried before
+// it locks the wallets for the whole transfer, like a pessimistic one.
+const MaxOptimisticAttempts = 10
+
+// LoadLockingStrategy reads the locking strategy of transfers from WALLET_LOCKING.
+func LoadLockingStrategy() (LockingStrategy, error) {
+	strategy := LockingStrategy(os.Getenv("WALLET_LOCKING"))
+	switch strategy {
+	case "":
+		return Pessimistic, nil
+	case Pessimistic, Optimistic:
+		return strategy, nil
+	default:
+		return "", fmt.Errorf("invalid WALLET_LOCKING %q, expected %s or %s", strategy, Pessimistic, Optimistic)
+	}
+}
@@ -3,11 +3,20 @@ package transactions
 import (
 	"github.com/gin-gonic/gin"
 
+	"concurrent_money_transfer_system/internals/authz"
 	"concurrent_money_transfer_system/utils"
 )
 
 type TransactionController interface {
 	CreateTransfer(c *gin.Context)
+	CreateBatchTransfer(c *gin.Context)
+	CreateSplitTransfer(c *gin.Context)
+	GetSplitTransfer(c *gin.Context)
+	CreateDeposit(c *gin.Context)
+	CreateWithdrawal(c *gin.Context)
+	ReverseTransaction(c *gin.Context)
+	CaptureTransaction(c *gin.Context)
+	VoidTransaction(c *gin.Context)
 	GetTransaction(c *gin.Context)
 	GetTransactionsByUserID(c *gin.Context)
 	GetAllTransactions(c *gin.Context)
@@ -28,6 +37,27 @@ func (tc *transactionController) CreateTransfer(c *gin.Context) {
 		utils.ResponseError(c, err)
 		return
 	}
+	// Nobody, not even an admin, can send money from someone else's wallet
+	err = authz.AuthorizeOwner(c.Request.Context(), transferRequest.SenderID)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+
+	err = bindIdempotencyKey(c, &transferRequest.IdempotencyKey)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+	switch c.Query("mode") {
+	case "":
+		transferRequest.Hold = false
+	case "hold":
+		transferRequest.Hold = true
+	default:
+		utils.ResponseError(c, utils.NewErrorWithMessage(utils.ErrInvalidRequest, "Mode must be hold when set"))
+		return
+	}
 
 	transaction, err := tc.service.CreateTransaction(c.Request.Context(), &transferRequest)
 	if err != nil {
@@ -37,6 +67,232 @@ func (tc *transactionController) CreateTransfer(c *gin.Context) {
 	utils.ResponseSuccess(c, transaction)
 }
 
+// CreateBatchTransfer responds with the result of every transfer, also when some or all failed.
+func (tc *transactionController) CreateBatchTransfer(c *gin.Context) {
+	batchRequest := BatchTransferRequest{}
+	err := utils.BindAndValidateRequest(c, &batchRequest)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+	// The service checks that every transfer has the same sender
+	err = authz.AuthorizeOwner(c.Request.Context(), batchRequest.Transfers[0].SenderID)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+
+	result, err := tc.service.CreateBatchTransfer(c.Request.Context(), &batchRequest)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+	utils.ResponseSuccess(c, result)
+}
+
+// CreateSplitTransfer lets a sender pay several receivers. Collecting from several senders
+// takes money out of wallets the caller does not own, so only admins, e.g. the marketplace
+// operator, can do it.
+func (tc *transactionController) CreateSplitTransfer(c *gin.Context) {
+	splitRequest := SplitTransferRequest{}
+	err := utils.BindAndValidateRequest(c, &splitRequest)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+	if splitRequest.SenderID != "" {
+		err = authz.AuthorizeOwner(c.Request.Context(), splitRequest.SenderID)
+	} else {
+		err = authz.AuthorizeRole(c.Request.Context(), authz.RoleAdmin)
+	}
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+	err = bindIdempotencyKey(c, &splitRequest.IdempotencyKey)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+
+	split, err := tc.service.CreateSplitTransfer(c.Request.Context(), &splitRequest)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+	utils.ResponseSuccess(c, split)
+}
+
+// GetSplitTransfer lets any party of the split, including the users of its legs, see it.
+func (tc *transactionController) GetSplitTransfer(c *gin.Context) {
+	id := c.Param("id")
+	if id == "" {
+		utils.ResponseError(c, utils.NewErrorWithMessage(utils.ErrInvalidRequest, "Transaction ID is required"))
+		return
+	}
+	split, err := tc.service.GetSplitTransfer(c.Request.Context(), id)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+	err = authz.AuthorizeAnyOwner(c.Request.Context(), split.parties(), authz.RoleSupport, authz.RoleAdmin)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+	utils.ResponseSuccess(c, split)
+}
+
+func (tc *transactionController) CreateDeposit(c *gin.Context) {
+	depositRequest := FundsRequest{}
+	err := utils.BindAndValidateRequest(c, &depositRequest)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+	// A deposit brings in money from outside, which only staff can vouch for, so owners may
+	// not deposit into their own wallets
+	err = authz.AuthorizeRole(c.Request.Context(), authz.RoleSupport, authz.RoleAdmin)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+	err = bindIdempotencyKey(c, &depositRequest.IdempotencyKey)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+
+	transaction, err := tc.service.Deposit(c.Request.Context(), &depositRequest)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+	utils.ResponseSuccess(c, transaction)
+}
+
+func (tc *transactionController) CreateWithdrawal(c *gin.Context) {
+	withdrawalRequest := FundsRequest{}
+	err := utils.BindAndValidateRequest(c, &withdrawalRequest)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+	err = authz.AuthorizeOwner(c.Request.Context(), withdrawalRequest.UserID)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+	err = bindIdempotencyKey(c, &withdrawalRequest.IdempotencyKey)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+
+	transaction, err := tc.service.Withdraw(c.Request.Context(), &withdrawalRequest)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+	utils.ResponseSuccess(c, transaction)
+}
+
+func (tc *transactionController) ReverseTransaction(c *gin.Context) {
+	id := c.Param("id")
+	if id == "" {
+		utils.ResponseError(c, utils.NewErrorWithMessage(utils.ErrInvalidRequest, "Transaction ID is required"))
+		return
+	}
+	reverseRequest := ReverseRequest{}
+	err := utils.BindAndValidateRequest(c, &reverseRequest)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+	original, err := tc.service.GetTransaction(c.Request.Context(), id)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+	// The money is paid back by the receiver of the original transfer
+	err = authz.AuthorizeOwner(c.Request.Context(), original.CreditUserID, authz.RoleSupport, authz.RoleAdmin)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+
+	refund, err := tc.service.ReverseTransaction(c.Request.Context(), id, &reverseRequest)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+	utils.ResponseSuccess(c, refund)
+}
+
+// CaptureTransaction lets either party of a hold complete it. The sender authorized the amount
+// when creating the hold, and the receiver is the one collecting it.
+func (tc *transactionController) CaptureTransaction(c *gin.Context) {
+	hold, ok := tc.getHoldForParty(c)
+	if !ok {
+		return
+	}
+	transaction, err := tc.service.CaptureTransaction(c.Request.Context(), hold.ID)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+	utils.ResponseSuccess(c, transaction)
+}
+
+// VoidTransaction lets either party of a hold, or an admin, release it.
+func (tc *transactionController) VoidTransaction(c *gin.Context) {
+	hold, ok := tc.getHoldForParty(c, authz.RoleAdmin)
+	if !ok {
+		return
+	}
+	transaction, err := tc.service.VoidTransaction(c.Request.Context(), hold.ID)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+	utils.ResponseSuccess(c, transaction)
+}
+
+// getHoldForParty returns the transaction named by the id parameter if the caller is one of
+// its parties or has one of the roles, responding with the error otherwise.
+func (tc *transactionController) getHoldForParty(c *gin.Context, roles ...authz.Role) (Transaction, bool) {
+	id := c.Param("id")
+	if id == "" {
+		utils.ResponseError(c, utils.NewErrorWithMessage(utils.ErrInvalidRequest, "Transaction ID is required"))
+		return Transaction{}, false
+	}
+	hold, err := tc.service.GetTransaction(c.Request.Context(), id)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return Transaction{}, false
+	}
+	err = authz.AuthorizeAnyOwner(c.Request.Context(), []string{hold.DebitUserID, hold.CreditUserID}, roles...)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return Transaction{}, false
+	}
+	return hold, true
+}
+
+// bindIdempotencyKey copies the Idempotency-Key header into the request's idempotency key,
+// rejecting a header that contradicts the key sent in the body.
+func bindIdempotencyKey(c *gin.Context, idempotencyKey *string) error {
+	headerKey := c.GetHeader(utils.IdempotencyKeyHeader)
+	if headerKey == "" {
+		return nil
+	}
+	if *idempotencyKey != "" && *idempotencyKey != headerKey {
+		return utils.NewErrorWithMessage(utils.ErrInvalidRequest, "Idempotency-Key header does not match idempotency_key in body")
+	}
+	*idempotencyKey = headerKey
+	return nil
+}
+
 func (tc *transactionController) GetTransaction(c *gin.Context) {
 	id := c.Param("id")
 	if id == "" {
@@ -48,29 +304,65 @@ func (tc *transactionController) GetTransaction(c *gin.Context) {
 		utils.ResponseError(c, err)
 		return
 	}
+	err = authz.AuthorizeAnyOwner(c.Request.Context(), []string{transaction.DebitUserID, transaction.CreditUserID}, authz.RoleSupport, authz.RoleAdmin)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
 	utils.ResponseSuccess(c, transaction)
 }
 
+// GetTransactionsByUserID responds with a page of the user's history. The cursor of the next
+// page, if any, is sent in the X-Next-Cursor header.
 func (tc *transactionController) GetTransactionsByUserID(c *gin.Context) {
 	userID := c.Param("user_id")
 	if userID == "" {
 		utils.ResponseError(c, utils.NewErrorWithMessage(utils.ErrInvalidRequest, "User ID is required"))
 		return
 	}
+	err := authz.AuthorizeOwner(c.Request.Context(), userID, authz.RoleSupport, authz.RoleAdmin)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
 
-	transactions, err := tc.service.GetTransactionsByUserID(c.Request.Context(), userID)
+	request := HistoryRequest{}
+	err = c.ShouldBindQuery(&request)
+	if err != nil {
+		utils.ResponseError(c, utils.NewErrorWithMessage(utils.ErrInvalidRequest, err.Error()))
+		return
+	}
+	err = utils.ValidateStruct(&request)
 	if err != nil {
 		utils.ResponseError(c, err)
 		return
 	}
-	utils.ResponseSuccess(c, transactions)
+	query, err := request.Query()
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+	page, err := tc.service.GetTransactionHistory(c.Request.Context(), userID, query)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+	if page.NextCursor != "" {
+		c.Header(NextCursorHeader, page.NextCursor)
+	}
+	utils.ResponseSuccess(c, page.Transactions)
 }
 
 func (tc *transactionController) GetAllTransactions(c *gin.Context) {
+	err := authz.AuthorizeRole(c.Request.Context(), authz.RoleSupport, authz.RoleAdmin)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
 	transactions, err := tc.service.GetAllTransactions(c.Request.Context())
 	if err != nil {
 		utils.ResponseError(c, err)
 		return
 	}
 	utils.ResponseSuccess(c, transactions)
-}
\ No newline at end of file
+}
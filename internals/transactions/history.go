@@ -0,0 +1,196 @@
+package transactions
+
+import (
+	"encoding/base64"
+	"strings"
+	"time"
+
+	"concurrent_money_transfer_system/utils"
+)
+
+type Direction string
+
+const (
+	Sent     Direction = "sent"     // The user is the debit side
+	Received Direction = "received" // The user is the credit side
+)
+
+type SortOrder string
+
+const (
+	Ascending  SortOrder = "asc"  // Oldest first
+	Descending SortOrder = "desc" // Newest first
+)
+
+// NextCursorHeader carries the cursor of the next page of a history
+const NextCursorHeader = "X-Next-Cursor"
+
+const (
+	DefaultHistoryLimit = 50  // Transactions in a page of history when no limit is given
+	MaxHistoryLimit     = 200 // Most transactions in a page of history
+)
+
+// HistoryQuery selects a page of a user's transactions, sorted by creation time. Zero fields
+// do not filter.
+type HistoryQuery struct {
+	Status          TransactionStatus
+	TransactionType TransactionType
+	Direction       Direction
+	CounterpartyID  string // The other party of the transaction
+	Currency        utils.Currency
+	MinAmount       *utils.Money // Inclusive; only set with Currency
+	MaxAmount       *utils.Money // Inclusive; only set with Currency
+	From            *time.Time   // Inclusive
+	To              *time.Time   // Exclusive
+	Order           SortOrder
+	After           *HistoryCursor // The page starts after this transaction, in the order of the query
+	Limit           int
+}
+
+// matches reports whether the transaction of the user passes the filters of the query. The
+// cursor and the date range are left to the caller, who seeks them in the order of the history.
+func (q HistoryQuery) matches(userID string, transaction Transaction) bool {
+	switch {
+	case q.Status != "" && transaction.Status != q.Status,
+		q.TransactionType != "" && transaction.TransactionType != q.TransactionType,
+		q.Direction == Sent && transaction.DebitUserID != userID,
+		q.Direction == Received && transaction.CreditUserID != userID,
+		q.Currency != "" && transaction.Currency != q.Currency,
+		q.MinAmount != nil && transaction.Amount.LessThan(*q.MinAmount),
+		q.MaxAmount != nil && q.MaxAmount.LessThan(transaction.Amount):
+		return false
+	case q.CounterpartyID != "":
+		return transaction.DebitUserID == userID && transaction.CreditUserID == q.CounterpartyID ||
+			transaction.CreditUserID == userID && transaction.DebitUserID == q.CounterpartyID
+	}
+	return true
+}
+
+// HistoryCursor is the position of a transaction in a history.
+type HistoryCursor struct {
+	CreatedAt time.Time
+	ID        string
+}
+
+func cursorOf(transaction Transaction) HistoryCursor {
+	return HistoryCursor{CreatedAt: transaction.CreatedAt, ID: transaction.ID}
+}
+
+// String encodes the cursor for the X-Next-Cursor header and the cursor query parameter.
+func (c HistoryCursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(c.CreatedAt.Format(time.RFC3339Nano) + "|" + c.ID))
+}
+
+func ParseHistoryCursor(value string) (HistoryCursor, error) {
+	invalid := utils.NewErrorWithMessage(utils.ErrInvalidRequest, "Cursor is invalid")
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return HistoryCursor{}, invalid
+	}
+	createdAt, id, ok := strings.Cut(string(data), "|")
+	if !ok || id == "" {
+		return HistoryCursor{}, invalid
+	}
+	cursor := HistoryCursor{ID: id}
+	cursor.CreatedAt, err = time.Parse(time.RFC3339Nano, createdAt)
+	if err != nil {
+		return HistoryCursor{}, invalid
+	}
+	return cursor, nil
+}
+
+// HistoryPage is a page of a user's history. NextCursor is empty on the last page.
+type HistoryPage struct {
+	Transactions []Transaction
+	NextCursor   string
+}
+
+// newHistoryPage returns the page of the first limit transactions, given up to one more to
+// tell whether another page follows.
+func newHistoryPage(transactions []Transaction, limit int) HistoryPage {
+	if len(transactions) <= limit {
+		return HistoryPage{Transactions: transactions}
+	}
+	transactions = transactions[:limit]
+	return HistoryPage{Transactions: transactions, NextCursor: cursorOf(transactions[limit-1]).String()}
+}
+
+// HistoryRequest holds the query parameters of GET /api/transaction/user/:user_id.
+type HistoryRequest struct {
+	Status          string `form:"status" validate:"omitempty,oneof=pending completed failed refunded reversed voided expired"`
+	TransactionType string `form:"type" validate:"omitempty,oneof=deposit withdrawal transfer refund split"`
+	Direction       string `form:"direction" validate:"omitempty,oneof=sent received"`
+	CounterpartyID  string `form:"counterparty_id"`
+	Currency        string `form:"currency"`
+	MinAmount       string `form:"min_amount"`
+	MaxAmount       string `form:"max_amount"`
+	From            string `form:"from"` // RFC 3339 time
+	To              string `form:"to"`   // RFC 3339 time
+	Sort            string `form:"sort" validate:"omitempty,oneof=asc desc"`
+	Cursor          string `form:"cursor"`
+	Limit           int    `form:"limit" validate:"omitempty,min=1,max=200"`
+}
+
+// Query parses the request into a HistoryQuery, defaulting to the oldest DefaultHistoryLimit
+// transactions.
+func (r *HistoryRequest) Query() (HistoryQuery, error) {
+	query := HistoryQuery{
+		Status:          TransactionStatus(r.Status),
+		TransactionType: TransactionType(r.TransactionType),
+		Direction:       Direction(r.Direction),
+		CounterpartyID:  r.CounterpartyID,
+		Currency:        utils.Currency(r.Currency),
+		Order:           SortOrder(r.Sort),
+		Limit:           r.Limit,
+	}
+	if query.Order == "" {
+		query.Order = Ascending
+	}
+	if query.Limit == 0 {
+		query.Limit = DefaultHistoryLimit
+	}
+	if (r.MinAmount != "" || r.MaxAmount != "") && r.Currency == "" {
+		return HistoryQuery{}, utils.NewErrorWithMessage(utils.ErrValidationError, "Currency is required to filter by amount")
+	}
+	for _, amount := range []struct {
+		value  string
+		parsed **utils.Money
+	}{
+		{r.MinAmount, &query.MinAmount},
+		{r.MaxAmount, &query.MaxAmount},
+	} {
+		if amount.value == "" {
+			continue
+		}
+		money, err := utils.ParseMoney(amount.value, query.Currency)
+		if err != nil {
+			return HistoryQuery{}, err
+		}
+		*amount.parsed = &money
+	}
+	for _, date := range []struct {
+		name   string
+		value  string
+		parsed **time.Time
+	}{
+		{"from", r.From, &query.From},
+		{"to", r.To, &query.To},
+	} {
+		if date.value == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, date.value)
+		if err != nil {
+			return HistoryQuery{}, utils.NewErrorWithMessage(utils.ErrValidationError, date.name+" must be an RFC 3339 time such as 2025-01-31T00:00:00Z")
+		}
+		*date.parsed = &parsed
+	}
+	if r.Cursor != "" {
+		cursor, err := ParseHistoryCursor(r.Cursor)
+		if err != nil {
+			return HistoryQuery{}, err
+		}
+		query.After = &cursor
+	}
+	return query, nil
+}
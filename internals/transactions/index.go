@@ -0,0 +1,260 @@
+package transactions
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// indexEntry points at a transaction from an index, with the time the index is ordered by.
+type indexEntry struct {
+	at time.Time
+	id string
+}
+
+func (e indexEntry) before(other indexEntry) bool {
+	return e.at.Before(other.at) || e.at.Equal(other.at) && e.id < other.id
+}
+
+// transactionIndex keeps the transactions of the memory repo ordered by creation, oldest first,
+// both overall, per user on the debit and the credit side and per split on its legs, and the
+// pending holds ordered by when they expire. A transaction's users, parent, creation and expiry
+// times never change once it was created, so only creating and deleting a transaction touch the
+// index, and updating a hold only its place among the pending holds.
+type transactionIndex struct {
+	mu     sync.RWMutex
+	all    []indexEntry
+	debit  map[string][]indexEntry // debit user ID -> the user's entries
+	credit map[string][]indexEntry // credit user ID -> the user's entries
+	legs   map[string][]indexEntry // parent transaction ID -> the split's legs
+	holds  []indexEntry            // Pending holds, ordered by expiry
+}
+
+func newTransactionIndex() *transactionIndex {
+	return &transactionIndex{
+		debit:  make(map[string][]indexEntry),
+		credit: make(map[string][]indexEntry),
+		legs:   make(map[string][]indexEntry),
+	}
+}
+
+// add indexes the transaction unless it already is, e.g. when the WAL replays its updates.
+func (x *transactionIndex) add(transaction Transaction) {
+	entry := indexEntry{at: transaction.CreatedAt, id: transaction.ID}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.all = insertEntry(x.all, entry)
+	x.debit[transaction.DebitUserID] = insertEntry(x.debit[transaction.DebitUserID], entry)
+	x.credit[transaction.CreditUserID] = insertEntry(x.credit[transaction.CreditUserID], entry)
+	if transaction.ParentTransactionID != "" {
+		x.legs[transaction.ParentTransactionID] = insertEntry(x.legs[transaction.ParentTransactionID], entry)
+	}
+}
+
+func (x *transactionIndex) remove(transaction Transaction) {
+	entry := indexEntry{at: transaction.CreatedAt, id: transaction.ID}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.all = removeEntry(x.all, entry)
+	x.debit[transaction.DebitUserID] = removeEntry(x.debit[transaction.DebitUserID], entry)
+	if len(x.debit[transaction.DebitUserID]) == 0 {
+		delete(x.debit, transaction.DebitUserID)
+	}
+	x.credit[transaction.CreditUserID] = removeEntry(x.credit[transaction.CreditUserID], entry)
+	if len(x.credit[transaction.CreditUserID]) == 0 {
+		delete(x.credit, transaction.CreditUserID)
+	}
+	if transaction.ParentTransactionID != "" {
+		x.legs[transaction.ParentTransactionID] = removeEntry(x.legs[transaction.ParentTransactionID], entry)
+		if len(x.legs[transaction.ParentTransactionID]) == 0 {
+			delete(x.legs, transaction.ParentTransactionID)
+		}
+	}
+	if transaction.IsHold() {
+		x.holds = removeEntry(x.holds, indexEntry{at: *transaction.ExpiresAt, id: transaction.ID})
+	}
+}
+
+// updateHold keeps the transaction among the pending holds while it is a pending hold.
+func (x *transactionIndex) updateHold(transaction Transaction) {
+	if !transaction.IsHold() {
+		return
+	}
+	entry := indexEntry{at: *transaction.ExpiresAt, id: transaction.ID}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if transaction.Status == Pending {
+		x.holds = insertEntry(x.holds, entry)
+	} else {
+		x.holds = removeEntry(x.holds, entry)
+	}
+}
+
+// expiredHoldIDs returns the IDs of the pending holds that expired at or before now, first expired first.
+func (x *transactionIndex) expiredHoldIDs(now time.Time) []string {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	end := sort.Search(len(x.holds), func(i int) bool { return x.holds[i].at.After(now) })
+	return entryIDs(x.holds[:end])
+}
+
+// allIDs returns the IDs of every transaction, oldest first.
+func (x *transactionIndex) allIDs() []string {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return entryIDs(x.all)
+}
+
+// legIDs returns the IDs of the legs of the split, oldest first.
+func (x *transactionIndex) legIDs(parentID string) []string {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return entryIDs(x.legs[parentID])
+}
+
+// userIDs returns the IDs of the transactions the user sent or received, oldest first.
+func (x *transactionIndex) userIDs(userID string) []string {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	ids := make([]string, 0, len(x.debit[userID])+len(x.credit[userID]))
+	x.walkUserEntries(userID, "", entryRange{}, false, func(entry indexEntry) bool {
+		ids = append(ids, entry.id)
+		return true
+	})
+	return ids
+}
+
+// userEntries returns up to limit entries in the range of the transactions the user sent,
+// received, or either when direction is empty, oldest first or newest first when descending.
+func (x *transactionIndex) userEntries(userID string, direction Direction, within entryRange, descending bool, limit int) []indexEntry {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	entries := make([]indexEntry, 0)
+	x.walkUserEntries(userID, direction, within, descending, func(entry indexEntry) bool {
+		entries = append(entries, entry)
+		return len(entries) < limit
+	})
+	return entries
+}
+
+// walkUserEntries visits the user's entries in the range in order until visit returns false.
+// Only the bounds of the range are sought in the debit and credit entries, which are then
+// merged as far as they are visited. x.mu must be held.
+func (x *transactionIndex) walkUserEntries(userID string, direction Direction, within entryRange, descending bool, visit func(indexEntry) bool) {
+	var debit, credit []indexEntry
+	if direction != Received {
+		debit = within.of(x.debit[userID])
+	}
+	if direction != Sent {
+		credit = within.of(x.credit[userID])
+	}
+	for len(debit) > 0 || len(credit) > 0 {
+		takeDebit, takeCredit := len(debit) > 0, len(credit) > 0
+		if takeDebit && takeCredit {
+			d, c := debit[0], credit[0]
+			if descending {
+				d, c = debit[len(debit)-1], credit[len(credit)-1]
+			}
+			switch {
+			case d.id == c.id:
+				// The user is on both sides of the transaction, which is listed once
+			case d.before(c) != descending:
+				takeCredit = false
+			default:
+				takeDebit = false
+			}
+		}
+		var next indexEntry
+		if takeDebit {
+			next, debit = popEntry(debit, descending)
+		}
+		if takeCredit {
+			next, credit = popEntry(credit, descending)
+		}
+		if !visit(next) {
+			return
+		}
+	}
+}
+
+// popEntry takes the first entry off entries, or the last one when fromBack.
+func popEntry(entries []indexEntry, fromBack bool) (indexEntry, []indexEntry) {
+	if fromBack {
+		return entries[len(entries)-1], entries[:len(entries)-1]
+	}
+	return entries[0], entries[1:]
+}
+
+// entryRange selects the entries at or after from, after after and before before. Nil
+// bounds do not limit it.
+type entryRange struct {
+	from   *indexEntry
+	after  *indexEntry
+	before *indexEntry
+}
+
+// of returns the entries in the range, found by binary search.
+func (r entryRange) of(entries []indexEntry) []indexEntry {
+	start, end := 0, len(entries)
+	if r.from != nil {
+		start = sort.Search(len(entries), func(i int) bool { return !entries[i].before(*r.from) })
+	}
+	if r.after != nil {
+		start = max(start, sort.Search(len(entries), func(i int) bool { return r.after.before(entries[i]) }))
+	}
+	if r.before != nil {
+		end = sort.Search(len(entries), func(i int) bool { return !entries[i].before(*r.before) })
+	}
+	if end <= start {
+		return nil
+	}
+	return entries[start:end]
+}
+
+// debitIDsSince returns the IDs of the transactions the user sent at or after since, oldest first.
+func (x *transactionIndex) debitIDsSince(userID string, since time.Time) []string {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	debit := x.debit[userID]
+	start := sort.Search(len(debit), func(i int) bool { return !debit[i].at.Before(since) })
+	return entryIDs(debit[start:])
+}
+
+func (x *transactionIndex) reset() {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.all = nil
+	x.debit = make(map[string][]indexEntry)
+	x.credit = make(map[string][]indexEntry)
+	x.legs = make(map[string][]indexEntry)
+	x.holds = nil
+}
+
+// insertEntry inserts the entry in its place unless it is there already. Transactions are
+// mostly created in time order, so this is usually an append.
+func insertEntry(entries []indexEntry, entry indexEntry) []indexEntry {
+	i := sort.Search(len(entries), func(i int) bool { return !entries[i].before(entry) })
+	if i < len(entries) && entries[i].id == entry.id {
+		return entries
+	}
+	entries = append(entries, indexEntry{})
+	copy(entries[i+1:], entries[i:])
+	entries[i] = entry
+	return entries
+}
+
+func removeEntry(entries []indexEntry, entry indexEntry) []indexEntry {
+	i := sort.Search(len(entries), func(i int) bool { return !entries[i].before(entry) })
+	if i == len(entries) || entries[i].id != entry.id {
+		return entries
+	}
+	return append(entries[:i], entries[i+1:]...)
+}
+
+func entryIDs(entries []indexEntry) []string {
+	ids := make([]string, len(entries))
+	for i, entry := range entries {
+		ids[i] = entry.id
+	}
+	return ids
+}
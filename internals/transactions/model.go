@@ -1,8 +1,13 @@
 package transactions
 
 import (
-	"concurrent_money_transfer_system/utils"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"time"
+
+	"concurrent_money_transfer_system/internals/fx"
+	"concurrent_money_transfer_system/utils"
 )
 
 type TransactionStatus string
@@ -11,35 +16,295 @@ const (
 	Pending   TransactionStatus = "pending"
 	Completed TransactionStatus = "completed"
 	Failed    TransactionStatus = "failed"
+	Refunded  TransactionStatus = "refunded" // Part of the amount has been returned to the sender
+	Reversed  TransactionStatus = "reversed" // The whole amount has been returned to the sender
+	Voided    TransactionStatus = "voided"   // A hold released before it was captured
+	Expired   TransactionStatus = "expired"  // A hold released by the sweeper once it expired
 )
 
+// SystemUserID is the counterparty of deposits and withdrawals, i.e. money entering or leaving the system
+const SystemUserID = "system"
+
 type TransactionType string
 
 const (
 	Deposit    TransactionType = "deposit"
 	Withdrawal TransactionType = "withdrawal"
 	Transfer   TransactionType = "transfer"
+	Refund     TransactionType = "refund" // Compensating transfer returning money of an original transfer
+	Split      TransactionType = "split"  // Parent of the transfer legs of a split, which move the money themselves
 )
 
 type Transaction struct {
-	ID              string            `json:"id"`
-	DebitUserID     string            `json:"debit_user_id"`
-	CreditUserID    string            `json:"credit_user_id"`
-	Amount          float64           `json:"amount"`
-	Currency        utils.Currency    `json:"currency"`
-	Status          TransactionStatus `json:"status"`
-	TransactionType TransactionType   `json:"transaction_type"`
-	CreatedAt       time.Time         `json:"created_at"`
-	UpdatedAt       time.Time         `json:"updated_at"`
-	Description     string            `json:"description,omitempty"`
-	PaymentDetails  string            `json:"payment_details,omitempty"`
+	ID                    string            `json:"id"`
+	DebitUserID           string            `json:"debit_user_id"`
+	CreditUserID          string            `json:"credit_user_id"`
+	Amount                utils.Money       `json:"amount"`
+	Currency              utils.Currency    `json:"currency"`
+	Status                TransactionStatus `json:"status"`
+	TransactionType       TransactionType   `json:"transaction_type"`
+	CreatedAt             time.Time         `json:"created_at"`
+	UpdatedAt             time.Time         `json:"updated_at"`
+	Description           string            `json:"description,omitempty"`
+	PaymentDetails        string            `json:"payment_details,omitempty"`
+	IdempotencyKey        string            `json:"idempotency_key,omitempty"`
+	OriginalTransactionID string            `json:"original_transaction_id,omitempty"` // Transfer compensated by a refund
+	RefundedAmount        *utils.Money      `json:"refunded_amount,omitempty"`         // Part of a transfer returned by refunds so far
+	QuoteID               string            `json:"quote_id,omitempty"`                // FX quote of a converted transfer, whose Amount is the source amount
+	TargetAmount          *utils.Money      `json:"target_amount,omitempty"`           // Amount credited to the receiver of a converted transfer
+	TargetCurrency        utils.Currency    `json:"target_currency,omitempty"`
+	FXRate                fx.Rate           `json:"fx_rate,omitempty"`
+	ExpiresAt             *time.Time        `json:"expires_at,omitempty"`            // When a hold is released if it has not been captured; only set on holds
+	ParentTransactionID   string            `json:"parent_transaction_id,omitempty"` // Split whose leg this transfer is
+	SettledAt             *time.Time        `json:"settled_at,omitempty"`            // When the money moved, once the transaction completed; for a hold, when it was captured
+	RequestHash           string            `json:"-"`                               // Fingerprint of the request that created the transaction, used to detect idempotency key reuse
+}
+
+// CreditAmount is the amount credited to the receiver: the target amount of a converted
+// transfer, and Amount otherwise.
+func (t Transaction) CreditAmount() utils.Money {
+	if t.TargetAmount != nil {
+		return *t.TargetAmount
+	}
+	return t.Amount
+}
+
+// BookedAt is when the transaction moved the money: when it settled, or when it was created
+// if it completed before settlement times were kept.
+func (t Transaction) BookedAt() time.Time {
+	if t.SettledAt != nil {
+		return *t.SettledAt
+	}
+	return t.CreatedAt
+}
+
+// IsHold reports whether the transaction is a transfer created in hold mode, whatever its status.
+func (t Transaction) IsHold() bool {
+	return t.TransactionType == Transfer && t.ExpiresAt != nil
+}
+
+// countsTowardsLimits reports whether the transaction is a transfer that went through or is
+// still on hold, so it is counted against the sender's daily and monthly limits even if it
+// was refunded later.
+func (t Transaction) countsTowardsLimits() bool {
+	return t.TransactionType == Transfer &&
+		(t.Status == Pending || t.Status == Completed || t.Status == Refunded || t.Status == Reversed)
 }
 
 type TransferRequest struct {
 	SenderID       string         `json:"sender_id" validate:"required"`
 	ReceiverID     string         `json:"receiver_id" validate:"required,nefield=SenderID"`
-	Amount         float64        `json:"amount" validate:"required,min=0"`
+	Amount         utils.Money    `json:"amount" validate:"required,min=0"`
 	Currency       utils.Currency `json:"currency" validate:"required"`
 	Description    string         `json:"description"`
 	PaymentDetails string         `json:"payment_details"`
+	IdempotencyKey string         `json:"idempotency_key"`
+	QuoteID        string         `json:"quote_id"`       // Converts the amount to the quote's currency for the receiver
+	Hold           bool           `json:"hold,omitempty"` // Reserves the amount until it is captured or voided; set from the mode=hold query parameter
+}
+
+// UnmarshalJSON binds the decoded amount to the request currency once both fields are read.
+func (r *TransferRequest) UnmarshalJSON(data []byte) error {
+	type transferRequest TransferRequest // avoids recursing into this method
+	if err := json.Unmarshal(data, (*transferRequest)(r)); err != nil {
+		return err
+	}
+	if r.Currency == "" {
+		return nil // reported by validation
+	}
+	amount, err := r.Amount.WithCurrency(r.Currency)
+	if err != nil {
+		return err
+	}
+	r.Amount = amount
+	return nil
+}
+
+// ReverseRequest returns money of a completed transfer to its sender. An empty amount
+// refunds everything not refunded yet.
+type ReverseRequest struct {
+	Amount utils.Money `json:"amount" validate:"min=0"`
+	Reason string      `json:"reason"`
+}
+
+// FundsRequest moves money between a user's wallet and the outside world (deposits and withdrawals)
+type FundsRequest struct {
+	UserID         string         `json:"user_id" validate:"required"`
+	Amount         utils.Money    `json:"amount" validate:"required,min=0"`
+	Currency       utils.Currency `json:"currency" validate:"required"`
+	Description    string         `json:"description"`
+	PaymentDetails string         `json:"payment_details"`
+	IdempotencyKey string         `json:"idempotency_key"`
+}
+
+// UnmarshalJSON binds the decoded amount to the request currency once both fields are read.
+func (r *FundsRequest) UnmarshalJSON(data []byte) error {
+	type fundsRequest FundsRequest // avoids recursing into this method
+	if err := json.Unmarshal(data, (*fundsRequest)(r)); err != nil {
+		return err
+	}
+	if r.Currency == "" {
+		return nil // reported by validation
+	}
+	amount, err := r.Amount.WithCurrency(r.Currency)
+	if err != nil {
+		return err
+	}
+	r.Amount = amount
+	return nil
+}
+
+type BatchMode string
+
+const (
+	AllOrNothing BatchMode = "all_or_nothing" // Every transfer is made or none is
+	BestEffort   BatchMode = "best_effort"    // Transfers that fail are skipped and the others made
+)
+
+// MaxBatchSize is the most transfers a batch may hold
+const MaxBatchSize = 5000
+
+// BatchTransferRequest sends many transfers from one sender, e.g. a payroll run, while the
+// sender's wallet is locked once for all of them. Every transfer must have the same sender.
+type BatchTransferRequest struct {
+	Mode      BatchMode         `json:"mode" validate:"omitempty,oneof=all_or_nothing best_effort"` // all_or_nothing when empty
+	Transfers []TransferRequest `json:"transfers" validate:"required,min=1,max=5000"`               // Validated one by one, so an invalid transfer only fails itself in best-effort mode
+}
+
+type BatchStatus string
+
+const (
+	BatchCompleted          BatchStatus = "completed"
+	BatchPartiallyCompleted BatchStatus = "partially_completed"
+	BatchFailed             BatchStatus = "failed"
+)
+
+type BatchItemStatus string
+
+const (
+	ItemCompleted BatchItemStatus = "completed"
+	ItemFailed    BatchItemStatus = "failed"
+	ItemSkipped   BatchItemStatus = "skipped" // Not made because another transfer of an all-or-nothing batch failed
+)
+
+// BatchItemResult is the outcome of the transfer at Index in the batch request.
+type BatchItemResult struct {
+	Index       int             `json:"index"`
+	Status      BatchItemStatus `json:"status"`
+	Transaction *Transaction    `json:"transaction,omitempty"`
+	ErrorCode   utils.ErrorCode `json:"error_code,omitempty"`
+	Error       string          `json:"error,omitempty"`
+}
+
+type BatchTransferResult struct {
+	Mode      BatchMode         `json:"mode"`
+	Status    BatchStatus       `json:"status"`
+	Completed int               `json:"completed"`
+	Failed    int               `json:"failed"`
+	Results   []BatchItemResult `json:"results"`
+}
+
+// MaxSplitLegs is the most legs a split may have
+const MaxSplitLegs = 100
+
+// SplitLeg is the part of a split paid to one receiver, or collected from one sender.
+type SplitLeg struct {
+	UserID string      `json:"user_id" validate:"required"` // Receiver when the split pays out, sender when it collects
+	Amount utils.Money `json:"amount" validate:"required,min=0"`
+}
+
+// SplitTransferRequest pays several receivers from one sender, e.g. a marketplace order split
+// between sellers and the platform fee, or collects from several senders to one receiver.
+// Exactly one of SenderID and ReceiverID is set; every leg moves money between it and the
+// leg's user, and either all legs are made or none is.
+type SplitTransferRequest struct {
+	SenderID       string         `json:"sender_id,omitempty"`
+	ReceiverID     string         `json:"receiver_id,omitempty"`
+	Currency       utils.Currency `json:"currency" validate:"required"`
+	Description    string         `json:"description"`
+	IdempotencyKey string         `json:"idempotency_key"`
+	Legs           []SplitLeg     `json:"legs" validate:"required,min=2,max=100,dive"`
+}
+
+// UnmarshalJSON binds the decoded leg amounts to the request currency once all fields are read.
+func (r *SplitTransferRequest) UnmarshalJSON(data []byte) error {
+	type splitTransferRequest SplitTransferRequest // avoids recursing into this method
+	if err := json.Unmarshal(data, (*splitTransferRequest)(r)); err != nil {
+		return err
+	}
+	if r.Currency == "" {
+		return nil // reported by validation
+	}
+	for i := range r.Legs {
+		amount, err := r.Legs[i].Amount.WithCurrency(r.Currency)
+		if err != nil {
+			return err
+		}
+		r.Legs[i].Amount = amount
+	}
+	return nil
+}
+
+// legRequests returns the transfer of each leg, in the order of the legs.
+func (r *SplitTransferRequest) legRequests() []TransferRequest {
+	transfers := make([]TransferRequest, len(r.Legs))
+	for i, leg := range r.Legs {
+		transfers[i] = TransferRequest{
+			SenderID:    r.SenderID,
+			ReceiverID:  r.ReceiverID,
+			Amount:      leg.Amount,
+			Currency:    r.Currency,
+			Description: r.Description,
+		}
+		if r.SenderID != "" {
+			transfers[i].ReceiverID = leg.UserID
+		} else {
+			transfers[i].SenderID = leg.UserID
+		}
+	}
+	return transfers
+}
+
+// SplitTransfer is the parent transaction of a split with its transfer legs. The parent holds
+// the total of the split and only the party shared by the legs; it moves no money itself.
+type SplitTransfer struct {
+	Transaction
+	Legs []Transaction `json:"legs"`
+}
+
+// parties returns the users the split moves money between.
+func (s SplitTransfer) parties() []string {
+	parties := []string{s.DebitUserID, s.CreditUserID}
+	for _, leg := range s.Legs {
+		parties = append(parties, leg.DebitUserID, leg.CreditUserID)
+	}
+	return parties
+}
+
+// Fingerprint returns a hash of the fields that define the transfer, so a replayed
+// request can be told apart from a different request reusing the same idempotency key.
+func (r *TransferRequest) Fingerprint() string {
+	request := *r
+	request.IdempotencyKey = ""
+	return fingerprint(request)
+}
+
+// Fingerprint returns a hash of the fields that define the deposit or withdrawal.
+func (r *FundsRequest) Fingerprint() string {
+	request := *r
+	request.IdempotencyKey = ""
+	return fingerprint(request)
+}
+
+// Fingerprint returns a hash of the fields that define the split.
+func (r *SplitTransferRequest) Fingerprint() string {
+	request := *r
+	request.IdempotencyKey = ""
+	return fingerprint(request)
+}
+
+func fingerprint(request any) string {
+	data, _ := json.Marshal(request)
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
 }
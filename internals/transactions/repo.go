@@ -5,26 +5,59 @@ import (
 	"sync"
 	"time"
 
+	"concurrent_money_transfer_system/internals/storage"
 	"concurrent_money_transfer_system/utils"
 )
 
+// transactionRecord is the WAL record kind holding a transaction's post-image
+const transactionRecord = "transaction"
+
 type TransactionRepo interface {
 	CreateTransaction(ctx context.Context, transaction Transaction) (Transaction, error)
 	GetTransaction(ctx context.Context, id string) (Transaction, error)
+	GetTransactionByIdempotencyKey(ctx context.Context, key string) (Transaction, error)
 	GetTransactionsByUserID(ctx context.Context, userID string) ([]Transaction, error)
+	// GetTransactionHistory returns the page of the user's transactions selected by the query.
+	GetTransactionHistory(ctx context.Context, userID string, query HistoryQuery) (HistoryPage, error)
+	// GetTransactionsByParentID returns the legs of a split, oldest first.
+	GetTransactionsByParentID(ctx context.Context, parentID string) ([]Transaction, error)
 	UpdateTransactionStatus(ctx context.Context, id string, status TransactionStatus) (Transaction, error)
+	// SettleTransaction completes the transaction, recording that its money moved at settledAt.
+	SettleTransaction(ctx context.Context, id string, settledAt time.Time) (Transaction, error)
+	UpdateTransaction(ctx context.Context, transaction Transaction) (Transaction, error)
 	GetAllTransactions(ctx context.Context) ([]Transaction, error)
+	// GetOutgoingTransferTotal sums the transfers the user sent in the currency since the given
+	// time, including pending holds and transfers that were refunded or reversed later.
+	GetOutgoingTransferTotal(ctx context.Context, userID string, currency utils.Currency, since time.Time) (utils.Money, error)
+	// GetExpiredHolds returns the pending holds that expired at or before now.
+	GetExpiredHolds(ctx context.Context, now time.Time) ([]Transaction, error)
 }
 
 type transactionRepo struct {
-	transactions sync.Map
+	transactions    sync.Map
+	idempotencyKeys sync.Map          // idempotency key -> transaction ID
+	index           *transactionIndex // Transaction IDs in creation order, overall and per user
+	wal             *storage.WAL      // Writes are logged here first when set
 }
 
 func (r *transactionRepo) CreateTransaction(ctx context.Context, transaction Transaction) (Transaction, error) {
 	if transaction.ID == "" {
 		transaction.ID = utils.GenerateUniqueEntityId()
 	}
-	r.transactions.Store(transaction.ID, transaction)
+	if transaction.IdempotencyKey != "" {
+		// LoadOrStore makes claiming the key atomic, so two concurrent requests
+		// with the same key can never both create a transaction
+		if _, loaded := r.idempotencyKeys.LoadOrStore(transaction.IdempotencyKey, transaction.ID); loaded {
+			return Transaction{}, utils.NewError(utils.ErrIdempotencyKeyReused)
+		}
+	}
+	err := r.storeTransaction(ctx, transaction)
+	if err != nil {
+		r.deleteTransaction(transaction)
+		return Transaction{}, err
+	}
+	r.index.add(transaction)
+	storage.OnRollback(ctx, func() { r.deleteTransaction(transaction) })
 	return transaction, nil
 }
 
@@ -36,35 +69,199 @@ func (r *transactionRepo) GetTransaction(ctx context.Context, id string) (Transa
 	return transaction.(Transaction), nil
 }
 
+func (r *transactionRepo) GetTransactionByIdempotencyKey(ctx context.Context, key string) (Transaction, error) {
+	id, ok := r.idempotencyKeys.Load(key)
+	if !ok {
+		return Transaction{}, utils.NewError(utils.ErrTransactionNotFound)
+	}
+	return r.GetTransaction(ctx, id.(string))
+}
+
 func (r *transactionRepo) UpdateTransactionStatus(ctx context.Context, id string, status TransactionStatus) (Transaction, error) {
-	transaction, err := r.GetTransaction(ctx, id)
+	previous, err := r.GetTransaction(ctx, id)
 	if err != nil {
 		return Transaction{}, err
 	}
+	transaction := previous
 	transaction.Status = status
 	transaction.UpdatedAt = time.Now()
-	r.transactions.Store(id, transaction)
+	err = r.storeTransaction(ctx, transaction)
+	if err != nil {
+		return Transaction{}, err
+	}
+	storage.OnRollback(ctx, func() { r.putTransaction(previous) })
+	return transaction, nil
+}
+
+func (r *transactionRepo) SettleTransaction(ctx context.Context, id string, settledAt time.Time) (Transaction, error) {
+	transaction, err := r.GetTransaction(ctx, id)
+	if err != nil {
+		return Transaction{}, err
+	}
+	transaction.Status = Completed
+	transaction.SettledAt = &settledAt
+	return r.UpdateTransaction(ctx, transaction)
+}
+
+func (r *transactionRepo) UpdateTransaction(ctx context.Context, transaction Transaction) (Transaction, error) {
+	previous, err := r.GetTransaction(ctx, transaction.ID)
+	if err != nil {
+		return Transaction{}, err
+	}
+	transaction.UpdatedAt = time.Now()
+	err = r.storeTransaction(ctx, transaction)
+	if err != nil {
+		return Transaction{}, err
+	}
+	storage.OnRollback(ctx, func() { r.putTransaction(previous) })
 	return transaction, nil
 }
 
+// storeTransaction logs the transaction to the WAL and stores it.
+func (r *transactionRepo) storeTransaction(ctx context.Context, transaction Transaction) error {
+	return r.wal.Log(ctx, transactionRecord, transaction, func() { r.putTransaction(transaction) })
+}
+
+// putTransaction stores the transaction and keeps the pending holds of the index in step with it.
+func (r *transactionRepo) putTransaction(transaction Transaction) {
+	r.transactions.Store(transaction.ID, transaction)
+	r.index.updateHold(transaction)
+}
+
+// deleteTransaction removes the transaction from the repo and its indexes and frees its idempotency key.
+func (r *transactionRepo) deleteTransaction(transaction Transaction) {
+	r.index.remove(transaction)
+	r.transactions.Delete(transaction.ID)
+	if transaction.IdempotencyKey != "" {
+		r.idempotencyKeys.CompareAndDelete(transaction.IdempotencyKey, transaction.ID)
+	}
+}
+
 func (r *transactionRepo) GetTransactionsByUserID(ctx context.Context, userID string) ([]Transaction, error) {
+	return r.loadTransactions(r.index.userIDs(userID)), nil
+}
+
+func (r *transactionRepo) GetTransactionHistory(ctx context.Context, userID string, query HistoryQuery) (HistoryPage, error) {
+	// The date range and the cursor are sought in the index, which is in the order of the history
+	var within entryRange
+	if query.From != nil {
+		within.from = &indexEntry{at: *query.From}
+	}
+	if query.To != nil {
+		within.before = &indexEntry{at: *query.To}
+	}
+	descending := query.Order == Descending
+	if query.After != nil {
+		after := indexEntry{at: query.After.CreatedAt, id: query.After.ID}
+		if !descending {
+			within.after = &after
+		} else if within.before == nil || after.before(*within.before) {
+			within.before = &after
+		}
+	}
+	// Entries are read a page at a time, and again after the last one read while the other
+	// filters leave the page short
 	transactions := make([]Transaction, 0)
-	r.transactions.Range(func(key, value any) bool {
-		if value.(Transaction).DebitUserID == userID || value.(Transaction).CreditUserID == userID {
-			transactions = append(transactions, value.(Transaction))
+	for len(transactions) <= query.Limit {
+		entries := r.index.userEntries(userID, query.Direction, within, descending, query.Limit+1)
+		for _, entry := range entries {
+			value, ok := r.transactions.Load(entry.id)
+			if ok && query.matches(userID, value.(Transaction)) {
+				transactions = append(transactions, value.(Transaction))
+				if len(transactions) > query.Limit {
+					break
+				}
+			}
 		}
-		return true
-	})
-	return transactions, nil
+		if len(entries) <= query.Limit {
+			break
+		}
+		last := entries[len(entries)-1]
+		if descending {
+			within.before = &last
+		} else {
+			within.after = &last
+		}
+	}
+	return newHistoryPage(transactions, query.Limit), nil
+}
+
+func (r *transactionRepo) GetTransactionsByParentID(ctx context.Context, parentID string) ([]Transaction, error) {
+	return r.loadTransactions(r.index.legIDs(parentID)), nil
 }
 
 func (r *transactionRepo) GetAllTransactions(ctx context.Context) ([]Transaction, error) {
+	return r.loadTransactions(r.index.allIDs()), nil
+}
+
+func (r *transactionRepo) GetOutgoingTransferTotal(ctx context.Context, userID string, currency utils.Currency, since time.Time) (utils.Money, error) {
+	total := utils.NewMoney(0, currency)
+	for _, transaction := range r.loadTransactions(r.index.debitIDsSince(userID, since)) {
+		if transaction.Currency == currency && transaction.countsTowardsLimits() {
+			var err error
+			total, err = total.CheckedAdd(transaction.Amount)
+			if err != nil {
+				return utils.Money{}, err
+			}
+		}
+	}
+	return total, nil
+}
+
+// loadTransactions returns the transactions with the IDs, in the same order, skipping the ones
+// deleted since the IDs were read from the index.
+func (r *transactionRepo) loadTransactions(ids []string) []Transaction {
+	transactions := make([]Transaction, 0, len(ids))
+	for _, id := range ids {
+		if transaction, ok := r.transactions.Load(id); ok {
+			transactions = append(transactions, transaction.(Transaction))
+		}
+	}
+	return transactions
+}
+
+func (r *transactionRepo) GetExpiredHolds(ctx context.Context, now time.Time) ([]Transaction, error) {
 	transactions := make([]Transaction, 0)
+	for _, transaction := range r.loadTransactions(r.index.expiredHoldIDs(now)) {
+		// The hold may have been captured or released since the IDs were read
+		if transaction.Status == Pending {
+			transactions = append(transactions, transaction)
+		}
+	}
+	return transactions, nil
+}
+
+func (r *transactionRepo) SetWAL(wal *storage.WAL) {
+	r.wal = wal
+}
+
+func (r *transactionRepo) ApplyRecord(record storage.Record) (bool, error) {
+	if record.Kind != transactionRecord {
+		return false, nil
+	}
+	var transaction Transaction
+	err := record.Decode(&transaction)
+	if err != nil {
+		return true, err
+	}
+	r.putTransaction(transaction)
+	r.index.add(transaction)
+	if transaction.IdempotencyKey != "" {
+		r.idempotencyKeys.Store(transaction.IdempotencyKey, transaction.ID)
+	}
+	return true, nil
+}
+
+func (r *transactionRepo) SnapshotRecords() ([]storage.Record, error) {
+	records := make([]storage.Record, 0)
+	var err error
 	r.transactions.Range(func(key, value any) bool {
-		transactions = append(transactions, value.(Transaction))
-		return true
+		var record storage.Record
+		record, err = storage.NewRecord(transactionRecord, value.(Transaction))
+		records = append(records, record)
+		return err == nil
 	})
-	return transactions, nil
+	return records, err
 }
 
 var transactionRepoInstance *transactionRepo
@@ -72,8 +269,10 @@ var transactionRepoInstance *transactionRepo
 func NewTransactionRepo() TransactionRepo {
 	if transactionRepoInstance == nil {
 		transactionRepoInstance = &transactionRepo{
-			transactions: sync.Map{},
-		}	
+			transactions:    sync.Map{},
+			idempotencyKeys: sync.Map{},
+			index:           newTransactionIndex(),
+		}
 	}
 	return transactionRepoInstance
 }
@@ -84,4 +283,9 @@ func Reset() {
 		transactionRepoInstance.transactions.Delete(key)
 		return true
 	})
+	transactionRepoInstance.idempotencyKeys.Range(func(key, value any) bool {
+		transactionRepoInstance.idempotencyKeys.Delete(key)
+		return true
+	})
+	transactionRepoInstance.index.reset()
 }
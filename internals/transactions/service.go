@@ -1,22 +1,50 @@
 package transactions
 
 import (
+	"concurrent_money_transfer_system/internals/events"
+	"concurrent_money_transfer_system/internals/fx"
+	"concurrent_money_transfer_system/internals/ledger"
+	"concurrent_money_transfer_system/internals/limits"
+	"concurrent_money_transfer_system/internals/storage"
 	"concurrent_money_transfer_system/internals/wallet"
 	"concurrent_money_transfer_system/utils"
 	"context"
+	"log"
+	"math/rand"
+	"sort"
 	"time"
 )
 
 type TransactionService interface {
 	CreateTransaction(ctx context.Context, transferRequest *TransferRequest) (Transaction, error)
+	CreateBatchTransfer(ctx context.Context, batchRequest *BatchTransferRequest) (BatchTransferResult, error)
+	CreateSplitTransfer(ctx context.Context, splitRequest *SplitTransferRequest) (SplitTransfer, error)
+	GetSplitTransfer(ctx context.Context, id string) (SplitTransfer, error)
+	Deposit(ctx context.Context, depositRequest *FundsRequest) (Transaction, error)
+	Withdraw(ctx context.Context, withdrawalRequest *FundsRequest) (Transaction, error)
+	ReverseTransaction(ctx context.Context, id string, reverseRequest *ReverseRequest) (Transaction, error)
 	GetTransaction(ctx context.Context, id string) (Transaction, error)
-	GetTransactionsByUserID(ctx context.Context, userID string) ([]Transaction, error)
+	GetTransactionHistory(ctx context.Context, userID string, query HistoryQuery) (HistoryPage, error)
 	GetAllTransactions(ctx context.Context) ([]Transaction, error)
+	CaptureTransaction(ctx context.Context, id string) (Transaction, error)
+	VoidTransaction(ctx context.Context, id string) (Transaction, error)
+	// ExpireHolds releases the pending holds that expired at or before now and returns how many it
+	// released. A hold that cannot be released, e.g. while its wallet is busy, is left for the
+	// next call without holding up the others, and the first such error is returned.
+	ExpireHolds(ctx context.Context, now time.Time) (int, error)
+	StartHoldSweeper(interval time.Duration, stop <-chan struct{})
 }
 
 type transactionService struct {
 	repo          TransactionRepo
 	walletService wallet.WalletService
+	ledgerService ledger.LedgerService
+	fxService     fx.FXService
+	limitsService limits.LimitsService
+	eventService  events.EventService
+	unitOfWork    storage.UnitOfWork
+	holdTTL       time.Duration // How long a hold reserves funds before it expires
+	locking       LockingStrategy
 }
 
 func (s *transactionService) getSenderAndReceiverWalletsWithLockingOrder(ctx context.Context, transferRequest *TransferRequest) (senderWallet wallet.Wallet, receiverWallet wallet.Wallet, err error) {
@@ -24,46 +52,271 @@ func (s *transactionService) getSenderAndReceiverWalletsWithLockingOrder(ctx con
 	// minimum ID first, we are making sure of not falling into deadlock.
 	// This prevents a situation where two concurrent transactions could lock
 	// wallets in opposite order, causing a deadlock.
+	// When the second lock cannot be taken, e.g. it times out, the first one is released, so
+	// on error the caller holds no lock and must not release any.
 	if transferRequest.SenderID < transferRequest.ReceiverID {
 		senderWallet, err = s.walletService.GetWalletForUpdate(ctx, transferRequest.SenderID)
 		if err != nil {
 			return
 		}
 		receiverWallet, err = s.walletService.GetWalletForUpdate(ctx, transferRequest.ReceiverID)
+		if err != nil {
+			s.walletService.ReleaseGetWalletForUpdateLock(ctx, transferRequest.SenderID)
+		}
 	} else {
 		receiverWallet, err = s.walletService.GetWalletForUpdate(ctx, transferRequest.ReceiverID)
 		if err != nil {
 			return
 		}
 		senderWallet, err = s.walletService.GetWalletForUpdate(ctx, transferRequest.SenderID)
+		if err != nil {
+			s.walletService.ReleaseGetWalletForUpdateLock(ctx, transferRequest.ReceiverID)
+		}
 	}
 
 	return senderWallet, receiverWallet, err
 }
 
+// makeLockedTransfer checks and posts one transfer of a batch or split between the locked
+// wallets, then reads the wallets again so the next transfer starts from their new balances.
+func (s *transactionService) makeLockedTransfer(ctx context.Context, transferRequest *TransferRequest, wallets map[string]wallet.Wallet,
+	post func(ctx context.Context, transaction Transaction, debitWallet *wallet.Wallet, creditWallet *wallet.Wallet) (Transaction, error)) (Transaction, error) {
+	senderWallet, receiverWallet := wallets[transferRequest.SenderID], wallets[transferRequest.ReceiverID]
+	transaction, replayed, err := s.prepareTransfer(ctx, transferRequest, senderWallet, receiverWallet)
+	if err != nil || replayed {
+		return transaction, err
+	}
+	transaction, err = post(ctx, transaction, &senderWallet, &receiverWallet)
+	if err != nil {
+		return Transaction{}, err
+	}
+	for _, userID := range []string{transferRequest.SenderID, transferRequest.ReceiverID} {
+		wallets[userID], err = s.walletService.GetWallet(ctx, userID)
+		if err != nil {
+			return Transaction{}, err
+		}
+	}
+	return transaction, nil
+}
+
+// lockWallets generalizes getSenderAndReceiverWalletsWithLockingOrder to any number of users:
+// it locks their wallets in ascending user ID order, the order every transfer locks its two
+// wallets in, so batches and splits never deadlock with transfers or with each other. Wallets
+// that cannot be locked are left out, with their error in lockErrors.
+func (s *transactionService) lockWallets(ctx context.Context, userIDs []string) (wallets map[string]wallet.Wallet, lockErrors map[string]error) {
+	wallets = make(map[string]wallet.Wallet, len(userIDs))
+	lockErrors = make(map[string]error)
+	sorted := append([]string(nil), userIDs...)
+	sort.Strings(sorted)
+	for i, userID := range sorted {
+		if i > 0 && userID == sorted[i-1] {
+			continue
+		}
+		lockedWallet, err := s.walletService.GetWalletForUpdate(ctx, userID)
+		if err != nil {
+			lockErrors[userID] = err
+			continue
+		}
+		wallets[userID] = lockedWallet
+	}
+	return wallets, lockErrors
+}
+
+// releaseWallets releases the locks taken by lockWallets.
+func (s *transactionService) releaseWallets(ctx context.Context, wallets map[string]wallet.Wallet) {
+	for userID := range wallets {
+		s.walletService.ReleaseGetWalletForUpdateLock(ctx, userID)
+	}
+}
+
+// getWalletsWithLockingOrder locks the wallets of all the users like lockWallets, but fails
+// with the first error when any of them cannot be locked, releasing the others.
+func (s *transactionService) getWalletsWithLockingOrder(ctx context.Context, userIDs []string) (map[string]wallet.Wallet, error) {
+	wallets, lockErrors := s.lockWallets(ctx, userIDs)
+	if len(lockErrors) == 0 {
+		return wallets, nil
+	}
+	s.releaseWallets(ctx, wallets)
+	failedIDs := make([]string, 0, len(lockErrors))
+	for userID := range lockErrors {
+		failedIDs = append(failedIDs, userID)
+	}
+	sort.Strings(failedIDs)
+	return nil, lockErrors[failedIDs[0]]
+}
+
+// CreateTransaction transfers the amount to the receiver, or only reserves it in the sender's
+// wallet when the request is a hold.
 func (s *transactionService) CreateTransaction(ctx context.Context, transferRequest *TransferRequest) (Transaction, error) {
 	if transferRequest.SenderID == transferRequest.ReceiverID {
 		return Transaction{}, utils.NewError(utils.ErrTransactionSameUser)
 	}
+	if s.locking == Optimistic && !transferRequest.Hold {
+		return s.createTransactionOptimistically(ctx, transferRequest)
+	}
+	return s.createTransactionLocked(ctx, transferRequest)
+}
 
+// createTransactionLocked makes the transfer or the hold with both wallets locked while it is
+// checked and written.
+func (s *transactionService) createTransactionLocked(ctx context.Context, transferRequest *TransferRequest) (Transaction, error) {
+	senderWallet, receiverWallet, err := s.getSenderAndReceiverWalletsWithLockingOrder(ctx, transferRequest)
+
+	if err != nil {
+		return Transaction{}, err
+	}
 	defer s.walletService.ReleaseGetWalletForUpdateLock(ctx, transferRequest.SenderID)
 	defer s.walletService.ReleaseGetWalletForUpdateLock(ctx, transferRequest.ReceiverID)
 
-	senderWallet, receiverWallet, err := s.getSenderAndReceiverWalletsWithLockingOrder(ctx, transferRequest)
+	transaction, replayed, err := s.prepareTransfer(ctx, transferRequest, senderWallet, receiverWallet)
+	if err != nil || replayed {
+		return transaction, err
+	}
 
+	if transferRequest.Hold {
+		return s.holdTransaction(ctx, transaction, &senderWallet)
+	}
+	return s.applyTransaction(ctx, transaction, &senderWallet, &receiverWallet)
+}
+
+// createTransactionOptimistically makes the transfer without holding the wallet locks while
+// it is checked. When either wallet changed between the check and the writes, the transfer is
+// checked and tried again after a random wait. A transfer that queues for the lock of a busy
+// wallet finds it changed almost every time, so after MaxOptimisticAttempts it locks the
+// wallets for the whole transfer instead of being starved.
+func (s *transactionService) createTransactionOptimistically(ctx context.Context, transferRequest *TransferRequest) (Transaction, error) {
+	for attempt := 1; attempt <= MaxOptimisticAttempts; attempt++ {
+		transaction, err := s.tryTransactionOptimistically(ctx, transferRequest)
+		if !utils.IsError(err, utils.ErrVersionConflict) {
+			return transaction, err
+		}
+		backoff := time.NewTimer(optimisticBackoff(attempt))
+		select {
+		case <-backoff.C:
+		case <-ctx.Done():
+			backoff.Stop()
+			return Transaction{}, err
+		}
+	}
+	return s.createTransactionLocked(ctx, transferRequest)
+}
+
+// optimisticBackoff returns how long to wait after the attempt failed: a random time up to a
+// limit that doubles with every attempt, so clashing transfers spread out further the more
+// they clash.
+func optimisticBackoff(attempt int) time.Duration {
+	limit := min(100*time.Microsecond<<min(attempt, 10), 10*time.Millisecond)
+	return time.Duration(rand.Int63n(int64(limit)))
+}
+
+// tryTransactionOptimistically checks the transfer against unlocked reads of the wallets, then
+// writes their balances only if they are still at the versions read, failing with
+// VERSION_CONFLICT otherwise. Every transfer the sender completes changes their wallet, so
+// this also catches one that got in between the check of the sender's limits and the writes.
+//
+// The writes still take the wallet locks, but only for the unit of work that makes them: the
+// memory repos undo a rolled back write by restoring the wallet it replaced, which is only
+// safe while nothing else can write the wallet, and the flows that lock the wallets for their
+// whole duration must not see a swap between their read and their write.
+func (s *transactionService) tryTransactionOptimistically(ctx context.Context, transferRequest *TransferRequest) (Transaction, error) {
+	senderWallet, err := s.walletService.GetWallet(ctx, transferRequest.SenderID)
 	if err != nil {
 		return Transaction{}, err
 	}
+	receiverWallet, err := s.walletService.GetWallet(ctx, transferRequest.ReceiverID)
+	if err != nil {
+		return Transaction{}, err
+	}
+	transaction, replayed, err := s.prepareTransfer(ctx, transferRequest, senderWallet, receiverWallet)
+	if err != nil || replayed {
+		return transaction, err
+	}
 
-	if senderWallet.Balance < transferRequest.Amount {
-		return Transaction{}, utils.NewError(utils.ErrInsufficientBalance)
+	_, _, err = s.getSenderAndReceiverWalletsWithLockingOrder(ctx, transferRequest)
+	if err != nil {
+		return Transaction{}, err
+	}
+	defer s.walletService.ReleaseGetWalletForUpdateLock(ctx, transferRequest.SenderID)
+	defer s.walletService.ReleaseGetWalletForUpdateLock(ctx, transferRequest.ReceiverID)
+
+	var posted Transaction
+	err = s.unitOfWork.RunInTx(ctx, func(ctx context.Context) error {
+		posted, err = s.createTransaction(ctx, transaction)
+		if err != nil {
+			return err
+		}
+		posted, err = s.settleTransactionWith(ctx, posted, &senderWallet, &receiverWallet, s.swapWalletBalance)
+		return err
+	})
+	if utils.IsError(err, utils.ErrIdempotencyKeyReused) && transferRequest.IdempotencyKey != "" {
+		// A request with the same key got in after the check. The locks were taken after it
+		// ended, so its transaction is final and is replayed, or the key is another request's
+		existingTransaction, found, replayErr := s.getTransactionForReplay(ctx, transferRequest.IdempotencyKey, transferRequest.Fingerprint())
+		if replayErr != nil || found {
+			return existingTransaction, replayErr
+		}
+	}
+	// A conflict is tried again, so only other failures are kept in the history
+	if err != nil && !utils.IsError(err, utils.ErrVersionConflict) {
+		s.recordFailedTransaction(ctx, transaction, err)
+	}
+	if err != nil {
+		return Transaction{}, err
+	}
+	return posted, nil
+}
+
+// prepareTransfer checks the transfer against the locked wallets and the sender's limits and
+// returns the pending transaction to post, or the transaction previously created with the
+// request's idempotency key, in which case replayed is true.
+func (s *transactionService) prepareTransfer(ctx context.Context, transferRequest *TransferRequest, senderWallet wallet.Wallet, receiverWallet wallet.Wallet) (transaction Transaction, replayed bool, err error) {
+	// The idempotency check runs while the wallet locks are held, so a replay
+	// racing the original request waits for it and then sees its result
+	if transferRequest.IdempotencyKey != "" {
+		existingTransaction, found, err := s.getTransactionForReplay(ctx, transferRequest.IdempotencyKey, transferRequest.Fingerprint())
+		if err != nil || found {
+			return existingTransaction, found, err
+		}
+	}
+
+	senderBalance, err := availableInCurrency(senderWallet, transferRequest.Currency, "Sender")
+	if err != nil {
+		return Transaction{}, false, err
+	}
+	// A quoted transfer credits the receiver in the quote's target currency
+	creditCurrency := transferRequest.Currency
+	var quote fx.Quote
+	if transferRequest.QuoteID != "" {
+		quote, err = s.fxService.GetValidQuote(ctx, transferRequest.QuoteID, transferRequest.SenderID)
+		if err != nil {
+			return Transaction{}, false, err
+		}
+		if quote.From != transferRequest.Currency {
+			return Transaction{}, false, utils.NewErrorWithMessage(utils.ErrValidationError, "Quote converts from "+string(quote.From)+", not "+string(transferRequest.Currency))
+		}
+		creditCurrency = quote.To
+	}
+	_, err = availableInCurrency(receiverWallet, creditCurrency, "Receiver")
+	if err != nil {
+		return Transaction{}, false, err
+	}
+
+	if senderBalance.LessThan(transferRequest.Amount) {
+		return Transaction{}, false, utils.NewError(utils.ErrInsufficientBalance)
 	}
 
 	if senderWallet.Status == wallet.Inactive || receiverWallet.Status == wallet.Inactive {
-		return Transaction{}, utils.NewError(utils.ErrWalletInactive)
+		return Transaction{}, false, utils.NewError(utils.ErrWalletInactive)
 	}
 
-	transaction := Transaction{
+	// The sender's wallet lock keeps their other transfers from completing between the
+	// check and this one, so they cannot exceed a limit by racing
+	err = s.limitsService.CheckTransfer(ctx, transferRequest.SenderID, transferRequest.Amount)
+	if err != nil {
+		return Transaction{}, false, err
+	}
+
+	transaction = Transaction{
 		ID:              utils.GenerateUniqueEntityId(),
 		DebitUserID:     transferRequest.SenderID,
 		CreditUserID:    transferRequest.ReceiverID,
@@ -75,37 +328,573 @@ func (s *transactionService) CreateTransaction(ctx context.Context, transferRequ
 		UpdatedAt:       time.Now(),
 		Description:     transferRequest.Description,
 		PaymentDetails:  transferRequest.PaymentDetails,
+		IdempotencyKey:  transferRequest.IdempotencyKey,
+		RequestHash:     transferRequest.Fingerprint(),
+	}
+	if transferRequest.QuoteID != "" {
+		targetAmount, err := fx.Convert(transferRequest.Amount, quote)
+		if err != nil {
+			return Transaction{}, false, err
+		}
+		if !targetAmount.IsPositive() {
+			return Transaction{}, false, utils.NewErrorWithMessage(utils.ErrValidationError, "Amount is too small to convert to "+string(quote.To))
+		}
+		transaction.QuoteID = quote.ID
+		transaction.TargetAmount = &targetAmount
+		transaction.TargetCurrency = quote.To
+		transaction.FXRate = quote.Rate
 	}
 
-	newSenderBalance := senderWallet.Balance - transferRequest.Amount
-	newReceiverBalance := receiverWallet.Balance + transferRequest.Amount
-	s.repo.CreateTransaction(ctx, transaction)
+	return transaction, false, nil
+}
 
-	err = s.walletService.UpdateWalletBalance(ctx, senderWallet.ID, newSenderBalance)
+// holdTransaction records the transfer as a pending hold and reserves its amount in the
+// locked sender wallet until the hold is captured, voided or expires.
+func (s *transactionService) holdTransaction(ctx context.Context, transaction Transaction, senderWallet *wallet.Wallet) (Transaction, error) {
+	expiresAt := transaction.CreatedAt.Add(s.holdTTL)
+	transaction.ExpiresAt = &expiresAt
+	var hold Transaction
+	err := s.unitOfWork.RunInTx(ctx, func(ctx context.Context) error {
+		var err error
+		hold, err = s.createTransaction(ctx, transaction)
+		if err != nil {
+			return err
+		}
+		held, err := senderWallet.HeldIn(transaction.Currency).CheckedAdd(transaction.Amount)
+		if err != nil {
+			return err
+		}
+		return s.walletService.UpdateWalletHeld(ctx, senderWallet.ID, held)
+	})
 	if err != nil {
-		transaction, err = s.repo.UpdateTransactionStatus(ctx, transaction.ID, Failed)
-		s.walletService.UpdateWalletBalance(ctx, senderWallet.ID, senderWallet.Balance) // make the balance as it is
-		return transaction, err
+		s.recordFailedTransaction(ctx, transaction, err)
+		return Transaction{}, err
 	}
+	return hold, nil
+}
 
-	err = s.walletService.UpdateWalletBalance(ctx, receiverWallet.ID, newReceiverBalance)
+// CaptureTransaction completes a pending hold, moving the reserved amount to the receiver.
+func (s *transactionService) CaptureTransaction(ctx context.Context, id string) (Transaction, error) {
+	hold, err := s.getPendingHold(ctx, id)
 	if err != nil {
-		transaction, err = s.repo.UpdateTransactionStatus(ctx, transaction.ID, Failed)
-		s.walletService.UpdateWalletBalance(ctx, senderWallet.ID, senderWallet.Balance) // make the balance as it is
 		return Transaction{}, err
 	}
+	lockRequest := &TransferRequest{SenderID: hold.DebitUserID, ReceiverID: hold.CreditUserID}
 
-	transaction, err = s.repo.UpdateTransactionStatus(ctx, transaction.ID, Completed)
+	senderWallet, receiverWallet, err := s.getSenderAndReceiverWalletsWithLockingOrder(ctx, lockRequest)
+	if err != nil {
+		return Transaction{}, err
+	}
+	defer s.walletService.ReleaseGetWalletForUpdateLock(ctx, lockRequest.SenderID)
+	defer s.walletService.ReleaseGetWalletForUpdateLock(ctx, lockRequest.ReceiverID)
 
-	return transaction, err
+	// Read the hold again now that its wallets are locked, since it may have been captured
+	// or released while waiting
+	hold, err = s.getPendingHold(ctx, id)
+	if err != nil {
+		return Transaction{}, err
+	}
+	if !time.Now().Before(*hold.ExpiresAt) {
+		return Transaction{}, utils.NewErrorWithMessage(utils.ErrHoldNotPending, "Hold expired at "+hold.ExpiresAt.Format(time.RFC3339))
+	}
+	_, err = availableInCurrency(receiverWallet, hold.CreditAmount().Currency, "Receiver")
+	if err != nil {
+		return Transaction{}, err
+	}
+	if senderWallet.Status == wallet.Inactive || receiverWallet.Status == wallet.Inactive {
+		return Transaction{}, utils.NewError(utils.ErrWalletInactive)
+	}
+
+	// The amount is still part of the sender's balance, so releasing it and settling the
+	// transfer cannot overdraw the wallet
+	var captured Transaction
+	err = s.unitOfWork.RunInTx(ctx, func(ctx context.Context) error {
+		err := s.walletService.UpdateWalletHeld(ctx, senderWallet.ID, senderWallet.HeldIn(hold.Currency).Sub(hold.Amount))
+		if err != nil {
+			return err
+		}
+		captured, err = s.settleTransaction(ctx, hold, &senderWallet, &receiverWallet)
+		return err
+	})
+	if err != nil {
+		return Transaction{}, err
+	}
+	return captured, nil
+}
+
+// VoidTransaction releases a pending hold, giving the reserved amount back to the sender.
+func (s *transactionService) VoidTransaction(ctx context.Context, id string) (Transaction, error) {
+	return s.releaseHold(ctx, id, Voided)
+}
+
+func (s *transactionService) ExpireHolds(ctx context.Context, now time.Time) (int, error) {
+	holds, err := s.repo.GetExpiredHolds(ctx, now)
+	if err != nil {
+		return 0, err
+	}
+	expired := 0
+	var firstErr error
+	for _, hold := range holds {
+		_, err = s.releaseHold(ctx, hold.ID, Expired)
+		// The hold may have been voided since it was listed
+		if utils.IsError(err, utils.ErrHoldNotPending) {
+			continue
+		}
+		if err != nil {
+			log.Printf("Failed to release expired hold %s: %v", hold.ID, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		expired++
+	}
+	return expired, firstErr
+}
+
+// StartHoldSweeper releases expired holds every interval until stop is closed.
+func (s *transactionService) StartHoldSweeper(interval time.Duration, stop <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				expired, err := s.ExpireHolds(context.Background(), time.Now())
+				if err != nil {
+					log.Printf("Failed to release expired holds: %v", err)
+				}
+				if expired > 0 {
+					log.Printf("Released %d expired holds", expired)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// releaseHold ends a pending hold with the status, giving the reserved amount back to the sender.
+func (s *transactionService) releaseHold(ctx context.Context, id string, status TransactionStatus) (Transaction, error) {
+	hold, err := s.getPendingHold(ctx, id)
+	if err != nil {
+		return Transaction{}, err
+	}
+	senderWallet, err := s.walletService.GetWalletForUpdate(ctx, hold.DebitUserID)
+	if err != nil {
+		return Transaction{}, err
+	}
+	defer s.walletService.ReleaseGetWalletForUpdateLock(ctx, hold.DebitUserID)
+
+	// Captures and releases of the hold all lock the sender's wallet, so the hold cannot
+	// change once it is read again here
+	hold, err = s.getPendingHold(ctx, id)
+	if err != nil {
+		return Transaction{}, err
+	}
+	var released Transaction
+	err = s.unitOfWork.RunInTx(ctx, func(ctx context.Context) error {
+		err := s.walletService.UpdateWalletHeld(ctx, senderWallet.ID, senderWallet.HeldIn(hold.Currency).Sub(hold.Amount))
+		if err != nil {
+			return err
+		}
+		released, err = s.repo.UpdateTransactionStatus(ctx, hold.ID, status)
+		return err
+	})
+	if err != nil {
+		return Transaction{}, err
+	}
+	return released, nil
+}
+
+// getPendingHold returns the hold with the ID, or a HOLD_NOT_PENDING error when the
+// transaction is not a hold or has already been captured or released.
+func (s *transactionService) getPendingHold(ctx context.Context, id string) (Transaction, error) {
+	hold, err := s.repo.GetTransaction(ctx, id)
+	if err != nil {
+		return Transaction{}, err
+	}
+	if !hold.IsHold() {
+		return Transaction{}, utils.NewErrorWithMessage(utils.ErrHoldNotPending, "Transaction is not a hold")
+	}
+	if hold.Status != Pending {
+		return Transaction{}, utils.NewErrorWithMessage(utils.ErrHoldNotPending, "Hold is "+string(hold.Status))
+	}
+	return hold, nil
+}
+
+// Deposit credits a wallet with money coming from outside the system.
+func (s *transactionService) Deposit(ctx context.Context, depositRequest *FundsRequest) (Transaction, error) {
+	walletToCredit, err := s.walletService.GetWalletForUpdate(ctx, depositRequest.UserID)
+	if err != nil {
+		return Transaction{}, err
+	}
+	defer s.walletService.ReleaseGetWalletForUpdateLock(ctx, depositRequest.UserID)
+
+	return s.createFundsTransaction(ctx, depositRequest, Deposit, &walletToCredit)
+}
+
+// Withdraw debits a wallet with money leaving the system.
+func (s *transactionService) Withdraw(ctx context.Context, withdrawalRequest *FundsRequest) (Transaction, error) {
+	walletToDebit, err := s.walletService.GetWalletForUpdate(ctx, withdrawalRequest.UserID)
+	if err != nil {
+		return Transaction{}, err
+	}
+	defer s.walletService.ReleaseGetWalletForUpdateLock(ctx, withdrawalRequest.UserID)
+
+	return s.createFundsTransaction(ctx, withdrawalRequest, Withdrawal, &walletToDebit)
+}
+
+// createFundsTransaction creates a deposit or withdrawal between the locked user wallet
+// and the system counterparty.
+func (s *transactionService) createFundsTransaction(ctx context.Context, fundsRequest *FundsRequest, transactionType TransactionType, userWallet *wallet.Wallet) (Transaction, error) {
+	if fundsRequest.IdempotencyKey != "" {
+		existingTransaction, found, err := s.getTransactionForReplay(ctx, fundsRequest.IdempotencyKey, fundsRequest.Fingerprint())
+		if err != nil || found {
+			return existingTransaction, err
+		}
+	}
+
+	balance, err := availableInCurrency(*userWallet, fundsRequest.Currency, "User")
+	if err != nil {
+		return Transaction{}, err
+	}
+
+	if transactionType == Withdrawal && balance.LessThan(fundsRequest.Amount) {
+		return Transaction{}, utils.NewError(utils.ErrInsufficientBalance)
+	}
+
+	if userWallet.Status == wallet.Inactive {
+		return Transaction{}, utils.NewError(utils.ErrWalletInactive)
+	}
+
+	transaction := Transaction{
+		ID:              utils.GenerateUniqueEntityId(),
+		Amount:          fundsRequest.Amount,
+		Currency:        fundsRequest.Currency,
+		Status:          Pending,
+		TransactionType: transactionType,
+		CreatedAt:       time.Now(),
+		UpdatedAt:       time.Now(),
+		Description:     fundsRequest.Description,
+		PaymentDetails:  fundsRequest.PaymentDetails,
+		IdempotencyKey:  fundsRequest.IdempotencyKey,
+		RequestHash:     fundsRequest.Fingerprint(),
+	}
+	if transactionType == Deposit {
+		transaction.DebitUserID = SystemUserID
+		transaction.CreditUserID = fundsRequest.UserID
+		return s.applyTransaction(ctx, transaction, nil, userWallet)
+	}
+	transaction.DebitUserID = fundsRequest.UserID
+	transaction.CreditUserID = SystemUserID
+	return s.applyTransaction(ctx, transaction, userWallet, nil)
+}
+
+// ReverseTransaction returns all or part of a completed transfer to its sender through a
+// compensating refund transfer linked to the original.
+func (s *transactionService) ReverseTransaction(ctx context.Context, id string, reverseRequest *ReverseRequest) (Transaction, error) {
+	original, err := s.repo.GetTransaction(ctx, id)
+	if err != nil {
+		return Transaction{}, err
+	}
+	if original.TransactionType != Transfer {
+		return Transaction{}, utils.NewErrorWithMessage(utils.ErrTransactionNotReversible, "Only transfers can be reversed")
+	}
+	if original.TargetAmount != nil {
+		return Transaction{}, utils.NewErrorWithMessage(utils.ErrTransactionNotReversible, "Converted transfers cannot be reversed")
+	}
+
+	// The refund flows from the original receiver back to the original sender
+	refundRequest := &TransferRequest{
+		SenderID:    original.CreditUserID,
+		ReceiverID:  original.DebitUserID,
+		Currency:    original.Currency,
+		Description: reverseRequest.Reason,
+	}
+
+	senderWallet, receiverWallet, err := s.getSenderAndReceiverWalletsWithLockingOrder(ctx, refundRequest)
+	if err != nil {
+		return Transaction{}, err
+	}
+	defer s.walletService.ReleaseGetWalletForUpdateLock(ctx, refundRequest.SenderID)
+	defer s.walletService.ReleaseGetWalletForUpdateLock(ctx, refundRequest.ReceiverID)
+
+	// Read the original again now that its wallets are locked, since refunds of the same
+	// transfer take the same locks and may have completed while waiting
+	original, err = s.repo.GetTransaction(ctx, id)
+	if err != nil {
+		return Transaction{}, err
+	}
+	if original.Status != Completed && original.Status != Refunded {
+		return Transaction{}, utils.NewErrorWithMessage(utils.ErrTransactionNotReversible, "Transaction is "+string(original.Status))
+	}
+
+	refunded := utils.NewMoney(0, original.Currency)
+	if original.RefundedAmount != nil {
+		refunded = *original.RefundedAmount
+	}
+	remaining := original.Amount.Sub(refunded)
+	amount := remaining
+	if !reverseRequest.Amount.IsZero() {
+		amount, err = reverseRequest.Amount.WithCurrency(original.Currency)
+		if err != nil {
+			return Transaction{}, err
+		}
+	}
+	if remaining.LessThan(amount) {
+		return Transaction{}, utils.NewError(utils.ErrRefundExceedsRemaining)
+	}
+
+	senderBalance, err := availableInCurrency(senderWallet, original.Currency, "Receiver of the original transaction")
+	if err != nil {
+		return Transaction{}, err
+	}
+	if senderBalance.LessThan(amount) {
+		return Transaction{}, utils.NewErrorWithMessage(utils.ErrInsufficientBalance, "Receiver of the original transaction has insufficient balance for the refund")
+	}
+
+	if senderWallet.Status == wallet.Inactive || receiverWallet.Status == wallet.Inactive {
+		return Transaction{}, utils.NewError(utils.ErrWalletInactive)
+	}
+
+	refund := Transaction{
+		ID:                    utils.GenerateUniqueEntityId(),
+		DebitUserID:           refundRequest.SenderID,
+		CreditUserID:          refundRequest.ReceiverID,
+		Amount:                amount,
+		Currency:              original.Currency,
+		Status:                Pending,
+		TransactionType:       Refund,
+		CreatedAt:             time.Now(),
+		UpdatedAt:             time.Now(),
+		Description:           reverseRequest.Reason,
+		OriginalTransactionID: original.ID,
+	}
+	// The refund and the original's refunded amount are saved together, so a failed
+	// refund never counts against the amount left to refund
+	var posted Transaction
+	err = s.unitOfWork.RunInTx(ctx, func(ctx context.Context) error {
+		posted, err = s.postTransaction(ctx, refund, &senderWallet, &receiverWallet)
+		if err != nil {
+			return err
+		}
+		refunded, err = refunded.CheckedAdd(amount)
+		if err != nil {
+			return err
+		}
+		original.RefundedAmount = &refunded
+		original.Status = Refunded
+		if refunded == original.Amount {
+			original.Status = Reversed
+		}
+		_, err = s.repo.UpdateTransaction(ctx, original)
+		return err
+	})
+	if err != nil {
+		s.recordFailedTransaction(ctx, refund, err)
+		return Transaction{}, err
+	}
+	return posted, nil
+}
+
+// applyTransaction posts the transaction in its own unit of work, keeping a failed record of
+// it when the unit of work rolls back.
+func (s *transactionService) applyTransaction(ctx context.Context, transaction Transaction, debitWallet *wallet.Wallet, creditWallet *wallet.Wallet) (Transaction, error) {
+	var posted Transaction
+	err := s.unitOfWork.RunInTx(ctx, func(ctx context.Context) error {
+		var err error
+		posted, err = s.postTransaction(ctx, transaction, debitWallet, creditWallet)
+		return err
+	})
+	if err != nil {
+		s.recordFailedTransaction(ctx, transaction, err)
+		return Transaction{}, err
+	}
+	return posted, nil
+}
+
+// postTransaction records the transaction and settles it. It must run in a unit of work, so
+// that the writes are undone together when any of them fails, and the wallets must already
+// be locked and checked for sufficient balance.
+func (s *transactionService) postTransaction(ctx context.Context, transaction Transaction, debitWallet *wallet.Wallet, creditWallet *wallet.Wallet) (Transaction, error) {
+	transaction, err := s.createTransaction(ctx, transaction)
+	if err != nil {
+		return Transaction{}, err
+	}
+	return s.settleTransaction(ctx, transaction, debitWallet, creditWallet)
+}
+
+// createTransaction records the transaction with a TransferCreated event, in the unit of work in ctx.
+func (s *transactionService) createTransaction(ctx context.Context, transaction Transaction) (Transaction, error) {
+	transaction, err := s.repo.CreateTransaction(ctx, transaction)
+	if err != nil {
+		return Transaction{}, err
+	}
+	// A quote is good for one transaction only, and a concurrent transfer may have used it
+	// since it was checked
+	if transaction.QuoteID != "" {
+		err = s.fxService.UseQuote(ctx, transaction.QuoteID, transaction.ID)
+		if err != nil {
+			return Transaction{}, err
+		}
+	}
+	err = s.recordEvent(ctx, events.TransferCreated, transaction, nil)
+	if err != nil {
+		return Transaction{}, err
+	}
+	return transaction, nil
+}
+
+// completeTransaction marks the transaction completed, and settled now, with a TransferCompleted event, in the
+// unit of work in ctx.
+func (s *transactionService) completeTransaction(ctx context.Context, id string) (Transaction, error) {
+	transaction, err := s.repo.SettleTransaction(ctx, id, time.Now())
+	if err != nil {
+		return Transaction{}, err
+	}
+	err = s.recordEvent(ctx, events.TransferCompleted, transaction, nil)
+	if err != nil {
+		return Transaction{}, err
+	}
+	return transaction, nil
+}
+
+// recordEvent adds a transfer event about the transaction to the outbox. cause is the error
+// a failed transaction failed with.
+func (s *transactionService) recordEvent(ctx context.Context, eventType events.EventType, transaction Transaction, cause error) error {
+	payload := events.TransferPayload{
+		TransactionID:       transaction.ID,
+		TransactionType:     string(transaction.TransactionType),
+		Status:              string(transaction.Status),
+		DebitUserID:         transaction.DebitUserID,
+		CreditUserID:        transaction.CreditUserID,
+		Amount:              transaction.Amount,
+		Currency:            transaction.Currency,
+		ParentTransactionID: transaction.ParentTransactionID,
+	}
+	if causeErr, ok := cause.(*utils.Error); ok {
+		payload.ErrorCode = string(causeErr.Code)
+	}
+	return s.eventService.Record(ctx, eventType, transaction.ID, payload)
+}
+
+// settleTransaction moves the recorded transaction's amount from the debit wallet to the
+// credit wallet, posting the matching ledger entry, and completes it. A nil wallet stands for
+// the system counterparty, whose side is only posted to the ledger.
+func (s *transactionService) settleTransaction(ctx context.Context, transaction Transaction, debitWallet *wallet.Wallet, creditWallet *wallet.Wallet) (Transaction, error) {
+	return s.settleTransactionWith(ctx, transaction, debitWallet, creditWallet, s.updateWalletBalance)
+}
+
+// balanceWriter replaces the balance of the wallet in newBalance's currency.
+type balanceWriter func(ctx context.Context, w *wallet.Wallet, newBalance utils.Money) error
+
+// updateWalletBalance writes the balance of a wallet locked for the whole flow.
+func (s *transactionService) updateWalletBalance(ctx context.Context, w *wallet.Wallet, newBalance utils.Money) error {
+	return s.walletService.UpdateWalletBalance(ctx, w.ID, newBalance)
+}
+
+// swapWalletBalance writes the balance only if the wallet is still at the version it was read at.
+func (s *transactionService) swapWalletBalance(ctx context.Context, w *wallet.Wallet, newBalance utils.Money) error {
+	return s.walletService.CompareAndSwapWalletBalance(ctx, w.ID, w.Version, newBalance)
+}
+
+// settleTransactionWith settles the transaction like settleTransaction, writing the balances
+// with writeBalance.
+func (s *transactionService) settleTransactionWith(ctx context.Context, transaction Transaction, debitWallet *wallet.Wallet, creditWallet *wallet.Wallet, writeBalance balanceWriter) (Transaction, error) {
+	var err error
+	debitAmount, creditAmount := transaction.Amount, transaction.CreditAmount()
+
+	debitAccountID, creditAccountID := ledger.ExternalFundsAccountID, ledger.ExternalFundsAccountID
+	if debitWallet != nil {
+		debitAccountID = ledger.WalletAccountID(debitWallet.ID)
+		debitBalance, _ := debitWallet.BalanceIn(debitAmount.Currency)
+		debitBalance, err = debitBalance.CheckedSub(debitAmount)
+		if err != nil {
+			return Transaction{}, err
+		}
+		err = writeBalance(ctx, debitWallet, debitBalance)
+		if err != nil {
+			return Transaction{}, err
+		}
+	}
+
+	if creditWallet != nil {
+		creditAccountID = ledger.WalletAccountID(creditWallet.ID)
+		creditBalance, _ := creditWallet.BalanceIn(creditAmount.Currency)
+		// A credit is the one write that can grow a balance past what an amount can hold
+		creditBalance, err = creditBalance.CheckedAdd(creditAmount)
+		if err != nil {
+			return Transaction{}, err
+		}
+		err = writeBalance(ctx, creditWallet, creditBalance)
+		if err != nil {
+			return Transaction{}, err
+		}
+	}
+
+	if debitAmount.Currency == creditAmount.Currency {
+		_, err = s.ledgerService.RecordTransfer(ctx, transaction.ID, debitAccountID, creditAccountID, debitAmount, transaction.Description)
+	} else {
+		_, err = s.ledgerService.RecordConversion(ctx, transaction.ID, debitAccountID, creditAccountID, debitAmount, creditAmount, transaction.Description)
+	}
+	if err != nil {
+		return Transaction{}, err
+	}
+
+	return s.completeTransaction(ctx, transaction.ID)
+}
+
+// recordFailedTransaction keeps a failed attempt in the history once its unit of work has
+// rolled back, with a TransferFailed event carrying the code of cause. It keeps the
+// idempotency key, so retries with the key replay the failure; when the key belongs to
+// another transaction neither the record nor the event is saved.
+func (s *transactionService) recordFailedTransaction(ctx context.Context, transaction Transaction, cause error) {
+	transaction.Status = Failed
+	transaction.UpdatedAt = time.Now()
+	s.unitOfWork.RunInTx(ctx, func(ctx context.Context) error {
+		failed, err := s.repo.CreateTransaction(ctx, transaction)
+		if err != nil {
+			return err
+		}
+		return s.recordEvent(ctx, events.TransferFailed, failed, cause)
+	})
+}
+
+// availableInCurrency returns the wallet's balance in the currency less what holds reserve,
+// or a CURRENCY_MISMATCH error naming the party (sender, receiver...) when the wallet does
+// not hold the currency.
+func availableInCurrency(w wallet.Wallet, currency utils.Currency, party string) (utils.Money, error) {
+	balance, ok := w.AvailableIn(currency)
+	if !ok {
+		return utils.Money{}, utils.NewErrorWithMessage(utils.ErrCurrencyMismatch, party+" wallet does not hold "+string(currency))
+	}
+	return balance, nil
+}
+
+// getTransactionForReplay returns the transaction previously created with the idempotency
+// key, provided it came from a request with the same fingerprint. found is false when the
+// key has not been used yet.
+func (s *transactionService) getTransactionForReplay(ctx context.Context, idempotencyKey string, requestHash string) (transaction Transaction, found bool, err error) {
+	transaction, err = s.repo.GetTransactionByIdempotencyKey(ctx, idempotencyKey)
+	if utils.IsError(err, utils.ErrTransactionNotFound) {
+		return Transaction{}, false, nil
+	}
+	if err != nil {
+		return Transaction{}, false, err
+	}
+	if transaction.RequestHash != requestHash {
+		return Transaction{}, false, utils.NewError(utils.ErrIdempotencyKeyReused)
+	}
+	return transaction, true, nil
 }
 
 func (s *transactionService) GetTransaction(ctx context.Context, id string) (Transaction, error) {
 	return s.repo.GetTransaction(ctx, id)
 }
 
-func (s *transactionService) GetTransactionsByUserID(ctx context.Context, userID string) ([]Transaction, error) {
-	return s.repo.GetTransactionsByUserID(ctx, userID)
+func (s *transactionService) GetTransactionHistory(ctx context.Context, userID string, query HistoryQuery) (HistoryPage, error) {
+	return s.repo.GetTransactionHistory(ctx, userID, query)
 }
 
 func (s *transactionService) GetAllTransactions(ctx context.Context) ([]Transaction, error) {
@@ -114,9 +903,14 @@ func (s *transactionService) GetAllTransactions(ctx context.Context) ([]Transact
 
 var transactionServiceInstance *transactionService
 
-func NewTransactionService(repo TransactionRepo, walletService wallet.WalletService) TransactionService {
+func NewTransactionService(repo TransactionRepo, walletService wallet.WalletService, ledgerService ledger.LedgerService, fxService fx.FXService, limitsService limits.LimitsService, eventService events.EventService, unitOfWork storage.UnitOfWork, holdTTL time.Duration, locking LockingStrategy) TransactionService {
 	if transactionServiceInstance == nil {
-		transactionServiceInstance = &transactionService{repo: repo, walletService: walletService}
+		transactionServiceInstance = &transactionService{repo: repo, walletService: walletService, ledgerService: ledgerService, fxService: fxService, limitsService: limitsService, eventService: eventService, unitOfWork: unitOfWork, holdTTL: holdTTL, locking: locking}
 	}
 	return transactionServiceInstance
 }
+
+// SetLockingStrategy is just used for testing purposes
+func SetLockingStrategy(locking LockingStrategy) {
+	transactionServiceInstance.locking = locking
+}
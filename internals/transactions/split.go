@@ -0,0 +1,112 @@
+package transactions
+
+import (
+	"context"
+	"time"
+
+	"concurrent_money_transfer_system/internals/wallet"
+	"concurrent_money_transfer_system/utils"
+)
+
+// CreateSplitTransfer makes every leg of the split in one unit of work while the wallets of
+// all its parties stay locked, recording the legs as transfers under a split parent. When any
+// leg fails, e.g. because a sender runs out of balance halfway, none of them is kept and the
+// parent is recorded as failed.
+func (s *transactionService) CreateSplitTransfer(ctx context.Context, splitRequest *SplitTransferRequest) (SplitTransfer, error) {
+	if (splitRequest.SenderID == "") == (splitRequest.ReceiverID == "") {
+		return SplitTransfer{}, utils.NewErrorWithMessage(utils.ErrValidationError, "Exactly one of SenderID and ReceiverID must be set")
+	}
+	party := splitRequest.SenderID + splitRequest.ReceiverID // The one that is set
+	userIDs := []string{party}
+	total := utils.NewMoney(0, splitRequest.Currency)
+	for _, leg := range splitRequest.Legs {
+		if leg.UserID == party {
+			return SplitTransfer{}, utils.NewError(utils.ErrTransactionSameUser)
+		}
+		userIDs = append(userIDs, leg.UserID)
+		var err error
+		total, err = total.CheckedAdd(leg.Amount)
+		if err != nil {
+			return SplitTransfer{}, err
+		}
+	}
+
+	wallets, err := s.getWalletsWithLockingOrder(ctx, userIDs)
+	if err != nil {
+		return SplitTransfer{}, err
+	}
+	defer s.releaseWallets(ctx, wallets)
+
+	if splitRequest.IdempotencyKey != "" {
+		existingTransaction, found, err := s.getTransactionForReplay(ctx, splitRequest.IdempotencyKey, splitRequest.Fingerprint())
+		if err != nil {
+			return SplitTransfer{}, err
+		}
+		if found {
+			return s.getSplitTransfer(ctx, existingTransaction)
+		}
+	}
+
+	parent := Transaction{
+		ID:              utils.GenerateUniqueEntityId(),
+		DebitUserID:     splitRequest.SenderID,
+		CreditUserID:    splitRequest.ReceiverID,
+		Amount:          total,
+		Currency:        splitRequest.Currency,
+		Status:          Pending,
+		TransactionType: Split,
+		CreatedAt:       time.Now(),
+		UpdatedAt:       time.Now(),
+		Description:     splitRequest.Description,
+		IdempotencyKey:  splitRequest.IdempotencyKey,
+		RequestHash:     splitRequest.Fingerprint(),
+	}
+	postLeg := func(ctx context.Context, leg Transaction, debitWallet *wallet.Wallet, creditWallet *wallet.Wallet) (Transaction, error) {
+		leg.ParentTransactionID = parent.ID
+		return s.postTransaction(ctx, leg, debitWallet, creditWallet)
+	}
+	legRequests := splitRequest.legRequests()
+	split := SplitTransfer{Legs: make([]Transaction, 0, len(legRequests))}
+	err = s.unitOfWork.RunInTx(ctx, func(ctx context.Context) error {
+		_, err := s.createTransaction(ctx, parent)
+		if err != nil {
+			return err
+		}
+		// Each leg is checked against the balances left by the previous ones, and counts
+		// towards its sender's limits like any other transfer
+		for i := range legRequests {
+			leg, err := s.makeLockedTransfer(ctx, &legRequests[i], wallets, postLeg)
+			if err != nil {
+				return err
+			}
+			split.Legs = append(split.Legs, leg)
+		}
+		split.Transaction, err = s.completeTransaction(ctx, parent.ID)
+		return err
+	})
+	if err != nil {
+		s.recordFailedTransaction(ctx, parent, err)
+		return SplitTransfer{}, err
+	}
+	return split, nil
+}
+
+// GetSplitTransfer returns the split with the ID and its legs.
+func (s *transactionService) GetSplitTransfer(ctx context.Context, id string) (SplitTransfer, error) {
+	parent, err := s.repo.GetTransaction(ctx, id)
+	if err != nil {
+		return SplitTransfer{}, err
+	}
+	if parent.TransactionType != Split {
+		return SplitTransfer{}, utils.NewErrorWithMessage(utils.ErrTransactionNotFound, "Transaction is not a split")
+	}
+	return s.getSplitTransfer(ctx, parent)
+}
+
+func (s *transactionService) getSplitTransfer(ctx context.Context, parent Transaction) (SplitTransfer, error) {
+	legs, err := s.repo.GetTransactionsByParentID(ctx, parent.ID)
+	if err != nil {
+		return SplitTransfer{}, err
+	}
+	return SplitTransfer{Transaction: parent, Legs: legs}, nil
+}
@@ -0,0 +1,257 @@
+package transactions
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"concurrent_money_transfer_system/internals/storage"
+	"concurrent_money_transfer_system/utils"
+)
+
+// sqlTransactionRepo keeps transactions in the transactions table. Amounts are stored in
+// minor units; the unique idempotency_key column makes claiming a key atomic.
+type sqlTransactionRepo struct {
+	db *sql.DB
+}
+
+// NewSQLTransactionRepo returns a TransactionRepo backed by db, whose schema is created by storage.Migrate.
+func NewSQLTransactionRepo(db *sql.DB) TransactionRepo {
+	return &sqlTransactionRepo{db: db}
+}
+
+const transactionColumns = `id, debit_user_id, credit_user_id, amount, currency, status, transaction_type,
+	description, payment_details, idempotency_key, request_hash, original_transaction_id, refunded_amount,
+	quote_id, target_amount, target_currency, fx_rate, expires_at, parent_transaction_id, created_at, updated_at, settled_at`
+
+func scanTransaction(row storage.Scanner) (Transaction, error) {
+	var transaction Transaction
+	var idempotencyKey sql.NullString
+	var refundedAmount, targetAmount sql.NullInt64
+	var expiresAt, settledAt sql.NullTime
+	err := row.Scan(&transaction.ID, &transaction.DebitUserID, &transaction.CreditUserID, &transaction.Amount.MinorUnits,
+		&transaction.Currency, &transaction.Status, &transaction.TransactionType, &transaction.Description,
+		&transaction.PaymentDetails, &idempotencyKey, &transaction.RequestHash, &transaction.OriginalTransactionID,
+		&refundedAmount, &transaction.QuoteID, &targetAmount, &transaction.TargetCurrency, &transaction.FXRate,
+		&expiresAt, &transaction.ParentTransactionID, &transaction.CreatedAt, &transaction.UpdatedAt, &settledAt)
+	if err != nil {
+		return Transaction{}, err
+	}
+	transaction.Amount.Currency = transaction.Currency
+	transaction.IdempotencyKey = idempotencyKey.String
+	if refundedAmount.Valid {
+		refunded := utils.NewMoney(refundedAmount.Int64, transaction.Currency)
+		transaction.RefundedAmount = &refunded
+	}
+	if targetAmount.Valid {
+		target := utils.NewMoney(targetAmount.Int64, transaction.TargetCurrency)
+		transaction.TargetAmount = &target
+	}
+	if expiresAt.Valid {
+		transaction.ExpiresAt = &expiresAt.Time
+	}
+	if settledAt.Valid {
+		transaction.SettledAt = &settledAt.Time
+	}
+	return transaction, nil
+}
+
+// nullableAmount stores a missing amount as NULL.
+func nullableAmount(amount *utils.Money) sql.NullInt64 {
+	if amount == nil {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: amount.MinorUnits, Valid: true}
+}
+
+func (r *sqlTransactionRepo) CreateTransaction(ctx context.Context, transaction Transaction) (Transaction, error) {
+	if transaction.ID == "" {
+		transaction.ID = utils.GenerateUniqueEntityId()
+	}
+	// Transactions without a key store NULL, which the unique constraint ignores
+	idempotencyKey := sql.NullString{String: transaction.IdempotencyKey, Valid: transaction.IdempotencyKey != ""}
+	_, err := storage.Conn(ctx, r.db).ExecContext(ctx, `INSERT INTO transactions (`+transactionColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22)`,
+		transaction.ID, transaction.DebitUserID, transaction.CreditUserID, transaction.Amount.MinorUnits, transaction.Currency,
+		transaction.Status, transaction.TransactionType, transaction.Description, transaction.PaymentDetails, idempotencyKey,
+		transaction.RequestHash, transaction.OriginalTransactionID, nullableAmount(transaction.RefundedAmount),
+		transaction.QuoteID, nullableAmount(transaction.TargetAmount), transaction.TargetCurrency, transaction.FXRate,
+		transaction.ExpiresAt, transaction.ParentTransactionID, transaction.CreatedAt, transaction.UpdatedAt, transaction.SettledAt)
+	if storage.IsUniqueViolation(err) && transaction.IdempotencyKey != "" {
+		return Transaction{}, utils.NewError(utils.ErrIdempotencyKeyReused)
+	}
+	if err != nil {
+		return Transaction{}, storage.DatabaseError(err)
+	}
+	return transaction, nil
+}
+
+func (r *sqlTransactionRepo) getTransactionWhere(ctx context.Context, condition string, arg any) (Transaction, error) {
+	row := storage.Conn(ctx, r.db).QueryRowContext(ctx, `SELECT `+transactionColumns+` FROM transactions WHERE `+condition, arg)
+	transaction, err := scanTransaction(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Transaction{}, utils.NewError(utils.ErrTransactionNotFound)
+	}
+	if err != nil {
+		return Transaction{}, storage.DatabaseError(err)
+	}
+	return transaction, nil
+}
+
+func (r *sqlTransactionRepo) GetTransaction(ctx context.Context, id string) (Transaction, error) {
+	return r.getTransactionWhere(ctx, `id = $1`, id)
+}
+
+func (r *sqlTransactionRepo) GetTransactionByIdempotencyKey(ctx context.Context, key string) (Transaction, error) {
+	return r.getTransactionWhere(ctx, `idempotency_key = $1`, key)
+}
+
+func (r *sqlTransactionRepo) UpdateTransactionStatus(ctx context.Context, id string, status TransactionStatus) (Transaction, error) {
+	result, err := storage.Conn(ctx, r.db).ExecContext(ctx, `UPDATE transactions SET status = $2, updated_at = $3 WHERE id = $1`, id, status, time.Now())
+	if err != nil {
+		return Transaction{}, storage.DatabaseError(err)
+	}
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		return Transaction{}, utils.NewError(utils.ErrTransactionNotFound)
+	}
+	return r.GetTransaction(ctx, id)
+}
+
+func (r *sqlTransactionRepo) SettleTransaction(ctx context.Context, id string, settledAt time.Time) (Transaction, error) {
+	result, err := storage.Conn(ctx, r.db).ExecContext(ctx, `UPDATE transactions SET status = $2, settled_at = $3, updated_at = $3 WHERE id = $1`, id, Completed, settledAt)
+	if err != nil {
+		return Transaction{}, storage.DatabaseError(err)
+	}
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		return Transaction{}, utils.NewError(utils.ErrTransactionNotFound)
+	}
+	return r.GetTransaction(ctx, id)
+}
+
+// UpdateTransaction saves the fields that change after a transaction is created.
+func (r *sqlTransactionRepo) UpdateTransaction(ctx context.Context, transaction Transaction) (Transaction, error) {
+	transaction.UpdatedAt = time.Now()
+	result, err := storage.Conn(ctx, r.db).ExecContext(ctx, `UPDATE transactions
+		SET status = $2, description = $3, payment_details = $4, refunded_amount = $5, updated_at = $6
+		WHERE id = $1`,
+		transaction.ID, transaction.Status, transaction.Description, transaction.PaymentDetails,
+		nullableAmount(transaction.RefundedAmount), transaction.UpdatedAt)
+	if err != nil {
+		return Transaction{}, storage.DatabaseError(err)
+	}
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		return Transaction{}, utils.NewError(utils.ErrTransactionNotFound)
+	}
+	return transaction, nil
+}
+
+func (r *sqlTransactionRepo) GetTransactionsByUserID(ctx context.Context, userID string) ([]Transaction, error) {
+	return r.queryTransactions(ctx, `SELECT `+transactionColumns+` FROM transactions
+		WHERE debit_user_id = $1 OR credit_user_id = $1 ORDER BY created_at, id`, userID)
+}
+
+func (r *sqlTransactionRepo) GetTransactionHistory(ctx context.Context, userID string, query HistoryQuery) (HistoryPage, error) {
+	args := []any{userID}
+	arg := func(value any) string {
+		args = append(args, value)
+		return "$" + strconv.Itoa(len(args))
+	}
+	conditions := []string{"(debit_user_id = $1 OR credit_user_id = $1)"}
+	where := func(condition string) {
+		conditions = append(conditions, condition)
+	}
+	switch query.Direction {
+	case Sent:
+		conditions[0] = "debit_user_id = $1"
+	case Received:
+		conditions[0] = "credit_user_id = $1"
+	}
+	if query.Status != "" {
+		where("status = " + arg(query.Status))
+	}
+	if query.TransactionType != "" {
+		where("transaction_type = " + arg(query.TransactionType))
+	}
+	if query.CounterpartyID != "" {
+		counterparty := arg(query.CounterpartyID)
+		where("((debit_user_id = $1 AND credit_user_id = " + counterparty + ") OR (credit_user_id = $1 AND debit_user_id = " + counterparty + "))")
+	}
+	if query.Currency != "" {
+		where("currency = " + arg(query.Currency))
+	}
+	if query.MinAmount != nil {
+		where("amount >= " + arg(query.MinAmount.MinorUnits))
+	}
+	if query.MaxAmount != nil {
+		where("amount <= " + arg(query.MaxAmount.MinorUnits))
+	}
+	if query.From != nil {
+		where("created_at >= " + arg(*query.From))
+	}
+	if query.To != nil {
+		where("created_at < " + arg(*query.To))
+	}
+	order, after := "ASC", ">"
+	if query.Order == Descending {
+		order, after = "DESC", "<"
+	}
+	if query.After != nil {
+		createdAt, id := arg(query.After.CreatedAt), arg(query.After.ID)
+		where("(created_at " + after + " " + createdAt + " OR (created_at = " + createdAt + " AND id " + after + " " + id + "))")
+	}
+	// One more than the limit tells whether another page follows
+	transactions, err := r.queryTransactions(ctx, `SELECT `+transactionColumns+` FROM transactions
+		WHERE `+strings.Join(conditions, " AND ")+` ORDER BY created_at `+order+`, id `+order+` LIMIT `+arg(query.Limit+1), args...)
+	if err != nil {
+		return HistoryPage{}, err
+	}
+	return newHistoryPage(transactions, query.Limit), nil
+}
+
+func (r *sqlTransactionRepo) GetTransactionsByParentID(ctx context.Context, parentID string) ([]Transaction, error) {
+	return r.queryTransactions(ctx, `SELECT `+transactionColumns+` FROM transactions
+		WHERE parent_transaction_id = $1 ORDER BY created_at, id`, parentID)
+}
+
+func (r *sqlTransactionRepo) GetAllTransactions(ctx context.Context) ([]Transaction, error) {
+	return r.queryTransactions(ctx, `SELECT `+transactionColumns+` FROM transactions ORDER BY created_at, id`)
+}
+
+func (r *sqlTransactionRepo) GetOutgoingTransferTotal(ctx context.Context, userID string, currency utils.Currency, since time.Time) (utils.Money, error) {
+	var total int64
+	err := storage.Conn(ctx, r.db).QueryRowContext(ctx, `SELECT COALESCE(SUM(amount), 0) FROM transactions
+		WHERE debit_user_id = $1 AND currency = $2 AND transaction_type = $3 AND status IN ($4, $5, $6, $7) AND created_at >= $8`,
+		userID, currency, Transfer, Pending, Completed, Refunded, Reversed, since).Scan(&total)
+	if err != nil {
+		return utils.Money{}, storage.DatabaseError(err)
+	}
+	return utils.NewMoney(total, currency), nil
+}
+
+func (r *sqlTransactionRepo) GetExpiredHolds(ctx context.Context, now time.Time) ([]Transaction, error) {
+	return r.queryTransactions(ctx, `SELECT `+transactionColumns+` FROM transactions
+		WHERE status = $1 AND expires_at <= $2 ORDER BY expires_at, id`, Pending, now)
+}
+
+func (r *sqlTransactionRepo) queryTransactions(ctx context.Context, query string, args ...any) ([]Transaction, error) {
+	rows, err := storage.Conn(ctx, r.db).QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, storage.DatabaseError(err)
+	}
+	defer rows.Close()
+	transactions := make([]Transaction, 0)
+	for rows.Next() {
+		transaction, err := scanTransaction(rows)
+		if err != nil {
+			return nil, storage.DatabaseError(err)
+		}
+		transactions = append(transactions, transaction)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, storage.DatabaseError(err)
+	}
+	return transactions, nil
+}
@@ -5,6 +5,7 @@ import (
 
 	"github.com/gin-gonic/gin"
 
+	"concurrent_money_transfer_system/internals/authz"
 	"concurrent_money_transfer_system/utils"
 )
 
@@ -35,6 +36,11 @@ func (uc *UserController) GetUser(c *gin.Context) {
 		utils.ResponseError(c, utils.NewErrorWithMessage(utils.ErrInvalidRequest, "User ID is required"))
 		return
 	}
+	err := authz.AuthorizeOwner(c.Request.Context(), id, authz.RoleSupport, authz.RoleAdmin)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
 
 	user, err := uc.userService.GetUser(c.Request.Context(), id)
 	if err != nil {
@@ -52,6 +58,11 @@ func (uc *UserController) UpdateUser(c *gin.Context) {
 		utils.ResponseError(c, err)
 		return
 	}
+	err = authz.AuthorizeOwner(c.Request.Context(), user.ID, authz.RoleAdmin)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
 
 	updatedUser, err := uc.userService.UpdateUser(c.Request.Context(), user)
 	if err != nil {
@@ -63,6 +74,12 @@ func (uc *UserController) UpdateUser(c *gin.Context) {
 }
 
 func (uc *UserController) GetAllUsers(c *gin.Context) {
+	err := authz.AuthorizeRole(c.Request.Context(), authz.RoleSupport, authz.RoleAdmin)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+
 	users, err := uc.userService.GetAllUsers(c.Request.Context())
 	if err != nil {
 		utils.ResponseError(c, err)
@@ -78,8 +95,13 @@ func (uc *UserController) DeleteUser(c *gin.Context) {
 		utils.ResponseError(c, utils.NewErrorWithMessage(utils.ErrInvalidRequest, "User ID is required"))
 		return
 	}
+	err := authz.AuthorizeOwner(c.Request.Context(), id, authz.RoleAdmin)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
 
-	err := uc.userService.DeleteUser(c.Request.Context(), id)
+	err = uc.userService.DeleteUser(c.Request.Context(), id)
 	if err != nil {
 		utils.ResponseError(c, err)
 		return
@@ -88,6 +110,33 @@ func (uc *UserController) DeleteUser(c *gin.Context) {
 	utils.ResponseSuccess(c, gin.H{"message": "User deleted successfully"})
 }
 
+func (uc *UserController) SetRole(c *gin.Context) {
+	id := c.Param("id")
+	if id == "" {
+		utils.ResponseError(c, utils.NewErrorWithMessage(utils.ErrInvalidRequest, "User ID is required"))
+		return
+	}
+	var roleRequest RoleRequest
+	err := utils.BindAndValidateRequest(c, &roleRequest)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+	err = authz.AuthorizeRole(c.Request.Context(), authz.RoleAdmin)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+
+	user, err := uc.userService.SetRole(c.Request.Context(), id, roleRequest.Role)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+
+	utils.ResponseSuccess(c, user)
+}
+
 func NewUserController(userService UserService) *UserController {
 	return &UserController{userService: userService}
 }
@@ -1,6 +1,7 @@
 package users
 
 import (
+	"concurrent_money_transfer_system/internals/authz"
 	"concurrent_money_transfer_system/internals/wallet"
 	"time"
 )
@@ -12,8 +13,21 @@ type User struct {
 	LastName    string     `json:"last_name,omitempty"`
 	PhoneNumber string     `json:"phone_number" validate:"required,e164"`
 	Email       string     `json:"email" validate:"required,email"`
-	Password    string     `json:"password,omitempty" validate:"required,min=4"`
+	Password    string     `json:"password,omitempty" validate:"required,min=4,max=72"`
+	Role        authz.Role `json:"role"` // Only changed through SetRole, never by signing up or updating
 	CreatedAt   time.Time  `json:"created_at"`
 	UpdatedAt   time.Time  `json:"updated_at"`
 	DeletedAt   *time.Time `json:"-"`
 }
+
+// RoleOrDefault returns the user's role, which is RoleUser for users created before roles existed.
+func (u User) RoleOrDefault() authz.Role {
+	if u.Role == "" {
+		return authz.RoleUser
+	}
+	return u.Role
+}
+
+type RoleRequest struct {
+	Role authz.Role `json:"role" validate:"required"`
+}
@@ -0,0 +1,21 @@
+package users
+
+import (
+	"golang.org/x/crypto/bcrypt"
+
+	"concurrent_money_transfer_system/utils"
+)
+
+// HashPassword returns the bcrypt hash of a password. Only the hash is ever stored.
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", utils.NewErrorWithMessage(utils.ErrInternalServerError, "Failed to hash password: "+err.Error())
+	}
+	return string(hash), nil
+}
+
+// CheckPassword reports whether password is the one hashed by HashPassword.
+func CheckPassword(hash string, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
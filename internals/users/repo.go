@@ -1,14 +1,20 @@
 package users
 
 import (
+	"concurrent_money_transfer_system/internals/storage"
 	"concurrent_money_transfer_system/utils"
+	"context"
 	"sync"
 	"time"
 )
 
+// userRecord is the WAL record kind holding a user's post-image
+const userRecord = "user"
+
 type UserRepo interface {
 	CreateUser(user User) (User, error)
 	GetUser(id string) (User, error)
+	GetUserByEmail(email string) (User, error)
 	UpdateUser(user User) (User, error)
 	DeleteUser(id string) error
 	GetAllUsers() ([]User, error)
@@ -16,6 +22,7 @@ type UserRepo interface {
 
 type userRepo struct {
 	users sync.Map
+	wal   *storage.WAL // Writes are logged here first when set
 }
 
 func (r *userRepo) CreateUser(user User) (User, error) {
@@ -25,8 +32,11 @@ func (r *userRepo) CreateUser(user User) (User, error) {
 	if _, ok := r.users.Load(user.ID); ok {
 		return User{}, utils.NewError(utils.ErrUserAlreadyExists)
 	}
-	r.users.Store(user.ID, user)
-	return user, nil	
+	err := r.wal.Log(context.Background(), userRecord, user, func() { r.users.Store(user.ID, user) })
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
 }
 
 // TODO: Handle error if user not found
@@ -46,7 +56,10 @@ func (r *userRepo) UpdateUser(user User) (User, error) {
 	if err != nil {
 		return User{}, err
 	}
-	r.users.Store(user.ID, user)
+	err = r.wal.Log(context.Background(), userRecord, user, func() { r.users.Store(user.ID, user) })
+	if err != nil {
+		return User{}, err
+	}
 	return user, nil
 }
 
@@ -60,7 +73,10 @@ func (r *userRepo) DeleteUser(id string) error {
 
 	u := user.(User)
 	u.DeletedAt = &deletedAt
-	r.users.Store(id, u)
+	err := r.wal.Log(context.Background(), userRecord, u, func() { r.users.Store(id, u) })
+	if err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -69,7 +85,7 @@ func (r *userRepo) GetUserByEmail(email string) (User, error) {
 	var found bool
 	
 	r.users.Range(func(key, value interface{}) bool {
-		if user, ok := value.(User); ok && user.Email == email {
+		if user, ok := value.(User); ok && user.Email == email && user.DeletedAt == nil {
 			foundUser = user
 			found = true
 			return false // Stop iteration
@@ -96,6 +112,35 @@ func (r *userRepo) GetAllUsers() ([]User, error) {
 }
 
 
+func (r *userRepo) SetWAL(wal *storage.WAL) {
+	r.wal = wal
+}
+
+func (r *userRepo) ApplyRecord(record storage.Record) (bool, error) {
+	if record.Kind != userRecord {
+		return false, nil
+	}
+	var user User
+	err := record.Decode(&user)
+	if err != nil {
+		return true, err
+	}
+	r.users.Store(user.ID, user)
+	return true, nil
+}
+
+func (r *userRepo) SnapshotRecords() ([]storage.Record, error) {
+	records := make([]storage.Record, 0)
+	var err error
+	r.users.Range(func(key, value any) bool {
+		var record storage.Record
+		record, err = storage.NewRecord(userRecord, value.(User))
+		records = append(records, record)
+		return err == nil
+	})
+	return records, err
+}
+
 var userRepoInstance *userRepo
 
 func NewUserRepo() UserRepo {
@@ -106,3 +151,11 @@ func NewUserRepo() UserRepo {
 	}
 	return userRepoInstance
 }
+
+// Reset is just used for testing purposes
+func Reset() {
+	userRepoInstance.users.Range(func(key, value any) bool {
+		userRepoInstance.users.Delete(key)
+		return true
+	})
+}
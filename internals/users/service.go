@@ -1,7 +1,11 @@
 package users
 
 import (
+	"concurrent_money_transfer_system/internals/authz"
+	"concurrent_money_transfer_system/internals/events"
+	"concurrent_money_transfer_system/internals/storage"
 	"concurrent_money_transfer_system/internals/wallet"
+	"concurrent_money_transfer_system/utils"
 	"context"
 )
 
@@ -11,23 +15,47 @@ type UserService interface {
 	UpdateUser(ctx context.Context, user User) (User, error)
 	DeleteUser(ctx context.Context, id string) error
 	GetAllUsers(ctx context.Context) ([]User, error)
+	SetRole(ctx context.Context, id string, role authz.Role) (User, error)
 }
 
 type userService struct {
 	userRepo      UserRepo
 	walletService wallet.WalletService
+	eventService  events.EventService
+	unitOfWork    storage.UnitOfWork
 }
 
+// CreateUser creates the user and their wallet. The user repo does not join units of work, so
+// the UserCreated event is recorded with the wallet, the last part of the user to be created.
 func (s *userService) CreateUser(ctx context.Context, user User) (User, error) {
-	user, err := s.userRepo.CreateUser(user)
+	var err error
+	user.Role = authz.RoleUser
+	user.Password, err = HashPassword(user.Password)
 	if err != nil {
 		return User{}, err
 	}
-	wallet, err := s.walletService.CreateWallet(ctx, user.ID, user.Wallet.Balance)
+	user, err = s.userRepo.CreateUser(user)
+	if err != nil {
+		return User{}, err
+	}
+	initialBalance := user.Wallet.Balance
+	if user.Wallet.Currency != "" {
+		initialBalance, err = initialBalance.WithCurrency(user.Wallet.Currency)
+		if err != nil {
+			return User{}, err
+		}
+	}
+	err = s.unitOfWork.RunInTx(ctx, func(ctx context.Context) error {
+		var err error
+		user.Wallet, err = s.walletService.CreateWallet(ctx, user.ID, initialBalance)
+		if err != nil {
+			return err
+		}
+		return s.eventService.Record(ctx, events.UserCreated, user.ID, events.UserPayload{UserID: user.ID, Email: user.Email})
+	})
 	if err != nil {
 		return User{}, err
 	}
-	user.Wallet = wallet
 	user.Password = ""
 
 	return user, nil
@@ -63,14 +91,40 @@ func (s *userService) GetUser(ctx context.Context, id string) (User, error) {
 }
 
 func (s *userService) UpdateUser(ctx context.Context, user User) (User, error) {
-	user, err := s.userRepo.UpdateUser(user)
+	existing, err := s.userRepo.GetUser(user.ID)
+	if err != nil {
+		return User{}, err
+	}
+	user.Role = existing.Role
+	user.Password, err = HashPassword(user.Password)
+	if err != nil {
+		return User{}, err
+	}
+	user, err = s.userRepo.UpdateUser(user)
 	if err != nil {
 		return User{}, err
 	}
 	user.Wallet = wallet.Wallet{}
+	user.Password = ""
 	return user, nil
 }
 
+func (s *userService) SetRole(ctx context.Context, id string, role authz.Role) (User, error) {
+	if !role.IsValid() {
+		return User{}, utils.NewErrorWithMessage(utils.ErrValidationError, "Role is invalid")
+	}
+	user, err := s.userRepo.GetUser(id)
+	if err != nil {
+		return User{}, err
+	}
+	user.Role = role
+	_, err = s.userRepo.UpdateUser(user)
+	if err != nil {
+		return User{}, err
+	}
+	return s.GetUser(ctx, id)
+}
+
 func (s *userService) DeleteUser(ctx context.Context, id string) error {
 	err := s.userRepo.DeleteUser(id)
 	if err != nil {
@@ -85,9 +139,9 @@ func (s *userService) DeleteUser(ctx context.Context, id string) error {
 
 var userServiceInstance *userService
 
-func NewUserService(userRepo UserRepo, walletService wallet.WalletService) UserService {
+func NewUserService(userRepo UserRepo, walletService wallet.WalletService, eventService events.EventService, unitOfWork storage.UnitOfWork) UserService {
 	if userServiceInstance == nil {
-		userServiceInstance = &userService{userRepo: userRepo, walletService: walletService}
+		userServiceInstance = &userService{userRepo: userRepo, walletService: walletService, eventService: eventService, unitOfWork: unitOfWork}
 	}
 	return userServiceInstance
 }
@@ -0,0 +1,123 @@
+package users
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"concurrent_money_transfer_system/internals/storage"
+	"concurrent_money_transfer_system/utils"
+)
+
+// sqlUserRepo keeps users in the users table. Deleted users keep their row with deleted_at set.
+type sqlUserRepo struct {
+	db *sql.DB
+}
+
+// NewSQLUserRepo returns a UserRepo backed by db, whose schema is created by storage.Migrate.
+func NewSQLUserRepo(db *sql.DB) UserRepo {
+	return &sqlUserRepo{db: db}
+}
+
+const userColumns = `id, first_name, last_name, phone_number, email, password, role, created_at, updated_at, deleted_at`
+
+func scanUser(row storage.Scanner) (User, error) {
+	var user User
+	var deletedAt sql.NullTime
+	err := row.Scan(&user.ID, &user.FirstName, &user.LastName, &user.PhoneNumber, &user.Email, &user.Password, &user.Role,
+		&user.CreatedAt, &user.UpdatedAt, &deletedAt)
+	if err != nil {
+		return User{}, err
+	}
+	if deletedAt.Valid {
+		user.DeletedAt = &deletedAt.Time
+	}
+	return user, nil
+}
+
+func (r *sqlUserRepo) CreateUser(user User) (User, error) {
+	if user.ID == "" {
+		user.ID = utils.GenerateUniqueEntityId()
+	}
+	_, err := r.db.ExecContext(context.Background(), `INSERT INTO users (`+userColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, NULL)`,
+		user.ID, user.FirstName, user.LastName, user.PhoneNumber, user.Email, user.Password, user.RoleOrDefault(), user.CreatedAt, user.UpdatedAt)
+	if storage.IsUniqueViolation(err) {
+		return User{}, utils.NewError(utils.ErrUserAlreadyExists)
+	}
+	if err != nil {
+		return User{}, storage.DatabaseError(err)
+	}
+	return user, nil
+}
+
+func (r *sqlUserRepo) GetUser(id string) (User, error) {
+	row := r.db.QueryRowContext(context.Background(), `SELECT `+userColumns+` FROM users WHERE id = $1 AND deleted_at IS NULL`, id)
+	user, err := scanUser(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, utils.NewError(utils.ErrUserNotFound)
+	}
+	if err != nil {
+		return User{}, storage.DatabaseError(err)
+	}
+	return user, nil
+}
+
+func (r *sqlUserRepo) GetUserByEmail(email string) (User, error) {
+	row := r.db.QueryRowContext(context.Background(), `SELECT `+userColumns+` FROM users
+		WHERE email = $1 AND deleted_at IS NULL ORDER BY created_at, id LIMIT 1`, email)
+	user, err := scanUser(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, utils.NewError(utils.ErrUserNotFound)
+	}
+	if err != nil {
+		return User{}, storage.DatabaseError(err)
+	}
+	return user, nil
+}
+
+func (r *sqlUserRepo) UpdateUser(user User) (User, error) {
+	result, err := r.db.ExecContext(context.Background(), `UPDATE users
+		SET first_name = $2, last_name = $3, phone_number = $4, email = $5, password = $6, role = $7, created_at = $8, updated_at = $9
+		WHERE id = $1 AND deleted_at IS NULL`,
+		user.ID, user.FirstName, user.LastName, user.PhoneNumber, user.Email, user.Password, user.RoleOrDefault(), user.CreatedAt, user.UpdatedAt)
+	if err != nil {
+		return User{}, storage.DatabaseError(err)
+	}
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		return User{}, utils.NewError(utils.ErrUserNotFound)
+	}
+	return user, nil
+}
+
+func (r *sqlUserRepo) DeleteUser(id string) error {
+	result, err := r.db.ExecContext(context.Background(), `UPDATE users SET deleted_at = $2 WHERE id = $1`, id, time.Now())
+	if err != nil {
+		return storage.DatabaseError(err)
+	}
+	if deleted, _ := result.RowsAffected(); deleted == 0 {
+		return utils.NewError(utils.ErrUserNotFound)
+	}
+	return nil
+}
+
+func (r *sqlUserRepo) GetAllUsers() ([]User, error) {
+	rows, err := r.db.QueryContext(context.Background(), `SELECT `+userColumns+` FROM users ORDER BY created_at, id`)
+	if err != nil {
+		return nil, storage.DatabaseError(err)
+	}
+	defer rows.Close()
+	users := make([]User, 0)
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, storage.DatabaseError(err)
+		}
+		users = append(users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, storage.DatabaseError(err)
+	}
+	return users, nil
+}
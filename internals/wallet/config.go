@@ -0,0 +1,40 @@
+package wallet
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// DefaultLockTimeout is how long a request waits for a wallet lock before failing with LOCK_TIMEOUT
+const DefaultLockTimeout = 5 * time.Second
+
+// LoadLockTimeout reads how long a request waits for a wallet lock from LOCK_TIMEOUT.
+func LoadLockTimeout() (time.Duration, error) {
+	value := os.Getenv("LOCK_TIMEOUT")
+	if value == "" {
+		return DefaultLockTimeout, nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 {
+		return 0, fmt.Errorf("invalid LOCK_TIMEOUT %q, expected a positive duration such as 5s", value)
+	}
+	return timeout, nil
+}
+
+// DefaultShards locks each wallet with its own mutex instead of sharding the wallets
+const DefaultShards = 0
+
+// LoadShards reads from WALLET_SHARDS how many goroutines own the wallets and their writes.
+func LoadShards() (int, error) {
+	value := os.Getenv("WALLET_SHARDS")
+	if value == "" {
+		return DefaultShards, nil
+	}
+	shards, err := strconv.Atoi(value)
+	if err != nil || shards < 0 {
+		return 0, fmt.Errorf("invalid WALLET_SHARDS %q, expected a number of shards, or 0 to lock each wallet with a mutex", value)
+	}
+	return shards, nil
+}
@@ -3,12 +3,15 @@ package wallet
 import (
 	"github.com/gin-gonic/gin"
 
+	"concurrent_money_transfer_system/internals/authz"
 	"concurrent_money_transfer_system/utils"
 )
 
 type WalletController interface {
 	DisableWallet(c *gin.Context)
 	GetWallet(c *gin.Context)
+	ReconcileWallet(c *gin.Context)
+	AddCurrency(c *gin.Context)
 }
 
 type walletController struct {
@@ -21,7 +24,12 @@ func NewWalletController(service WalletService) WalletController {
 
 func (wc *walletController) DisableWallet(c *gin.Context) {
 	userID := c.Query("user_id")
-	err := wc.service.DisableWallet(c.Request.Context(), userID)
+	err := authz.AuthorizeOwner(c.Request.Context(), userID, authz.RoleAdmin)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+	err = wc.service.DisableWallet(c.Request.Context(), userID)
 	if err != nil {
 		utils.ResponseError(c, err)
 		return
@@ -35,6 +43,11 @@ func (wc *walletController) GetWallet(c *gin.Context) {
 		utils.ResponseError(c, utils.NewErrorWithMessage(utils.ErrInvalidRequest, "User ID is required"))
 		return
 	}
+	err := authz.AuthorizeOwner(c.Request.Context(), userID, authz.RoleSupport, authz.RoleAdmin)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
 	wallet, err := wc.service.GetWallet(c.Request.Context(), userID)
 	if err != nil {
 		utils.ResponseError(c, err)
@@ -42,3 +55,46 @@ func (wc *walletController) GetWallet(c *gin.Context) {
 	}
 	utils.ResponseSuccess(c, wallet)
 }
+
+func (wc *walletController) ReconcileWallet(c *gin.Context) {
+	userID := c.Query("user_id")
+	if userID == "" {
+		utils.ResponseError(c, utils.NewErrorWithMessage(utils.ErrInvalidRequest, "User ID is required"))
+		return
+	}
+	err := authz.AuthorizeOwner(c.Request.Context(), userID, authz.RoleSupport, authz.RoleAdmin)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+	reconciliation, err := wc.service.ReconcileWallet(c.Request.Context(), userID)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+	utils.ResponseSuccess(c, reconciliation)
+}
+
+func (wc *walletController) AddCurrency(c *gin.Context) {
+	userID := c.Query("user_id")
+	if userID == "" {
+		utils.ResponseError(c, utils.NewErrorWithMessage(utils.ErrInvalidRequest, "User ID is required"))
+		return
+	}
+	currency := utils.Currency(c.Query("currency"))
+	if currency == "" {
+		utils.ResponseError(c, utils.NewErrorWithMessage(utils.ErrInvalidRequest, "Currency is required"))
+		return
+	}
+	err := authz.AuthorizeOwner(c.Request.Context(), userID, authz.RoleAdmin)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+	wallet, err := wc.service.AddCurrency(c.Request.Context(), userID, currency)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+	utils.ResponseSuccess(c, wallet)
+}
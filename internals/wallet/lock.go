@@ -0,0 +1,50 @@
+package wallet
+
+import (
+	"context"
+	"errors"
+
+	"concurrent_money_transfer_system/utils"
+)
+
+// walletLock is a mutex whose lock gives up when the context is done, so a request stops
+// waiting for a wallet when it is cancelled or its lock timeout passes, instead of blocking
+// forever behind a stuck holder.
+type walletLock chan struct{}
+
+func newWalletLock() walletLock {
+	return make(walletLock, 1)
+}
+
+// lock takes the lock, or returns a LOCK_TIMEOUT error once ctx is done.
+func (l walletLock) lock(ctx context.Context, userID string) error {
+	// A free lock is taken even when ctx is already done
+	select {
+	case l <- struct{}{}:
+		return nil
+	default:
+	}
+	select {
+	case l <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return lockTimeoutError(ctx, userID)
+	}
+}
+
+// lockTimeoutError tells whether the request stopped waiting for the wallet because its lock
+// timeout passed or because it was cancelled.
+func lockTimeoutError(ctx context.Context, userID string) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return utils.NewErrorWithMessage(utils.ErrLockTimeout, "Timed out waiting for the lock of the wallet of userID: "+userID)
+	}
+	return utils.NewErrorWithMessage(utils.ErrLockTimeout, "Request was cancelled while waiting for the lock of the wallet of userID: "+userID)
+}
+
+// unlock releases the lock. Unlike sync.Mutex it does not panic when the lock is not held.
+func (l walletLock) unlock() {
+	select {
+	case <-l:
+	default:
+	}
+}
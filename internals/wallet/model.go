@@ -13,12 +13,100 @@ const (
 	Inactive WalletStatus = "inactive"
 )
 
+// Wallet holds one balance per currency it accepts. Currency is the wallet's primary currency
+// and Balance its balance in that currency; Balances has every currency, the primary one included.
+// Balances are ledger balances, which still include the funds reserved by holds until the holds
+// are captured or voided; Available is what is left to spend.
 type Wallet struct {
-	ID        string         `json:"id"`
-	UserID    string         `json:"-"`
-	Balance   float64        `json:"balance"`
-	Currency  utils.Currency `json:"currency"`
-	Status    WalletStatus   `json:"wallet_status"`
-	CreatedAt time.Time      `json:"created_at"`
-	UpdatedAt time.Time      `json:"updated_at"`
+	ID        string                         `json:"id"`
+	UserID    string                         `json:"-"`
+	Balance   utils.Money                    `json:"balance"`
+	Currency  utils.Currency                 `json:"currency"`
+	Balances  map[utils.Currency]utils.Money `json:"balances,omitempty"`
+	Held      map[utils.Currency]utils.Money `json:"held_balances,omitempty"`      // Funds reserved by pending holds, only for currencies with any
+	Available map[utils.Currency]utils.Money `json:"available_balances,omitempty"` // Balances minus Held
+	Status    WalletStatus                   `json:"wallet_status"`
+	Version   int64                          `json:"-"` // Incremented by every write, so a write can tell the wallet changed since it was read
+	CreatedAt time.Time                      `json:"created_at"`
+	UpdatedAt time.Time                      `json:"updated_at"`
+}
+
+// BalanceIn returns the wallet's balance in a currency and whether the wallet holds that currency.
+func (w Wallet) BalanceIn(currency utils.Currency) (utils.Money, bool) {
+	balance, ok := w.Balances[currency]
+	return balance, ok
+}
+
+// HeldIn returns the funds reserved by holds in a currency, zero when there are none.
+func (w Wallet) HeldIn(currency utils.Currency) utils.Money {
+	held, ok := w.Held[currency]
+	if !ok {
+		return utils.NewMoney(0, currency)
+	}
+	return held
+}
+
+// AvailableIn returns the balance in a currency that is not reserved by holds, and whether the
+// wallet holds that currency.
+func (w Wallet) AvailableIn(currency utils.Currency) (utils.Money, bool) {
+	balance, ok := w.BalanceIn(currency)
+	if !ok {
+		return utils.Money{}, false
+	}
+	return balance.Sub(w.HeldIn(currency)), true
+}
+
+// withBalance returns a copy of the wallet with the balance of newBalance's currency replaced.
+// The balances map is copied rather than modified, as stored wallets are shared between readers.
+func (w Wallet) withBalance(newBalance utils.Money) Wallet {
+	balances := make(map[utils.Currency]utils.Money, len(w.Balances)+1)
+	for currency, balance := range w.Balances {
+		balances[currency] = balance
+	}
+	balances[newBalance.Currency] = newBalance
+	w.Balances = balances
+	if newBalance.Currency == w.Currency {
+		w.Balance = newBalance
+	}
+	return w.withAvailable()
+}
+
+// withHeld returns a copy of the wallet with the funds held in newHeld's currency replaced.
+func (w Wallet) withHeld(newHeld utils.Money) Wallet {
+	held := make(map[utils.Currency]utils.Money, len(w.Held)+1)
+	for currency, amount := range w.Held {
+		held[currency] = amount
+	}
+	held[newHeld.Currency] = newHeld
+	if newHeld.IsZero() {
+		delete(held, newHeld.Currency)
+	}
+	w.Held = held
+	if len(held) == 0 {
+		w.Held = nil
+	}
+	return w.withAvailable()
+}
+
+// withAvailable returns a copy of the wallet with Available computed from Balances and Held.
+func (w Wallet) withAvailable() Wallet {
+	w.Available = make(map[utils.Currency]utils.Money, len(w.Balances))
+	for currency := range w.Balances {
+		w.Available[currency], _ = w.AvailableIn(currency)
+	}
+	return w
+}
+
+// Reconciliation compares a wallet's stored balances with the balances derived from its ledger postings.
+type Reconciliation struct {
+	WalletID   string                   `json:"wallet_id"`
+	Currencies []CurrencyReconciliation `json:"currencies"`
+	Balanced   bool                     `json:"balanced"`
+}
+
+type CurrencyReconciliation struct {
+	Currency      utils.Currency `json:"currency"`
+	WalletBalance utils.Money    `json:"wallet_balance"`
+	LedgerBalance utils.Money    `json:"ledger_balance"`
+	Balanced      bool           `json:"balanced"`
 }
@@ -1,50 +1,104 @@
 package wallet
 
 import (
+	"concurrent_money_transfer_system/internals/storage"
 	"concurrent_money_transfer_system/utils"
 	"context"
 	"sync"
 	"time"
 )
 
+// walletRecord is the WAL record kind holding a wallet's post-image
+const walletRecord = "wallet"
+
 type WalletRepo interface {
 	CreateWallet(ctx context.Context, wallet Wallet) (Wallet, error)
+	// DisableWallet must be called with the wallet locked, like the balance updates.
 	DisableWallet(ctx context.Context, userID string) error
+	AddCurrency(ctx context.Context, userID string, currency utils.Currency) (Wallet, error)
 	GetWalletByUserID(ctx context.Context, userID string) (Wallet, error)
 	GetWalletForUpdateByUserID(ctx context.Context, userID string) (Wallet, error)
 	ReleaseGetWalletForUpdateLock(ctx context.Context, userID string)
-	UpdateWalletBalance(ctx context.Context, walletID string, newBalance float64) error
+	UpdateWalletBalance(ctx context.Context, walletID string, newBalance utils.Money) error
+	// CompareAndSwapWalletBalance replaces the balance like UpdateWalletBalance, but only while
+	// the wallet is still at expectedVersion, failing with VERSION_CONFLICT otherwise.
+	CompareAndSwapWalletBalance(ctx context.Context, walletID string, expectedVersion int64, newBalance utils.Money) error
+	// UpdateWalletHeld replaces the funds held in newHeld's currency, which must not exceed the balance.
+	UpdateWalletHeld(ctx context.Context, walletID string, newHeld utils.Money) error
 }
 
 type walletRepo struct {
-	wallets       sync.Map // Using sync.Map for concurrent safe map[string]Wallet operations
-	walletMutexes sync.Map // Mutex for each wallet to avoid race conditions
+	wallets       sync.Map     // Using sync.Map for concurrent safe map[string]Wallet operations
+	walletMutexes sync.Map     // walletLock for each wallet to avoid race conditions
+	wal           *storage.WAL // Writes are logged here first when set
 }
 
 func (r *walletRepo) CreateWallet(ctx context.Context, wallet Wallet) (Wallet, error) {
 	wallet.ID = wallet.UserID // Kept same as userID for simplicity
+	wallet = wallet.withBalance(wallet.Balance)
 	wallet.CreatedAt = time.Now()
 	wallet.UpdatedAt = time.Now()
-	r.wallets.Store(wallet.ID, wallet)
-	r.walletMutexes.Store(wallet.ID, &sync.Mutex{})
+	previous, existed := r.wallets.Load(wallet.ID)
+	err := r.wal.Log(ctx, walletRecord, wallet, func() {
+		r.wallets.Store(wallet.ID, wallet)
+		r.walletMutexes.Store(wallet.ID, newWalletLock())
+	})
+	if err != nil {
+		return Wallet{}, err
+	}
+	storage.OnRollback(ctx, func() {
+		if existed {
+			r.wallets.Store(wallet.ID, previous)
+			return
+		}
+		r.wallets.Delete(wallet.ID)
+		r.walletMutexes.Delete(wallet.ID)
+	})
 	return wallet, nil
 }
 
 func (r *walletRepo) DisableWallet(ctx context.Context, userID string) error {
-	wallet, err := r.GetWalletByUserID(ctx, userID)
+	previous, err := r.GetWalletByUserID(ctx, userID)
 	if err != nil {
 		return err
 	}
+	wallet := previous
+	wallet.Status = Inactive
+	wallet.Version++
+	wallet.UpdatedAt = time.Now()
+	err = r.storeWallet(ctx, wallet)
+	if err != nil {
+		return err
+	}
+	storage.OnRollback(ctx, func() { r.wallets.Store(previous.ID, previous) })
+	return nil
+}
+
+func (r *walletRepo) AddCurrency(ctx context.Context, userID string, currency utils.Currency) (Wallet, error) {
 	walletMutex, ok := r.walletMutexes.Load(userID)
 	if !ok {
-		return utils.NewErrorWithMessage(utils.ErrWalletNotFound, "Wallet Mutex not found for userID: "+userID)
+		return Wallet{}, utils.NewErrorWithMessage(utils.ErrWalletNotFound, "Wallet not found for userID: "+userID)
 	}
-	walletMutex.(*sync.Mutex).Lock()
-	defer walletMutex.(*sync.Mutex).Unlock()
-	wallet.Status = Inactive
+	err := walletMutex.(walletLock).lock(ctx, userID)
+	if err != nil {
+		return Wallet{}, err
+	}
+	defer walletMutex.(walletLock).unlock()
+	wallet, err := r.GetWalletByUserID(ctx, userID)
+	if err != nil {
+		return Wallet{}, err
+	}
+	if _, ok := wallet.BalanceIn(currency); ok {
+		return wallet, nil
+	}
+	wallet = wallet.withBalance(utils.NewMoney(0, currency))
+	wallet.Version++
 	wallet.UpdatedAt = time.Now()
-	r.wallets.Store(userID, wallet)
-	return nil
+	err = r.storeWallet(ctx, wallet)
+	if err != nil {
+		return Wallet{}, err
+	}
+	return wallet, nil
 }
 
 func (r *walletRepo) GetWalletByUserID(ctx context.Context, userID string) (Wallet, error) {
@@ -63,10 +117,15 @@ func (r *walletRepo) GetWalletForUpdateByUserID(ctx context.Context, userID stri
 	if !ok {
 		return Wallet{}, utils.NewErrorWithMessage(utils.ErrWalletNotFound, "Wallet not found for userID: "+userID)
 	}
-	walletMutex.(*sync.Mutex).Lock()
+	// Gives up with LOCK_TIMEOUT when ctx is cancelled or its deadline passes while waiting
+	err := walletMutex.(walletLock).lock(ctx, userID)
+	if err != nil {
+		return Wallet{}, err
+	}
 
 	wallet, err := r.GetWalletByUserID(ctx, userID)
 	if err != nil {
+		walletMutex.(walletLock).unlock()
 		return Wallet{}, utils.NewErrorWithMessage(utils.ErrInternalServerError, "Mutex found but wallet not found for userID: "+userID)
 	}
 
@@ -74,25 +133,101 @@ func (r *walletRepo) GetWalletForUpdateByUserID(ctx context.Context, userID stri
 }
 
 func (r *walletRepo) ReleaseGetWalletForUpdateLock(ctx context.Context, userID string) {
-	// Check if the mutex exists before unlocking to avoid "unlock of unlocked mutex" panic
 	walletMutex, ok := r.walletMutexes.Load(userID)
 	if ok {
-		walletMutex.(*sync.Mutex).Unlock()
+		walletMutex.(walletLock).unlock()
 	}
 }
 
-func (r *walletRepo) UpdateWalletBalance(ctx context.Context, walletID string, newBalance float64) error {
+func (r *walletRepo) UpdateWalletBalance(ctx context.Context, walletID string, newBalance utils.Money) error {
 	wallet, ok := r.wallets.Load(walletID)
 	if !ok {
 		return utils.NewErrorWithMessage(utils.ErrInternalServerError, "Wallet not found for walletID: "+walletID)
 	}
-	wal := wallet.(Wallet)
-	wal.Balance = newBalance
+	previous := wallet.(Wallet)
+	if _, ok := previous.BalanceIn(newBalance.Currency); !ok {
+		return utils.NewErrorWithMessage(utils.ErrCurrencyMismatch, "Wallet "+walletID+" does not hold "+string(newBalance.Currency))
+	}
+	wal := previous.withBalance(newBalance)
+	wal.Version++
 	wal.UpdatedAt = time.Now()
-	r.wallets.Store(walletID, wal)
+	err := r.storeWallet(ctx, wal)
+	if err != nil {
+		return err
+	}
+	// The caller holds the wallet lock until the unit of work ends, so nothing else has changed the wallet when this runs
+	storage.OnRollback(ctx, func() { r.wallets.Store(previous.ID, previous) })
 	return nil
 }
 
+// CompareAndSwapWalletBalance must be called with the wallet locked, like every write, so the
+// wallet cannot change between the comparison and the swap.
+func (r *walletRepo) CompareAndSwapWalletBalance(ctx context.Context, walletID string, expectedVersion int64, newBalance utils.Money) error {
+	wallet, ok := r.wallets.Load(walletID)
+	if !ok {
+		return utils.NewErrorWithMessage(utils.ErrInternalServerError, "Wallet not found for walletID: "+walletID)
+	}
+	if wallet.(Wallet).Version != expectedVersion {
+		return utils.NewErrorWithMessage(utils.ErrVersionConflict, "Wallet "+walletID+" changed since it was read")
+	}
+	return r.UpdateWalletBalance(ctx, walletID, newBalance)
+}
+
+func (r *walletRepo) UpdateWalletHeld(ctx context.Context, walletID string, newHeld utils.Money) error {
+	wallet, ok := r.wallets.Load(walletID)
+	if !ok {
+		return utils.NewErrorWithMessage(utils.ErrInternalServerError, "Wallet not found for walletID: "+walletID)
+	}
+	previous := wallet.(Wallet)
+	if _, ok := previous.BalanceIn(newHeld.Currency); !ok {
+		return utils.NewErrorWithMessage(utils.ErrCurrencyMismatch, "Wallet "+walletID+" does not hold "+string(newHeld.Currency))
+	}
+	wal := previous.withHeld(newHeld)
+	wal.Version++
+	wal.UpdatedAt = time.Now()
+	err := r.storeWallet(ctx, wal)
+	if err != nil {
+		return err
+	}
+	storage.OnRollback(ctx, func() { r.wallets.Store(previous.ID, previous) })
+	return nil
+}
+
+// storeWallet logs the wallet to the WAL and replaces the stored wallet with it.
+func (r *walletRepo) storeWallet(ctx context.Context, wallet Wallet) error {
+	return r.wal.Log(ctx, walletRecord, wallet, func() { r.wallets.Store(wallet.ID, wallet) })
+}
+
+func (r *walletRepo) SetWAL(wal *storage.WAL) {
+	r.wal = wal
+}
+
+func (r *walletRepo) ApplyRecord(record storage.Record) (bool, error) {
+	if record.Kind != walletRecord {
+		return false, nil
+	}
+	var wallet Wallet
+	err := record.Decode(&wallet)
+	if err != nil {
+		return true, err
+	}
+	r.wallets.Store(wallet.ID, wallet)
+	r.walletMutexes.LoadOrStore(wallet.ID, newWalletLock())
+	return true, nil
+}
+
+func (r *walletRepo) SnapshotRecords() ([]storage.Record, error) {
+	records := make([]storage.Record, 0)
+	var err error
+	r.wallets.Range(func(key, value any) bool {
+		var record storage.Record
+		record, err = storage.NewRecord(walletRecord, value.(Wallet))
+		records = append(records, record)
+		return err == nil
+	})
+	return records, err
+}
+
 var walletRepoInstance *walletRepo
 
 func NewWalletRepo() WalletRepo {
@@ -104,3 +239,15 @@ func NewWalletRepo() WalletRepo {
 	}
 	return walletRepoInstance
 }
+
+// Reset is just used for testing purposes
+func Reset() {
+	walletRepoInstance.wallets.Range(func(key, value any) bool {
+		walletRepoInstance.wallets.Delete(key)
+		return true
+	})
+	walletRepoInstance.walletMutexes.Range(func(key, value any) bool {
+		walletRepoInstance.walletMutexes.Delete(key)
+		return true
+	})
+}
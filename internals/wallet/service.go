@@ -1,36 +1,114 @@
 package wallet
 
 import (
+	"concurrent_money_transfer_system/internals/events"
+	"concurrent_money_transfer_system/internals/ledger"
+	"concurrent_money_transfer_system/internals/storage"
 	"concurrent_money_transfer_system/utils"
 	"context"
+	"sort"
+	"time"
 )
 
 type WalletService interface {
-	CreateWallet(ctx context.Context, userID string, initialBalance float64) (Wallet, error)
+	CreateWallet(ctx context.Context, userID string, initialBalance utils.Money) (Wallet, error)
 	DisableWallet(ctx context.Context, userID string) error
+	AddCurrency(ctx context.Context, userID string, currency utils.Currency) (Wallet, error)
 	GetWallet(ctx context.Context, userID string) (Wallet, error)
 	GetWalletForUpdate(ctx context.Context, userID string) (Wallet, error)
 	ReleaseGetWalletForUpdateLock(ctx context.Context, userID string)
-	UpdateWalletBalance(ctx context.Context, walletID string, newBalance float64) error
+	UpdateWalletBalance(ctx context.Context, walletID string, newBalance utils.Money) error
+	CompareAndSwapWalletBalance(ctx context.Context, walletID string, expectedVersion int64, newBalance utils.Money) error
+	UpdateWalletHeld(ctx context.Context, walletID string, newHeld utils.Money) error
+	ReconcileWallet(ctx context.Context, userID string) (Reconciliation, error)
 }
 
 type walletService struct {
-	repo WalletRepo
+	repo          WalletRepo
+	writer        walletWriter // Locks and writes the wallets: the repo itself, or the shards owning them
+	ledgerService ledger.LedgerService
+	eventService  events.EventService
+	unitOfWork    storage.UnitOfWork
+	lockTimeout   time.Duration // How long to wait for a wallet lock
 }
 
-func (s *walletService) CreateWallet(ctx context.Context, userID string, initialBalance float64) (Wallet, error) {
+// walletWriter is the part of WalletRepo that locks and writes wallets. Like balances, a
+// wallet must be locked to be disabled.
+type walletWriter interface {
+	DisableWallet(ctx context.Context, userID string) error
+	AddCurrency(ctx context.Context, userID string, currency utils.Currency) (Wallet, error)
+	GetWalletForUpdateByUserID(ctx context.Context, userID string) (Wallet, error)
+	ReleaseGetWalletForUpdateLock(ctx context.Context, userID string)
+	UpdateWalletBalance(ctx context.Context, walletID string, newBalance utils.Money) error
+	CompareAndSwapWalletBalance(ctx context.Context, walletID string, expectedVersion int64, newBalance utils.Money) error
+	UpdateWalletHeld(ctx context.Context, walletID string, newHeld utils.Money) error
+}
+
+// CreateWallet creates a wallet whose primary currency is the initial balance's currency.
+// An initial balance without a currency (e.g. decoded from a signup request) is in USD.
+func (s *walletService) CreateWallet(ctx context.Context, userID string, initialBalance utils.Money) (Wallet, error) {
+	balance := initialBalance
+	if !balance.IsBound() {
+		var err error
+		balance, err = initialBalance.WithCurrency(utils.USD)
+		if err != nil {
+			return Wallet{}, err
+		}
+	}
+	if balance.IsNegative() {
+		return Wallet{}, utils.NewErrorWithMessage(utils.ErrValidationError, "Balance cannot be negative")
+	}
 	wallet := Wallet{
 		ID:       userID,
 		UserID:   userID,
-		Balance:  initialBalance,
-		Currency: utils.USD,
+		Balance:  balance,
+		Currency: balance.Currency,
 		Status:   Active,
 	}
-	return s.repo.CreateWallet(ctx, wallet)
+	err := s.unitOfWork.RunInTx(ctx, func(ctx context.Context) error {
+		var err error
+		wallet, err = s.repo.CreateWallet(ctx, wallet)
+		if err != nil {
+			return err
+		}
+		// The initial balance is funded from the opening balances account so the wallet's
+		// ledger account matches its balance from the start
+		if balance.IsPositive() {
+			_, err = s.ledgerService.RecordTransfer(ctx, "", ledger.OpeningBalanceAccountID, ledger.WalletAccountID(wallet.ID), balance, "Opening balance")
+		}
+		return err
+	})
+	if err != nil {
+		return Wallet{}, err
+	}
+	return wallet, nil
 }
 
+// DisableWallet stops the wallet from sending and receiving money, recording a WalletDisabled
+// event with the change.
 func (s *walletService) DisableWallet(ctx context.Context, userID string) error {
-	return s.repo.DisableWallet(ctx, userID)
+	wallet, err := s.GetWalletForUpdate(ctx, userID)
+	if err != nil {
+		return err
+	}
+	defer s.ReleaseGetWalletForUpdateLock(ctx, userID)
+	return s.unitOfWork.RunInTx(ctx, func(ctx context.Context) error {
+		err := s.writer.DisableWallet(ctx, userID)
+		if err != nil {
+			return err
+		}
+		return s.eventService.Record(ctx, events.WalletDisabled, wallet.ID, events.WalletPayload{WalletID: wallet.ID, UserID: wallet.UserID})
+	})
+}
+
+// AddCurrency lets the wallet hold and receive the currency, starting from a zero balance.
+func (s *walletService) AddCurrency(ctx context.Context, userID string, currency utils.Currency) (Wallet, error) {
+	if _, ok := currency.Exponent(); !ok {
+		return Wallet{}, utils.NewErrorWithMessage(utils.ErrValidationError, "Currency "+string(currency)+" is not supported")
+	}
+	ctx, cancel := s.lockContext(ctx)
+	defer cancel()
+	return s.writer.AddCurrency(ctx, userID, currency)
 }
 
 func (s *walletService) GetWallet(ctx context.Context, userID string) (Wallet, error) {
@@ -41,26 +119,95 @@ func (s *walletService) GetWalletForUpdate(ctx context.Context, userID string) (
 	// This method acquires an exclusive lock on the wallet, similar to
 	// SELECT ... FOR UPDATE in MySQL. The lock prevents concurrent modifications
 	// to the same wallet and must be released by calling UpdateWallet. // TODO: but what to do if no update?
-	return s.repo.GetWalletForUpdateByUserID(ctx, userID)
+	// It fails with LOCK_TIMEOUT, holding nothing, when ctx is cancelled or the lock timeout passes first.
+	ctx, cancel := s.lockContext(ctx)
+	defer cancel()
+	return s.writer.GetWalletForUpdateByUserID(ctx, userID)
+}
+
+// lockContext returns ctx with the deadline by which a wallet lock must be taken.
+func (s *walletService) lockContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, s.lockTimeout)
 }
 
 func (s *walletService) ReleaseGetWalletForUpdateLock(ctx context.Context, userID string) {
-	s.repo.ReleaseGetWalletForUpdateLock(ctx, userID)
+	s.writer.ReleaseGetWalletForUpdateLock(ctx, userID)
 }
 
-func (s *walletService) UpdateWalletBalance(ctx context.Context, walletID string, newBalance float64) error {
-	err := s.repo.UpdateWalletBalance(ctx, walletID, newBalance)
+func (s *walletService) UpdateWalletBalance(ctx context.Context, walletID string, newBalance utils.Money) error {
+	err := s.writer.UpdateWalletBalance(ctx, walletID, newBalance)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// CompareAndSwapWalletBalance replaces the balance only while the wallet is still at
+// expectedVersion, the version it had when it was read, and fails with VERSION_CONFLICT otherwise.
+func (s *walletService) CompareAndSwapWalletBalance(ctx context.Context, walletID string, expectedVersion int64, newBalance utils.Money) error {
+	return s.writer.CompareAndSwapWalletBalance(ctx, walletID, expectedVersion, newBalance)
+}
+
+// UpdateWalletHeld replaces the funds reserved by holds in newHeld's currency. Like balances,
+// it must be called with the wallet locked.
+func (s *walletService) UpdateWalletHeld(ctx context.Context, walletID string, newHeld utils.Money) error {
+	return s.writer.UpdateWalletHeld(ctx, walletID, newHeld)
+}
+
+// ReconcileWallet checks each of the wallet's balances against the sum of its ledger postings.
+func (s *walletService) ReconcileWallet(ctx context.Context, userID string) (Reconciliation, error) {
+	wallet, err := s.repo.GetWalletByUserID(ctx, userID)
+	if err != nil {
+		return Reconciliation{}, err
+	}
+	reconciliation := Reconciliation{WalletID: wallet.ID, Balanced: true}
+	for currency, balance := range wallet.Balances {
+		accountBalance, err := s.ledgerService.GetAccountBalance(ctx, ledger.WalletAccountID(wallet.ID), currency)
+		if err != nil {
+			return Reconciliation{}, err
+		}
+		currencyReconciliation := CurrencyReconciliation{
+			Currency:      currency,
+			WalletBalance: balance,
+			LedgerBalance: accountBalance.Balance,
+			Balanced:      balance == accountBalance.Balance,
+		}
+		reconciliation.Currencies = append(reconciliation.Currencies, currencyReconciliation)
+		reconciliation.Balanced = reconciliation.Balanced && currencyReconciliation.Balanced
+	}
+	sort.Slice(reconciliation.Currencies, func(i, j int) bool {
+		return reconciliation.Currencies[i].Currency < reconciliation.Currencies[j].Currency
+	})
+	return reconciliation, nil
+}
+
 var walletServiceInstance *walletService
 
-func NewWalletService(repo WalletRepo) WalletService {
+// NewWalletService locks each wallet with a mutex of the repo when shards is 0, and otherwise
+// partitions the wallets across that many goroutine-owned shards.
+func NewWalletService(repo WalletRepo, ledgerService ledger.LedgerService, eventService events.EventService, unitOfWork storage.UnitOfWork, lockTimeout time.Duration, shards int) WalletService {
 	if walletServiceInstance == nil {
-		walletServiceInstance = &walletService{repo: repo}
+		walletServiceInstance = &walletService{repo: repo, writer: newWalletWriter(repo, shards), ledgerService: ledgerService, eventService: eventService, unitOfWork: unitOfWork, lockTimeout: lockTimeout}
 	}
 	return walletServiceInstance
 }
+
+func newWalletWriter(repo WalletRepo, shards int) walletWriter {
+	if shards == 0 {
+		return repo
+	}
+	return newWalletShards(repo, shards)
+}
+
+// SetShards is just used for testing purposes
+func SetShards(shards int) {
+	if previous, ok := walletServiceInstance.writer.(*walletShards); ok {
+		previous.stop()
+	}
+	walletServiceInstance.writer = newWalletWriter(walletServiceInstance.repo, shards)
+}
+
+// SetLockTimeout is just used for testing purposes
+func SetLockTimeout(lockTimeout time.Duration) {
+	walletServiceInstance.lockTimeout = lockTimeout
+}
@@ -0,0 +1,194 @@
+package wallet
+
+import (
+	"context"
+	"hash/fnv"
+
+	"concurrent_money_transfer_system/utils"
+)
+
+// walletShards partitions wallets across goroutines that each own the wallets of their shard.
+// Instead of contending on a mutex, requests for a wallet send commands to its shard, which
+// grants the wallet to one request at a time in the order they asked for it and makes the
+// writes to it one after another, so a hot wallet costs a queue rather than a crowd of
+// goroutines waking up for its lock.
+//
+// A transfer between wallets of different shards takes two steps: it first reserves each
+// wallet from its shard, in ascending ID order like the mutexes, and only once it holds all of
+// them sends the balance commands and releases them. Shards never wait on each other or on a
+// request, so a transfer cannot deadlock them.
+type walletShards struct {
+	repo   WalletRepo
+	shards []chan shardCommand
+}
+
+// shardCommand is run by the goroutine of the shard, the only one that touches its queues.
+type shardCommand func(queues map[string]*walletQueue)
+
+// walletQueue holds the request that reserved a wallet and the ones waiting for it, in order.
+// A wallet nobody holds has no queue.
+type walletQueue struct {
+	holder  *walletTicket
+	waiting []*walletTicket
+}
+
+// walletTicket is a request's place in the queue of a wallet.
+type walletTicket struct {
+	granted chan struct{} // Receives once the wallet is reserved for the request
+}
+
+// shardCommandBuffer lets requests hand a shard commands without waiting for it to take them.
+const shardCommandBuffer = 1024
+
+func newWalletShards(repo WalletRepo, count int) *walletShards {
+	s := &walletShards{repo: repo, shards: make([]chan shardCommand, count)}
+	for i := range s.shards {
+		s.shards[i] = make(chan shardCommand, shardCommandBuffer)
+		go runShard(s.shards[i])
+	}
+	return s
+}
+
+func runShard(commands <-chan shardCommand) {
+	queues := make(map[string]*walletQueue)
+	for command := range commands {
+		command(queues)
+	}
+}
+
+// stop ends the goroutines of the shards. No wallet may be reserved or written after it.
+func (s *walletShards) stop() {
+	for _, shard := range s.shards {
+		close(shard)
+	}
+}
+
+// shardOf returns the shard owning the wallet. Wallet IDs are the IDs of their users, so a
+// wallet is owned by the same shard whichever of the two it is looked up by.
+func (s *walletShards) shardOf(walletID string) chan<- shardCommand {
+	hash := fnv.New32a()
+	hash.Write([]byte(walletID))
+	return s.shards[hash.Sum32()%uint32(len(s.shards))]
+}
+
+// reserve waits until the wallet is reserved for the request, or returns a LOCK_TIMEOUT error
+// once ctx is done. A wallet granted by the time the request gives up is kept, so a free
+// wallet is reserved even when ctx is already done.
+func (s *walletShards) reserve(ctx context.Context, walletID string) error {
+	shard := s.shardOf(walletID)
+	ticket := &walletTicket{granted: make(chan struct{}, 1)}
+	shard <- func(queues map[string]*walletQueue) {
+		queue, ok := queues[walletID]
+		if !ok {
+			queues[walletID] = &walletQueue{holder: ticket}
+			ticket.granted <- struct{}{}
+			return
+		}
+		queue.waiting = append(queue.waiting, ticket)
+	}
+	select {
+	case <-ticket.granted:
+		return nil
+	case <-ctx.Done():
+	}
+
+	kept := make(chan bool, 1)
+	shard <- func(queues map[string]*walletQueue) {
+		queue := queues[walletID]
+		if queue.holder == ticket {
+			kept <- true
+			return
+		}
+		for i, waiting := range queue.waiting {
+			if waiting == ticket {
+				queue.waiting = append(queue.waiting[:i], queue.waiting[i+1:]...)
+				break
+			}
+		}
+		kept <- false
+	}
+	if <-kept {
+		return nil
+	}
+	return lockTimeoutError(ctx, walletID)
+}
+
+// release passes the wallet on to the next request waiting for it. Like unlock it does
+// nothing when the wallet is not reserved.
+func (s *walletShards) release(walletID string) {
+	s.shardOf(walletID) <- func(queues map[string]*walletQueue) {
+		queue, ok := queues[walletID]
+		if !ok {
+			return
+		}
+		if len(queue.waiting) == 0 {
+			delete(queues, walletID)
+			return
+		}
+		queue.holder = queue.waiting[0]
+		queue.waiting = queue.waiting[1:]
+		queue.holder.granted <- struct{}{}
+	}
+}
+
+// write makes the write on the goroutine of the wallet's shard and returns its error. The
+// write still joins the caller's unit of work through ctx, which the caller does not use
+// while it waits.
+func (s *walletShards) write(walletID string, write func() error) error {
+	done := make(chan error, 1)
+	s.shardOf(walletID) <- func(map[string]*walletQueue) { done <- write() }
+	return <-done
+}
+
+// The methods below make walletShards a walletWriter. The repo's own locks are never taken
+// by anyone else while the shards are in use, so its methods that take them do not wait.
+
+func (s *walletShards) GetWalletForUpdateByUserID(ctx context.Context, userID string) (Wallet, error) {
+	err := s.reserve(ctx, userID)
+	if err != nil {
+		return Wallet{}, err
+	}
+	wallet, err := s.repo.GetWalletByUserID(ctx, userID)
+	if err != nil {
+		s.release(userID)
+		return Wallet{}, err
+	}
+	return wallet, nil
+}
+
+func (s *walletShards) ReleaseGetWalletForUpdateLock(ctx context.Context, userID string) {
+	s.release(userID)
+}
+
+func (s *walletShards) DisableWallet(ctx context.Context, userID string) error {
+	return s.write(userID, func() error { return s.repo.DisableWallet(ctx, userID) })
+}
+
+func (s *walletShards) AddCurrency(ctx context.Context, userID string, currency utils.Currency) (Wallet, error) {
+	_, err := s.GetWalletForUpdateByUserID(ctx, userID)
+	if err != nil {
+		return Wallet{}, err
+	}
+	defer s.release(userID)
+	var wallet Wallet
+	err = s.write(userID, func() error {
+		var err error
+		wallet, err = s.repo.AddCurrency(ctx, userID, currency)
+		return err
+	})
+	return wallet, err
+}
+
+func (s *walletShards) UpdateWalletBalance(ctx context.Context, walletID string, newBalance utils.Money) error {
+	return s.write(walletID, func() error { return s.repo.UpdateWalletBalance(ctx, walletID, newBalance) })
+}
+
+func (s *walletShards) CompareAndSwapWalletBalance(ctx context.Context, walletID string, expectedVersion int64, newBalance utils.Money) error {
+	return s.write(walletID, func() error {
+		return s.repo.CompareAndSwapWalletBalance(ctx, walletID, expectedVersion, newBalance)
+	})
+}
+
+func (s *walletShards) UpdateWalletHeld(ctx context.Context, walletID string, newHeld utils.Money) error {
+	return s.write(walletID, func() error { return s.repo.UpdateWalletHeld(ctx, walletID, newHeld) })
+}
@@ -0,0 +1,212 @@
+package wallet
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+
+	"concurrent_money_transfer_system/internals/storage"
+	"concurrent_money_transfer_system/utils"
+)
+
+// sqlWalletRepo keeps wallets in the wallets table and their balances in wallet_balances.
+// Wallet locks stay in process memory, like in walletRepo, since a single server owns the database.
+type sqlWalletRepo struct {
+	db            *sql.DB
+	walletMutexes sync.Map // Created on first use, as wallets outlive the process that created them
+}
+
+// NewSQLWalletRepo returns a WalletRepo backed by db, whose schema is created by storage.Migrate.
+func NewSQLWalletRepo(db *sql.DB) WalletRepo {
+	return &sqlWalletRepo{db: db}
+}
+
+func (r *sqlWalletRepo) CreateWallet(ctx context.Context, wallet Wallet) (Wallet, error) {
+	wallet.ID = wallet.UserID // Kept same as userID for simplicity
+	wallet = wallet.withBalance(wallet.Balance)
+	wallet.CreatedAt = time.Now()
+	wallet.UpdatedAt = time.Now()
+
+	err := storage.RunInTx(ctx, r.db, func(ctx context.Context) error {
+		_, err := storage.Conn(ctx, r.db).ExecContext(ctx, `INSERT INTO wallets (id, user_id, currency, status, created_at, updated_at)
+			VALUES ($1, $2, $3, $4, $5, $6)`,
+			wallet.ID, wallet.UserID, wallet.Currency, wallet.Status, wallet.CreatedAt, wallet.UpdatedAt)
+		if err != nil {
+			return storage.DatabaseError(err)
+		}
+		for currency, balance := range wallet.Balances {
+			_, err = storage.Conn(ctx, r.db).ExecContext(ctx, `INSERT INTO wallet_balances (wallet_id, currency, balance) VALUES ($1, $2, $3)`,
+				wallet.ID, currency, balance.MinorUnits)
+			if err != nil {
+				return storage.DatabaseError(err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return Wallet{}, err
+	}
+	return wallet, nil
+}
+
+func (r *sqlWalletRepo) DisableWallet(ctx context.Context, userID string) error {
+	result, err := storage.Conn(ctx, r.db).ExecContext(ctx, `UPDATE wallets SET status = $2, version = version + 1, updated_at = $3 WHERE user_id = $1`, userID, Inactive, time.Now())
+	if err != nil {
+		return storage.DatabaseError(err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return storage.DatabaseError(err)
+	}
+	if affected == 0 {
+		return utils.NewErrorWithMessage(utils.ErrWalletNotFound, "Wallet not found for userID: "+userID)
+	}
+	return nil
+}
+
+func (r *sqlWalletRepo) AddCurrency(ctx context.Context, userID string, currency utils.Currency) (Wallet, error) {
+	wallet, err := r.GetWalletForUpdateByUserID(ctx, userID)
+	if err != nil {
+		return Wallet{}, err
+	}
+	defer r.ReleaseGetWalletForUpdateLock(ctx, userID)
+	if _, ok := wallet.BalanceIn(currency); ok {
+		return wallet, nil
+	}
+	wallet = wallet.withBalance(utils.NewMoney(0, currency))
+	wallet.UpdatedAt = time.Now()
+
+	err = storage.RunInTx(ctx, r.db, func(ctx context.Context) error {
+		_, err := storage.Conn(ctx, r.db).ExecContext(ctx, `INSERT INTO wallet_balances (wallet_id, currency, balance) VALUES ($1, $2, 0)`, wallet.ID, currency)
+		if err != nil {
+			return storage.DatabaseError(err)
+		}
+		_, err = storage.Conn(ctx, r.db).ExecContext(ctx, `UPDATE wallets SET version = version + 1, updated_at = $2 WHERE id = $1`, wallet.ID, wallet.UpdatedAt)
+		if err != nil {
+			return storage.DatabaseError(err)
+		}
+		return nil
+	})
+	if err != nil {
+		return Wallet{}, err
+	}
+	return wallet, nil
+}
+
+func (r *sqlWalletRepo) GetWalletByUserID(ctx context.Context, userID string) (Wallet, error) {
+	var wallet Wallet
+	err := storage.Conn(ctx, r.db).QueryRowContext(ctx, `SELECT id, user_id, currency, status, version, created_at, updated_at FROM wallets WHERE user_id = $1`, userID).
+		Scan(&wallet.ID, &wallet.UserID, &wallet.Currency, &wallet.Status, &wallet.Version, &wallet.CreatedAt, &wallet.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Wallet{}, utils.NewErrorWithMessage(utils.ErrWalletNotFound, "Wallet not found for userID: "+userID)
+	}
+	if err != nil {
+		return Wallet{}, storage.DatabaseError(err)
+	}
+
+	rows, err := storage.Conn(ctx, r.db).QueryContext(ctx, `SELECT currency, balance, held FROM wallet_balances WHERE wallet_id = $1`, wallet.ID)
+	if err != nil {
+		return Wallet{}, storage.DatabaseError(err)
+	}
+	defer rows.Close()
+	wallet.Balances = make(map[utils.Currency]utils.Money)
+	for rows.Next() {
+		var balance utils.Money
+		var held int64
+		err = rows.Scan(&balance.Currency, &balance.MinorUnits, &held)
+		if err != nil {
+			return Wallet{}, storage.DatabaseError(err)
+		}
+		wallet.Balances[balance.Currency] = balance
+		if held != 0 {
+			wallet = wallet.withHeld(utils.NewMoney(held, balance.Currency))
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return Wallet{}, storage.DatabaseError(err)
+	}
+	wallet.Balance = wallet.Balances[wallet.Currency]
+	return wallet.withAvailable(), nil
+}
+
+func (r *sqlWalletRepo) GetWalletForUpdateByUserID(ctx context.Context, userID string) (Wallet, error) {
+	// The wallet must exist before its mutex is created, otherwise any user ID would get one
+	_, err := r.GetWalletByUserID(ctx, userID)
+	if err != nil {
+		return Wallet{}, err
+	}
+	walletMutex, _ := r.walletMutexes.LoadOrStore(userID, newWalletLock())
+	err = walletMutex.(walletLock).lock(ctx, userID)
+	if err != nil {
+		return Wallet{}, err
+	}
+
+	// Read again under the lock, otherwise 2 transactions can get the same walletBalance
+	wallet, err := r.GetWalletByUserID(ctx, userID)
+	if err != nil {
+		walletMutex.(walletLock).unlock()
+		return Wallet{}, err
+	}
+	return wallet, nil
+}
+
+func (r *sqlWalletRepo) ReleaseGetWalletForUpdateLock(ctx context.Context, userID string) {
+	walletMutex, ok := r.walletMutexes.Load(userID)
+	if ok {
+		walletMutex.(walletLock).unlock()
+	}
+}
+
+func (r *sqlWalletRepo) UpdateWalletBalance(ctx context.Context, walletID string, newBalance utils.Money) error {
+	return r.updateBalanceColumn(ctx, walletID, "balance", newBalance, nil)
+}
+
+// CompareAndSwapWalletBalance compares the version in the same statement that increments it,
+// so it is atomic whether or not the wallet is locked.
+func (r *sqlWalletRepo) CompareAndSwapWalletBalance(ctx context.Context, walletID string, expectedVersion int64, newBalance utils.Money) error {
+	return r.updateBalanceColumn(ctx, walletID, "balance", newBalance, &expectedVersion)
+}
+
+func (r *sqlWalletRepo) UpdateWalletHeld(ctx context.Context, walletID string, newHeld utils.Money) error {
+	return r.updateBalanceColumn(ctx, walletID, "held", newHeld, nil)
+}
+
+// updateBalanceColumn sets the balance or held column of the wallet's row for the amount's
+// currency and increments the wallet's version, provided it is expectedVersion when set.
+func (r *sqlWalletRepo) updateBalanceColumn(ctx context.Context, walletID string, column string, amount utils.Money, expectedVersion *int64) error {
+	return storage.RunInTx(ctx, r.db, func(ctx context.Context) error {
+		conn := storage.Conn(ctx, r.db)
+		query := `UPDATE wallets SET version = version + 1, updated_at = $2 WHERE id = $1`
+		args := []any{walletID, time.Now()}
+		if expectedVersion != nil {
+			query += ` AND version = $3`
+			args = append(args, *expectedVersion)
+		}
+		result, err := conn.ExecContext(ctx, query, args...)
+		if err != nil {
+			return storage.DatabaseError(err)
+		}
+		if updated, _ := result.RowsAffected(); updated == 0 {
+			var wallets int
+			err = conn.QueryRowContext(ctx, `SELECT COUNT(*) FROM wallets WHERE id = $1`, walletID).Scan(&wallets)
+			if err != nil {
+				return storage.DatabaseError(err)
+			}
+			if wallets == 0 {
+				return utils.NewErrorWithMessage(utils.ErrInternalServerError, "Wallet not found for walletID: "+walletID)
+			}
+			return utils.NewErrorWithMessage(utils.ErrVersionConflict, "Wallet "+walletID+" changed since it was read")
+		}
+		result, err = conn.ExecContext(ctx, `UPDATE wallet_balances SET `+column+` = $3 WHERE wallet_id = $1 AND currency = $2`,
+			walletID, amount.Currency, amount.MinorUnits)
+		if err != nil {
+			return storage.DatabaseError(err)
+		}
+		if updated, _ := result.RowsAffected(); updated == 0 {
+			return utils.NewErrorWithMessage(utils.ErrCurrencyMismatch, "Wallet "+walletID+" does not hold "+string(amount.Currency))
+		}
+		return nil
+	})
+}
@@ -0,0 +1,99 @@
+package webhooks
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"syscall"
+	"time"
+
+	"concurrent_money_transfer_system/utils"
+)
+
+// sharedAddressSpace is the carrier-grade NAT range, which also holds the metadata service of
+// some clouds.
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// isPublicAddress reports whether webhooks may be sent to the address. Loopback, private,
+// link-local and multicast addresses are where the server's own services and those of its
+// network listen, such as the cloud metadata service at 169.254.169.254, which a partner must
+// not be able to reach through a webhook.
+func isPublicAddress(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsGlobalUnicast() && !addr.IsPrivate() && !sharedAddressSpace.Contains(addr)
+}
+
+// checkEndpointURL checks that the URL is an https URL whose host only resolves to public
+// addresses. When private endpoints are allowed, plain http and any address are accepted.
+func checkEndpointURL(ctx context.Context, rawURL string, allowPrivate bool) error {
+	endpointURL, err := url.Parse(rawURL)
+	if err != nil || endpointURL.Hostname() == "" {
+		return utils.NewErrorWithMessage(utils.ErrValidationError, "URL must be an absolute https URL")
+	}
+	if allowPrivate {
+		if endpointURL.Scheme != "http" && endpointURL.Scheme != "https" {
+			return utils.NewErrorWithMessage(utils.ErrValidationError, "URL must be an http or https URL")
+		}
+		return nil
+	}
+	if endpointURL.Scheme != "https" {
+		return utils.NewErrorWithMessage(utils.ErrValidationError, "URL must be an https URL")
+	}
+	addrs, err := resolve(ctx, endpointURL.Hostname())
+	if err != nil {
+		return utils.NewErrorWithMessage(utils.ErrValidationError, "URL host "+endpointURL.Hostname()+" cannot be resolved")
+	}
+	for _, addr := range addrs {
+		if !isPublicAddress(addr) {
+			return utils.NewErrorWithMessage(utils.ErrValidationError, "URL must not point to a loopback, private or link-local address")
+		}
+	}
+	return nil
+}
+
+// resolve returns the addresses of the host, which may be an IP address.
+func resolve(ctx context.Context, host string) ([]netip.Addr, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{addr}, nil
+	}
+	return net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+}
+
+// newDeliveryClient returns the client deliveries are sent with. Its host may resolve to
+// another address by the time a delivery is sent than when the endpoint was registered, so
+// the address is checked again as it is dialed, unless allowPrivate reports that private
+// endpoints are allowed. It connects directly rather than through a proxy, whose address is
+// the only one it could check, and does not follow redirects, which could lead anywhere.
+func newDeliveryClient(allowPrivate func() bool) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: DeliveryTimeout,
+		Control: func(network string, address string, _ syscall.RawConn) error {
+			if allowPrivate() {
+				return nil
+			}
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if !isPublicAddress(addrPort.Addr()) {
+				return fmt.Errorf("%s is not a public address", addrPort.Addr())
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout: DeliveryTimeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			ForceAttemptHTTP2:   true,
+			TLSHandshakeTimeout: DeliveryTimeout,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
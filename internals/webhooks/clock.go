@@ -0,0 +1,15 @@
+package webhooks
+
+import "time"
+
+// Clock tells the dispatcher the time, so tests can move it instead of waiting for retries.
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock is the wall clock.
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
@@ -0,0 +1,60 @@
+package webhooks
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	// DefaultDispatchInterval is how often due deliveries are looked for
+	DefaultDispatchInterval = 10 * time.Second
+	// MaxAttempts is how many times a delivery is tried before it becomes dead
+	MaxAttempts = 6
+	// InitialBackoff is the wait before the first retry; each later retry waits twice as long
+	InitialBackoff = 30 * time.Second
+	// MaxBackoff caps the wait between two retries
+	MaxBackoff = time.Hour
+	// DeliveryTimeout is how long an endpoint has to answer an attempt
+	DeliveryTimeout = 10 * time.Second
+	// MaxConcurrentDeliveries is how many due deliveries are sent at once
+	MaxConcurrentDeliveries = 8
+)
+
+// LoadDispatchInterval reads how often due deliveries are looked for from WEBHOOK_INTERVAL.
+func LoadDispatchInterval() (time.Duration, error) {
+	value := os.Getenv("WEBHOOK_INTERVAL")
+	if value == "" {
+		return DefaultDispatchInterval, nil
+	}
+	interval, err := time.ParseDuration(value)
+	if err != nil || interval <= 0 {
+		return 0, fmt.Errorf("invalid WEBHOOK_INTERVAL %q, expected a positive duration such as 10s", value)
+	}
+	return interval, nil
+}
+
+// LoadAllowPrivateEndpoints reads from WEBHOOK_ALLOW_PRIVATE_URLS whether endpoints may be
+// plain http URLs of any address, e.g. of a receiver on localhost during development. By
+// default they must be https URLs of public addresses.
+func LoadAllowPrivateEndpoints() (bool, error) {
+	value := os.Getenv("WEBHOOK_ALLOW_PRIVATE_URLS")
+	if value == "" {
+		return false, nil
+	}
+	allow, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid WEBHOOK_ALLOW_PRIVATE_URLS %q, expected true or false", value)
+	}
+	return allow, nil
+}
+
+// backoff returns how long to wait for the next attempt after the given number of failed ones.
+func backoff(failedAttempts int) time.Duration {
+	wait := InitialBackoff
+	for i := 1; i < failedAttempts && wait < MaxBackoff; i++ {
+		wait *= 2
+	}
+	return min(wait, MaxBackoff)
+}
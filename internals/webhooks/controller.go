@@ -0,0 +1,173 @@
+package webhooks
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"concurrent_money_transfer_system/internals/authz"
+	"concurrent_money_transfer_system/utils"
+)
+
+type WebhookController interface {
+	RegisterEndpoint(c *gin.Context)
+	GetEndpoint(c *gin.Context)
+	GetEndpointsByUserID(c *gin.Context)
+	DeleteEndpoint(c *gin.Context)
+	GetDeliveries(c *gin.Context)
+	GetDeadDeliveries(c *gin.Context)
+	Redeliver(c *gin.Context)
+}
+
+type webhookController struct {
+	service WebhookService
+}
+
+func NewWebhookController(service WebhookService) WebhookController {
+	return &webhookController{service: service}
+}
+
+// RegisterEndpoint responds with the endpoint's signing secret, which is not shown again.
+func (wc *webhookController) RegisterEndpoint(c *gin.Context) {
+	request := EndpointRequest{}
+	err := utils.BindAndValidateRequest(c, &request)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+	err = authz.AuthorizeOwner(c.Request.Context(), request.UserID)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+	endpoint, err := wc.service.RegisterEndpoint(c.Request.Context(), &request)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, endpoint)
+}
+
+func (wc *webhookController) GetEndpoint(c *gin.Context) {
+	endpoint, ok := wc.getEndpointForOwner(c, authz.RoleSupport, authz.RoleAdmin)
+	if !ok {
+		return
+	}
+	endpoint.Secret = ""
+	utils.ResponseSuccess(c, endpoint)
+}
+
+func (wc *webhookController) GetEndpointsByUserID(c *gin.Context) {
+	userID, ok := wc.getUserID(c)
+	if !ok {
+		return
+	}
+	endpoints, err := wc.service.GetEndpointsByUserID(c.Request.Context(), userID)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+	for i := range endpoints {
+		endpoints[i].Secret = ""
+	}
+	utils.ResponseSuccess(c, endpoints)
+}
+
+// Admins can delete endpoints, e.g. of a closed account, but not register them.
+func (wc *webhookController) DeleteEndpoint(c *gin.Context) {
+	endpoint, ok := wc.getEndpointForOwner(c, authz.RoleAdmin)
+	if !ok {
+		return
+	}
+	err := wc.service.DeleteEndpoint(c.Request.Context(), endpoint.ID)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+	utils.ResponseSuccess(c, gin.H{"message": "Webhook endpoint deleted successfully"})
+}
+
+// GetDeliveries responds with the delivery log of the endpoint: every delivery with its attempts.
+func (wc *webhookController) GetDeliveries(c *gin.Context) {
+	endpoint, ok := wc.getEndpointForOwner(c, authz.RoleSupport, authz.RoleAdmin)
+	if !ok {
+		return
+	}
+	deliveries, err := wc.service.GetDeliveriesByEndpointID(c.Request.Context(), endpoint.ID)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+	utils.ResponseSuccess(c, deliveries)
+}
+
+func (wc *webhookController) GetDeadDeliveries(c *gin.Context) {
+	userID, ok := wc.getUserID(c)
+	if !ok {
+		return
+	}
+	deliveries, err := wc.service.GetDeadDeliveries(c.Request.Context(), userID)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+	utils.ResponseSuccess(c, deliveries)
+}
+
+func (wc *webhookController) Redeliver(c *gin.Context) {
+	endpoint, ok := wc.getEndpointForOwner(c, authz.RoleAdmin)
+	if !ok {
+		return
+	}
+	delivery, err := wc.service.GetDelivery(c.Request.Context(), c.Param("delivery_id"))
+	if err == nil && delivery.EndpointID != endpoint.ID {
+		err = utils.NewError(utils.ErrWebhookDeliveryNotFound)
+	}
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+	delivery, err = wc.service.Redeliver(c.Request.Context(), delivery.ID)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return
+	}
+	utils.ResponseSuccess(c, delivery)
+}
+
+// getUserID returns the user_id parameter if the caller is that user or staff, responding
+// with the error otherwise.
+func (wc *webhookController) getUserID(c *gin.Context) (string, bool) {
+	userID := c.Param("user_id")
+	if userID == "" {
+		utils.ResponseError(c, utils.NewErrorWithMessage(utils.ErrInvalidRequest, "User ID is required"))
+		return "", false
+	}
+	err := authz.AuthorizeOwner(c.Request.Context(), userID, authz.RoleSupport, authz.RoleAdmin)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return "", false
+	}
+	return userID, true
+}
+
+// getEndpointForOwner returns the endpoint named by the id parameter if the caller is its
+// user or has one of the roles, responding with the error otherwise.
+func (wc *webhookController) getEndpointForOwner(c *gin.Context, roles ...authz.Role) (Endpoint, bool) {
+	id := c.Param("id")
+	if id == "" {
+		utils.ResponseError(c, utils.NewErrorWithMessage(utils.ErrInvalidRequest, "Webhook endpoint ID is required"))
+		return Endpoint{}, false
+	}
+	endpoint, err := wc.service.GetEndpoint(c.Request.Context(), id)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return Endpoint{}, false
+	}
+	err = authz.AuthorizeOwner(c.Request.Context(), endpoint.UserID, roles...)
+	if err != nil {
+		utils.ResponseError(c, err)
+		return Endpoint{}, false
+	}
+	return endpoint, true
+}
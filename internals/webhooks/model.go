@@ -0,0 +1,81 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"slices"
+	"time"
+
+	"concurrent_money_transfer_system/internals/events"
+)
+
+type DeliveryStatus string
+
+const (
+	Pending   DeliveryStatus = "pending"   // Waiting for its next attempt
+	Delivered DeliveryStatus = "delivered" // The endpoint answered an attempt with a 2xx status
+	Dead      DeliveryStatus = "dead"      // Every attempt failed; it stays in the dead-letter list until redelivered
+)
+
+// TransferEventTypes are the events that can be delivered to webhook endpoints. Endpoints
+// registered without event types receive all of them.
+var TransferEventTypes = []events.EventType{events.TransferCreated, events.TransferCompleted, events.TransferFailed}
+
+// Endpoint is a URL of a user that is sent the events of the transfers the user takes part in.
+type Endpoint struct {
+	ID         string             `json:"id"`
+	UserID     string             `json:"user_id"`
+	URL        string             `json:"url"`
+	Secret     string             `json:"secret,omitempty"` // Signs the deliveries; only shown when the endpoint is registered
+	EventTypes []events.EventType `json:"event_types"`
+	CreatedAt  time.Time          `json:"created_at"`
+}
+
+// Subscribes tells whether the endpoint receives events of the type.
+func (e Endpoint) Subscribes(eventType events.EventType) bool {
+	return slices.Contains(e.EventTypes, eventType)
+}
+
+// Delivery is an event to send to an endpoint, with the log of the attempts to send it.
+type Delivery struct {
+	ID            string            `json:"id"` // The same for every attempt, so receivers can skip deliveries they already handled
+	EndpointID    string            `json:"endpoint_id"`
+	UserID        string            `json:"user_id"`
+	EventID       string            `json:"event_id"`
+	EventType     events.EventType  `json:"event_type"`
+	Body          json.RawMessage   `json:"body"` // The event, exactly as it is signed and sent
+	Status        DeliveryStatus    `json:"status"`
+	NextAttemptAt *time.Time        `json:"next_attempt_at,omitempty"` // Unset once the delivery is delivered or dead
+	Attempts      []DeliveryAttempt `json:"attempts"`
+	CreatedAt     time.Time         `json:"created_at"`
+	UpdatedAt     time.Time         `json:"updated_at"`
+}
+
+// DeliveryAttempt is one try at sending a delivery.
+type DeliveryAttempt struct {
+	AttemptedAt time.Time `json:"attempted_at"`
+	StatusCode  int       `json:"status_code,omitempty"` // Unset when no response was received
+	Error       string    `json:"error,omitempty"`
+	Manual      bool      `json:"manual,omitempty"` // Asked for through the redelivery API rather than retried
+}
+
+// Succeeded tells whether the endpoint accepted the delivery.
+func (a DeliveryAttempt) Succeeded() bool {
+	return a.Error == "" && a.StatusCode >= 200 && a.StatusCode < 300
+}
+
+// retries returns how many of the delivery's attempts were made automatically.
+func (d Delivery) retries() int {
+	retries := 0
+	for _, attempt := range d.Attempts {
+		if !attempt.Manual {
+			retries++
+		}
+	}
+	return retries
+}
+
+type EndpointRequest struct {
+	UserID     string             `json:"user_id" validate:"required"`
+	URL        string             `json:"url" validate:"required,url"`
+	EventTypes []events.EventType `json:"event_types"` // All of TransferEventTypes when empty
+}
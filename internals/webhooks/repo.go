@@ -0,0 +1,254 @@
+package webhooks
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"concurrent_money_transfer_system/internals/storage"
+	"concurrent_money_transfer_system/utils"
+)
+
+// WAL record kinds of the webhook repo
+const (
+	endpointRecord        = "webhook.endpoint"         // Post-image of an endpoint
+	endpointDeletedRecord = "webhook.endpoint.deleted" // Endpoint deleted with its deliveries
+	deliveryRecord        = "webhook.delivery"         // Post-image of a delivery
+)
+
+type WebhookRepo interface {
+	CreateEndpoint(ctx context.Context, endpoint Endpoint) (Endpoint, error)
+	GetEndpoint(ctx context.Context, id string) (Endpoint, error)
+	// GetEndpointsByUserID returns the endpoints of the user, oldest first.
+	GetEndpointsByUserID(ctx context.Context, userID string) ([]Endpoint, error)
+	// DeleteEndpoint deletes the endpoint with its deliveries.
+	DeleteEndpoint(ctx context.Context, id string) error
+	// CreateDelivery saves the delivery unless one with its ID already exists, and returns the
+	// saved one, so an event published again is not delivered twice.
+	CreateDelivery(ctx context.Context, delivery Delivery) (Delivery, error)
+	GetDelivery(ctx context.Context, id string) (Delivery, error)
+	// GetDeliveriesByEndpointID returns the deliveries of the endpoint, oldest first.
+	GetDeliveriesByEndpointID(ctx context.Context, endpointID string) ([]Delivery, error)
+	// GetDeliveriesByUserID returns the deliveries of the user's endpoints with the status, oldest first.
+	GetDeliveriesByUserID(ctx context.Context, userID string, status DeliveryStatus) ([]Delivery, error)
+	// GetDueDeliveries returns the pending deliveries whose next attempt is at or before now,
+	// earliest first, then in the order they were created.
+	GetDueDeliveries(ctx context.Context, now time.Time) ([]Delivery, error)
+	// RecordAttempt appends the attempt to the delivery and saves the delivery's status and next attempt.
+	RecordAttempt(ctx context.Context, delivery Delivery, attempt DeliveryAttempt) (Delivery, error)
+}
+
+type webhookRepo struct {
+	endpoints  sync.Map
+	deliveries sync.Map
+	mu         sync.Mutex   // Keeps two copies of an event from both creating its delivery
+	wal        *storage.WAL // Writes are logged here first when set
+}
+
+func (r *webhookRepo) CreateEndpoint(ctx context.Context, endpoint Endpoint) (Endpoint, error) {
+	if endpoint.ID == "" {
+		endpoint.ID = utils.GenerateUniqueEntityId()
+	}
+	err := r.wal.Log(ctx, endpointRecord, endpoint, func() { r.endpoints.Store(endpoint.ID, endpoint) })
+	if err != nil {
+		return Endpoint{}, err
+	}
+	return endpoint, nil
+}
+
+func (r *webhookRepo) GetEndpoint(ctx context.Context, id string) (Endpoint, error) {
+	endpoint, ok := r.endpoints.Load(id)
+	if !ok {
+		return Endpoint{}, utils.NewError(utils.ErrWebhookNotFound)
+	}
+	return endpoint.(Endpoint), nil
+}
+
+func (r *webhookRepo) GetEndpointsByUserID(ctx context.Context, userID string) ([]Endpoint, error) {
+	endpoints := make([]Endpoint, 0)
+	r.endpoints.Range(func(key, value any) bool {
+		if value.(Endpoint).UserID == userID {
+			endpoints = append(endpoints, value.(Endpoint))
+		}
+		return true
+	})
+	sort.Slice(endpoints, func(i, j int) bool {
+		a, b := endpoints[i], endpoints[j]
+		return a.CreatedAt.Before(b.CreatedAt) || a.CreatedAt.Equal(b.CreatedAt) && a.ID < b.ID
+	})
+	return endpoints, nil
+}
+
+func (r *webhookRepo) DeleteEndpoint(ctx context.Context, id string) error {
+	endpoint, err := r.GetEndpoint(ctx, id)
+	if err != nil {
+		return err
+	}
+	return r.wal.Log(ctx, endpointDeletedRecord, endpoint, func() { r.deleteEndpoint(endpoint.ID) })
+}
+
+func (r *webhookRepo) deleteEndpoint(id string) {
+	r.endpoints.Delete(id)
+	r.deliveries.Range(func(key, value any) bool {
+		if value.(Delivery).EndpointID == id {
+			r.deliveries.Delete(key)
+		}
+		return true
+	})
+}
+
+func (r *webhookRepo) CreateDelivery(ctx context.Context, delivery Delivery) (Delivery, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	existing, err := r.GetDelivery(ctx, delivery.ID)
+	if err == nil {
+		return existing, nil
+	}
+	delivery.Attempts = make([]DeliveryAttempt, 0)
+	err = r.storeDelivery(ctx, delivery)
+	if err != nil {
+		return Delivery{}, err
+	}
+	return delivery, nil
+}
+
+func (r *webhookRepo) GetDelivery(ctx context.Context, id string) (Delivery, error) {
+	delivery, ok := r.deliveries.Load(id)
+	if !ok {
+		return Delivery{}, utils.NewError(utils.ErrWebhookDeliveryNotFound)
+	}
+	return delivery.(Delivery), nil
+}
+
+func (r *webhookRepo) GetDeliveriesByEndpointID(ctx context.Context, endpointID string) ([]Delivery, error) {
+	return r.filterDeliveries(func(delivery Delivery) bool {
+		return delivery.EndpointID == endpointID
+	}, byCreation), nil
+}
+
+func (r *webhookRepo) GetDeliveriesByUserID(ctx context.Context, userID string, status DeliveryStatus) ([]Delivery, error) {
+	return r.filterDeliveries(func(delivery Delivery) bool {
+		return delivery.UserID == userID && delivery.Status == status
+	}, byCreation), nil
+}
+
+func (r *webhookRepo) GetDueDeliveries(ctx context.Context, now time.Time) ([]Delivery, error) {
+	return r.filterDeliveries(func(delivery Delivery) bool {
+		return delivery.Status == Pending && delivery.NextAttemptAt != nil && !delivery.NextAttemptAt.After(now)
+	}, func(a, b Delivery) bool {
+		return a.NextAttemptAt.Before(*b.NextAttemptAt) || a.NextAttemptAt.Equal(*b.NextAttemptAt) && byCreation(a, b)
+	}), nil
+}
+
+func (r *webhookRepo) RecordAttempt(ctx context.Context, delivery Delivery, attempt DeliveryAttempt) (Delivery, error) {
+	previous, err := r.GetDelivery(ctx, delivery.ID)
+	if err != nil {
+		return Delivery{}, err
+	}
+	// Clipping makes append copy the stored attempts, so deliveries handed out earlier never see the new attempt
+	delivery.Attempts = append(slices.Clip(previous.Attempts), attempt)
+	err = r.storeDelivery(ctx, delivery)
+	if err != nil {
+		return Delivery{}, err
+	}
+	return delivery, nil
+}
+
+// storeDelivery logs the delivery to the WAL and stores it.
+func (r *webhookRepo) storeDelivery(ctx context.Context, delivery Delivery) error {
+	return r.wal.Log(ctx, deliveryRecord, delivery, func() { r.deliveries.Store(delivery.ID, delivery) })
+}
+
+func byCreation(a, b Delivery) bool {
+	return a.CreatedAt.Before(b.CreatedAt) || a.CreatedAt.Equal(b.CreatedAt) && a.ID < b.ID
+}
+
+// filterDeliveries returns the deliveries matching keep, sorted by less.
+func (r *webhookRepo) filterDeliveries(keep func(Delivery) bool, less func(a, b Delivery) bool) []Delivery {
+	deliveries := make([]Delivery, 0)
+	r.deliveries.Range(func(key, value any) bool {
+		if keep(value.(Delivery)) {
+			deliveries = append(deliveries, value.(Delivery))
+		}
+		return true
+	})
+	sort.Slice(deliveries, func(i, j int) bool { return less(deliveries[i], deliveries[j]) })
+	return deliveries
+}
+
+func (r *webhookRepo) SetWAL(wal *storage.WAL) {
+	r.wal = wal
+}
+
+func (r *webhookRepo) ApplyRecord(record storage.Record) (bool, error) {
+	switch record.Kind {
+	case endpointRecord, endpointDeletedRecord:
+		var endpoint Endpoint
+		err := record.Decode(&endpoint)
+		if err != nil {
+			return true, err
+		}
+		if record.Kind == endpointDeletedRecord {
+			r.deleteEndpoint(endpoint.ID)
+			return true, nil
+		}
+		r.endpoints.Store(endpoint.ID, endpoint)
+		return true, nil
+	case deliveryRecord:
+		var delivery Delivery
+		err := record.Decode(&delivery)
+		if err != nil {
+			return true, err
+		}
+		r.deliveries.Store(delivery.ID, delivery)
+		return true, nil
+	}
+	return false, nil
+}
+
+func (r *webhookRepo) SnapshotRecords() ([]storage.Record, error) {
+	records := make([]storage.Record, 0)
+	var err error
+	r.endpoints.Range(func(key, value any) bool {
+		var record storage.Record
+		record, err = storage.NewRecord(endpointRecord, value.(Endpoint))
+		records = append(records, record)
+		return err == nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	r.deliveries.Range(func(key, value any) bool {
+		var record storage.Record
+		record, err = storage.NewRecord(deliveryRecord, value.(Delivery))
+		records = append(records, record)
+		return err == nil
+	})
+	return records, err
+}
+
+var webhookRepoInstance *webhookRepo
+
+func NewWebhookRepo() WebhookRepo {
+	if webhookRepoInstance == nil {
+		webhookRepoInstance = &webhookRepo{
+			endpoints:  sync.Map{},
+			deliveries: sync.Map{},
+		}
+	}
+	return webhookRepoInstance
+}
+
+// Reset is just used for testing purposes
+func Reset() {
+	webhookRepoInstance.endpoints.Range(func(key, value any) bool {
+		webhookRepoInstance.endpoints.Delete(key)
+		return true
+	})
+	webhookRepoInstance.deliveries.Range(func(key, value any) bool {
+		webhookRepoInstance.deliveries.Delete(key)
+		return true
+	})
+}
@@ -0,0 +1,349 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"concurrent_money_transfer_system/internals/events"
+	"concurrent_money_transfer_system/utils"
+)
+
+type WebhookService interface {
+	RegisterEndpoint(ctx context.Context, request *EndpointRequest) (Endpoint, error)
+	GetEndpoint(ctx context.Context, id string) (Endpoint, error)
+	GetEndpointsByUserID(ctx context.Context, userID string) ([]Endpoint, error)
+	DeleteEndpoint(ctx context.Context, id string) error
+	GetDelivery(ctx context.Context, id string) (Delivery, error)
+	GetDeliveriesByEndpointID(ctx context.Context, endpointID string) ([]Delivery, error)
+	// GetDeadDeliveries returns the dead-letter list of the user: the deliveries to the user's
+	// endpoints that failed every attempt, oldest first.
+	GetDeadDeliveries(ctx context.Context, userID string) ([]Delivery, error)
+	// HandleEvent queues a delivery of a transfer event to every endpoint of the transfer's
+	// parties that subscribes to it. It is subscribed to the in-process event publisher.
+	HandleEvent(ctx context.Context, event events.Event) error
+	// DeliverDue attempts the deliveries due by the clock's now and returns how many of them
+	// the endpoints accepted.
+	DeliverDue(ctx context.Context) (int, error)
+	// Redeliver attempts the delivery at once, whatever its status. When the attempt fails, a
+	// pending delivery keeps its retries and a dead one stays dead.
+	Redeliver(ctx context.Context, id string) (Delivery, error)
+	Start(interval time.Duration, stop <-chan struct{})
+}
+
+type webhookService struct {
+	repo         WebhookRepo
+	client       *http.Client
+	clock        Clock
+	allowPrivate bool            // Endpoints may be plain http URLs of loopback, private or link-local addresses
+	mu           sync.Mutex      // Guards attempting, and orders recording attempts with deleting endpoints
+	attempting   map[string]bool // IDs of the deliveries being sent, which no one else may attempt meanwhile
+}
+
+func (s *webhookService) RegisterEndpoint(ctx context.Context, request *EndpointRequest) (Endpoint, error) {
+	err := checkEndpointURL(ctx, request.URL, s.allowPrivate)
+	if err != nil {
+		return Endpoint{}, err
+	}
+	eventTypes := request.EventTypes
+	if len(eventTypes) == 0 {
+		eventTypes = TransferEventTypes
+	}
+	for _, eventType := range eventTypes {
+		if !slices.Contains(TransferEventTypes, eventType) {
+			return Endpoint{}, utils.NewErrorWithMessage(utils.ErrValidationError, "Event type "+string(eventType)+" cannot be delivered to webhooks")
+		}
+	}
+	secret, err := newSecret()
+	if err != nil {
+		return Endpoint{}, utils.NewErrorWithMessage(utils.ErrInternalServerError, "Failed to generate a signing secret: "+err.Error())
+	}
+	return s.repo.CreateEndpoint(ctx, Endpoint{
+		UserID:     request.UserID,
+		URL:        request.URL,
+		Secret:     secret,
+		EventTypes: slices.Clone(eventTypes),
+		CreatedAt:  s.clock.Now(),
+	})
+}
+
+func (s *webhookService) GetEndpoint(ctx context.Context, id string) (Endpoint, error) {
+	return s.repo.GetEndpoint(ctx, id)
+}
+
+func (s *webhookService) GetEndpointsByUserID(ctx context.Context, userID string) ([]Endpoint, error) {
+	return s.repo.GetEndpointsByUserID(ctx, userID)
+}
+
+// DeleteEndpoint does not wait for the deliveries being sent to the endpoint, whose attempts
+// are dropped instead of recorded.
+func (s *webhookService) DeleteEndpoint(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.repo.DeleteEndpoint(ctx, id)
+}
+
+func (s *webhookService) GetDelivery(ctx context.Context, id string) (Delivery, error) {
+	return s.repo.GetDelivery(ctx, id)
+}
+
+func (s *webhookService) GetDeliveriesByEndpointID(ctx context.Context, endpointID string) ([]Delivery, error) {
+	return s.repo.GetDeliveriesByEndpointID(ctx, endpointID)
+}
+
+func (s *webhookService) GetDeadDeliveries(ctx context.Context, userID string) ([]Delivery, error) {
+	return s.repo.GetDeliveriesByUserID(ctx, userID, Dead)
+}
+
+func (s *webhookService) HandleEvent(ctx context.Context, event events.Event) error {
+	if !slices.Contains(TransferEventTypes, event.Type) {
+		return nil
+	}
+	var transfer events.TransferPayload
+	err := event.Decode(&transfer)
+	if err != nil {
+		return err
+	}
+	event.PublishedAt = nil // The body is the same whenever the event is published
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	now := s.clock.Now()
+	for _, userID := range []string{transfer.DebitUserID, transfer.CreditUserID} {
+		if userID == "" {
+			continue
+		}
+		endpoints, err := s.repo.GetEndpointsByUserID(ctx, userID)
+		if err != nil {
+			return err
+		}
+		for _, endpoint := range endpoints {
+			if !endpoint.Subscribes(event.Type) {
+				continue
+			}
+			_, err = s.repo.CreateDelivery(ctx, Delivery{
+				// An event published again maps to the same delivery, which is only created once
+				ID:            endpoint.ID + ":" + event.ID,
+				EndpointID:    endpoint.ID,
+				UserID:        endpoint.UserID,
+				EventID:       event.ID,
+				EventType:     event.Type,
+				Body:          body,
+				Status:        Pending,
+				NextAttemptAt: &now,
+				CreatedAt:     now,
+				UpdatedAt:     now,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// DeliverDue claims the due deliveries, sends them MaxConcurrentDeliveries at a time and then
+// records their attempts. The lock is only held to claim and to record, so a slow endpoint
+// holds up neither the other deliveries nor redeliveries and endpoint deletions.
+func (s *webhookService) DeliverDue(ctx context.Context) (int, error) {
+	claimed, err := s.claimDue(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var wg sync.WaitGroup
+	var resultsMutex sync.Mutex
+	delivered := 0
+	var firstErr error
+	slots := make(chan struct{}, MaxConcurrentDeliveries)
+	for _, claim := range claimed {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			delivery, err := s.attempt(ctx, claim, false)
+			resultsMutex.Lock()
+			defer resultsMutex.Unlock()
+			switch {
+			case utils.IsError(err, utils.ErrWebhookNotFound):
+				// The endpoint was deleted while the delivery was sent
+			case err != nil:
+				if firstErr == nil {
+					firstErr = err
+				}
+			case delivery.Status == Delivered:
+				delivered++
+			}
+		}()
+	}
+	wg.Wait()
+	return delivered, firstErr
+}
+
+func (s *webhookService) Redeliver(ctx context.Context, id string) (Delivery, error) {
+	s.mu.Lock()
+	delivery, err := s.repo.GetDelivery(ctx, id)
+	var claim claimedDelivery
+	if err == nil {
+		claim, err = s.claim(ctx, delivery)
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return Delivery{}, err
+	}
+	return s.attempt(ctx, claim, true)
+}
+
+// claimedDelivery is a delivery claimed for an attempt, with the endpoint to send it to.
+type claimedDelivery struct {
+	delivery Delivery
+	endpoint Endpoint
+}
+
+// claimDue claims the due deliveries that are not being attempted already.
+func (s *webhookService) claimDue(ctx context.Context) ([]claimedDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	deliveries, err := s.repo.GetDueDeliveries(ctx, s.clock.Now())
+	if err != nil {
+		return nil, err
+	}
+	claimed := make([]claimedDelivery, 0, len(deliveries))
+	for _, delivery := range deliveries {
+		claim, err := s.claim(ctx, delivery)
+		if utils.IsError(err, utils.ErrWebhookDeliveryBusy) {
+			continue
+		}
+		if err != nil {
+			for _, claim := range claimed {
+				delete(s.attempting, claim.delivery.ID)
+			}
+			return nil, err
+		}
+		claimed = append(claimed, claim)
+	}
+	return claimed, nil
+}
+
+// claim marks the delivery as being attempted, failing when it already is. s.mu must be held.
+func (s *webhookService) claim(ctx context.Context, delivery Delivery) (claimedDelivery, error) {
+	if s.attempting[delivery.ID] {
+		return claimedDelivery{}, utils.NewError(utils.ErrWebhookDeliveryBusy)
+	}
+	endpoint, err := s.repo.GetEndpoint(ctx, delivery.EndpointID)
+	if err != nil {
+		return claimedDelivery{}, err
+	}
+	s.attempting[delivery.ID] = true
+	return claimedDelivery{delivery: delivery, endpoint: endpoint}, nil
+}
+
+// attempt sends the claimed delivery to its endpoint, then records the attempt and releases
+// the claim. A failed retry is tried again after a backoff that doubles with each failure,
+// until MaxAttempts were made. The attempt is dropped when the endpoint was deleted meanwhile,
+// taking its deliveries with it.
+func (s *webhookService) attempt(ctx context.Context, claim claimedDelivery, manual bool) (Delivery, error) {
+	delivery := claim.delivery
+	now := s.clock.Now()
+	attempt := s.send(ctx, claim.endpoint, delivery, now)
+	attempt.Manual = manual
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer delete(s.attempting, delivery.ID)
+	_, err := s.repo.GetEndpoint(ctx, delivery.EndpointID)
+	if err != nil {
+		return Delivery{}, err
+	}
+	switch {
+	case attempt.Succeeded():
+		delivery.Status = Delivered
+		delivery.NextAttemptAt = nil
+	case manual:
+		// Redeliveries are asked for on top of the retries, which carry on as planned
+	case delivery.retries()+1 >= MaxAttempts:
+		delivery.Status = Dead
+		delivery.NextAttemptAt = nil
+	default:
+		next := now.Add(backoff(delivery.retries() + 1))
+		delivery.NextAttemptAt = &next
+	}
+	delivery.UpdatedAt = now
+	return s.repo.RecordAttempt(ctx, delivery, attempt)
+}
+
+// send posts the delivery's body to the endpoint, signed with the endpoint's secret.
+func (s *webhookService) send(ctx context.Context, endpoint Endpoint, delivery Delivery, now time.Time) DeliveryAttempt {
+	attempt := DeliveryAttempt{AttemptedAt: now}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.URL, bytes.NewReader(delivery.Body))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	timestamp := now.Unix()
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(DeliveryIDHeader, delivery.ID)
+	request.Header.Set(EventTypeHeader, string(delivery.EventType))
+	request.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	request.Header.Set(SignatureHeader, Sign(endpoint.Secret, timestamp, delivery.Body))
+	response, err := s.client.Do(request)
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64<<10)) // Lets the connection be reused
+	attempt.StatusCode = response.StatusCode
+	if !attempt.Succeeded() {
+		attempt.Error = "Endpoint answered " + response.Status
+	}
+	return attempt
+}
+
+// Start attempts the due deliveries every interval until stop is closed.
+func (s *webhookService) Start(interval time.Duration, stop <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				_, err := s.DeliverDue(context.Background())
+				if err != nil {
+					log.Printf("Failed to deliver webhooks: %v", err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+var webhookServiceInstance *webhookService
+
+func NewWebhookService(repo WebhookRepo, clock Clock, allowPrivate bool) WebhookService {
+	if webhookServiceInstance == nil {
+		service := &webhookService{repo: repo, clock: clock, allowPrivate: allowPrivate, attempting: make(map[string]bool)}
+		service.client = newDeliveryClient(func() bool { return service.allowPrivate })
+		webhookServiceInstance = service
+	}
+	return webhookServiceInstance
+}
+
+// SetClock is just used for testing purposes
+func SetClock(clock Clock) {
+	webhookServiceInstance.clock = clock
+}
+
+// SetAllowPrivateEndpoints is just used for testing purposes
+func SetAllowPrivateEndpoints(allowPrivate bool) {
+	webhookServiceInstance.allowPrivate = allowPrivate
+}
@@ -0,0 +1,44 @@
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+)
+
+// Headers of every delivery
+const (
+	DeliveryIDHeader = "X-Webhook-ID"
+	EventTypeHeader  = "X-Webhook-Event"
+	TimestampHeader  = "X-Webhook-Timestamp" // Unix seconds of the attempt, so receivers can reject old replays
+	SignatureHeader  = "X-Webhook-Signature"
+)
+
+// Sign returns the signature header of a delivery body sent at the timestamp:
+// "sha256=" followed by the hex HMAC-SHA256, keyed by the endpoint's secret, of the
+// timestamp, a dot and the body.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifySignature tells whether the signature was made by Sign with the secret, comparing in
+// constant time. Receivers written in Go can use it as is.
+func VerifySignature(secret string, timestamp int64, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, timestamp, body)), []byte(signature))
+}
+
+// newSecret returns a random signing secret.
+func newSecret() (string, error) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(key), nil
+}
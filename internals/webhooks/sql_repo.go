@@ -0,0 +1,257 @@
+package webhooks
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"concurrent_money_transfer_system/internals/events"
+	"concurrent_money_transfer_system/internals/storage"
+	"concurrent_money_transfer_system/utils"
+)
+
+// sqlWebhookRepo keeps endpoints in webhook_endpoints, their deliveries in webhook_deliveries
+// and the attempts of each delivery in webhook_attempts, numbered in the order they were made.
+type sqlWebhookRepo struct {
+	db *sql.DB
+}
+
+// NewSQLWebhookRepo returns a WebhookRepo backed by db, whose schema is created by storage.Migrate.
+func NewSQLWebhookRepo(db *sql.DB) WebhookRepo {
+	return &sqlWebhookRepo{db: db}
+}
+
+const endpointColumns = `id, user_id, url, secret, event_types, created_at`
+
+func scanEndpoint(row storage.Scanner) (Endpoint, error) {
+	var endpoint Endpoint
+	var eventTypes string
+	err := row.Scan(&endpoint.ID, &endpoint.UserID, &endpoint.URL, &endpoint.Secret, &eventTypes, &endpoint.CreatedAt)
+	if err != nil {
+		return Endpoint{}, err
+	}
+	endpoint.EventTypes = make([]events.EventType, 0)
+	for _, eventType := range strings.Split(eventTypes, ",") {
+		endpoint.EventTypes = append(endpoint.EventTypes, events.EventType(eventType))
+	}
+	return endpoint, nil
+}
+
+func (r *sqlWebhookRepo) CreateEndpoint(ctx context.Context, endpoint Endpoint) (Endpoint, error) {
+	if endpoint.ID == "" {
+		endpoint.ID = utils.GenerateUniqueEntityId()
+	}
+	eventTypes := make([]string, len(endpoint.EventTypes))
+	for i, eventType := range endpoint.EventTypes {
+		eventTypes[i] = string(eventType)
+	}
+	_, err := storage.Conn(ctx, r.db).ExecContext(ctx, `INSERT INTO webhook_endpoints (`+endpointColumns+`) VALUES ($1, $2, $3, $4, $5, $6)`,
+		endpoint.ID, endpoint.UserID, endpoint.URL, endpoint.Secret, strings.Join(eventTypes, ","), endpoint.CreatedAt)
+	if err != nil {
+		return Endpoint{}, storage.DatabaseError(err)
+	}
+	return endpoint, nil
+}
+
+func (r *sqlWebhookRepo) GetEndpoint(ctx context.Context, id string) (Endpoint, error) {
+	endpoint, err := scanEndpoint(storage.Conn(ctx, r.db).QueryRowContext(ctx, `SELECT `+endpointColumns+` FROM webhook_endpoints WHERE id = $1`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Endpoint{}, utils.NewError(utils.ErrWebhookNotFound)
+	}
+	if err != nil {
+		return Endpoint{}, storage.DatabaseError(err)
+	}
+	return endpoint, nil
+}
+
+func (r *sqlWebhookRepo) GetEndpointsByUserID(ctx context.Context, userID string) ([]Endpoint, error) {
+	rows, err := storage.Conn(ctx, r.db).QueryContext(ctx, `SELECT `+endpointColumns+` FROM webhook_endpoints
+		WHERE user_id = $1 ORDER BY created_at, id`, userID)
+	if err != nil {
+		return nil, storage.DatabaseError(err)
+	}
+	defer rows.Close()
+	endpoints := make([]Endpoint, 0)
+	for rows.Next() {
+		endpoint, err := scanEndpoint(rows)
+		if err != nil {
+			return nil, storage.DatabaseError(err)
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, storage.DatabaseError(err)
+	}
+	return endpoints, nil
+}
+
+func (r *sqlWebhookRepo) DeleteEndpoint(ctx context.Context, id string) error {
+	var deleted int64
+	err := storage.RunInTx(ctx, r.db, func(ctx context.Context) error {
+		conn := storage.Conn(ctx, r.db)
+		_, err := conn.ExecContext(ctx, `DELETE FROM webhook_attempts
+			WHERE delivery_id IN (SELECT id FROM webhook_deliveries WHERE endpoint_id = $1)`, id)
+		if err != nil {
+			return storage.DatabaseError(err)
+		}
+		_, err = conn.ExecContext(ctx, `DELETE FROM webhook_deliveries WHERE endpoint_id = $1`, id)
+		if err != nil {
+			return storage.DatabaseError(err)
+		}
+		result, err := conn.ExecContext(ctx, `DELETE FROM webhook_endpoints WHERE id = $1`, id)
+		if err != nil {
+			return storage.DatabaseError(err)
+		}
+		deleted, _ = result.RowsAffected()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return utils.NewError(utils.ErrWebhookNotFound)
+	}
+	return nil
+}
+
+const deliveryColumns = `id, endpoint_id, user_id, event_id, event_type, body, status, next_attempt_at, created_at, updated_at`
+
+func scanDelivery(row storage.Scanner) (Delivery, error) {
+	var delivery Delivery
+	var body string
+	var nextAttemptAt sql.NullTime
+	err := row.Scan(&delivery.ID, &delivery.EndpointID, &delivery.UserID, &delivery.EventID, &delivery.EventType, &body,
+		&delivery.Status, &nextAttemptAt, &delivery.CreatedAt, &delivery.UpdatedAt)
+	if err != nil {
+		return Delivery{}, err
+	}
+	delivery.Body = []byte(body)
+	if nextAttemptAt.Valid {
+		delivery.NextAttemptAt = &nextAttemptAt.Time
+	}
+	return delivery, nil
+}
+
+func (r *sqlWebhookRepo) CreateDelivery(ctx context.Context, delivery Delivery) (Delivery, error) {
+	_, err := storage.Conn(ctx, r.db).ExecContext(ctx, `INSERT INTO webhook_deliveries (`+deliveryColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) ON CONFLICT (id) DO NOTHING`,
+		delivery.ID, delivery.EndpointID, delivery.UserID, delivery.EventID, delivery.EventType, string(delivery.Body),
+		delivery.Status, delivery.NextAttemptAt, delivery.CreatedAt, delivery.UpdatedAt)
+	if err != nil {
+		return Delivery{}, storage.DatabaseError(err)
+	}
+	return r.GetDelivery(ctx, delivery.ID)
+}
+
+func (r *sqlWebhookRepo) GetDelivery(ctx context.Context, id string) (Delivery, error) {
+	delivery, err := scanDelivery(storage.Conn(ctx, r.db).QueryRowContext(ctx, `SELECT `+deliveryColumns+` FROM webhook_deliveries WHERE id = $1`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Delivery{}, utils.NewError(utils.ErrWebhookDeliveryNotFound)
+	}
+	if err != nil {
+		return Delivery{}, storage.DatabaseError(err)
+	}
+	delivery.Attempts, err = r.getAttempts(ctx, delivery.ID)
+	if err != nil {
+		return Delivery{}, err
+	}
+	return delivery, nil
+}
+
+func (r *sqlWebhookRepo) GetDeliveriesByEndpointID(ctx context.Context, endpointID string) ([]Delivery, error) {
+	return r.queryDeliveries(ctx, `WHERE endpoint_id = $1 ORDER BY created_at, id`, endpointID)
+}
+
+func (r *sqlWebhookRepo) GetDeliveriesByUserID(ctx context.Context, userID string, status DeliveryStatus) ([]Delivery, error) {
+	return r.queryDeliveries(ctx, `WHERE user_id = $1 AND status = $2 ORDER BY created_at, id`, userID, status)
+}
+
+func (r *sqlWebhookRepo) GetDueDeliveries(ctx context.Context, now time.Time) ([]Delivery, error) {
+	return r.queryDeliveries(ctx, `WHERE status = $1 AND next_attempt_at <= $2 ORDER BY next_attempt_at, created_at, id`, Pending, now)
+}
+
+func (r *sqlWebhookRepo) RecordAttempt(ctx context.Context, delivery Delivery, attempt DeliveryAttempt) (Delivery, error) {
+	err := storage.RunInTx(ctx, r.db, func(ctx context.Context) error {
+		conn := storage.Conn(ctx, r.db)
+		result, err := conn.ExecContext(ctx, `UPDATE webhook_deliveries SET status = $2, next_attempt_at = $3, updated_at = $4 WHERE id = $1`,
+			delivery.ID, delivery.Status, delivery.NextAttemptAt, delivery.UpdatedAt)
+		if err != nil {
+			return storage.DatabaseError(err)
+		}
+		if updated, _ := result.RowsAffected(); updated == 0 {
+			return utils.NewError(utils.ErrWebhookDeliveryNotFound)
+		}
+		var position int
+		err = conn.QueryRowContext(ctx, `SELECT COUNT(*) FROM webhook_attempts WHERE delivery_id = $1`, delivery.ID).Scan(&position)
+		if err != nil {
+			return storage.DatabaseError(err)
+		}
+		_, err = conn.ExecContext(ctx, `INSERT INTO webhook_attempts (delivery_id, position, attempted_at, status_code, error, manual)
+			VALUES ($1, $2, $3, $4, $5, $6)`,
+			delivery.ID, position, attempt.AttemptedAt, attempt.StatusCode, attempt.Error, attempt.Manual)
+		if err != nil {
+			return storage.DatabaseError(err)
+		}
+		return nil
+	})
+	if err != nil {
+		return Delivery{}, err
+	}
+	delivery.Attempts, err = r.getAttempts(ctx, delivery.ID)
+	if err != nil {
+		return Delivery{}, err
+	}
+	return delivery, nil
+}
+
+// queryDeliveries returns the deliveries selected by the condition, each with its attempts.
+func (r *sqlWebhookRepo) queryDeliveries(ctx context.Context, condition string, args ...any) ([]Delivery, error) {
+	rows, err := storage.Conn(ctx, r.db).QueryContext(ctx, `SELECT `+deliveryColumns+` FROM webhook_deliveries `+condition, args...)
+	if err != nil {
+		return nil, storage.DatabaseError(err)
+	}
+	defer rows.Close()
+	deliveries := make([]Delivery, 0)
+	for rows.Next() {
+		delivery, err := scanDelivery(rows)
+		if err != nil {
+			return nil, storage.DatabaseError(err)
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, storage.DatabaseError(err)
+	}
+	rows.Close() // frees the connection for the queries of the attempts
+	for i := range deliveries {
+		deliveries[i].Attempts, err = r.getAttempts(ctx, deliveries[i].ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return deliveries, nil
+}
+
+func (r *sqlWebhookRepo) getAttempts(ctx context.Context, deliveryID string) ([]DeliveryAttempt, error) {
+	rows, err := storage.Conn(ctx, r.db).QueryContext(ctx, `SELECT attempted_at, status_code, error, manual
+		FROM webhook_attempts WHERE delivery_id = $1 ORDER BY position`, deliveryID)
+	if err != nil {
+		return nil, storage.DatabaseError(err)
+	}
+	defer rows.Close()
+	attempts := make([]DeliveryAttempt, 0)
+	for rows.Next() {
+		var attempt DeliveryAttempt
+		err = rows.Scan(&attempt.AttemptedAt, &attempt.StatusCode, &attempt.Error, &attempt.Manual)
+		if err != nil {
+			return nil, storage.DatabaseError(err)
+		}
+		attempts = append(attempts, attempt)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, storage.DatabaseError(err)
+	}
+	return attempts, nil
+}
@@ -5,12 +5,29 @@ import (
 	"net/http"
 	"os"
 
+	"concurrent_money_transfer_system/internals/events"
+	"concurrent_money_transfer_system/internals/fx"
+	"concurrent_money_transfer_system/internals/ledger"
+	"concurrent_money_transfer_system/internals/limits"
+	"concurrent_money_transfer_system/internals/scheduler"
 	"concurrent_money_transfer_system/internals/server"
+	"concurrent_money_transfer_system/internals/storage"
+	"concurrent_money_transfer_system/internals/transactions"
+	"concurrent_money_transfer_system/internals/users"
+	"concurrent_money_transfer_system/internals/wallet"
+	"concurrent_money_transfer_system/internals/webhooks"
 	"concurrent_money_transfer_system/tests"
 )
 
 func main() {
 	log.Println("Starting server on port 8080")
+	config, err := storage.LoadConfig()
+	if err != nil {
+		log.Fatalf("Invalid storage configuration: %v", err)
+	}
+	if config.Backend == storage.Memory && config.WALDir != "" {
+		recoverMemoryStore(config)
+	}
 	router := server.SetupRouter()
 	// Check if the with_test_users flag is provided
 	withTestUsers := false
@@ -27,4 +44,30 @@ func main() {
 	}
 
 	log.Fatal(http.ListenAndServe(":8080", router))
-}
\ No newline at end of file
+}
+
+// recoverMemoryStore replays the WAL into the in-memory repos, which then log every write
+// to it, and starts taking periodic snapshots.
+func recoverMemoryStore(config storage.Config) {
+	repos := []storage.Journaled{
+		users.NewUserRepo().(storage.Journaled),
+		wallet.NewWalletRepo().(storage.Journaled),
+		transactions.NewTransactionRepo().(storage.Journaled),
+		ledger.NewLedgerRepo().(storage.Journaled),
+		limits.NewLimitsRepo().(storage.Journaled),
+		scheduler.NewScheduleRepo().(storage.Journaled),
+		events.NewOutboxRepo().(storage.Journaled),
+		webhooks.NewWebhookRepo().(storage.Journaled),
+		fx.NewQuoteRepo().(storage.Journaled),
+	}
+	wal, err := storage.OpenWAL(config.WALDir)
+	if err != nil {
+		log.Fatalf("Failed to open the WAL: %v", err)
+	}
+	err = wal.Recover(repos...)
+	if err != nil {
+		log.Fatalf("Failed to recover the in-memory store: %v", err)
+	}
+	log.Printf("Recovered the in-memory store from %s", config.WALDir)
+	wal.StartSnapshots(config.SnapshotInterval, nil, repos...)
+}
@@ -0,0 +1,278 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"concurrent_money_transfer_system/internals/authz"
+	"concurrent_money_transfer_system/internals/events"
+	"concurrent_money_transfer_system/internals/ledger"
+	"concurrent_money_transfer_system/internals/scheduler"
+	"concurrent_money_transfer_system/internals/storage"
+	"concurrent_money_transfer_system/internals/transactions"
+	"concurrent_money_transfer_system/internals/users"
+	"concurrent_money_transfer_system/internals/wallet"
+	"concurrent_money_transfer_system/tests"
+	"concurrent_money_transfer_system/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMain(m *testing.M) {
+	tests.Setup()
+	setup()
+	code := m.Run()
+	os.Exit(code)
+}
+
+// fakeClock is moved by the tests instead of waiting for runs to be due
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+// Monday 2025-03-03 08:00 UTC
+var startOfTest = time.Date(2025, 3, 3, 8, 0, 0, 0, time.UTC)
+
+var clock = &fakeClock{now: startOfTest}
+var walletRepo wallet.WalletRepo
+var schedulerService scheduler.SchedulerService
+
+var testData map[string]tests.TestData
+
+func setup() {
+	testData = tests.ReadTestData("test_data.json")
+	walletRepo = wallet.NewWalletRepo()
+	walletService := wallet.NewWalletService(walletRepo, ledger.NewLedgerService(ledger.NewLedgerRepo()), events.NewEventService(events.NewOutboxRepo(), events.NewInProcessPublisher()), storage.NewMemoryUnitOfWork(), wallet.DefaultLockTimeout, wallet.DefaultShards)
+	// The router already created the service, so this returns it
+	schedulerService = scheduler.NewSchedulerService(scheduler.NewScheduleRepo(), nil, clock)
+	scheduler.SetClock(clock)
+
+	ctx := context.Background()
+	for _, id := range []string{"s1", "s2"} {
+		users.NewUserRepo().CreateUser(users.User{ID: id, FirstName: "User " + id, Email: id + "@example.com", PhoneNumber: "+1234567890"})
+		walletService.CreateWallet(ctx, id, utils.MustParseMoney("100", utils.USD))
+	}
+	users.NewUserRepo().CreateUser(users.User{ID: "schedule-admin", FirstName: "Admin", Email: "schedule-admin@example.com", PhoneNumber: "+1234567890", Role: authz.RoleAdmin})
+}
+
+// resetSchedules puts the clock back and forgets the schedules of the previous test, so their
+// runs do not fall due in the next one.
+func resetSchedules() {
+	clock.now = startOfTest
+	scheduler.Reset()
+}
+
+func TestCreateSchedule(t *testing.T) {
+	defer resetSchedules()
+	test_data := testData["TestCreateSchedule"]
+	actual_response, _ := tests.MakeRequestAndGetResponse(t, test_data)
+	expected_response := test_data.Response.Body
+	expected_response["id"] = actual_response["id"]
+	assert.True(t, tests.SelectiveEqual(expected_response, actual_response))
+
+	schedules, err := schedulerService.GetSchedulesByUserID(context.Background(), "s1")
+	assert.NoError(t, err)
+	assert.Len(t, schedules, 1)
+	assert.Equal(t, actual_response["id"], schedules[0].ID)
+}
+
+func TestInvalidSchedules(t *testing.T) {
+	defer resetSchedules()
+	tests.MakeRequestAndValidateResponse(t, testData["TestScheduleFromAnotherUsersWallet"])
+	tests.MakeRequestAndValidateResponse(t, testData["TestScheduleWithIntervalAndCron"])
+	tests.MakeRequestAndValidateResponse(t, testData["TestScheduleInThePast"])
+}
+
+func TestOneOffScheduleRunsWhenDue(t *testing.T) {
+	defer resetSchedules()
+	senderWallet, err := walletRepo.GetWalletByUserID(context.Background(), "s1")
+	assert.NoError(t, err)
+	id := createSchedule(t, map[string]interface{}{"start_at": "2025-03-03T09:00:00Z"}, 201)["id"].(string)
+
+	ran, err := schedulerService.RunDue(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, ran)
+
+	clock.now = startOfTest.Add(time.Hour)
+	ran, err = schedulerService.RunDue(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, ran)
+
+	schedule, err := schedulerService.GetSchedule(context.Background(), id)
+	assert.NoError(t, err)
+	assert.Equal(t, scheduler.Completed, schedule.Status)
+	assert.Nil(t, schedule.NextRunAt)
+	assert.Len(t, schedule.Runs, 1)
+	assert.Equal(t, scheduler.RunCompleted, schedule.Runs[0].Status)
+	transaction, err := transactions.NewTransactionRepo().GetTransaction(context.Background(), schedule.Runs[0].TransactionID)
+	assert.NoError(t, err)
+	assert.Equal(t, transactions.Completed, transaction.Status)
+	assert.Equal(t, utils.MustParseMoney("10", utils.USD), transaction.Amount)
+
+	updatedSenderWallet, err := walletRepo.GetWalletByUserID(context.Background(), "s1")
+	assert.NoError(t, err)
+	assert.Equal(t, senderWallet.Balance.Sub(utils.MustParseMoney("10", utils.USD)), updatedSenderWallet.Balance)
+
+	// A completed schedule never runs again
+	clock.now = clock.now.Add(24 * time.Hour)
+	ran, err = schedulerService.RunDue(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, ran)
+}
+
+func TestCronScheduleSkipsMissedRuns(t *testing.T) {
+	defer resetSchedules()
+	// Mondays at 09:00, starting now
+	id := createSchedule(t, map[string]interface{}{"cron": "0 9 * * 1"}, 201)["id"].(string)
+
+	clock.now = time.Date(2025, 3, 3, 9, 0, 0, 0, time.UTC)
+	ran, err := schedulerService.RunDue(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, ran)
+	schedule, err := schedulerService.GetSchedule(context.Background(), id)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2025, 3, 10, 9, 0, 0, 0, time.UTC), *schedule.NextRunAt)
+
+	// The scheduler was down for three weeks, which makes one run and not three
+	clock.now = time.Date(2025, 3, 24, 9, 30, 0, 0, time.UTC)
+	ran, err = schedulerService.RunDue(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, ran)
+	schedule, err = schedulerService.GetSchedule(context.Background(), id)
+	assert.NoError(t, err)
+	assert.Equal(t, scheduler.Active, schedule.Status)
+	assert.Equal(t, time.Date(2025, 3, 31, 9, 0, 0, 0, time.UTC), *schedule.NextRunAt)
+	assert.Len(t, schedule.Runs, 2)
+	assert.Equal(t, time.Date(2025, 3, 10, 9, 0, 0, 0, time.UTC), schedule.Runs[1].DueAt)
+	assert.NotEqual(t, schedule.Runs[0].TransactionID, schedule.Runs[1].TransactionID)
+}
+
+func TestIntervalScheduleCompletesAtEnd(t *testing.T) {
+	defer resetSchedules()
+	id := createSchedule(t, map[string]interface{}{
+		"start_at": "2025-03-03T09:00:00Z",
+		"interval": "24h",
+		"end_at":   "2025-03-04T12:00:00Z",
+	}, 201)["id"].(string)
+
+	for _, now := range []time.Time{startOfTest.Add(time.Hour), startOfTest.Add(25 * time.Hour)} {
+		clock.now = now
+		ran, err := schedulerService.RunDue(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, 1, ran)
+	}
+	schedule, err := schedulerService.GetSchedule(context.Background(), id)
+	assert.NoError(t, err)
+	assert.Equal(t, scheduler.Completed, schedule.Status)
+	assert.Len(t, schedule.Runs, 2)
+}
+
+func TestFailedRunIsRecorded(t *testing.T) {
+	defer resetSchedules()
+	id := createSchedule(t, map[string]interface{}{
+		"start_at": "2025-03-03T09:00:00Z",
+		"interval": "24h",
+		"amount":   "100000",
+	}, 201)["id"].(string)
+
+	clock.now = startOfTest.Add(time.Hour)
+	ran, err := schedulerService.RunDue(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, ran)
+
+	schedule, err := schedulerService.GetSchedule(context.Background(), id)
+	assert.NoError(t, err)
+	assert.Len(t, schedule.Runs, 1)
+	assert.Equal(t, scheduler.RunFailed, schedule.Runs[0].Status)
+	assert.Equal(t, utils.ErrInsufficientBalance, schedule.Runs[0].ErrorCode)
+	assert.Empty(t, schedule.Runs[0].TransactionID)
+	// The schedule carries on with its next run
+	assert.Equal(t, scheduler.Active, schedule.Status)
+	assert.Equal(t, startOfTest.Add(25*time.Hour), *schedule.NextRunAt)
+}
+
+func TestScheduleAccess(t *testing.T) {
+	defer resetSchedules()
+	id := createSchedule(t, map[string]interface{}{"start_at": "2025-03-03T09:00:00Z"}, 201)["id"].(string)
+	url := fmt.Sprintf("api/schedule/%s", id)
+
+	scheduleRequest(t, "GET", url, "s2", nil, 403)
+	body := scheduleBody(map[string]interface{}{"start_at": "2025-03-03T10:00:00Z", "amount": "20"})
+	scheduleRequest(t, "PUT", url, "s2", body, 403)
+	response := scheduleRequest(t, "PUT", url, "s1", body, 200)
+	assert.Equal(t, "20.00", response["amount"])
+	assert.Equal(t, "2025-03-03T10:00:00Z", response["next_run_at"])
+
+	// The sender of a schedule cannot be changed, even by its sender
+	body["sender_id"], body["receiver_id"] = "s2", "s1"
+	response = scheduleRequest(t, "PUT", url, "s1", body, 400)
+	assert.Equal(t, "SenderID cannot be changed", response["message"])
+
+	scheduleRequest(t, "DELETE", url, "s2", nil, 403)
+	scheduleRequest(t, "DELETE", url, "schedule-admin", nil, 200)
+	response = scheduleRequest(t, "GET", url, "s1", nil, 404)
+	assert.Equal(t, "SCHEDULE_NOT_FOUND", response["code"])
+}
+
+func TestParseCron(t *testing.T) {
+	after := time.Date(2025, 3, 3, 8, 0, 0, 0, time.UTC) // Monday
+	for expr, next := range map[string]time.Time{
+		"* * * * *":       time.Date(2025, 3, 3, 8, 1, 0, 0, time.UTC),
+		"*/15 * * * *":    time.Date(2025, 3, 3, 8, 15, 0, 0, time.UTC),
+		"30 9-17 * * 1-5": time.Date(2025, 3, 3, 9, 30, 0, 0, time.UTC),
+		"0 0 1 * *":       time.Date(2025, 4, 1, 0, 0, 0, 0, time.UTC),
+		"0 12 * * 0":      time.Date(2025, 3, 9, 12, 0, 0, 0, time.UTC),
+		"0 12 * * 7":      time.Date(2025, 3, 9, 12, 0, 0, 0, time.UTC),
+		"0 0 29 2 *":      time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC),
+		"0 6 15 * 3":      time.Date(2025, 3, 5, 6, 0, 0, 0, time.UTC), // either the 15th or a Wednesday
+		"5,10 8 3 3 *":    time.Date(2025, 3, 3, 8, 5, 0, 0, time.UTC),
+		"0 0/12 * * *":    time.Date(2025, 3, 3, 12, 0, 0, 0, time.UTC),
+		"0 0 31 2 *":      {}, // never
+	} {
+		cron, err := scheduler.ParseCron(expr)
+		assert.NoError(t, err, expr)
+		assert.Equal(t, next, cron.Next(after), expr)
+	}
+
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8", "5-1 * * * *", "*/0 * * * *", "a * * * *"} {
+		_, err := scheduler.ParseCron(expr)
+		assert.True(t, utils.IsError(err, utils.ErrValidationError), expr)
+	}
+}
+
+// scheduleBody is a transfer of 10 USD from s1 to s2 with the fields overridden
+func scheduleBody(fields map[string]interface{}) map[string]interface{} {
+	body := map[string]interface{}{
+		"sender_id":   "s1",
+		"receiver_id": "s2",
+		"amount":      "10",
+		"currency":    "USD",
+	}
+	for key, value := range fields {
+		body[key] = value
+	}
+	return body
+}
+
+func createSchedule(t *testing.T, fields map[string]interface{}, status int) map[string]interface{} {
+	return scheduleRequest(t, "POST", "api/schedule", "s1", scheduleBody(fields), status)
+}
+
+func scheduleRequest(t *testing.T, method string, url string, asUser string, body map[string]interface{}, status int) map[string]interface{} {
+	response, _ := tests.MakeRequestAndGetResponse(t, tests.TestData{
+		Request: tests.Request{
+			URL:    url,
+			Method: method,
+			AsUser: asUser,
+			Body:   body,
+		},
+		Response: tests.Response{Status: status},
+	})
+	return response
+}
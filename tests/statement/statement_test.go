@@ -0,0 +1,222 @@
+package statement
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/xml"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"concurrent_money_transfer_system/internals/events"
+	"concurrent_money_transfer_system/internals/ledger"
+	"concurrent_money_transfer_system/internals/storage"
+	"concurrent_money_transfer_system/internals/transactions"
+	"concurrent_money_transfer_system/internals/users"
+	"concurrent_money_transfer_system/internals/wallet"
+	"concurrent_money_transfer_system/tests"
+	"concurrent_money_transfer_system/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMain(m *testing.M) {
+	tests.Setup()
+	setup()
+	code := m.Run()
+	os.Exit(code)
+}
+
+func date(month time.Month, day int) time.Time {
+	return time.Date(2025, month, day, 12, 0, 0, 0, time.UTC)
+}
+
+// setup gives statement-1 a history around February 2025: it opened its wallet with 1000 USD
+// and then made these transactions, of which only the completed ones in February are booked
+// on its February statement. statement-3 captured two holds after creating them.
+func setup() {
+	ctx := context.Background()
+	ledgerService := ledger.NewLedgerService(ledger.NewLedgerRepo())
+	// The router already created the service, so this returns it
+	walletService := wallet.NewWalletService(wallet.NewWalletRepo(), ledgerService, events.NewEventService(events.NewOutboxRepo(), events.NewInProcessPublisher()),
+		storage.NewMemoryUnitOfWork(), wallet.DefaultLockTimeout, wallet.DefaultShards)
+	for _, id := range []string{"statement-1", "statement-2", "statement-3"} {
+		users.NewUserRepo().CreateUser(users.User{ID: id, FirstName: "User " + id, Email: id + "@example.com", PhoneNumber: "+1234567890"})
+		walletService.CreateWallet(ctx, id, utils.MustParseMoney("1000", utils.USD))
+	}
+
+	expiresAt := date(time.February, 15).Add(15 * time.Minute)
+	capturedAt := func(month time.Month, day int) *time.Time {
+		at := date(month, day)
+		return &at
+	}
+	for _, transaction := range []transactions.Transaction{
+		{ID: "statement-tx-1", DebitUserID: transactions.SystemUserID, CreditUserID: "statement-1", Amount: utils.MustParseMoney("500", utils.USD), Status: transactions.Completed, TransactionType: transactions.Deposit, CreatedAt: date(time.January, 5)},
+		{ID: "statement-tx-2", DebitUserID: "statement-1", CreditUserID: "statement-2", Amount: utils.MustParseMoney("200", utils.USD), Status: transactions.Completed, TransactionType: transactions.Transfer, CreatedAt: date(time.February, 3), Description: "=HYPERLINK(\"x\")"},
+		{ID: "statement-tx-3", DebitUserID: "statement-2", CreditUserID: "statement-1", Amount: utils.MustParseMoney("50", utils.USD), Status: transactions.Completed, TransactionType: transactions.Transfer, CreatedAt: date(time.February, 10), Description: "Lunch"},
+		{ID: "statement-tx-4", DebitUserID: "statement-1", CreditUserID: "statement-2", Amount: utils.MustParseMoney("30", utils.USD), Status: transactions.Failed, TransactionType: transactions.Transfer, CreatedAt: date(time.February, 12)},
+		{ID: "statement-tx-5", DebitUserID: "statement-1", CreditUserID: "statement-2", Amount: utils.MustParseMoney("40", utils.USD), Status: transactions.Pending, TransactionType: transactions.Transfer, CreatedAt: date(time.February, 15), ExpiresAt: &expiresAt},
+		{ID: "statement-tx-6", DebitUserID: "statement-1", CreditUserID: transactions.SystemUserID, Amount: utils.MustParseMoney("100", utils.USD), Status: transactions.Completed, TransactionType: transactions.Withdrawal, CreatedAt: date(time.February, 20)},
+		{ID: "statement-tx-7", DebitUserID: "statement-1", CreditUserID: "statement-2", Amount: utils.MustParseMoney("70", utils.USD), Status: transactions.Completed, TransactionType: transactions.Transfer, CreatedAt: date(time.March, 2)},
+		{ID: "statement-hold-1", DebitUserID: "statement-3", CreditUserID: "statement-2", Amount: utils.MustParseMoney("100", utils.USD), Status: transactions.Completed, TransactionType: transactions.Transfer, CreatedAt: date(time.January, 20), ExpiresAt: capturedAt(time.March, 31), SettledAt: capturedAt(time.February, 12)},
+		{ID: "statement-tx-8", DebitUserID: "statement-3", CreditUserID: "statement-2", Amount: utils.MustParseMoney("20", utils.USD), Status: transactions.Completed, TransactionType: transactions.Transfer, CreatedAt: date(time.February, 10), SettledAt: capturedAt(time.February, 10)},
+		{ID: "statement-hold-2", DebitUserID: "statement-3", CreditUserID: "statement-2", Amount: utils.MustParseMoney("60", utils.USD), Status: transactions.Completed, TransactionType: transactions.Transfer, CreatedAt: date(time.February, 25), ExpiresAt: capturedAt(time.March, 31), SettledAt: capturedAt(time.March, 5)},
+	} {
+		transaction.Currency = transaction.Amount.Currency
+		transaction.UpdatedAt = transaction.CreatedAt
+		transactions.NewTransactionRepo().CreateTransaction(ctx, transaction)
+	}
+	// 1000 + 500 - 200 + 50 - 100 - 70
+	wallet.NewWalletRepo().UpdateWalletBalance(ctx, "statement-1", utils.MustParseMoney("1180", utils.USD))
+	// 1000 - 100 - 20 - 60
+	wallet.NewWalletRepo().UpdateWalletBalance(ctx, "statement-3", utils.MustParseMoney("820", utils.USD))
+}
+
+func getStatement(t *testing.T, query string, asUser string, status int) []byte {
+	recorder := tests.MakeRequest(t, tests.TestData{
+		Request:  tests.Request{URL: "wallets/statement?" + query, Method: "GET", AsUser: asUser},
+		Response: tests.Response{Status: status},
+	})
+	return recorder.Body.Bytes()
+}
+
+func TestCSVStatement(t *testing.T) {
+	// A transfer made now is after the period, so it changes the balance but not the statement
+	tests.MakeRequestAndGetResponse(t, tests.TestData{
+		Request: tests.Request{
+			URL:    "api/transaction/transfer",
+			Method: "POST",
+			AsUser: "statement-1",
+			Body:   map[string]interface{}{"sender_id": "statement-1", "receiver_id": "statement-2", "amount": "10", "currency": "USD"},
+		},
+		Response: tests.Response{Status: 200},
+	})
+
+	body := getStatement(t, "user_id=statement-1&from=2025-02-01&to=2025-02-28", "statement-1", 200)
+	rows, err := csv.NewReader(bytes.NewReader(body)).ReadAll()
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{
+		{"booked_at", "transaction_id", "type", "counterparty_id", "description", "amount", "currency", "balance"},
+		{"2025-02-01T00:00:00Z", "", "opening_balance", "", "", "", "USD", "1500.00"},
+		{"2025-02-03T12:00:00Z", "statement-tx-2", "transfer", "statement-2", "'=HYPERLINK(\"x\")", "-200.00", "USD", "1300.00"},
+		{"2025-02-10T12:00:00Z", "statement-tx-3", "transfer", "statement-2", "Lunch", "50.00", "USD", "1350.00"},
+		{"2025-02-20T12:00:00Z", "statement-tx-6", "withdrawal", "system", "", "-100.00", "USD", "1250.00"},
+		{"2025-03-01T00:00:00Z", "", "closing_balance", "", "", "", "USD", "1250.00"},
+	}, rows)
+
+	// A period without transactions opens and closes with the same balance
+	body = getStatement(t, "user_id=statement-1&from=2025-01-10T00:00:00Z&to=2025-02-01T00:00:00Z&format=csv", "statement-1", 200)
+	rows, err = csv.NewReader(bytes.NewReader(body)).ReadAll()
+	assert.NoError(t, err)
+	assert.Len(t, rows, 3)
+	assert.Equal(t, "1500.00", rows[1][7])
+	assert.Equal(t, "1500.00", rows[2][7])
+}
+
+func TestStatementBooksHoldsWhenCaptured(t *testing.T) {
+	// The hold created in January is booked in February and the one created in February in
+	// March, when their amounts left the balance
+	body := getStatement(t, "user_id=statement-3&from=2025-02-01&to=2025-02-28", "statement-3", 200)
+	rows, err := csv.NewReader(bytes.NewReader(body)).ReadAll()
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{
+		{"booked_at", "transaction_id", "type", "counterparty_id", "description", "amount", "currency", "balance"},
+		{"2025-02-01T00:00:00Z", "", "opening_balance", "", "", "", "USD", "1000.00"},
+		{"2025-02-10T12:00:00Z", "statement-tx-8", "transfer", "statement-2", "", "-20.00", "USD", "980.00"},
+		{"2025-02-12T12:00:00Z", "statement-hold-1", "transfer", "statement-2", "", "-100.00", "USD", "880.00"},
+		{"2025-03-01T00:00:00Z", "", "closing_balance", "", "", "", "USD", "880.00"},
+	}, rows)
+}
+
+func TestOFXStatement(t *testing.T) {
+	body := getStatement(t, "user_id=statement-1&from=2025-02-01&to=2025-02-28&format=ofx", "statement-1", 200)
+	assert.True(t, strings.Contains(string(body), `<?OFX OFXHEADER="200" VERSION="220"`))
+	var ofx struct {
+		Currency     string `xml:"BANKMSGSRSV1>STMTTRNRS>STMTRS>CURDEF"`
+		AccountID    string `xml:"BANKMSGSRSV1>STMTTRNRS>STMTRS>BANKACCTFROM>ACCTID"`
+		Transactions []struct {
+			Type   string `xml:"TRNTYPE"`
+			Amount string `xml:"TRNAMT"`
+			ID     string `xml:"FITID"`
+			Memo   string `xml:"MEMO"`
+		} `xml:"BANKMSGSRSV1>STMTTRNRS>STMTRS>BANKTRANLIST>STMTTRN"`
+		Balance string `xml:"BANKMSGSRSV1>STMTTRNRS>STMTRS>LEDGERBAL>BALAMT"`
+	}
+	assert.NoError(t, xml.Unmarshal(body, &ofx))
+	assert.Equal(t, "USD", ofx.Currency)
+	assert.Equal(t, "statement-1", ofx.AccountID)
+	assert.Len(t, ofx.Transactions, 3)
+	assert.Equal(t, "DEBIT", ofx.Transactions[0].Type)
+	assert.Equal(t, "-200.00", ofx.Transactions[0].Amount)
+	assert.Equal(t, "statement-tx-2", ofx.Transactions[0].ID)
+	assert.Equal(t, "CREDIT", ofx.Transactions[1].Type)
+	assert.Equal(t, "Lunch", ofx.Transactions[1].Memo)
+	assert.Equal(t, "1250.00", ofx.Balance)
+}
+
+func TestCamt053Statement(t *testing.T) {
+	recorder := tests.MakeRequest(t, tests.TestData{
+		Request:  tests.Request{URL: "wallets/statement?user_id=statement-1&from=2025-02-01&to=2025-02-28&format=camt053", Method: "GET", AsUser: "statement-1"},
+		Response: tests.Response{Status: 200},
+	})
+	assert.Equal(t, "application/xml", recorder.Header().Get("Content-Type"))
+	assert.True(t, strings.HasSuffix(recorder.Header().Get("Content-Disposition"), `.xml"`))
+
+	type amount struct {
+		Currency string `xml:"Ccy,attr"`
+		Value    string `xml:",chardata"`
+	}
+	var camt struct {
+		Namespace string `xml:"xmlns,attr"`
+		Balances  []struct {
+			Type        string `xml:"Tp>CdOrPrtry>Cd"`
+			Amount      amount `xml:"Amt"`
+			CreditDebit string `xml:"CdtDbtInd"`
+		} `xml:"BkToCstmrStmt>Stmt>Bal"`
+		Count      int    `xml:"BkToCstmrStmt>Stmt>TxsSummry>TtlNtries>NbOfNtries"`
+		DebitCount int    `xml:"BkToCstmrStmt>Stmt>TxsSummry>TtlDbtNtries>NbOfNtries"`
+		DebitSum   string `xml:"BkToCstmrStmt>Stmt>TxsSummry>TtlDbtNtries>Sum"`
+		Entries    []struct {
+			Amount      amount `xml:"Amt"`
+			CreditDebit string `xml:"CdtDbtInd"`
+			Status      string `xml:"Sts>Cd"`
+			Code        string `xml:"BkTxCd>Prtry>Cd"`
+			EndToEndID  string `xml:"NtryDtls>TxDtls>Refs>EndToEndId"`
+		} `xml:"BkToCstmrStmt>Stmt>Ntry"`
+	}
+	assert.NoError(t, xml.Unmarshal(recorder.Body.Bytes(), &camt))
+	assert.Equal(t, "urn:iso:std:iso:20022:tech:xsd:camt.053.001.08", camt.Namespace)
+	assert.Len(t, camt.Balances, 2)
+	assert.Equal(t, "OPBD", camt.Balances[0].Type)
+	assert.Equal(t, amount{Currency: "USD", Value: "1500.00"}, camt.Balances[0].Amount)
+	assert.Equal(t, "CLBD", camt.Balances[1].Type)
+	assert.Equal(t, amount{Currency: "USD", Value: "1250.00"}, camt.Balances[1].Amount)
+	assert.Equal(t, 3, camt.Count)
+	assert.Equal(t, 2, camt.DebitCount)
+	assert.Equal(t, "300.00", camt.DebitSum)
+	assert.Len(t, camt.Entries, 3)
+	assert.Equal(t, "200.00", camt.Entries[0].Amount.Value)
+	assert.Equal(t, "DBIT", camt.Entries[0].CreditDebit)
+	assert.Equal(t, "BOOK", camt.Entries[0].Status)
+	assert.Equal(t, "transfer", camt.Entries[0].Code)
+	assert.Equal(t, "statement-tx-2", camt.Entries[0].EndToEndID)
+	assert.Equal(t, "CRDT", camt.Entries[1].CreditDebit)
+}
+
+func TestStatementRequestIsChecked(t *testing.T) {
+	for _, request := range []struct {
+		query  string
+		asUser string
+		status int
+	}{
+		{"user_id=statement-1&from=2025-02-01&to=2025-02-28", "statement-2", 403},
+		{"user_id=statement-1&from=2025-02-01&to=2025-02-28&format=pdf", "statement-1", 400},
+		{"user_id=statement-1&from=2025-02-01", "statement-1", 400},
+		{"user_id=statement-1&from=2025-03-01&to=2025-02-01", "statement-1", 400},
+		{"user_id=statement-1&from=February&to=2025-02-28", "statement-1", 400},
+		{"user_id=statement-1&from=2025-02-01&to=2025-02-28&currency=EUR", "statement-1", 400},
+	} {
+		getStatement(t, request.query, request.asUser, request.status)
+	}
+}
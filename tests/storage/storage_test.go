@@ -0,0 +1,635 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"concurrent_money_transfer_system/internals/authz"
+	"concurrent_money_transfer_system/internals/events"
+	"concurrent_money_transfer_system/internals/fx"
+	"concurrent_money_transfer_system/internals/ledger"
+	"concurrent_money_transfer_system/internals/limits"
+	"concurrent_money_transfer_system/internals/scheduler"
+	"concurrent_money_transfer_system/internals/storage"
+	"concurrent_money_transfer_system/internals/transactions"
+	"concurrent_money_transfer_system/internals/users"
+	"concurrent_money_transfer_system/internals/wallet"
+	"concurrent_money_transfer_system/internals/webhooks"
+	"concurrent_money_transfer_system/utils"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func openSQLite(t *testing.T, path string) *sql.DB {
+	db, err := storage.Open(storage.Config{Backend: storage.SQLite, DSN: path})
+	assert.NoError(t, err)
+	return db
+}
+
+func TestSQLReposPersistAcrossRestart(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "money_transfer.db")
+	db := openSQLite(t, path)
+
+	_, err := users.NewSQLUserRepo(db).CreateUser(users.User{ID: "1", FirstName: "Mark", PhoneNumber: "+1234567890", Email: "mark@facebook.com", Password: "password"})
+	assert.NoError(t, err)
+
+	walletRepo := wallet.NewSQLWalletRepo(db)
+	_, err = walletRepo.CreateWallet(ctx, wallet.Wallet{UserID: "1", Balance: utils.MustParseMoney("100", utils.USD), Currency: utils.USD, Status: wallet.Active})
+	assert.NoError(t, err)
+	_, err = walletRepo.AddCurrency(ctx, "1", utils.EUR)
+	assert.NoError(t, err)
+	assert.NoError(t, walletRepo.UpdateWalletBalance(ctx, "1", utils.MustParseMoney("25.50", utils.EUR)))
+
+	refunded := utils.MustParseMoney("1.25", utils.USD)
+	target := utils.MustParseMoney("9.20", utils.EUR)
+	settledAt := time.Date(2025, 3, 3, 8, 0, 0, 0, time.UTC)
+	_, err = transactions.NewSQLTransactionRepo(db).CreateTransaction(ctx, transactions.Transaction{
+		ID:              "tx-1",
+		DebitUserID:     "1",
+		CreditUserID:    "2",
+		Amount:          utils.MustParseMoney("10", utils.USD),
+		Currency:        utils.USD,
+		Status:          transactions.Completed,
+		TransactionType: transactions.Transfer,
+		IdempotencyKey:  "key-1",
+		RefundedAmount:  &refunded,
+		TargetAmount:    &target,
+		TargetCurrency:  utils.EUR,
+		FXRate:          "0.92",
+		CreatedAt:       time.Now(),
+		UpdatedAt:       time.Now(),
+		SettledAt:       &settledAt,
+	})
+	assert.NoError(t, err)
+
+	_, err = ledger.NewSQLLedgerRepo(db).CreateEntry(ctx, ledger.Entry{
+		TransactionID: "tx-1",
+		Postings: []ledger.Posting{
+			{AccountID: ledger.OpeningBalanceAccountID, Direction: ledger.Debit, Amount: utils.MustParseMoney("100", utils.USD), Currency: utils.USD},
+			{AccountID: ledger.WalletAccountID("1"), Direction: ledger.Credit, Amount: utils.MustParseMoney("100", utils.USD), Currency: utils.USD},
+		},
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, db.Close())
+
+	// Reopening runs the migrations again, which must leave the data untouched
+	db = openSQLite(t, path)
+	defer db.Close()
+
+	user, err := users.NewSQLUserRepo(db).GetUser("1")
+	assert.NoError(t, err)
+	assert.Equal(t, "mark@facebook.com", user.Email)
+	assert.Equal(t, authz.RoleUser, user.Role)
+
+	wal, err := wallet.NewSQLWalletRepo(db).GetWalletByUserID(ctx, "1")
+	assert.NoError(t, err)
+	assert.Equal(t, utils.MustParseMoney("100", utils.USD), wal.Balance)
+	eurBalance, ok := wal.BalanceIn(utils.EUR)
+	assert.True(t, ok)
+	assert.Equal(t, utils.MustParseMoney("25.50", utils.EUR), eurBalance)
+
+	transaction, err := transactions.NewSQLTransactionRepo(db).GetTransactionByIdempotencyKey(ctx, "key-1")
+	assert.NoError(t, err)
+	assert.Equal(t, "tx-1", transaction.ID)
+	assert.Equal(t, utils.MustParseMoney("10", utils.USD), transaction.Amount)
+	assert.Equal(t, &refunded, transaction.RefundedAmount)
+	assert.Equal(t, &target, transaction.TargetAmount)
+	assert.Equal(t, &settledAt, transaction.SettledAt)
+
+	entries, err := ledger.NewSQLLedgerRepo(db).GetEntriesByTransactionID(ctx, "tx-1")
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+	assert.Len(t, entries[0].Postings, 2)
+	balance, err := ledger.NewSQLLedgerRepo(db).GetAccountBalance(ctx, ledger.WalletAccountID("1"), utils.USD)
+	assert.NoError(t, err)
+	assert.Equal(t, utils.MustParseMoney("100", utils.USD), balance)
+}
+
+func TestSQLTransactionRepoRejectsReusedIdempotencyKey(t *testing.T) {
+	ctx := context.Background()
+	db := openSQLite(t, filepath.Join(t.TempDir(), "money_transfer.db"))
+	defer db.Close()
+	repo := transactions.NewSQLTransactionRepo(db)
+
+	transaction := transactions.Transaction{
+		DebitUserID:     "1",
+		CreditUserID:    "2",
+		Amount:          utils.MustParseMoney("10", utils.USD),
+		Currency:        utils.USD,
+		Status:          transactions.Pending,
+		TransactionType: transactions.Transfer,
+		IdempotencyKey:  "key-1",
+	}
+	_, err := repo.CreateTransaction(ctx, transaction)
+	assert.NoError(t, err)
+	_, err = repo.CreateTransaction(ctx, transaction)
+	assert.True(t, utils.IsError(err, utils.ErrIdempotencyKeyReused))
+
+	// Transactions without a key never conflict with each other
+	transaction.IdempotencyKey = ""
+	_, err = repo.CreateTransaction(ctx, transaction)
+	assert.NoError(t, err)
+	_, err = repo.CreateTransaction(ctx, transaction)
+	assert.NoError(t, err)
+}
+
+func TestSQLWalletRepoRejectsCurrencyNotHeld(t *testing.T) {
+	ctx := context.Background()
+	db := openSQLite(t, filepath.Join(t.TempDir(), "money_transfer.db"))
+	defer db.Close()
+	repo := wallet.NewSQLWalletRepo(db)
+
+	_, err := repo.CreateWallet(ctx, wallet.Wallet{UserID: "1", Balance: utils.MustParseMoney("100", utils.USD), Currency: utils.USD, Status: wallet.Active})
+	assert.NoError(t, err)
+	err = repo.UpdateWalletBalance(ctx, "1", utils.MustParseMoney("10", utils.JPY))
+	assert.True(t, utils.IsError(err, utils.ErrCurrencyMismatch))
+
+	_, err = repo.GetWalletForUpdateByUserID(ctx, "unknown")
+	assert.True(t, utils.IsError(err, utils.ErrWalletNotFound))
+}
+
+func TestSQLWalletRepoComparesVersions(t *testing.T) {
+	ctx := context.Background()
+	db := openSQLite(t, filepath.Join(t.TempDir(), "money_transfer.db"))
+	defer db.Close()
+	repo := wallet.NewSQLWalletRepo(db)
+
+	created, err := repo.CreateWallet(ctx, wallet.Wallet{UserID: "1", Balance: utils.MustParseMoney("100", utils.USD), Currency: utils.USD, Status: wallet.Active})
+	assert.NoError(t, err)
+	read, err := repo.GetWalletByUserID(ctx, "1")
+	assert.NoError(t, err)
+
+	// The first swap moves the wallet to a new version, so a second one from the same read fails
+	assert.NoError(t, repo.CompareAndSwapWalletBalance(ctx, created.ID, read.Version, utils.MustParseMoney("90", utils.USD)))
+	err = repo.CompareAndSwapWalletBalance(ctx, created.ID, read.Version, utils.MustParseMoney("80", utils.USD))
+	assert.True(t, utils.IsError(err, utils.ErrVersionConflict))
+
+	current, err := repo.GetWalletByUserID(ctx, "1")
+	assert.NoError(t, err)
+	assert.Equal(t, read.Version+1, current.Version)
+	assert.Equal(t, utils.MustParseMoney("90", utils.USD), current.Balance)
+}
+
+func TestSQLHoldsPersist(t *testing.T) {
+	ctx := context.Background()
+	db := openSQLite(t, filepath.Join(t.TempDir(), "money_transfer.db"))
+	defer db.Close()
+
+	walletRepo := wallet.NewSQLWalletRepo(db)
+	_, err := walletRepo.CreateWallet(ctx, wallet.Wallet{UserID: "1", Balance: utils.MustParseMoney("100", utils.USD), Currency: utils.USD, Status: wallet.Active})
+	assert.NoError(t, err)
+	assert.NoError(t, walletRepo.UpdateWalletHeld(ctx, "1", utils.MustParseMoney("30", utils.USD)))
+	wal, err := walletRepo.GetWalletByUserID(ctx, "1")
+	assert.NoError(t, err)
+	assert.Equal(t, utils.MustParseMoney("100", utils.USD), wal.Balance)
+	assert.Equal(t, utils.MustParseMoney("30", utils.USD), wal.HeldIn(utils.USD))
+	assert.Equal(t, map[utils.Currency]utils.Money{utils.USD: utils.MustParseMoney("70", utils.USD)}, wal.Available)
+
+	transactionRepo := transactions.NewSQLTransactionRepo(db)
+	now := time.Now()
+	for i, expiresAt := range []time.Time{now.Add(-time.Minute), now.Add(time.Minute)} {
+		_, err = transactionRepo.CreateTransaction(ctx, transactions.Transaction{
+			ID:              fmt.Sprintf("hold-%d", i),
+			DebitUserID:     "1",
+			CreditUserID:    "2",
+			Amount:          utils.MustParseMoney("15", utils.USD),
+			Currency:        utils.USD,
+			Status:          transactions.Pending,
+			TransactionType: transactions.Transfer,
+			ExpiresAt:       &expiresAt,
+			CreatedAt:       now,
+			UpdatedAt:       now,
+		})
+		assert.NoError(t, err)
+	}
+	expired, err := transactionRepo.GetExpiredHolds(ctx, now)
+	assert.NoError(t, err)
+	assert.Len(t, expired, 1)
+	assert.Equal(t, "hold-0", expired[0].ID)
+	assert.True(t, expired[0].IsHold())
+}
+
+func TestSQLLimitsRepoReplacesOverrides(t *testing.T) {
+	ctx := context.Background()
+	db := openSQLite(t, filepath.Join(t.TempDir(), "money_transfer.db"))
+	defer db.Close()
+	repo := limits.NewSQLLimitsRepo(db)
+
+	_, err := repo.GetUserLimits(ctx, "1")
+	assert.True(t, utils.IsError(err, utils.ErrUserNotFound))
+
+	daily := utils.MustParseMoney("250", utils.USD)
+	monthly := utils.MustParseMoney("1000", utils.EUR)
+	_, err = repo.SetUserLimits(ctx, limits.UserLimits{UserID: "1", Tier: limits.DefaultTier, UpdatedAt: time.Now(), Overrides: map[utils.Currency]limits.Limits{
+		utils.USD: {Daily: &daily},
+		utils.EUR: {Monthly: &monthly},
+	}})
+	assert.NoError(t, err)
+	_, err = repo.SetUserLimits(ctx, limits.UserLimits{UserID: "1", Tier: "premium", UpdatedAt: time.Now(), Overrides: map[utils.Currency]limits.Limits{
+		utils.USD: {Daily: &daily},
+	}})
+	assert.NoError(t, err)
+
+	userLimits, err := repo.GetUserLimits(ctx, "1")
+	assert.NoError(t, err)
+	assert.Equal(t, limits.Tier("premium"), userLimits.Tier)
+	assert.Equal(t, map[utils.Currency]limits.Limits{utils.USD: {Daily: &daily}}, userLimits.Overrides)
+}
+
+func TestSQLOutgoingTransferTotal(t *testing.T) {
+	ctx := context.Background()
+	db := openSQLite(t, filepath.Join(t.TempDir(), "money_transfer.db"))
+	defer db.Close()
+	repo := transactions.NewSQLTransactionRepo(db)
+
+	now := time.Now()
+	for _, transaction := range []transactions.Transaction{
+		{DebitUserID: "1", Amount: utils.MustParseMoney("10", utils.USD), Status: transactions.Completed, TransactionType: transactions.Transfer, CreatedAt: now},
+		{DebitUserID: "1", Amount: utils.MustParseMoney("5", utils.USD), Status: transactions.Reversed, TransactionType: transactions.Transfer, CreatedAt: now},
+		{DebitUserID: "1", Amount: utils.MustParseMoney("7", utils.USD), Status: transactions.Failed, TransactionType: transactions.Transfer, CreatedAt: now},
+		{DebitUserID: "1", Amount: utils.MustParseMoney("3", utils.USD), Status: transactions.Completed, TransactionType: transactions.Withdrawal, CreatedAt: now},
+		{DebitUserID: "1", Amount: utils.MustParseMoney("20", utils.USD), Status: transactions.Completed, TransactionType: transactions.Transfer, CreatedAt: now.Add(-48 * time.Hour)},
+		{DebitUserID: "1", Amount: utils.MustParseMoney("8", utils.EUR), Status: transactions.Completed, TransactionType: transactions.Transfer, CreatedAt: now},
+		{DebitUserID: "2", Amount: utils.MustParseMoney("9", utils.USD), Status: transactions.Completed, TransactionType: transactions.Transfer, CreatedAt: now},
+	} {
+		transaction.CreditUserID = "3"
+		transaction.Currency = transaction.Amount.Currency
+		transaction.UpdatedAt = transaction.CreatedAt
+		_, err := repo.CreateTransaction(ctx, transaction)
+		assert.NoError(t, err)
+	}
+
+	total, err := repo.GetOutgoingTransferTotal(ctx, "1", utils.USD, now.Add(-limits.DailyWindow))
+	assert.NoError(t, err)
+	assert.Equal(t, utils.MustParseMoney("15", utils.USD), total)
+	total, err = repo.GetOutgoingTransferTotal(ctx, "1", utils.USD, now.Add(-limits.MonthlyWindow))
+	assert.NoError(t, err)
+	assert.Equal(t, utils.MustParseMoney("35", utils.USD), total)
+}
+
+func TestSQLSplitLegsByParent(t *testing.T) {
+	ctx := context.Background()
+	db := openSQLite(t, filepath.Join(t.TempDir(), "money_transfer.db"))
+	defer db.Close()
+	repo := transactions.NewSQLTransactionRepo(db)
+
+	now := time.Now()
+	for i, transaction := range []transactions.Transaction{
+		{ID: "split", DebitUserID: "1", Amount: utils.MustParseMoney("30", utils.USD), TransactionType: transactions.Split},
+		{ID: "leg-b", DebitUserID: "1", CreditUserID: "3", Amount: utils.MustParseMoney("20", utils.USD), TransactionType: transactions.Transfer, ParentTransactionID: "split"},
+		{ID: "leg-a", DebitUserID: "1", CreditUserID: "2", Amount: utils.MustParseMoney("10", utils.USD), TransactionType: transactions.Transfer, ParentTransactionID: "split"},
+		{ID: "other", DebitUserID: "1", CreditUserID: "2", Amount: utils.MustParseMoney("5", utils.USD), TransactionType: transactions.Transfer},
+	} {
+		transaction.Currency = transaction.Amount.Currency
+		transaction.Status = transactions.Completed
+		transaction.CreatedAt = now.Add(time.Duration(i) * time.Second)
+		transaction.UpdatedAt = transaction.CreatedAt
+		_, err := repo.CreateTransaction(ctx, transaction)
+		assert.NoError(t, err)
+	}
+
+	legs, err := repo.GetTransactionsByParentID(ctx, "split")
+	assert.NoError(t, err)
+	assert.Len(t, legs, 2)
+	assert.Equal(t, "leg-b", legs[0].ID)
+	assert.Equal(t, "split", legs[0].ParentTransactionID)
+	assert.Equal(t, "leg-a", legs[1].ID)
+	// The parent is not counted towards limits, only its legs are
+	total, err := repo.GetOutgoingTransferTotal(ctx, "1", utils.USD, now.Add(-time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, utils.MustParseMoney("35", utils.USD), total)
+}
+
+func TestSQLScheduleRepoRecordsRuns(t *testing.T) {
+	ctx := context.Background()
+	db := openSQLite(t, filepath.Join(t.TempDir(), "money_transfer.db"))
+	defer db.Close()
+	repo := scheduler.NewSQLScheduleRepo(db)
+
+	now := time.Date(2025, 3, 3, 8, 0, 0, 0, time.UTC)
+	nextRunAt := now.Add(time.Hour)
+	schedule, err := repo.CreateSchedule(ctx, scheduler.Schedule{SenderID: "1", ReceiverID: "2", Amount: utils.MustParseMoney("10", utils.USD),
+		Currency: utils.USD, StartAt: nextRunAt, Interval: "24h", NextRunAt: &nextRunAt, Status: scheduler.Active, CreatedAt: now, UpdatedAt: now})
+	assert.NoError(t, err)
+
+	due, err := repo.GetDueSchedules(ctx, now)
+	assert.NoError(t, err)
+	assert.Empty(t, due)
+	due, err = repo.GetDueSchedules(ctx, nextRunAt)
+	assert.NoError(t, err)
+	assert.Len(t, due, 1)
+
+	for i, status := range []scheduler.RunStatus{scheduler.RunCompleted, scheduler.RunFailed} {
+		dueAt := *schedule.NextRunAt
+		next := dueAt.Add(24 * time.Hour)
+		schedule.NextRunAt = &next
+		schedule, err = repo.RecordRun(ctx, schedule, scheduler.Run{DueAt: dueAt, RanAt: dueAt, Status: status, TransactionID: fmt.Sprintf("tx-%d", i)})
+		assert.NoError(t, err)
+	}
+	schedule, err = repo.GetSchedule(ctx, schedule.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, utils.MustParseMoney("10", utils.USD), schedule.Amount)
+	assert.Equal(t, nextRunAt.Add(48*time.Hour), schedule.NextRunAt.UTC())
+	assert.Len(t, schedule.Runs, 2)
+	assert.Equal(t, "tx-1", schedule.Runs[1].TransactionID)
+	assert.Equal(t, scheduler.RunFailed, schedule.Runs[1].Status)
+
+	// Updating the instruction keeps the runs
+	schedule.Amount = utils.MustParseMoney("20", utils.USD)
+	_, err = repo.UpdateSchedule(ctx, schedule)
+	assert.NoError(t, err)
+	schedules, err := repo.GetSchedulesByUserID(ctx, "1")
+	assert.NoError(t, err)
+	assert.Len(t, schedules, 1)
+	assert.Equal(t, utils.MustParseMoney("20", utils.USD), schedules[0].Amount)
+	assert.Len(t, schedules[0].Runs, 2)
+
+	assert.NoError(t, repo.DeleteSchedule(ctx, schedule.ID))
+	_, err = repo.GetSchedule(ctx, schedule.ID)
+	assert.True(t, utils.IsError(err, utils.ErrScheduleNotFound))
+	assert.True(t, utils.IsError(repo.DeleteSchedule(ctx, schedule.ID), utils.ErrScheduleNotFound))
+}
+
+func TestSQLWebhookRepoRecordsAttempts(t *testing.T) {
+	ctx := context.Background()
+	db := openSQLite(t, filepath.Join(t.TempDir(), "money_transfer.db"))
+	defer db.Close()
+	repo := webhooks.NewSQLWebhookRepo(db)
+	now := time.Date(2025, 3, 3, 8, 0, 0, 0, time.UTC)
+
+	endpoint, err := repo.CreateEndpoint(ctx, webhooks.Endpoint{UserID: "1", URL: "https://example.com/hooks", Secret: "whsec_1", EventTypes: webhooks.TransferEventTypes, CreatedAt: now})
+	assert.NoError(t, err)
+	endpoints, err := repo.GetEndpointsByUserID(ctx, "1")
+	assert.NoError(t, err)
+	assert.Equal(t, []webhooks.Endpoint{endpoint}, endpoints)
+
+	delivery := webhooks.Delivery{ID: endpoint.ID + ":event-1", EndpointID: endpoint.ID, UserID: "1", EventID: "event-1", EventType: events.TransferCompleted,
+		Body: []byte(`{"id":"event-1"}`), Status: webhooks.Pending, NextAttemptAt: &now, CreatedAt: now, UpdatedAt: now}
+	created, err := repo.CreateDelivery(ctx, delivery)
+	assert.NoError(t, err)
+	assert.Empty(t, created.Attempts)
+	// Creating it again keeps the delivery as it is
+	changed := delivery
+	changed.Status = webhooks.Dead
+	created, err = repo.CreateDelivery(ctx, changed)
+	assert.NoError(t, err)
+	assert.Equal(t, webhooks.Pending, created.Status)
+
+	due, err := repo.GetDueDeliveries(ctx, now.Add(-time.Second))
+	assert.NoError(t, err)
+	assert.Empty(t, due)
+	due, err = repo.GetDueDeliveries(ctx, now)
+	assert.NoError(t, err)
+	assert.Len(t, due, 1)
+
+	next := now.Add(webhooks.InitialBackoff)
+	delivery.NextAttemptAt = &next
+	_, err = repo.RecordAttempt(ctx, delivery, webhooks.DeliveryAttempt{AttemptedAt: now, StatusCode: 500, Error: "Endpoint answered 500 Internal Server Error"})
+	assert.NoError(t, err)
+	delivery.Status = webhooks.Dead
+	delivery.NextAttemptAt = nil
+	recorded, err := repo.RecordAttempt(ctx, delivery, webhooks.DeliveryAttempt{AttemptedAt: next, Error: "connection refused", Manual: true})
+	assert.NoError(t, err)
+	assert.Len(t, recorded.Attempts, 2)
+	assert.Equal(t, 500, recorded.Attempts[0].StatusCode)
+	assert.True(t, recorded.Attempts[1].Manual)
+
+	dead, err := repo.GetDeliveriesByUserID(ctx, "1", webhooks.Dead)
+	assert.NoError(t, err)
+	assert.Len(t, dead, 1)
+	assert.Nil(t, dead[0].NextAttemptAt)
+	assert.JSONEq(t, `{"id":"event-1"}`, string(dead[0].Body))
+	assert.Len(t, dead[0].Attempts, 2)
+
+	assert.NoError(t, repo.DeleteEndpoint(ctx, endpoint.ID))
+	_, err = repo.GetDelivery(ctx, delivery.ID)
+	assert.True(t, utils.IsError(err, utils.ErrWebhookDeliveryNotFound))
+	assert.True(t, utils.IsError(repo.DeleteEndpoint(ctx, endpoint.ID), utils.ErrWebhookNotFound))
+}
+
+func TestMemoryQuoteRepoUsesQuotesOnce(t *testing.T) {
+	validateQuoteIsUsedOnce(t, storage.NewMemoryUnitOfWork(), fx.NewQuoteRepo())
+}
+
+func TestSQLQuoteRepoUsesQuotesOnce(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "money_transfer.db")
+	db := openSQLite(t, path)
+	validateQuoteIsUsedOnce(t, storage.NewSQLUnitOfWork(db), fx.NewSQLQuoteRepo(db))
+	assert.NoError(t, db.Close())
+
+	// The quote stays used after a restart
+	db = openSQLite(t, path)
+	defer db.Close()
+	quote, err := fx.NewSQLQuoteRepo(db).GetQuote(context.Background(), "quote-1")
+	assert.NoError(t, err)
+	assert.Equal(t, "tx-2", quote.TransactionID)
+}
+
+// validateQuoteIsUsedOnce uses a quote in a unit of work that fails, then in one that commits,
+// expecting only the committed one to keep it, and no transaction to use it after that.
+func validateQuoteIsUsedOnce(t *testing.T, unitOfWork storage.UnitOfWork, repo fx.QuoteRepo) {
+	ctx := context.Background()
+	now := time.Date(2025, 3, 3, 8, 0, 0, 0, time.UTC)
+	created, err := repo.CreateQuote(ctx, fx.Quote{ID: "quote-1", UserID: "1", From: utils.USD, To: utils.EUR, Rate: "0.92", CreatedAt: now, ExpiresAt: now.Add(fx.DefaultQuoteTTL)})
+	assert.NoError(t, err)
+	assert.False(t, created.IsUsed())
+
+	failure := utils.NewError(utils.ErrInternalServerError)
+	err = unitOfWork.RunInTx(ctx, func(ctx context.Context) error {
+		_, err := repo.UseQuote(ctx, "quote-1", "tx-1")
+		if err != nil {
+			return err
+		}
+		return failure
+	})
+	assert.Equal(t, failure, err)
+	quote, err := repo.GetQuote(ctx, "quote-1")
+	assert.NoError(t, err)
+	assert.Equal(t, created, quote)
+
+	err = unitOfWork.RunInTx(ctx, func(ctx context.Context) error {
+		_, err := repo.UseQuote(ctx, "quote-1", "tx-2")
+		return err
+	})
+	assert.NoError(t, err)
+	_, err = repo.UseQuote(ctx, "quote-1", "tx-3")
+	assert.True(t, utils.IsError(err, utils.ErrQuoteUsed))
+	quote, err = repo.GetQuote(ctx, "quote-1")
+	assert.NoError(t, err)
+	assert.Equal(t, "tx-2", quote.TransactionID)
+
+	_, err = repo.UseQuote(ctx, "quote-2", "tx-3")
+	assert.True(t, utils.IsError(err, utils.ErrQuoteNotFound))
+}
+
+func TestMemoryUnitOfWorkRollsBackRepoWrites(t *testing.T) {
+	validateUnitOfWorkRollsBack(t, storage.NewMemoryUnitOfWork(), wallet.NewWalletRepo(), transactions.NewTransactionRepo(), ledger.NewLedgerRepo())
+}
+
+func TestSQLUnitOfWorkRollsBackRepoWrites(t *testing.T) {
+	db := openSQLite(t, filepath.Join(t.TempDir(), "money_transfer.db"))
+	defer db.Close()
+	validateUnitOfWorkRollsBack(t, storage.NewSQLUnitOfWork(db), wallet.NewSQLWalletRepo(db), transactions.NewSQLTransactionRepo(db), ledger.NewSQLLedgerRepo(db))
+}
+
+func TestMemoryOutboxKeepsOnlyCommittedEvents(t *testing.T) {
+	repo := events.NewOutboxRepo()
+	events.Reset()
+	unitOfWork := storage.NewMemoryUnitOfWork()
+	// Until its unit of work commits, the event is not seen, so it cannot be published early
+	err := unitOfWork.RunInTx(context.Background(), func(ctx context.Context) error {
+		_, err := repo.AddEvent(ctx, events.Event{Type: events.UserCreated, AggregateID: "outbox-0", Payload: []byte(`{}`)})
+		assert.NoError(t, err)
+		unpublished, err := repo.GetUnpublishedEvents(ctx, 0, 10)
+		assert.NoError(t, err)
+		assert.Empty(t, unpublished)
+		return nil
+	})
+	assert.NoError(t, err)
+	validateOutboxKeepsOnlyCommittedEvents(t, unitOfWork, repo)
+}
+
+func TestSQLOutboxKeepsOnlyCommittedEvents(t *testing.T) {
+	db := openSQLite(t, filepath.Join(t.TempDir(), "money_transfer.db"))
+	defer db.Close()
+	validateOutboxKeepsOnlyCommittedEvents(t, storage.NewSQLUnitOfWork(db), events.NewSQLOutboxRepo(db))
+}
+
+// validateOutboxKeepsOnlyCommittedEvents adds events in a unit of work that fails and in one
+// that commits, expecting only the committed ones to be published, oldest first.
+func validateOutboxKeepsOnlyCommittedEvents(t *testing.T, unitOfWork storage.UnitOfWork, repo events.OutboxRepo) {
+	ctx := context.Background()
+	addEvents := func(aggregateID string) func(ctx context.Context) error {
+		return func(ctx context.Context) error {
+			for _, eventType := range []events.EventType{events.TransferCreated, events.TransferCompleted} {
+				_, err := repo.AddEvent(ctx, events.Event{Type: eventType, AggregateID: aggregateID, Payload: []byte(`{"transaction_id":"` + aggregateID + `"}`)})
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	failure := utils.NewError(utils.ErrInternalServerError)
+	err := unitOfWork.RunInTx(ctx, func(ctx context.Context) error {
+		err := addEvents("outbox-1")(ctx)
+		if err != nil {
+			return err
+		}
+		return failure
+	})
+	assert.Equal(t, failure, err)
+	assert.NoError(t, unitOfWork.RunInTx(ctx, addEvents("outbox-2")))
+
+	rolledBack, err := repo.GetEventsByAggregateID(ctx, "outbox-1")
+	assert.NoError(t, err)
+	assert.Empty(t, rolledBack)
+	unpublished, err := repo.GetUnpublishedEvents(ctx, 0, 10)
+	assert.NoError(t, err)
+	unpublished = withoutAggregate(unpublished, "outbox-0")
+	assert.Len(t, unpublished, 2)
+	assert.Equal(t, events.TransferCreated, unpublished[0].Type)
+	assert.Equal(t, events.TransferCompleted, unpublished[1].Type)
+	assert.JSONEq(t, `{"transaction_id":"outbox-2"}`, string(unpublished[1].Payload))
+
+	assert.NoError(t, repo.MarkEventPublished(ctx, unpublished[0].ID, time.Now()))
+	remaining, err := repo.GetUnpublishedEvents(ctx, 0, 10)
+	assert.NoError(t, err)
+	remaining = withoutAggregate(remaining, "outbox-0")
+	assert.Len(t, remaining, 1)
+	assert.Equal(t, unpublished[1].ID, remaining[0].ID)
+	published, err := repo.GetEventsByAggregateID(ctx, "outbox-2")
+	assert.NoError(t, err)
+	assert.Len(t, published, 2)
+	assert.NotNil(t, published[0].PublishedAt)
+	assert.Nil(t, published[1].PublishedAt)
+}
+
+// withoutAggregate drops the events about aggregateID.
+func withoutAggregate(all []events.Event, aggregateID string) []events.Event {
+	kept := make([]events.Event, 0, len(all))
+	for _, event := range all {
+		if event.AggregateID != aggregateID {
+			kept = append(kept, event)
+		}
+	}
+	return kept
+}
+
+// validateUnitOfWorkRollsBack makes the writes of a transfer and then fails, expecting none of
+// them to remain, and then makes them again successfully.
+func validateUnitOfWorkRollsBack(t *testing.T, unitOfWork storage.UnitOfWork, walletRepo wallet.WalletRepo, transactionRepo transactions.TransactionRepo, ledgerRepo ledger.LedgerRepo) {
+	ctx := context.Background()
+	_, err := walletRepo.CreateWallet(ctx, wallet.Wallet{UserID: "uow-1", Balance: utils.MustParseMoney("100", utils.USD), Currency: utils.USD, Status: wallet.Active})
+	assert.NoError(t, err)
+
+	transfer := func(ctx context.Context) error {
+		_, err := transactionRepo.CreateTransaction(ctx, transactions.Transaction{
+			ID:              "uow-tx",
+			DebitUserID:     "uow-1",
+			CreditUserID:    transactions.SystemUserID,
+			Amount:          utils.MustParseMoney("40", utils.USD),
+			Currency:        utils.USD,
+			Status:          transactions.Pending,
+			TransactionType: transactions.Withdrawal,
+			IdempotencyKey:  "uow-key",
+		})
+		if err != nil {
+			return err
+		}
+		err = walletRepo.UpdateWalletBalance(ctx, "uow-1", utils.MustParseMoney("60", utils.USD))
+		if err != nil {
+			return err
+		}
+		_, err = ledgerRepo.CreateEntry(ctx, ledger.Entry{
+			TransactionID: "uow-tx",
+			Postings: []ledger.Posting{
+				{AccountID: ledger.WalletAccountID("uow-1"), Direction: ledger.Debit, Amount: utils.MustParseMoney("40", utils.USD), Currency: utils.USD},
+				{AccountID: ledger.ExternalFundsAccountID, Direction: ledger.Credit, Amount: utils.MustParseMoney("40", utils.USD), Currency: utils.USD},
+			},
+		})
+		if err != nil {
+			return err
+		}
+		_, err = transactionRepo.UpdateTransactionStatus(ctx, "uow-tx", transactions.Completed)
+		return err
+	}
+
+	failure := utils.NewError(utils.ErrInternalServerError)
+	err = unitOfWork.RunInTx(ctx, func(ctx context.Context) error {
+		err := transfer(ctx)
+		if err != nil {
+			return err
+		}
+		return failure
+	})
+	assert.Equal(t, failure, err)
+
+	wal, err := walletRepo.GetWalletByUserID(ctx, "uow-1")
+	assert.NoError(t, err)
+	assert.Equal(t, utils.MustParseMoney("100", utils.USD), wal.Balance)
+	_, err = transactionRepo.GetTransaction(ctx, "uow-tx")
+	assert.True(t, utils.IsError(err, utils.ErrTransactionNotFound))
+	_, err = transactionRepo.GetTransactionByIdempotencyKey(ctx, "uow-key")
+	assert.True(t, utils.IsError(err, utils.ErrTransactionNotFound))
+	entries, err := ledgerRepo.GetEntriesByTransactionID(ctx, "uow-tx")
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+	balance, err := ledgerRepo.GetAccountBalance(ctx, ledger.WalletAccountID("uow-1"), utils.USD)
+	assert.NoError(t, err)
+	assert.True(t, balance.IsZero())
+
+	// Nothing of the failed attempt, not even the idempotency key, gets in the way of a retry
+	assert.NoError(t, unitOfWork.RunInTx(ctx, transfer))
+	wal, err = walletRepo.GetWalletByUserID(ctx, "uow-1")
+	assert.NoError(t, err)
+	assert.Equal(t, utils.MustParseMoney("60", utils.USD), wal.Balance)
+	transaction, err := transactionRepo.GetTransactionByIdempotencyKey(ctx, "uow-key")
+	assert.NoError(t, err)
+	assert.Equal(t, transactions.Completed, transaction.Status)
+}
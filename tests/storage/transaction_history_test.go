@@ -0,0 +1,175 @@
+package storage
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"concurrent_money_transfer_system/internals/events"
+	"concurrent_money_transfer_system/internals/fx"
+	"concurrent_money_transfer_system/internals/ledger"
+	"concurrent_money_transfer_system/internals/limits"
+	"concurrent_money_transfer_system/internals/storage"
+	"concurrent_money_transfer_system/internals/transactions"
+	"concurrent_money_transfer_system/internals/wallet"
+	"concurrent_money_transfer_system/utils"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryTransactionHistory(t *testing.T) {
+	repo := transactions.NewTransactionRepo()
+	transactions.Reset()
+	defer transactions.Reset()
+	validateTransactionHistory(t, repo)
+}
+
+func TestSQLTransactionHistory(t *testing.T) {
+	db := openSQLite(t, filepath.Join(t.TempDir(), "money_transfer.db"))
+	defer db.Close()
+	validateTransactionHistory(t, transactions.NewSQLTransactionRepo(db))
+}
+
+// historyPages follows the cursors of the query to the last page and returns the IDs of each page.
+func historyPages(t *testing.T, repo transactions.TransactionRepo, userID string, query transactions.HistoryQuery) [][]string {
+	pages := make([][]string, 0)
+	for {
+		page, err := repo.GetTransactionHistory(context.Background(), userID, query)
+		assert.NoError(t, err)
+		pages = append(pages, historyIDs(page.Transactions))
+		if page.NextCursor == "" || len(pages) > 10 {
+			return pages
+		}
+		cursor, err := transactions.ParseHistoryCursor(page.NextCursor)
+		assert.NoError(t, err)
+		query.After = &cursor
+	}
+}
+
+// validateTransactionHistory creates transactions of history-1 and checks that every filter,
+// both orders and the pages of the history select the expected ones.
+func validateTransactionHistory(t *testing.T, repo transactions.TransactionRepo) {
+	ctx := context.Background()
+	start := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	at := func(minutes int) *time.Time {
+		at := start.Add(time.Duration(minutes) * time.Minute)
+		return &at
+	}
+	for i, transaction := range []transactions.Transaction{
+		{ID: "history-0", DebitUserID: "history-1", CreditUserID: "history-2", Amount: utils.MustParseMoney("10", utils.USD), Status: transactions.Completed, TransactionType: transactions.Transfer},
+		{ID: "history-1", DebitUserID: "history-2", CreditUserID: "history-1", Amount: utils.MustParseMoney("20", utils.USD), Status: transactions.Completed, TransactionType: transactions.Transfer},
+		{ID: "history-2", DebitUserID: "history-1", CreditUserID: "history-3", Amount: utils.MustParseMoney("30", utils.EUR), Status: transactions.Completed, TransactionType: transactions.Transfer},
+		{ID: "history-3", DebitUserID: transactions.SystemUserID, CreditUserID: "history-1", Amount: utils.MustParseMoney("40", utils.USD), Status: transactions.Completed, TransactionType: transactions.Deposit},
+		{ID: "history-4", DebitUserID: "history-1", CreditUserID: "history-2", Amount: utils.MustParseMoney("50", utils.USD), Status: transactions.Failed, TransactionType: transactions.Transfer},
+		{ID: "history-5", DebitUserID: "history-3", CreditUserID: "history-1", Amount: utils.MustParseMoney("60", utils.USD), Status: transactions.Pending, TransactionType: transactions.Transfer},
+		{ID: "history-6", DebitUserID: "history-2", CreditUserID: "history-3", Amount: utils.MustParseMoney("70", utils.USD), Status: transactions.Completed, TransactionType: transactions.Transfer},
+	} {
+		transaction.Currency = transaction.Amount.Currency
+		transaction.CreatedAt = *at(i)
+		transaction.UpdatedAt = transaction.CreatedAt
+		_, err := repo.CreateTransaction(ctx, transaction)
+		assert.NoError(t, err)
+	}
+	usd := func(amount string) *utils.Money {
+		money := utils.MustParseMoney(amount, utils.USD)
+		return &money
+	}
+
+	for _, test := range []struct {
+		name  string
+		query transactions.HistoryQuery
+		pages [][]string
+	}{
+		{"everything", transactions.HistoryQuery{},
+			[][]string{{"history-0", "history-1", "history-2", "history-3", "history-4", "history-5"}}},
+		{"newest first", transactions.HistoryQuery{Order: transactions.Descending},
+			[][]string{{"history-5", "history-4", "history-3", "history-2", "history-1", "history-0"}}},
+		{"pages", transactions.HistoryQuery{Limit: 2},
+			[][]string{{"history-0", "history-1"}, {"history-2", "history-3"}, {"history-4", "history-5"}}},
+		{"pages newest first", transactions.HistoryQuery{Order: transactions.Descending, Limit: 4},
+			[][]string{{"history-5", "history-4", "history-3", "history-2"}, {"history-1", "history-0"}}},
+		{"status", transactions.HistoryQuery{Status: transactions.Failed},
+			[][]string{{"history-4"}}},
+		{"status pages newest first", transactions.HistoryQuery{Status: transactions.Completed, Order: transactions.Descending, Limit: 1},
+			[][]string{{"history-3"}, {"history-2"}, {"history-1"}, {"history-0"}}},
+		{"type", transactions.HistoryQuery{TransactionType: transactions.Deposit},
+			[][]string{{"history-3"}}},
+		{"sent", transactions.HistoryQuery{Direction: transactions.Sent, Limit: 1},
+			[][]string{{"history-0"}, {"history-2"}, {"history-4"}}},
+		{"received", transactions.HistoryQuery{Direction: transactions.Received},
+			[][]string{{"history-1", "history-3", "history-5"}}},
+		{"counterparty", transactions.HistoryQuery{CounterpartyID: "history-2"},
+			[][]string{{"history-0", "history-1", "history-4"}}},
+		{"counterparty received", transactions.HistoryQuery{CounterpartyID: "history-2", Direction: transactions.Received},
+			[][]string{{"history-1"}}},
+		{"currency", transactions.HistoryQuery{Currency: utils.EUR},
+			[][]string{{"history-2"}}},
+		{"amount range", transactions.HistoryQuery{Currency: utils.USD, MinAmount: usd("20"), MaxAmount: usd("50")},
+			[][]string{{"history-1", "history-3", "history-4"}}},
+		{"date range", transactions.HistoryQuery{From: at(1), To: at(4)},
+			[][]string{{"history-1", "history-2", "history-3"}}},
+		{"date range newest first", transactions.HistoryQuery{From: at(1), To: at(4), Order: transactions.Descending, Limit: 2},
+			[][]string{{"history-3", "history-2"}, {"history-1"}}},
+		{"nothing", transactions.HistoryQuery{CounterpartyID: "history-4"},
+			[][]string{{}}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if test.query.Order == "" {
+				test.query.Order = transactions.Ascending
+			}
+			if test.query.Limit == 0 {
+				test.query.Limit = transactions.DefaultHistoryLimit
+			}
+			assert.Equal(t, test.pages, historyPages(t, repo, "history-1", test.query))
+		})
+	}
+}
+
+// TestSQLTransactionHistoryOfTransfers pages through transfers made by the service, which
+// stamps them with the current local time, and filters them by times in other offsets.
+func TestSQLTransactionHistoryOfTransfers(t *testing.T) {
+	ctx := context.Background()
+	db := openSQLite(t, filepath.Join(t.TempDir(), "money_transfer.db"))
+	defer db.Close()
+	repo := transactions.NewSQLTransactionRepo(db)
+	unitOfWork := storage.NewSQLUnitOfWork(db)
+	ledgerService := ledger.NewLedgerService(ledger.NewSQLLedgerRepo(db))
+	eventService := events.NewEventService(events.NewSQLOutboxRepo(db), events.NewInProcessPublisher())
+	walletService := wallet.NewWalletService(wallet.NewSQLWalletRepo(db), ledgerService, eventService, unitOfWork, wallet.DefaultLockTimeout, wallet.DefaultShards)
+	rateProvider, err := fx.NewStaticRateProvider(fx.DefaultRates)
+	assert.NoError(t, err)
+	transactionService := transactions.NewTransactionService(repo, walletService, ledgerService, fx.NewFXService(fx.NewSQLQuoteRepo(db), rateProvider, fx.DefaultQuoteTTL),
+		limits.NewLimitsService(limits.NewSQLLimitsRepo(db), repo, limits.DefaultTiers), eventService, unitOfWork, transactions.DefaultHoldTTL, transactions.Pessimistic)
+
+	for _, userID := range []string{"history-1", "history-2"} {
+		err := unitOfWork.RunInTx(ctx, func(ctx context.Context) error {
+			_, err := walletService.CreateWallet(ctx, userID, utils.MustParseMoney("100", utils.USD))
+			return err
+		})
+		assert.NoError(t, err)
+	}
+	created := make([]transactions.Transaction, 0)
+	for _, amount := range []string{"1", "2", "3", "4"} {
+		transaction, err := transactionService.CreateTransaction(ctx, &transactions.TransferRequest{
+			SenderID:   "history-1",
+			ReceiverID: "history-2",
+			Amount:     utils.MustParseMoney(amount, utils.USD),
+			Currency:   utils.USD,
+		})
+		assert.NoError(t, err)
+		created = append(created, transaction)
+	}
+	ids := historyIDs(created)
+
+	oldestFirst := historyPages(t, repo, "history-1", transactions.HistoryQuery{Order: transactions.Ascending, Limit: 1})
+	assert.Equal(t, [][]string{ids[0:1], ids[1:2], ids[2:3], ids[3:4]}, oldestFirst)
+	newestFirst := historyPages(t, repo, "history-1", transactions.HistoryQuery{Order: transactions.Descending, Limit: 3})
+	assert.Equal(t, [][]string{{ids[3], ids[2], ids[1]}, {ids[0]}}, newestFirst)
+
+	// The range holds the same transfers whatever the offset of its times
+	from := created[1].CreatedAt.In(time.FixedZone("UTC+5", 5*60*60))
+	to := created[3].CreatedAt.In(time.FixedZone("UTC-7", -7*60*60))
+	inRange := historyPages(t, repo, "history-1", transactions.HistoryQuery{From: &from, To: &to, Order: transactions.Ascending, Limit: 10})
+	assert.Equal(t, [][]string{ids[1:3]}, inRange)
+}
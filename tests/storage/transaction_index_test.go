@@ -0,0 +1,234 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"concurrent_money_transfer_system/internals/storage"
+	"concurrent_money_transfer_system/internals/transactions"
+	"concurrent_money_transfer_system/utils"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func indexedTransfer(id string, debitUserID string, creditUserID string, amount string, createdAt time.Time) transactions.Transaction {
+	return transactions.Transaction{
+		ID:              id,
+		DebitUserID:     debitUserID,
+		CreditUserID:    creditUserID,
+		Amount:          utils.MustParseMoney(amount, utils.USD),
+		Currency:        utils.USD,
+		Status:          transactions.Completed,
+		TransactionType: transactions.Transfer,
+		CreatedAt:       createdAt,
+		UpdatedAt:       createdAt,
+	}
+}
+
+func historyIDs(history []transactions.Transaction) []string {
+	ids := make([]string, len(history))
+	for i, transaction := range history {
+		ids[i] = transaction.ID
+	}
+	return ids
+}
+
+func TestMemoryTransactionHistoryIsIndexed(t *testing.T) {
+	ctx := context.Background()
+	repo := transactions.NewTransactionRepo()
+	transactions.Reset()
+	defer transactions.Reset()
+	start := time.Now()
+
+	// Created out of time order, on both sides of the user, and once on both sides at once
+	for _, transaction := range []transactions.Transaction{
+		indexedTransfer("index-tx-3", "index-1", "index-2", "30", start.Add(3*time.Second)),
+		indexedTransfer("index-tx-1", "index-2", "index-1", "10", start.Add(1*time.Second)),
+		indexedTransfer("index-tx-4", "index-1", "index-1", "40", start.Add(4*time.Second)),
+		indexedTransfer("index-tx-2", "index-1", "index-3", "20", start.Add(2*time.Second)),
+		indexedTransfer("index-tx-0", "index-2", "index-3", "5", start),
+	} {
+		_, err := repo.CreateTransaction(ctx, transaction)
+		assert.NoError(t, err)
+	}
+
+	history, err := repo.GetTransactionsByUserID(ctx, "index-1")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"index-tx-1", "index-tx-2", "index-tx-3", "index-tx-4"}, historyIDs(history))
+	history, err = repo.GetTransactionsByUserID(ctx, "index-3")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"index-tx-0", "index-tx-2"}, historyIDs(history))
+	all, err := repo.GetAllTransactions(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"index-tx-0", "index-tx-1", "index-tx-2", "index-tx-3", "index-tx-4"}, historyIDs(all))
+	total, err := repo.GetOutgoingTransferTotal(ctx, "index-1", utils.USD, start.Add(2*time.Second))
+	assert.NoError(t, err)
+	assert.Equal(t, utils.MustParseMoney("90", utils.USD), total)
+
+	// Lookups see the latest version of a transaction
+	_, err = repo.UpdateTransactionStatus(ctx, "index-tx-3", transactions.Reversed)
+	assert.NoError(t, err)
+	history, err = repo.GetTransactionsByUserID(ctx, "index-2")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"index-tx-0", "index-tx-1", "index-tx-3"}, historyIDs(history))
+	assert.Equal(t, transactions.Reversed, history[2].Status)
+
+	// A transaction rolled back is dropped from the indexes
+	failure := utils.NewError(utils.ErrInternalServerError)
+	err = storage.NewMemoryUnitOfWork().RunInTx(ctx, func(ctx context.Context) error {
+		_, err := repo.CreateTransaction(ctx, indexedTransfer("index-tx-failed", "index-1", "index-2", "50", start.Add(5*time.Second)))
+		assert.NoError(t, err)
+		return failure
+	})
+	assert.Equal(t, failure, err)
+	history, err = repo.GetTransactionsByUserID(ctx, "index-1")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"index-tx-1", "index-tx-2", "index-tx-3", "index-tx-4"}, historyIDs(history))
+	total, err = repo.GetOutgoingTransferTotal(ctx, "index-1", utils.USD, start.Add(5*time.Second))
+	assert.NoError(t, err)
+	assert.True(t, total.IsZero())
+}
+
+func TestMemoryExpiredHoldsAreIndexed(t *testing.T) {
+	ctx := context.Background()
+	repo := transactions.NewTransactionRepo()
+	transactions.Reset()
+	defer transactions.Reset()
+	start := time.Now()
+	hold := func(id string, expiresIn time.Duration) transactions.Transaction {
+		transaction := indexedTransfer(id, "index-1", "index-2", "10", start)
+		transaction.Status = transactions.Pending
+		expiresAt := start.Add(expiresIn)
+		transaction.ExpiresAt = &expiresAt
+		return transaction
+	}
+	for _, transaction := range []transactions.Transaction{
+		hold("index-hold-3", 3*time.Minute),
+		hold("index-hold-1", time.Minute),
+		hold("index-hold-2", 2*time.Minute),
+		hold("index-hold-later", time.Hour),
+		indexedTransfer("index-tx-0", "index-1", "index-2", "10", start),
+	} {
+		_, err := repo.CreateTransaction(ctx, transaction)
+		assert.NoError(t, err)
+	}
+	expiredHolds := func() []string {
+		expired, err := repo.GetExpiredHolds(ctx, start.Add(3*time.Minute))
+		assert.NoError(t, err)
+		return historyIDs(expired)
+	}
+	assert.Equal(t, []string{"index-hold-1", "index-hold-2", "index-hold-3"}, expiredHolds())
+
+	// Holds leave the index when they are captured or released, and come back when that is rolled back
+	_, err := repo.SettleTransaction(ctx, "index-hold-1", start)
+	assert.NoError(t, err)
+	failure := utils.NewError(utils.ErrInternalServerError)
+	err = storage.NewMemoryUnitOfWork().RunInTx(ctx, func(ctx context.Context) error {
+		_, err := repo.UpdateTransactionStatus(ctx, "index-hold-2", transactions.Voided)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"index-hold-3"}, expiredHolds())
+		return failure
+	})
+	assert.Equal(t, failure, err)
+	assert.Equal(t, []string{"index-hold-2", "index-hold-3"}, expiredHolds())
+}
+
+func TestMemorySplitLegsAreIndexed(t *testing.T) {
+	ctx := context.Background()
+	repo := transactions.NewTransactionRepo()
+	transactions.Reset()
+	defer transactions.Reset()
+	start := time.Now()
+	leg := func(id string, parentID string, createdAt time.Time) transactions.Transaction {
+		transaction := indexedTransfer(id, "index-1", "index-2", "10", createdAt)
+		transaction.ParentTransactionID = parentID
+		return transaction
+	}
+	for _, transaction := range []transactions.Transaction{
+		leg("index-leg-2", "index-split", start.Add(time.Second)),
+		leg("index-leg-1", "index-split", start),
+		leg("index-other-leg", "index-other-split", start),
+		indexedTransfer("index-tx-0", "index-1", "index-2", "10", start),
+	} {
+		_, err := repo.CreateTransaction(ctx, transaction)
+		assert.NoError(t, err)
+	}
+	splitLegs := func(parentID string) []string {
+		legs, err := repo.GetTransactionsByParentID(ctx, parentID)
+		assert.NoError(t, err)
+		return historyIDs(legs)
+	}
+	assert.Equal(t, []string{"index-leg-1", "index-leg-2"}, splitLegs("index-split"))
+	assert.Equal(t, []string{}, splitLegs("index-tx-0"))
+
+	// A leg rolled back is dropped from its split
+	failure := utils.NewError(utils.ErrInternalServerError)
+	err := storage.NewMemoryUnitOfWork().RunInTx(ctx, func(ctx context.Context) error {
+		_, err := repo.CreateTransaction(ctx, leg("index-leg-failed", "index-split", start.Add(2*time.Second)))
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"index-leg-1", "index-leg-2", "index-leg-failed"}, splitLegs("index-split"))
+		return failure
+	})
+	assert.Equal(t, failure, err)
+	assert.Equal(t, []string{"index-leg-1", "index-leg-2"}, splitLegs("index-split"))
+}
+
+// BenchmarkGetTransactionsByUserID looks up a history of 50 transactions among a growing
+// number of transactions of other users. The time per lookup should stay about the same.
+func BenchmarkGetTransactionsByUserID(b *testing.B) {
+	benchmarkIndexedLookup(b, func(ctx context.Context, repo transactions.TransactionRepo) error {
+		_, err := repo.GetTransactionsByUserID(ctx, "bench-user")
+		return err
+	})
+}
+
+// BenchmarkGetOutgoingTransferTotal sums the transfers the user sent in the last 10 minutes,
+// as the limits check of every transfer does.
+func BenchmarkGetOutgoingTransferTotal(b *testing.B) {
+	since := time.Now().Add(-10 * time.Minute)
+	benchmarkIndexedLookup(b, func(ctx context.Context, repo transactions.TransactionRepo) error {
+		_, err := repo.GetOutgoingTransferTotal(ctx, "bench-user", utils.USD, since)
+		return err
+	})
+}
+
+// BenchmarkGetExpiredHolds lists the expired holds, of which there are none, as the hold
+// sweeper does every minute.
+func BenchmarkGetExpiredHolds(b *testing.B) {
+	benchmarkIndexedLookup(b, func(ctx context.Context, repo transactions.TransactionRepo) error {
+		_, err := repo.GetExpiredHolds(ctx, time.Now())
+		return err
+	})
+}
+
+func benchmarkIndexedLookup(b *testing.B, lookup func(ctx context.Context, repo transactions.TransactionRepo) error) {
+	ctx := context.Background()
+	repo := transactions.NewTransactionRepo()
+	defer transactions.Reset()
+	for _, total := range []int{1_000, 10_000, 100_000} {
+		b.Run(fmt.Sprintf("total=%d", total), func(b *testing.B) {
+			transactions.Reset()
+			start := time.Now().Add(-time.Hour)
+			for i := 0; i < total; i++ {
+				debitUserID := fmt.Sprintf("bench-%d", i%1000)
+				if i%(total/50) == 0 {
+					debitUserID = "bench-user"
+				}
+				_, err := repo.CreateTransaction(ctx, indexedTransfer(fmt.Sprintf("bench-tx-%d", i), debitUserID, "bench-receiver",
+					"1", start.Add(time.Duration(i)*time.Hour/time.Duration(total))))
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				err := lookup(ctx, repo)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
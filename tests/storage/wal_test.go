@@ -0,0 +1,338 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"concurrent_money_transfer_system/internals/events"
+	"concurrent_money_transfer_system/internals/fx"
+	"concurrent_money_transfer_system/internals/ledger"
+	"concurrent_money_transfer_system/internals/limits"
+	"concurrent_money_transfer_system/internals/scheduler"
+	"concurrent_money_transfer_system/internals/storage"
+	"concurrent_money_transfer_system/internals/transactions"
+	"concurrent_money_transfer_system/internals/users"
+	"concurrent_money_transfer_system/internals/wallet"
+	"concurrent_money_transfer_system/internals/webhooks"
+	"concurrent_money_transfer_system/utils"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// journaledRepos returns the in-memory repos that are recovered from the WAL.
+func journaledRepos() []storage.Journaled {
+	return []storage.Journaled{
+		users.NewUserRepo().(storage.Journaled),
+		wallet.NewWalletRepo().(storage.Journaled),
+		transactions.NewTransactionRepo().(storage.Journaled),
+		ledger.NewLedgerRepo().(storage.Journaled),
+		limits.NewLimitsRepo().(storage.Journaled),
+		scheduler.NewScheduleRepo().(storage.Journaled),
+		events.NewOutboxRepo().(storage.Journaled),
+		webhooks.NewWebhookRepo().(storage.Journaled),
+		fx.NewQuoteRepo().(storage.Journaled),
+	}
+}
+
+// resetMemoryRepos empties the in-memory repos and detaches them from any WAL.
+func resetMemoryRepos() {
+	for _, repo := range journaledRepos() {
+		repo.SetWAL(nil)
+	}
+	users.Reset()
+	wallet.Reset()
+	transactions.Reset()
+	ledger.Reset()
+	limits.Reset()
+	scheduler.Reset()
+	events.Reset()
+	webhooks.Reset()
+	fx.Reset()
+}
+
+// recoverWAL simulates a restart: the repos lose everything they held and get it back
+// from the WAL directory.
+func recoverWAL(t *testing.T, dir string) *storage.WAL {
+	resetMemoryRepos()
+	wal, err := storage.OpenWAL(dir)
+	assert.NoError(t, err)
+	assert.NoError(t, wal.Recover(journaledRepos()...))
+	return wal
+}
+
+// walTransfer writes a user, a wallet, a completed withdrawal and its ledger entry the way
+// the services do.
+func walTransfer(t *testing.T, userID string, transactionID string) {
+	ctx := context.Background()
+	_, err := users.NewUserRepo().CreateUser(users.User{ID: userID, FirstName: "Mark", PhoneNumber: "+1234567890", Email: userID + "@facebook.com", Password: "password"})
+	assert.NoError(t, err)
+
+	walletRepo := wallet.NewWalletRepo()
+	_, err = walletRepo.CreateWallet(ctx, wallet.Wallet{UserID: userID, Balance: utils.MustParseMoney("100", utils.USD), Currency: utils.USD, Status: wallet.Active})
+	assert.NoError(t, err)
+
+	transactionRepo := transactions.NewTransactionRepo()
+	_, err = transactionRepo.CreateTransaction(ctx, transactions.Transaction{
+		ID:              transactionID,
+		DebitUserID:     userID,
+		CreditUserID:    transactions.SystemUserID,
+		Amount:          utils.MustParseMoney("40", utils.USD),
+		Currency:        utils.USD,
+		Status:          transactions.Pending,
+		TransactionType: transactions.Withdrawal,
+		IdempotencyKey:  transactionID + "-key",
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, walletRepo.UpdateWalletBalance(ctx, userID, utils.MustParseMoney("60", utils.USD)))
+	_, err = ledger.NewLedgerRepo().CreateEntry(ctx, ledger.Entry{
+		TransactionID: transactionID,
+		Postings: []ledger.Posting{
+			{AccountID: ledger.WalletAccountID(userID), Direction: ledger.Debit, Amount: utils.MustParseMoney("40", utils.USD), Currency: utils.USD},
+			{AccountID: ledger.ExternalFundsAccountID, Direction: ledger.Credit, Amount: utils.MustParseMoney("40", utils.USD), Currency: utils.USD},
+		},
+	})
+	assert.NoError(t, err)
+	_, err = transactionRepo.UpdateTransactionStatus(ctx, transactionID, transactions.Completed)
+	assert.NoError(t, err)
+
+	quoteRepo := fx.NewQuoteRepo()
+	_, err = quoteRepo.CreateQuote(ctx, fx.Quote{ID: transactionID + "-quote", UserID: userID, From: utils.USD, To: utils.EUR, Rate: "0.92"})
+	assert.NoError(t, err)
+	_, err = quoteRepo.UseQuote(ctx, transactionID+"-quote", transactionID)
+	assert.NoError(t, err)
+}
+
+// validateRecovered checks that everything written by walTransfer is back.
+func validateRecovered(t *testing.T, userID string, transactionID string) {
+	ctx := context.Background()
+	user, err := users.NewUserRepo().GetUser(userID)
+	assert.NoError(t, err)
+	assert.Equal(t, userID+"@facebook.com", user.Email)
+
+	wal, err := wallet.NewWalletRepo().GetWalletForUpdateByUserID(ctx, userID)
+	assert.NoError(t, err)
+	wallet.NewWalletRepo().ReleaseGetWalletForUpdateLock(ctx, userID)
+	assert.Equal(t, utils.MustParseMoney("60", utils.USD), wal.Balance)
+
+	transaction, err := transactions.NewTransactionRepo().GetTransactionByIdempotencyKey(ctx, transactionID+"-key")
+	assert.NoError(t, err)
+	assert.Equal(t, transactionID, transaction.ID)
+	assert.Equal(t, transactions.Completed, transaction.Status)
+	// The replayed updates of the transaction do not index it twice
+	history, err := transactions.NewTransactionRepo().GetTransactionsByUserID(ctx, userID)
+	assert.NoError(t, err)
+	assert.Equal(t, []transactions.Transaction{transaction}, history)
+
+	balance, err := ledger.NewLedgerRepo().GetAccountBalance(ctx, ledger.WalletAccountID(userID), utils.USD)
+	assert.NoError(t, err)
+	assert.Equal(t, utils.MustParseMoney("-40", utils.USD), balance)
+
+	quote, err := fx.NewQuoteRepo().GetQuote(ctx, transactionID+"-quote")
+	assert.NoError(t, err)
+	assert.Equal(t, userID, quote.UserID)
+	assert.Equal(t, transactionID, quote.TransactionID)
+}
+
+func TestWALRecoversMemoryRepos(t *testing.T) {
+	dir := t.TempDir()
+	defer resetMemoryRepos()
+	wal := recoverWAL(t, dir)
+	walTransfer(t, "wal-1", "wal-tx-1")
+
+	// Rolled back writes never reach the log, so they cannot come back
+	logSize := walSize(t, dir)
+	failure := utils.NewError(utils.ErrInternalServerError)
+	err := storage.NewMemoryUnitOfWork().RunInTx(context.Background(), func(ctx context.Context) error {
+		_, err := transactions.NewTransactionRepo().CreateTransaction(ctx, transactions.Transaction{ID: "wal-tx-failed", IdempotencyKey: "wal-tx-failed-key"})
+		if err != nil {
+			return err
+		}
+		return failure
+	})
+	assert.Equal(t, failure, err)
+	assert.Equal(t, logSize, walSize(t, dir))
+	assert.NoError(t, wal.Close())
+
+	wal = recoverWAL(t, dir)
+	defer wal.Close()
+	validateRecovered(t, "wal-1", "wal-tx-1")
+	_, err = transactions.NewTransactionRepo().GetTransactionByIdempotencyKey(context.Background(), "wal-tx-failed-key")
+	assert.True(t, utils.IsError(err, utils.ErrTransactionNotFound))
+
+	// A recovered idempotency key is still claimed
+	_, err = transactions.NewTransactionRepo().CreateTransaction(context.Background(), transactions.Transaction{IdempotencyKey: "wal-tx-1-key"})
+	assert.True(t, utils.IsError(err, utils.ErrIdempotencyKeyReused))
+}
+
+func TestWALRecoversFromSnapshotAndLog(t *testing.T) {
+	dir := t.TempDir()
+	defer resetMemoryRepos()
+	wal := recoverWAL(t, dir)
+	walTransfer(t, "wal-1", "wal-tx-1")
+	assert.NoError(t, wal.Snapshot(journaledRepos()...))
+	walTransfer(t, "wal-2", "wal-tx-2")
+	assert.NoError(t, wal.Close())
+
+	wal = recoverWAL(t, dir)
+	defer wal.Close()
+	validateRecovered(t, "wal-1", "wal-tx-1")
+	validateRecovered(t, "wal-2", "wal-tx-2")
+}
+
+func TestWALIgnoresTornTail(t *testing.T) {
+	dir := t.TempDir()
+	defer resetMemoryRepos()
+	wal := recoverWAL(t, dir)
+	walTransfer(t, "wal-1", "wal-tx-1")
+	assert.NoError(t, wal.Close())
+
+	// A crash in the middle of an append leaves a partial frame behind
+	file, err := os.OpenFile(filepath.Join(dir, "wal.log"), os.O_APPEND|os.O_WRONLY, 0)
+	assert.NoError(t, err)
+	_, err = file.Write([]byte{0, 0, 1, 0, 42, 42})
+	assert.NoError(t, err)
+	assert.NoError(t, file.Close())
+
+	wal = recoverWAL(t, dir)
+	validateRecovered(t, "wal-1", "wal-tx-1")
+
+	// The torn tail is cut off, so records appended after it are recovered as well
+	walTransfer(t, "wal-2", "wal-tx-2")
+	assert.NoError(t, wal.Close())
+	wal = recoverWAL(t, dir)
+	defer wal.Close()
+	validateRecovered(t, "wal-1", "wal-tx-1")
+	validateRecovered(t, "wal-2", "wal-tx-2")
+}
+
+// walSize returns the size of the log in dir.
+func walSize(t *testing.T, dir string) int64 {
+	info, err := os.Stat(filepath.Join(dir, "wal.log"))
+	assert.NoError(t, err)
+	return info.Size()
+}
+
+// createWALWallets creates a wallet holding 100 USD for each user, each in its own write.
+func createWALWallets(t *testing.T, userIDs ...string) {
+	for _, userID := range userIDs {
+		_, err := wallet.NewWalletRepo().CreateWallet(context.Background(), wallet.Wallet{UserID: userID, Balance: utils.MustParseMoney("100", utils.USD), Currency: utils.USD, Status: wallet.Active})
+		assert.NoError(t, err)
+	}
+}
+
+// walUnitTransfer moves 40 USD from the sender's wallet to the receiver's in ctx, debiting
+// the sender first, then crediting the receiver and posting the ledger entry.
+func walUnitTransfer(ctx context.Context, senderID string, receiverID string) error {
+	walletRepo := wallet.NewWalletRepo()
+	err := walletRepo.UpdateWalletBalance(ctx, senderID, utils.MustParseMoney("60", utils.USD))
+	if err != nil {
+		return err
+	}
+	err = walletRepo.UpdateWalletBalance(ctx, receiverID, utils.MustParseMoney("140", utils.USD))
+	if err != nil {
+		return err
+	}
+	_, err = ledger.NewLedgerRepo().CreateEntry(ctx, ledger.Entry{
+		Postings: []ledger.Posting{
+			{AccountID: ledger.WalletAccountID(senderID), Direction: ledger.Debit, Amount: utils.MustParseMoney("40", utils.USD), Currency: utils.USD},
+			{AccountID: ledger.WalletAccountID(receiverID), Direction: ledger.Credit, Amount: utils.MustParseMoney("40", utils.USD), Currency: utils.USD},
+		},
+	})
+	return err
+}
+
+// validateWALBalances checks the balances of the sender's and the receiver's wallets and
+// ledger accounts.
+func validateWALBalances(t *testing.T, senderID string, sender string, receiverID string, receiver string) {
+	ctx := context.Background()
+	for userID, expected := range map[string]string{senderID: sender, receiverID: receiver} {
+		wal, err := wallet.NewWalletRepo().GetWalletByUserID(ctx, userID)
+		assert.NoError(t, err)
+		assert.Equal(t, utils.MustParseMoney(expected, utils.USD), wal.Balance, userID)
+	}
+	moved := utils.MustParseMoney(sender, utils.USD).Sub(utils.MustParseMoney("100", utils.USD))
+	balance, err := ledger.NewLedgerRepo().GetAccountBalance(ctx, ledger.WalletAccountID(senderID), utils.USD)
+	assert.NoError(t, err)
+	assert.Equal(t, moved, balance)
+}
+
+func TestWALReplaysUnitsOfWorkWhole(t *testing.T) {
+	dir := t.TempDir()
+	defer resetMemoryRepos()
+	wal := recoverWAL(t, dir)
+	createWALWallets(t, "wal-sender", "wal-receiver")
+	before := walSize(t, dir)
+	err := storage.NewMemoryUnitOfWork().RunInTx(context.Background(), func(ctx context.Context) error {
+		return walUnitTransfer(ctx, "wal-sender", "wal-receiver")
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, wal.Close())
+	log, err := os.ReadFile(filepath.Join(dir, "wal.log"))
+	assert.NoError(t, err)
+	assert.Greater(t, int64(len(log)), before)
+
+	// The debit is logged before the credit, so cutting the log anywhere in the unit of
+	// work's record, e.g. between the two, is a crash before it committed
+	for cut := before + 1; cut < int64(len(log)); cut += 16 {
+		cutDir := t.TempDir()
+		assert.NoError(t, os.WriteFile(filepath.Join(cutDir, "wal.log"), log[:cut], 0o644))
+		wal = recoverWAL(t, cutDir)
+		validateWALBalances(t, "wal-sender", "100", "wal-receiver", "100")
+		assert.NoError(t, wal.Close())
+	}
+
+	wal = recoverWAL(t, dir)
+	defer wal.Close()
+	validateWALBalances(t, "wal-sender", "60", "wal-receiver", "140")
+}
+
+func TestWALSnapshotsOnlyCommittedWrites(t *testing.T) {
+	dir := t.TempDir()
+	defer resetMemoryRepos()
+	wal := recoverWAL(t, dir)
+	createWALWallets(t, "wal-sender", "wal-receiver")
+
+	// runHeldUnit starts a unit of work that makes the transfer and then waits for release
+	// before it rolls back
+	failure := utils.NewError(utils.ErrInternalServerError)
+	runHeldUnit := func() (release chan struct{}, done chan error) {
+		written := make(chan struct{})
+		release, done = make(chan struct{}), make(chan error)
+		go func() {
+			done <- storage.NewMemoryUnitOfWork().RunInTx(context.Background(), func(ctx context.Context) error {
+				err := walUnitTransfer(ctx, "wal-sender", "wal-receiver")
+				if err != nil {
+					return err
+				}
+				close(written)
+				<-release
+				return failure
+			})
+		}()
+		<-written
+		return release, done
+	}
+
+	// A snapshot waits for the units of work in flight to end
+	release, done := runHeldUnit()
+	snapshotted := make(chan error)
+	go func() { snapshotted <- wal.Snapshot(journaledRepos()...) }()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	assert.Equal(t, failure, <-done)
+	assert.NoError(t, <-snapshotted)
+
+	// and gives up on those that do not end in time
+	release, done = runHeldUnit()
+	assert.Error(t, wal.Snapshot(journaledRepos()...))
+	close(release)
+	assert.Equal(t, failure, <-done)
+	assert.NoError(t, wal.Close())
+
+	wal = recoverWAL(t, dir)
+	defer wal.Close()
+	validateWALBalances(t, "wal-sender", "100", "wal-receiver", "100")
+}
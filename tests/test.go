@@ -2,22 +2,29 @@ package tests
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http/httptest"
 	"os"
+	"reflect"
 	"testing"
 
+	"concurrent_money_transfer_system/internals/auth"
 	"concurrent_money_transfer_system/internals/server"
+	"concurrent_money_transfer_system/internals/users"
 
 	"github.com/gin-gonic/gin"
 )
 
 var router *gin.Engine
+var authService auth.AuthService
 
 func Setup() {
 	router = server.SetupRouter()
+	// The router created the auth service singleton, so this returns the one that verifies tokens
+	authService = auth.NewAuthService(users.NewUserRepo(), auth.Config{})
 }
 
 type Request struct {
@@ -25,6 +32,7 @@ type Request struct {
 	Method  string                 `json:"method"`
 	Body    map[string]interface{} `json:"body"`
 	Headers map[string]string      `json:"headers,omitempty"`
+	AsUser  string                 `json:"as_user,omitempty"` // Sends a token of this user, who must exist
 }
 
 type Response struct {
@@ -59,6 +67,37 @@ func MakeRequestAndValidateResponse(t *testing.T, testData TestData) *httptest.R
 }
 
 func MakeRequestAndGetResponse(t *testing.T, testData TestData) (map[string]interface{}, *httptest.ResponseRecorder) {
+	recorder := makeRequest(t, testData)
+
+	// Parse response body
+	var responseBodyMap map[string]interface{}
+	if err := json.NewDecoder(recorder.Body).Decode(&responseBodyMap); err != nil {
+		t.Fatalf("Failed to unmarshal response body: %v", err)
+	}
+
+	return responseBodyMap, recorder
+}
+
+// MakeRequestAndGetListResponse is MakeRequestAndGetResponse for endpoints responding with a list.
+func MakeRequestAndGetListResponse(t *testing.T, testData TestData) ([]map[string]interface{}, *httptest.ResponseRecorder) {
+	recorder := makeRequest(t, testData)
+
+	var responseBody []map[string]interface{}
+	if err := json.NewDecoder(recorder.Body).Decode(&responseBody); err != nil {
+		t.Fatalf("Failed to unmarshal response body: %v", err)
+	}
+
+	return responseBody, recorder
+}
+
+// MakeRequest serves the request and checks the status code, for endpoints whose response
+// is not JSON, such as file downloads.
+func MakeRequest(t *testing.T, testData TestData) *httptest.ResponseRecorder {
+	return makeRequest(t, testData)
+}
+
+// makeRequest serves the request and checks the status code of the response.
+func makeRequest(t *testing.T, testData TestData) *httptest.ResponseRecorder {
 	jsonBody, err := json.Marshal(testData.Request.Body)
 	if err != nil {
 		t.Fatalf("Failed to marshal request body: %v", err)
@@ -68,6 +107,14 @@ func MakeRequestAndGetResponse(t *testing.T, testData TestData) (map[string]inte
 	request := httptest.NewRequest(testData.Request.Method, "/"+testData.Request.URL, bytes.NewBuffer(jsonBody))
 	request.Header.Set("Content-Type", "application/json")
 
+	if testData.Request.AsUser != "" {
+		token, err := authService.IssueToken(context.Background(), testData.Request.AsUser)
+		if err != nil {
+			t.Fatalf("Failed to issue token: %v", err)
+		}
+		request.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	}
+
 	// Add headers if present
 	if testData.Request.Headers != nil {
 		for key, value := range testData.Request.Headers {
@@ -87,13 +134,7 @@ func MakeRequestAndGetResponse(t *testing.T, testData TestData) (map[string]inte
 			testData.Response.Status, recorder.Code, recorder.Body.String())
 	}
 
-	// Parse response body
-	var responseBodyMap map[string]interface{}
-	if err := json.NewDecoder(recorder.Body).Decode(&responseBodyMap); err != nil {
-		t.Fatalf("Failed to unmarshal response body: %v", err)
-	}
-
-	return responseBodyMap, recorder
+	return recorder
 }
 
 func SelectiveEqual(expectedBody map[string]interface{}, actualBody map[string]interface{}) bool {
@@ -102,10 +143,10 @@ func SelectiveEqual(expectedBody map[string]interface{}, actualBody map[string]i
 		if !ok {
 			return false
 		}
-		if key == "created_at" || key == "updated_at" || key == "deleted_at" {
+		if key == "created_at" || key == "updated_at" || key == "deleted_at" || key == "settled_at" {
 			continue
 		}
-		if expectedValue != actualValue {
+		if !reflect.DeepEqual(expectedValue, actualValue) {
 			return false
 		}
 	}
@@ -4,8 +4,13 @@ import (
 	"context"
 	"log"
 
+	"concurrent_money_transfer_system/internals/authz"
+	"concurrent_money_transfer_system/internals/events"
+	"concurrent_money_transfer_system/internals/ledger"
+	"concurrent_money_transfer_system/internals/storage"
 	"concurrent_money_transfer_system/internals/users"
 	"concurrent_money_transfer_system/internals/wallet"
+	"concurrent_money_transfer_system/utils"
 )
 
 var userService users.UserService
@@ -14,7 +19,10 @@ func CreateTestUsers() {
 	log.Println("Creating test users...")
 	userRepo := users.NewUserRepo()
 	walletRepo := wallet.NewWalletRepo()
-	userService = users.NewUserService(userRepo, wallet.NewWalletService(walletRepo))
+	ledgerService := ledger.NewLedgerService(ledger.NewLedgerRepo())
+	eventService := events.NewEventService(events.NewOutboxRepo(), events.NewInProcessPublisher())
+	unitOfWork := storage.NewMemoryUnitOfWork()
+	userService = users.NewUserService(userRepo, wallet.NewWalletService(walletRepo, ledgerService, eventService, unitOfWork, wallet.DefaultLockTimeout, wallet.DefaultShards), eventService, unitOfWork)
 
 	ctx := context.Background()
 	userService.CreateUser(ctx, users.User{
@@ -24,7 +32,7 @@ func CreateTestUsers() {
 		PhoneNumber: "+1234567890",
 		Password:  "password",
 		Wallet: wallet.Wallet{
-			Balance: 100,
+			Balance: utils.MustParseMoney("100", utils.USD),
 		},
 	})
 
@@ -35,7 +43,7 @@ func CreateTestUsers() {
 		PhoneNumber: "+1234567890",
 		Password:    "password",
 		Wallet: wallet.Wallet{
-			Balance: 50,
+			Balance: utils.MustParseMoney("50", utils.USD),
 		},
 	})
 
@@ -46,8 +54,20 @@ func CreateTestUsers() {
 		PhoneNumber: "+1234567890",
 		Password:    "password",
 		Wallet: wallet.Wallet{
-			Balance: 0,
+			Balance: utils.MustParseMoney("0", utils.USD),
 		},
 	})
 
+	userService.CreateUser(ctx, users.User{
+		ID:          "4",
+		FirstName:   "Ada",
+		Email:       "ada@example.com",
+		PhoneNumber: "+1234567890",
+		Password:    "password",
+		Wallet: wallet.Wallet{
+			Balance: utils.MustParseMoney("0", utils.USD),
+		},
+	})
+	userService.SetRole(ctx, "4", authz.RoleAdmin)
+
 }
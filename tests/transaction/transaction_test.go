@@ -3,15 +3,26 @@ package transaction
 import (
 	"context"
 	"fmt"
+	"math"
 	"math/rand"
 	"os"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"concurrent_money_transfer_system/internals/authz"
+	"concurrent_money_transfer_system/internals/events"
+	"concurrent_money_transfer_system/internals/fx"
+	"concurrent_money_transfer_system/internals/ledger"
+	"concurrent_money_transfer_system/internals/limits"
+	"concurrent_money_transfer_system/internals/storage"
 	"concurrent_money_transfer_system/internals/transactions"
+	"concurrent_money_transfer_system/internals/users"
 	"concurrent_money_transfer_system/internals/wallet"
 	"concurrent_money_transfer_system/tests"
+	"concurrent_money_transfer_system/utils"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -23,15 +34,27 @@ func TestMain(m *testing.M) {
 }
 
 var walletRepo wallet.WalletRepo
+var walletService wallet.WalletService
 var transactionRepo transactions.TransactionRepo
+var ledgerService ledger.LedgerService
+var transactionService transactions.TransactionService
+var outboxRepo events.OutboxRepo
+var eventService events.EventService
 
 var testData map[string]tests.TestData
 
 func setup() {
 	testData = tests.ReadTestData("test_data.json")
 	walletRepo = wallet.NewWalletRepo()
+	ledgerService = ledger.NewLedgerService(ledger.NewLedgerRepo())
+	outboxRepo = events.NewOutboxRepo()
+	eventService = events.NewEventService(outboxRepo, events.NewInProcessPublisher())
+	walletService = wallet.NewWalletService(walletRepo, ledgerService, eventService, storage.NewMemoryUnitOfWork(), wallet.DefaultLockTimeout, wallet.DefaultShards)
 	transactionRepo = transactions.NewTransactionRepo()
+	// The router already created the service, so this returns it
+	transactionService = transactions.NewTransactionService(transactionRepo, walletService, ledgerService, nil, nil, eventService, storage.NewMemoryUnitOfWork(), transactions.DefaultHoldTTL, transactions.Pessimistic)
 	transactions.Reset()
+	ledger.Reset()
 	createWallets()
 }
 
@@ -42,15 +65,15 @@ func createWallets() {
 	ctx := context.Background()
 	for i := 1; i <= 10; i++ {
 		id := fmt.Sprintf("%d", i)
-		wal, _ := walletRepo.CreateWallet(ctx, wallet.Wallet{
-			ID:       id,
-			UserID:   id,
-			Balance:  1000000, // 1 Million
-			Currency: "USD",
-			Status:   wallet.Active,
-		})
+		// Requests are authenticated as these users
+		users.NewUserRepo().CreateUser(users.User{ID: id, FirstName: "User " + id, Email: id + "@example.com", PhoneNumber: "+1234567890"})
+		wal, _ := walletService.CreateWallet(ctx, id, utils.MustParseMoney("1000000", utils.USD)) // 1 Million
 		wallets = append(wallets, wal)
 	}
+	// A user without a wallet
+	users.NewUserRepo().CreateUser(users.User{ID: "abc", FirstName: "User abc", Email: "abc@example.com", PhoneNumber: "+1234567890"})
+	// Support staff, who record deposits
+	users.NewUserRepo().CreateUser(users.User{ID: "teller", FirstName: "Teller", Email: "teller@example.com", PhoneNumber: "+1234567890", Role: authz.RoleSupport})
 }
 
 func TestTransferMoney(t *testing.T) {
@@ -65,12 +88,12 @@ func TestTransferMoney(t *testing.T) {
 	// Check if the sender wallet balance is updated correctly
 	senderWallet, err := walletRepo.GetWalletByUserID(context.Background(), "1")
 	assert.NoError(t, err)
-	assert.Equal(t, senderWallet.Balance, float64(999000))
+	assert.Equal(t, senderWallet.Balance, utils.MustParseMoney("999000", utils.USD))
 
 	// Check if the receiver wallet balance is updated correctly
 	receiverWallet, err := walletRepo.GetWalletByUserID(context.Background(), "2")
 	assert.NoError(t, err)
-	assert.Equal(t, receiverWallet.Balance, float64(1001000))
+	assert.Equal(t, receiverWallet.Balance, utils.MustParseMoney("1001000", utils.USD))
 }
 
 func TestGetTransaction(t *testing.T) {
@@ -89,21 +112,66 @@ func TestGetTransaction(t *testing.T) {
 	tests.MakeRequestAndValidateResponse(t, test_data)
 }
 
-// TODO: fix this test by handling array of transactions
 func TestGetTransactionsByUserID(t *testing.T) {
-	return
-	// first create a transaction
-	tests.MakeRequestAndGetResponse(t, testData["TestTranferMoney"])
-
-	fmt.Println("Transaction ID: ", "XXX")
-	// then get the transaction
-	transactions, err := transactionRepo.GetTransactionsByUserID(context.Background(), "1")
-	assert.NoError(t, err)
+	ctx := context.Background()
+	// Users of their own, so their history only holds the transfers made here
+	for _, id := range []string{"history-1", "history-2"} {
+		users.NewUserRepo().CreateUser(users.User{ID: id, FirstName: "User " + id, Email: id + "@example.com", PhoneNumber: "+1234567890"})
+		_, err := walletService.CreateWallet(ctx, id, utils.MustParseMoney("1000", utils.USD))
+		assert.NoError(t, err)
+	}
+	for _, transfer := range []struct{ sender, receiver, amount string }{
+		{"history-1", "history-2", "10"},
+		{"history-2", "history-1", "5"},
+		{"history-1", "history-2", "20"},
+		{"history-1", "history-2", "30"},
+	} {
+		tests.MakeRequestAndGetResponse(t, tests.TestData{
+			Request: tests.Request{
+				URL:    "api/transaction/transfer",
+				Method: "POST",
+				AsUser: transfer.sender,
+				Body:   map[string]interface{}{"sender_id": transfer.sender, "receiver_id": transfer.receiver, "amount": transfer.amount, "currency": "USD"},
+			},
+			Response: tests.Response{Status: 200},
+		})
+	}
 
+	// The newest two transfers sent, and a cursor to the rest
 	test_data := testData["TestGetTransactionsByUserID"]
-	test_data.Response.Body["id"] = transactions[0].ID
+	page, recorder := tests.MakeRequestAndGetListResponse(t, test_data)
+	assert.Len(t, page, 2)
+	test_data.Response.Body["id"] = page[0]["id"]
+	assert.True(t, tests.SelectiveEqual(test_data.Response.Body, page[0]))
+	assert.Equal(t, "20.00", page[1]["amount"])
+	cursor := recorder.Header().Get(transactions.NextCursorHeader)
+	assert.NotEmpty(t, cursor)
 
-	tests.MakeRequestAndValidateResponse(t, test_data)
+	next := test_data
+	next.Request.URL += "&cursor=" + cursor
+	page, recorder = tests.MakeRequestAndGetListResponse(t, next)
+	assert.Len(t, page, 1)
+	assert.Equal(t, "10.00", page[0]["amount"])
+	assert.Empty(t, recorder.Header().Get(transactions.NextCursorHeader))
+
+	// Invalid parameters are rejected, and nobody else reads the history
+	for _, request := range []struct {
+		url    string
+		asUser string
+		status int
+	}{
+		{"api/transaction/user/history-1?status=unknown", "history-1", 400},
+		{"api/transaction/user/history-1?limit=500", "history-1", 400},
+		{"api/transaction/user/history-1?min_amount=5", "history-1", 400},
+		{"api/transaction/user/history-1?from=yesterday", "history-1", 400},
+		{"api/transaction/user/history-1?cursor=invalid", "history-1", 400},
+		{"api/transaction/user/history-1", "history-2", 403},
+	} {
+		tests.MakeRequestAndGetResponse(t, tests.TestData{
+			Request:  tests.Request{URL: request.url, Method: "GET", AsUser: request.asUser},
+			Response: tests.Response{Status: request.status},
+		})
+	}
 }
 
 func TestValidateNegativeAmountTransferMoneyRequest(t *testing.T) {
@@ -123,7 +191,1055 @@ func TestCannotTransferMoreThanBalance(t *testing.T) {
 	tests.MakeRequestAndValidateResponse(t, testData["TestCannotTransferMoreThanBalance"])
 }
 
+func TestIdempotentTransferReplay(t *testing.T) {
+	senderWallet, err := walletRepo.GetWalletByUserID(context.Background(), "3")
+	assert.NoError(t, err)
+
+	test_data := testData["TestIdempotentTransferReplay"]
+	first_response, _ := tests.MakeRequestAndGetResponse(t, test_data)
+	transaction, err := transactionRepo.GetTransactionByIdempotencyKey(context.Background(), "replay-key")
+	assert.NoError(t, err)
+	test_data.Response.Body["id"] = transaction.ID
+	assert.True(t, tests.SelectiveEqual(test_data.Response.Body, first_response))
+
+	// Replaying the same request returns the original transaction without moving money again
+	tests.MakeRequestAndValidateResponse(t, test_data)
+
+	updatedSenderWallet, err := walletRepo.GetWalletByUserID(context.Background(), "3")
+	assert.NoError(t, err)
+	assert.Equal(t, senderWallet.Balance.Sub(utils.MustParseMoney("250", utils.USD)), updatedSenderWallet.Balance)
+}
+
+func TestIdempotencyKeyReusedWithDifferentRequest(t *testing.T) {
+	tests.MakeRequestAndGetResponse(t, testData["TestIdempotentTransferReplay"])
+	tests.MakeRequestAndValidateResponse(t, testData["TestIdempotencyKeyReusedWithDifferentRequest"])
+}
+
+func TestRepeatedDecimalTransfersDoNotDrift(t *testing.T) {
+	senderWallet, err := walletRepo.GetWalletByUserID(context.Background(), "5")
+	assert.NoError(t, err)
+	receiverWallet, err := walletRepo.GetWalletByUserID(context.Background(), "6")
+	assert.NoError(t, err)
+
+	data := tests.TestData{
+		Request: tests.Request{
+			URL:    "api/transaction/transfer",
+			Method: "POST",
+			AsUser: "5",
+			Body: map[string]interface{}{
+				"sender_id":   "5",
+				"receiver_id": "6",
+				"amount":      "0.10",
+				"currency":    "USD",
+			},
+		},
+		Response: tests.Response{Status: 200},
+	}
+	for i := 0; i < 10; i++ {
+		tests.MakeRequestAndGetResponse(t, data)
+	}
+
+	one := utils.MustParseMoney("1", utils.USD)
+	updatedSenderWallet, err := walletRepo.GetWalletByUserID(context.Background(), "5")
+	assert.NoError(t, err)
+	assert.Equal(t, senderWallet.Balance.Sub(one), updatedSenderWallet.Balance)
+	updatedReceiverWallet, err := walletRepo.GetWalletByUserID(context.Background(), "6")
+	assert.NoError(t, err)
+	assert.Equal(t, receiverWallet.Balance.Add(one), updatedReceiverWallet.Balance)
+}
+
+func TestTransferRecordsBalancedLedgerEntry(t *testing.T) {
+	test_data := testData["TestTranferMoney"]
+	actual_response, _ := tests.MakeRequestAndGetResponse(t, test_data)
+
+	entries, err := ledgerService.GetEntriesByTransactionID(context.Background(), actual_response["id"].(string))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+	amount := utils.MustParseMoney("1000", utils.USD)
+	assert.Equal(t, []ledger.Posting{
+		{AccountID: ledger.WalletAccountID("1"), Direction: ledger.Debit, Amount: amount, Currency: utils.USD},
+		{AccountID: ledger.WalletAccountID("2"), Direction: ledger.Credit, Amount: amount, Currency: utils.USD},
+	}, entries[0].Postings)
+
+	validateWalletsReconcileWithLedger(t)
+}
+
+func TestDeposit(t *testing.T) {
+	userWallet, err := walletRepo.GetWalletByUserID(context.Background(), "7")
+	assert.NoError(t, err)
+
+	test_data := testData["TestDeposit"]
+	actual_response, _ := tests.MakeRequestAndGetResponse(t, test_data)
+	test_data.Response.Body["id"] = actual_response["id"]
+	assert.True(t, tests.SelectiveEqual(test_data.Response.Body, actual_response))
+
+	updatedWallet, err := walletRepo.GetWalletByUserID(context.Background(), "7")
+	assert.NoError(t, err)
+	assert.Equal(t, userWallet.Balance.Add(utils.MustParseMoney("500", utils.USD)), updatedWallet.Balance)
+	validateWalletsReconcileWithLedger(t)
+}
+
+func TestOwnerCannotDeposit(t *testing.T) {
+	userWallet, err := walletRepo.GetWalletByUserID(context.Background(), "7")
+	assert.NoError(t, err)
+
+	response, _ := tests.MakeRequestAndGetResponse(t, tests.TestData{
+		Request: tests.Request{
+			URL:    "api/transaction/deposit",
+			Method: "POST",
+			AsUser: "7",
+			Body:   map[string]interface{}{"user_id": "7", "amount": "500", "currency": "USD"},
+		},
+		Response: tests.Response{Status: 403},
+	})
+	assert.Equal(t, "FORBIDDEN", response["code"])
+
+	unchangedWallet, err := walletRepo.GetWalletByUserID(context.Background(), "7")
+	assert.NoError(t, err)
+	assert.Equal(t, userWallet.Balance, unchangedWallet.Balance)
+}
+
+func TestWithdraw(t *testing.T) {
+	userWallet, err := walletRepo.GetWalletByUserID(context.Background(), "7")
+	assert.NoError(t, err)
+
+	test_data := testData["TestWithdraw"]
+	actual_response, _ := tests.MakeRequestAndGetResponse(t, test_data)
+	test_data.Response.Body["id"] = actual_response["id"]
+	assert.True(t, tests.SelectiveEqual(test_data.Response.Body, actual_response))
+
+	updatedWallet, err := walletRepo.GetWalletByUserID(context.Background(), "7")
+	assert.NoError(t, err)
+	assert.Equal(t, userWallet.Balance.Sub(utils.MustParseMoney("200.50", utils.USD)), updatedWallet.Balance)
+	validateWalletsReconcileWithLedger(t)
+}
+
+func TestCannotWithdrawMoreThanBalance(t *testing.T) {
+	tests.MakeRequestAndValidateResponse(t, testData["TestCannotWithdrawMoreThanBalance"])
+}
+
+func TestBalanceCannotOverflow(t *testing.T) {
+	ctx := context.Background()
+	users.NewUserRepo().CreateUser(users.User{ID: "overflow", FirstName: "User overflow", Email: "overflow@example.com", PhoneNumber: "+1234567890"})
+	_, err := walletService.CreateWallet(ctx, "overflow", utils.NewMoney(0, utils.USD))
+	assert.NoError(t, err)
+	// Not in the ledger, so this wallet is left out of the reconciliation checks
+	nearlyFull := utils.NewMoney(math.MaxInt64-50, utils.USD)
+	err = walletRepo.UpdateWalletBalance(ctx, "overflow", nearlyFull)
+	assert.NoError(t, err)
+
+	response, _ := tests.MakeRequestAndGetResponse(t, tests.TestData{
+		Request: tests.Request{
+			URL:    "api/transaction/deposit",
+			Method: "POST",
+			AsUser: "teller",
+			Body:   map[string]interface{}{"user_id": "overflow", "amount": "1", "currency": "USD"},
+		},
+		Response: tests.Response{Status: 422},
+	})
+	assert.Equal(t, "AMOUNT_OUT_OF_RANGE", response["code"])
+
+	senderWallet, err := walletRepo.GetWalletByUserID(ctx, "10")
+	assert.NoError(t, err)
+	response, _ = tests.MakeRequestAndGetResponse(t, tests.TestData{
+		Request: tests.Request{
+			URL:    "api/transaction/transfer",
+			Method: "POST",
+			AsUser: "10",
+			Body:   map[string]interface{}{"sender_id": "10", "receiver_id": "overflow", "amount": "1", "currency": "USD"},
+		},
+		Response: tests.Response{Status: 422},
+	})
+	assert.Equal(t, "AMOUNT_OUT_OF_RANGE", response["code"])
+
+	// Neither side of the failed transfer moved
+	updatedSenderWallet, err := walletRepo.GetWalletByUserID(ctx, "10")
+	assert.NoError(t, err)
+	assert.Equal(t, senderWallet.Balance, updatedSenderWallet.Balance)
+	overflowWallet, err := walletRepo.GetWalletByUserID(ctx, "overflow")
+	assert.NoError(t, err)
+	assert.Equal(t, nearlyFull, overflowWallet.Balance)
+	validateWalletsReconcileWithLedger(t)
+}
+
+func TestPartialRefundThenFullReversal(t *testing.T) {
+	original := transferMoney(t, "8", "9", "100")
+
+	refund := reverseTransaction(t, original["id"].(string), map[string]interface{}{"amount": "40", "reason": "Partial refund"}, 200)
+	assert.Equal(t, "9", refund["debit_user_id"])
+	assert.Equal(t, "8", refund["credit_user_id"])
+	assert.Equal(t, "40.00", refund["amount"])
+	assert.Equal(t, "refund", refund["transaction_type"])
+	assert.Equal(t, original["id"], refund["original_transaction_id"])
+
+	updatedOriginal, err := transactionRepo.GetTransaction(context.Background(), original["id"].(string))
+	assert.NoError(t, err)
+	assert.Equal(t, transactions.Refunded, updatedOriginal.Status)
+	assert.Equal(t, utils.MustParseMoney("40", utils.USD), *updatedOriginal.RefundedAmount)
+
+	// Without an amount the rest of the transfer is returned
+	refund = reverseTransaction(t, original["id"].(string), map[string]interface{}{}, 200)
+	assert.Equal(t, "60.00", refund["amount"])
+
+	updatedOriginal, err = transactionRepo.GetTransaction(context.Background(), original["id"].(string))
+	assert.NoError(t, err)
+	assert.Equal(t, transactions.Reversed, updatedOriginal.Status)
+
+	response := reverseTransaction(t, original["id"].(string), map[string]interface{}{}, 400)
+	assert.Equal(t, "TRANSACTION_NOT_REVERSIBLE", response["code"])
+	validateWalletsReconcileWithLedger(t)
+}
+
+func TestRefundCannotExceedRemainingAmount(t *testing.T) {
+	original := transferMoney(t, "8", "9", "100")
+	reverseTransaction(t, original["id"].(string), map[string]interface{}{"amount": "70"}, 200)
+
+	response := reverseTransaction(t, original["id"].(string), map[string]interface{}{"amount": "30.01"}, 400)
+	assert.Equal(t, "REFUND_EXCEEDS_REMAINING_AMOUNT", response["code"])
+}
+
+func TestReversalFailsWhenReceiverHasInsufficientBalance(t *testing.T) {
+	original := transferMoney(t, "10", "9", "100")
+	receiverWallet, err := walletRepo.GetWalletByUserID(context.Background(), "9")
+	assert.NoError(t, err)
+	tests.MakeRequestAndGetResponse(t, tests.TestData{
+		Request: tests.Request{
+			URL:    "api/transaction/withdraw",
+			Method: "POST",
+			AsUser: "9",
+			Body: map[string]interface{}{
+				"user_id":  "9",
+				"amount":   receiverWallet.Balance.String(),
+				"currency": "USD",
+			},
+		},
+		Response: tests.Response{Status: 200},
+	})
+
+	response := reverseTransaction(t, original["id"].(string), map[string]interface{}{}, 400)
+	assert.Equal(t, "INSUFFICIENT_BALANCE", response["code"])
+
+	unchangedOriginal, err := transactionRepo.GetTransaction(context.Background(), original["id"].(string))
+	assert.NoError(t, err)
+	assert.Equal(t, transactions.Completed, unchangedOriginal.Status)
+}
+
+func TestTransferInSecondCurrency(t *testing.T) {
+	addCurrency(t, "4", "EUR")
+	addCurrency(t, "5", "EUR")
+	tests.MakeRequestAndGetResponse(t, tests.TestData{
+		Request: tests.Request{
+			URL:    "api/transaction/deposit",
+			Method: "POST",
+			AsUser: "teller",
+			Body:   map[string]interface{}{"user_id": "4", "amount": "80", "currency": "EUR"},
+		},
+		Response: tests.Response{Status: 200},
+	})
+	senderWallet, err := walletRepo.GetWalletByUserID(context.Background(), "4")
+	assert.NoError(t, err)
+
+	response, _ := tests.MakeRequestAndGetResponse(t, tests.TestData{
+		Request: tests.Request{
+			URL:    "api/transaction/transfer",
+			Method: "POST",
+			AsUser: "4",
+			Body:   map[string]interface{}{"sender_id": "4", "receiver_id": "5", "amount": "30", "currency": "EUR"},
+		},
+		Response: tests.Response{Status: 200},
+	})
+	assert.Equal(t, "EUR", response["currency"])
+
+	updatedSenderWallet, err := walletRepo.GetWalletByUserID(context.Background(), "4")
+	assert.NoError(t, err)
+	eurBalance, _ := updatedSenderWallet.BalanceIn(utils.EUR)
+	assert.Equal(t, utils.MustParseMoney("50", utils.EUR), eurBalance)
+	assert.Equal(t, senderWallet.Balance, updatedSenderWallet.Balance) // USD balance is untouched
+
+	receiverWallet, err := walletRepo.GetWalletByUserID(context.Background(), "5")
+	assert.NoError(t, err)
+	eurBalance, _ = receiverWallet.BalanceIn(utils.EUR)
+	assert.Equal(t, utils.MustParseMoney("30", utils.EUR), eurBalance)
+	validateWalletsReconcileWithLedger(t)
+}
+
+func TestTransferToWalletWithoutCurrency(t *testing.T) {
+	tests.MakeRequestAndValidateResponse(t, testData["TestTransferToWalletWithoutCurrency"])
+}
+
+func TestConvertedTransfer(t *testing.T) {
+	addCurrency(t, "9", "EUR")
+	senderWallet, err := walletRepo.GetWalletByUserID(context.Background(), "8")
+	assert.NoError(t, err)
+	receiverWallet, err := walletRepo.GetWalletByUserID(context.Background(), "9")
+	assert.NoError(t, err)
+	quote := createQuote(t, "8")
+	assert.Equal(t, "0.92", quote["rate"])
+	assert.Equal(t, "8", quote["user_id"])
+
+	response := convertedTransfer(t, "8", quote["id"], "100.01", 200)
+	assert.Equal(t, "100.01", response["amount"])
+	assert.Equal(t, "USD", response["currency"])
+	assert.Equal(t, "92.00", response["target_amount"]) // 92.0092 rounded down
+	assert.Equal(t, "EUR", response["target_currency"])
+	assert.Equal(t, "0.92", response["fx_rate"])
+
+	updatedSenderWallet, err := walletRepo.GetWalletByUserID(context.Background(), "8")
+	assert.NoError(t, err)
+	assert.Equal(t, senderWallet.Balance.Sub(utils.MustParseMoney("100.01", utils.USD)), updatedSenderWallet.Balance)
+	updatedReceiverWallet, err := walletRepo.GetWalletByUserID(context.Background(), "9")
+	assert.NoError(t, err)
+	eurBalance, _ := updatedReceiverWallet.BalanceIn(utils.EUR)
+	assert.Equal(t, utils.MustParseMoney("92", utils.EUR), eurBalance)
+	assert.Equal(t, receiverWallet.Balance, updatedReceiverWallet.Balance) // USD balance is untouched
+
+	entries, err := ledgerService.GetEntriesByTransactionID(context.Background(), response["id"].(string))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+	assert.Len(t, entries[0].Postings, 4)
+	validateWalletsReconcileWithLedger(t)
+
+	// The FX account is the counterparty of a converted transfer, so it cannot be reversed
+	transactionID := response["id"].(string)
+	response = reverseTransaction(t, transactionID, map[string]interface{}{}, 400)
+	assert.Equal(t, "TRANSACTION_NOT_REVERSIBLE", response["code"])
+
+	// The quote was used up by the transfer
+	response = convertedTransfer(t, "8", quote["id"], "100.01", 409)
+	assert.Equal(t, "QUOTE_ALREADY_USED", response["code"])
+	usedQuote, err := fx.NewQuoteRepo().GetQuote(context.Background(), quote["id"].(string))
+	assert.NoError(t, err)
+	assert.Equal(t, transactionID, usedQuote.TransactionID)
+}
+
+func TestQuoteIsBoundToItsUser(t *testing.T) {
+	addCurrency(t, "9", "EUR")
+	quote := createQuote(t, "8")
+	response := convertedTransfer(t, "10", quote["id"], "10", 403)
+	assert.Equal(t, "FORBIDDEN", response["code"])
+
+	// A transfer that fails leaves the quote for the next one
+	response = convertedTransfer(t, "8", quote["id"], "10000000", 400)
+	assert.Equal(t, "INSUFFICIENT_BALANCE", response["code"])
+	convertedTransfer(t, "8", quote["id"], "10", 200)
+}
+
+func TestConcurrentTransfersUseAQuoteOnce(t *testing.T) {
+	addCurrency(t, "9", "EUR")
+	quote := createQuote(t, "8")
+	var completed atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := transactionService.CreateTransaction(context.Background(), &transactions.TransferRequest{
+				SenderID:   "8",
+				ReceiverID: "9",
+				Amount:     utils.MustParseMoney("1", utils.USD),
+				Currency:   utils.USD,
+				QuoteID:    quote["id"].(string),
+			})
+			if err == nil {
+				completed.Add(1)
+			} else {
+				assert.True(t, utils.IsError(err, utils.ErrQuoteUsed), err.Error())
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), completed.Load())
+	validateWalletsReconcileWithLedger(t)
+}
+
+func TestTransferWithUnknownQuote(t *testing.T) {
+	tests.MakeRequestAndValidateResponse(t, testData["TestTransferWithUnknownQuote"])
+}
+
+func TestTransferFromAnotherUsersWallet(t *testing.T) {
+	senderWallet, err := walletRepo.GetWalletByUserID(context.Background(), "1")
+	assert.NoError(t, err)
+	tests.MakeRequestAndValidateResponse(t, testData["TestTransferFromAnotherUsersWallet"])
+
+	// Admins cannot send from someone else's wallet either
+	users.NewUserRepo().UpdateUser(users.User{ID: "2", FirstName: "User 2", Email: "2@example.com", PhoneNumber: "+1234567890", Role: authz.RoleAdmin})
+	defer users.NewUserRepo().UpdateUser(users.User{ID: "2", FirstName: "User 2", Email: "2@example.com", PhoneNumber: "+1234567890", Role: authz.RoleUser})
+	tests.MakeRequestAndValidateResponse(t, testData["TestTransferFromAnotherUsersWallet"])
+
+	updatedSenderWallet, err := walletRepo.GetWalletByUserID(context.Background(), "1")
+	assert.NoError(t, err)
+	assert.Equal(t, senderWallet.Balance, updatedSenderWallet.Balance)
+}
+
+func TestTransferLimits(t *testing.T) {
+	users.NewUserRepo().CreateUser(users.User{ID: "limits-admin", FirstName: "Admin", Email: "limits-admin@example.com", PhoneNumber: "+1234567890", Role: authz.RoleAdmin})
+	defer limits.Reset()
+	tests.MakeRequestAndValidateResponse(t, testData["TestSetOwnLimits"])
+	tests.MakeRequestAndValidateResponse(t, testData["TestSetLimits"])
+	senderWallet, err := walletRepo.GetWalletByUserID(context.Background(), "6")
+	assert.NoError(t, err)
+
+	tests.MakeRequestAndValidateResponse(t, testData["TestTransferOverPerTransactionLimit"])
+	transferMoney(t, "6", "5", "100")
+	transferMoney(t, "6", "5", "100")
+	tests.MakeRequestAndValidateResponse(t, testData["TestTransferOverDailyLimit"])
+
+	// Reversed transfers still count towards the daily limit
+	response := transferMoney(t, "6", "5", "50")
+	reverseTransaction(t, response["id"].(string), map[string]interface{}{}, 200)
+	tests.MakeRequestAndValidateResponse(t, testData["TestTransferOverPerTransactionLimit"])
+	response, _ = tests.MakeRequestAndGetResponse(t, testData["TestTransferOverDailyLimit"])
+	assert.Equal(t, "LIMIT_EXCEEDED", response["code"])
+
+	updatedSenderWallet, err := walletRepo.GetWalletByUserID(context.Background(), "6")
+	assert.NoError(t, err)
+	assert.Equal(t, senderWallet.Balance.Sub(utils.MustParseMoney("200", utils.USD)), updatedSenderWallet.Balance)
+}
+
+func TestHoldThenCapture(t *testing.T) {
+	senderWallet, err := walletRepo.GetWalletByUserID(context.Background(), "3")
+	assert.NoError(t, err)
+	receiverWallet, err := walletRepo.GetWalletByUserID(context.Background(), "4")
+	assert.NoError(t, err)
+	amount := utils.MustParseMoney("100", utils.USD)
+
+	hold := holdMoney(t, "3", "4", "100", 200)
+	assert.Equal(t, "pending", hold["status"])
+	assert.NotEmpty(t, hold["expires_at"])
+	assert.Nil(t, hold["settled_at"])
+
+	// The amount is reserved but stays in the ledger balance until the hold is captured
+	heldWallet, err := walletRepo.GetWalletByUserID(context.Background(), "3")
+	assert.NoError(t, err)
+	assert.Equal(t, senderWallet.Balance, heldWallet.Balance)
+	assert.Equal(t, amount, heldWallet.HeldIn(utils.USD))
+	available, _ := heldWallet.AvailableIn(utils.USD)
+	assert.Equal(t, senderWallet.Balance.Sub(amount), available)
+	validateWalletsReconcileWithLedger(t)
+
+	captured := settleHold(t, hold["id"].(string), "capture", "4", 200)
+	assert.Equal(t, "completed", captured["status"])
+	assert.NotEmpty(t, captured["settled_at"])
+	settleHold(t, hold["id"].(string), "capture", "4", 400)
+
+	updatedSenderWallet, err := walletRepo.GetWalletByUserID(context.Background(), "3")
+	assert.NoError(t, err)
+	assert.Equal(t, senderWallet.Balance.Sub(amount), updatedSenderWallet.Balance)
+	assert.True(t, updatedSenderWallet.HeldIn(utils.USD).IsZero())
+	updatedReceiverWallet, err := walletRepo.GetWalletByUserID(context.Background(), "4")
+	assert.NoError(t, err)
+	assert.Equal(t, receiverWallet.Balance.Add(amount), updatedReceiverWallet.Balance)
+	validateWalletsReconcileWithLedger(t)
+}
+
+func TestHeldFundsCannotBeSpentUntilVoided(t *testing.T) {
+	senderWallet, err := walletRepo.GetWalletByUserID(context.Background(), "3")
+	assert.NoError(t, err)
+	hold := holdMoney(t, "3", "4", senderWallet.Balance.Sub(utils.MustParseMoney("100", utils.USD)).String(), 200)
+
+	response := holdMoney(t, "3", "4", "200", 400)
+	assert.Equal(t, "INSUFFICIENT_BALANCE", response["code"])
+	settleHold(t, hold["id"].(string), "void", "5", 403)
+
+	voided := settleHold(t, hold["id"].(string), "void", "3", 200)
+	assert.Equal(t, "voided", voided["status"])
+	response = settleHold(t, hold["id"].(string), "capture", "4", 400)
+	assert.Equal(t, "HOLD_NOT_PENDING", response["code"])
+	transferMoney(t, "3", "4", "200")
+
+	updatedSenderWallet, err := walletRepo.GetWalletByUserID(context.Background(), "3")
+	assert.NoError(t, err)
+	assert.Equal(t, senderWallet.Balance.Sub(utils.MustParseMoney("200", utils.USD)), updatedSenderWallet.Balance)
+	assert.True(t, updatedSenderWallet.HeldIn(utils.USD).IsZero())
+}
+
+func TestExpiredHoldsAreReleased(t *testing.T) {
+	senderWallet, err := walletRepo.GetWalletByUserID(context.Background(), "3")
+	assert.NoError(t, err)
+	hold := holdMoney(t, "3", "4", "50", 200)
+
+	expired, err := transactionService.ExpireHolds(context.Background(), time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, expired)
+	expired, err = transactionService.ExpireHolds(context.Background(), time.Now().Add(transactions.DefaultHoldTTL))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, expired)
+
+	transaction, err := transactionRepo.GetTransaction(context.Background(), hold["id"].(string))
+	assert.NoError(t, err)
+	assert.Equal(t, transactions.Expired, transaction.Status)
+	response := settleHold(t, hold["id"].(string), "capture", "4", 400)
+	assert.Equal(t, "HOLD_NOT_PENDING", response["code"])
+
+	updatedSenderWallet, err := walletRepo.GetWalletByUserID(context.Background(), "3")
+	assert.NoError(t, err)
+	assert.Equal(t, senderWallet.Balance, updatedSenderWallet.Balance)
+	assert.True(t, updatedSenderWallet.HeldIn(utils.USD).IsZero())
+}
+
+func TestBusyWalletDoesNotStopHoldsExpiring(t *testing.T) {
+	wallet.SetLockTimeout(50 * time.Millisecond)
+	defer wallet.SetLockTimeout(wallet.DefaultLockTimeout)
+	busyHold := holdMoney(t, "3", "4", "5", 200)
+	hold := holdMoney(t, "4", "3", "5", 200)
+
+	_, err := walletService.GetWalletForUpdate(context.Background(), "3")
+	assert.NoError(t, err)
+	_, err = transactionService.ExpireHolds(context.Background(), time.Now().Add(transactions.DefaultHoldTTL))
+	assert.True(t, utils.IsError(err, utils.ErrLockTimeout))
+	walletService.ReleaseGetWalletForUpdateLock(context.Background(), "3")
+	for id, status := range map[string]transactions.TransactionStatus{busyHold["id"].(string): transactions.Pending, hold["id"].(string): transactions.Expired} {
+		transaction, err := transactionRepo.GetTransaction(context.Background(), id)
+		assert.NoError(t, err)
+		assert.Equal(t, status, transaction.Status)
+	}
+
+	// The hold left pending is released once its wallet is free
+	expired, err := transactionService.ExpireHolds(context.Background(), time.Now().Add(transactions.DefaultHoldTTL))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, expired)
+	transaction, err := transactionRepo.GetTransaction(context.Background(), busyHold["id"].(string))
+	assert.NoError(t, err)
+	assert.Equal(t, transactions.Expired, transaction.Status)
+}
+
+func TestCaptureTransferThatIsNotAHold(t *testing.T) {
+	response := transferMoney(t, "3", "4", "10")
+	response = settleHold(t, response["id"].(string), "capture", "3", 400)
+	assert.Equal(t, "HOLD_NOT_PENDING", response["code"])
+}
+
+func TestBatchTransferAllOrNothing(t *testing.T) {
+	senderWallet, err := walletRepo.GetWalletByUserID(context.Background(), "5")
+	assert.NoError(t, err)
+	response := batchTransfer(t, "5", "", []map[string]interface{}{
+		{"receiver_id": "6", "amount": "10"},
+		{"receiver_id": "7", "amount": "20"},
+		{"receiver_id": "6", "amount": "30"},
+	}, 200)
+	assert.Equal(t, "all_or_nothing", response["mode"])
+	assert.Equal(t, "completed", response["status"])
+	assert.Equal(t, float64(3), response["completed"])
+
+	updatedSenderWallet, err := walletRepo.GetWalletByUserID(context.Background(), "5")
+	assert.NoError(t, err)
+	assert.Equal(t, senderWallet.Balance.Sub(utils.MustParseMoney("60", utils.USD)), updatedSenderWallet.Balance)
+	reconciliation, err := walletService.ReconcileWallet(context.Background(), "5")
+	assert.NoError(t, err)
+	assert.True(t, reconciliation.Balanced)
+}
+
+func TestBatchTransferAllOrNothingRollsBack(t *testing.T) {
+	senderWallet, err := walletRepo.GetWalletByUserID(context.Background(), "5")
+	assert.NoError(t, err)
+	response := batchTransfer(t, "5", "all_or_nothing", []map[string]interface{}{
+		{"receiver_id": "6", "amount": "10"},
+		{"receiver_id": "abc", "amount": "20"}, // has no wallet
+		{"receiver_id": "7", "amount": "30"},
+	}, 200)
+	assert.Equal(t, "failed", response["status"])
+	results := response["results"].([]interface{})
+	assert.Equal(t, "skipped", results[0].(map[string]interface{})["status"])
+	assert.Equal(t, "WALLET_NOT_FOUND", results[1].(map[string]interface{})["error_code"])
+	assert.Equal(t, "skipped", results[2].(map[string]interface{})["status"])
+
+	// A transfer failing after others were made undoes them too
+	response = batchTransfer(t, "5", "all_or_nothing", []map[string]interface{}{
+		{"receiver_id": "6", "amount": "10"},
+		{"receiver_id": "7", "amount": "20", "currency": "EUR"}, // 5 has no EUR
+	}, 200)
+	assert.Equal(t, "failed", response["status"])
+	results = response["results"].([]interface{})
+	assert.Equal(t, "skipped", results[0].(map[string]interface{})["status"])
+	assert.Equal(t, "CURRENCY_MISMATCH", results[1].(map[string]interface{})["error_code"])
+
+	updatedSenderWallet, err := walletRepo.GetWalletByUserID(context.Background(), "5")
+	assert.NoError(t, err)
+	assert.Equal(t, senderWallet.Balance, updatedSenderWallet.Balance)
+}
+
+func TestBatchTransferBestEffort(t *testing.T) {
+	senderWallet, err := walletRepo.GetWalletByUserID(context.Background(), "5")
+	assert.NoError(t, err)
+	response := batchTransfer(t, "5", "best_effort", []map[string]interface{}{
+		{"receiver_id": "6", "amount": "10"},
+		{"receiver_id": "abc", "amount": "20"},
+		{"receiver_id": "7", "amount": "-5"},
+		{"receiver_id": "7", "amount": "30"},
+	}, 200)
+	assert.Equal(t, "partially_completed", response["status"])
+	assert.Equal(t, float64(2), response["completed"])
+	assert.Equal(t, float64(2), response["failed"])
+	results := response["results"].([]interface{})
+	assert.Equal(t, "completed", results[0].(map[string]interface{})["status"])
+	assert.Equal(t, "WALLET_NOT_FOUND", results[1].(map[string]interface{})["error_code"])
+	assert.Equal(t, "VALIDATION_ERROR", results[2].(map[string]interface{})["error_code"])
+	transaction := results[3].(map[string]interface{})["transaction"].(map[string]interface{})
+	assert.Equal(t, "completed", transaction["status"])
+	assert.Equal(t, "30.00", transaction["amount"])
+
+	updatedSenderWallet, err := walletRepo.GetWalletByUserID(context.Background(), "5")
+	assert.NoError(t, err)
+	assert.Equal(t, senderWallet.Balance.Sub(utils.MustParseMoney("40", utils.USD)), updatedSenderWallet.Balance)
+}
+
+func TestBatchTransferOverBalance(t *testing.T) {
+	response := batchTransfer(t, "5", "all_or_nothing", []map[string]interface{}{
+		{"receiver_id": "6", "amount": "600000"},
+		{"receiver_id": "7", "amount": "600000"},
+	}, 400)
+	assert.Equal(t, "INSUFFICIENT_BALANCE", response["code"])
+
+	// A total too large to add up fails rather than wrapping around to a small one
+	transfers := make([]map[string]interface{}, 0)
+	for i := 0; i < 101; i++ {
+		transfers = append(transfers, map[string]interface{}{"receiver_id": "6", "amount": "922337203685477"})
+	}
+	response = batchTransfer(t, "5", "all_or_nothing", transfers, 422)
+	assert.Equal(t, "AMOUNT_OUT_OF_RANGE", response["code"])
+
+	// Sent from another user's wallet, or mixing senders
+	tests.MakeRequestAndGetResponse(t, tests.TestData{
+		Request: tests.Request{
+			URL:    "api/transaction/batch",
+			Method: "POST",
+			AsUser: "6",
+			Body: map[string]interface{}{
+				"transfers": []map[string]interface{}{{"sender_id": "5", "receiver_id": "6", "amount": "10", "currency": "USD"}},
+			},
+		},
+		Response: tests.Response{Status: 403},
+	})
+	tests.MakeRequestAndGetResponse(t, tests.TestData{
+		Request: tests.Request{
+			URL:    "api/transaction/batch",
+			Method: "POST",
+			AsUser: "5",
+			Body: map[string]interface{}{
+				"transfers": []map[string]interface{}{
+					{"sender_id": "5", "receiver_id": "6", "amount": "10", "currency": "USD"},
+					{"sender_id": "6", "receiver_id": "7", "amount": "10", "currency": "USD"},
+				},
+			},
+		},
+		Response: tests.Response{Status: 400},
+	})
+}
+
+func TestConcurrentBatchesAndTransfers(t *testing.T) {
+	userIDs := []string{"1", "2", "3", "4", "5"}
+	totalBefore := utils.NewMoney(0, utils.USD)
+	for _, userID := range userIDs {
+		userWallet, err := walletRepo.GetWalletByUserID(context.Background(), userID)
+		assert.NoError(t, err)
+		totalBefore = totalBefore.Add(userWallet.Balance)
+	}
+
+	// Batches lock many wallets at once while transfers lock two, in any order of receivers
+	wg := sync.WaitGroup{}
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+		senderID := userIDs[i%len(userIDs)]
+		go func() {
+			defer wg.Done()
+			transfers := make([]map[string]interface{}, 0)
+			for j := len(userIDs) - 1; j >= 0; j-- {
+				if userIDs[j] != senderID {
+					transfers = append(transfers, map[string]interface{}{"receiver_id": userIDs[j], "amount": "1"})
+				}
+			}
+			batchTransfer(t, senderID, "all_or_nothing", transfers, 200)
+		}()
+		go func() {
+			defer wg.Done()
+			transferMoney(t, userIDs[(i+1)%len(userIDs)], senderID, "1")
+		}()
+	}
+	wg.Wait()
+
+	totalAfter := utils.NewMoney(0, utils.USD)
+	for _, userID := range userIDs {
+		userWallet, err := walletRepo.GetWalletByUserID(context.Background(), userID)
+		assert.NoError(t, err)
+		totalAfter = totalAfter.Add(userWallet.Balance)
+	}
+	assert.Equal(t, totalBefore, totalAfter)
+}
+
+func TestSplitTransferPaysEveryReceiver(t *testing.T) {
+	balancesBefore := getBalances(t, "5", "6", "7")
+	split := splitTransfer(t, "5", map[string]interface{}{
+		"sender_id":   "5",
+		"description": "Order 42",
+		"legs": []map[string]interface{}{
+			{"user_id": "6", "amount": "10"},
+			{"user_id": "7", "amount": "20.50"},
+		},
+	}, 200)
+	assert.Equal(t, "split", split["transaction_type"])
+	assert.Equal(t, "completed", split["status"])
+	assert.Equal(t, "30.50", split["amount"])
+	assert.Equal(t, "5", split["debit_user_id"])
+	legs := split["legs"].([]interface{})
+	assert.Len(t, legs, 2)
+	for i, receiverID := range []string{"6", "7"} {
+		leg := legs[i].(map[string]interface{})
+		assert.Equal(t, "transfer", leg["transaction_type"])
+		assert.Equal(t, "completed", leg["status"])
+		assert.Equal(t, receiverID, leg["credit_user_id"])
+		assert.Equal(t, split["id"], leg["parent_transaction_id"])
+	}
+
+	balancesAfter := getBalances(t, "5", "6", "7")
+	assert.Equal(t, balancesBefore["5"].Sub(utils.MustParseMoney("30.50", utils.USD)), balancesAfter["5"])
+	assert.Equal(t, balancesBefore["6"].Add(utils.MustParseMoney("10", utils.USD)), balancesAfter["6"])
+	assert.Equal(t, balancesBefore["7"].Add(utils.MustParseMoney("20.50", utils.USD)), balancesAfter["7"])
+
+	// Receivers of a leg can see the whole split, other users cannot
+	response, _ := tests.MakeRequestAndGetResponse(t, tests.TestData{
+		Request:  tests.Request{URL: "api/transaction/" + split["id"].(string) + "/split", Method: "GET", AsUser: "7"},
+		Response: tests.Response{Status: 200},
+	})
+	assert.Len(t, response["legs"], 2)
+	tests.MakeRequestAndGetResponse(t, tests.TestData{
+		Request:  tests.Request{URL: "api/transaction/" + split["id"].(string) + "/split", Method: "GET", AsUser: "8"},
+		Response: tests.Response{Status: 403},
+	})
+	tests.MakeRequestAndGetResponse(t, tests.TestData{
+		Request:  tests.Request{URL: "api/transaction/" + legs[0].(map[string]interface{})["id"].(string) + "/split", Method: "GET", AsUser: "5"},
+		Response: tests.Response{Status: 404},
+	})
+}
+
+func TestSplitTransferCollectsFromSenders(t *testing.T) {
+	users.NewUserRepo().CreateUser(users.User{ID: "split-admin", FirstName: "Admin", Email: "split-admin@example.com", PhoneNumber: "+1234567890", Role: authz.RoleAdmin})
+	body := map[string]interface{}{
+		"receiver_id": "5",
+		"legs": []map[string]interface{}{
+			{"user_id": "6", "amount": "5"},
+			{"user_id": "7", "amount": "5"},
+		},
+	}
+	// Collecting takes money out of other users' wallets
+	splitTransfer(t, "5", body, 403)
+
+	balancesBefore := getBalances(t, "5", "6", "7")
+	split := splitTransfer(t, "split-admin", body, 200)
+	assert.Equal(t, "5", split["credit_user_id"])
+	assert.Equal(t, "10.00", split["amount"])
+	balancesAfter := getBalances(t, "5", "6", "7")
+	assert.Equal(t, balancesBefore["5"].Add(utils.MustParseMoney("10", utils.USD)), balancesAfter["5"])
+	assert.Equal(t, balancesBefore["6"].Sub(utils.MustParseMoney("5", utils.USD)), balancesAfter["6"])
+	assert.Equal(t, balancesBefore["7"].Sub(utils.MustParseMoney("5", utils.USD)), balancesAfter["7"])
+}
+
+func TestSplitTransferRollsBack(t *testing.T) {
+	balancesBefore := getBalances(t, "5", "6", "7")
+	body := map[string]interface{}{
+		"sender_id":       "5",
+		"idempotency_key": "split-over-balance",
+		"legs": []map[string]interface{}{
+			{"user_id": "6", "amount": "10"},
+			{"user_id": "7", "amount": "2000000"},
+		},
+	}
+	response := splitTransfer(t, "5", body, 400)
+	assert.Equal(t, "INSUFFICIENT_BALANCE", response["code"])
+	// The leg made before the failing one was undone with it
+	assert.Equal(t, balancesBefore, getBalances(t, "5", "6", "7"))
+
+	// The failed split is kept, so a retry replays the failure
+	split := splitTransfer(t, "5", body, 200)
+	assert.Equal(t, "failed", split["status"])
+	assert.Len(t, split["legs"], 0)
+
+	response = splitTransfer(t, "5", map[string]interface{}{
+		"sender_id": "5",
+		"legs": []map[string]interface{}{
+			{"user_id": "6", "amount": "10"},
+			{"user_id": "abc", "amount": "10"}, // has no wallet
+		},
+	}, 404)
+	assert.Equal(t, "WALLET_NOT_FOUND", response["code"])
+	assert.Equal(t, balancesBefore, getBalances(t, "5", "6", "7"))
+
+	response = splitTransfer(t, "5", map[string]interface{}{
+		"sender_id":   "5",
+		"receiver_id": "6",
+		"legs":        []map[string]interface{}{{"user_id": "7", "amount": "10"}, {"user_id": "8", "amount": "10"}},
+	}, 400)
+	assert.Equal(t, "VALIDATION_ERROR", response["code"])
+	response = splitTransfer(t, "5", map[string]interface{}{
+		"sender_id": "5",
+		"legs":      []map[string]interface{}{{"user_id": "6", "amount": "10"}, {"user_id": "5", "amount": "10"}},
+	}, 400)
+	assert.Equal(t, "TRANSACTION_SAME_USER", response["code"])
+}
+
+func TestTransferPublishesLifecycleEvents(t *testing.T) {
+	publishedEvents := subscribeToEvents(t)
+	transfer := transferMoney(t, "1", "2", "5")
+
+	published := publishedEvents(transfer["id"].(string))
+	assert.Len(t, published, 2)
+	assert.Equal(t, events.TransferCreated, published[0].Type)
+	assert.Equal(t, events.TransferCompleted, published[1].Type)
+	var payload events.TransferPayload
+	assert.NoError(t, published[1].Decode(&payload))
+	assert.Equal(t, events.TransferPayload{
+		TransactionID:   transfer["id"].(string),
+		TransactionType: "transfer",
+		Status:          "completed",
+		DebitUserID:     "1",
+		CreditUserID:    "2",
+		Amount:          utils.MustParseMoney("5", utils.USD),
+		Currency:        utils.USD,
+	}, payload)
+	recorded, err := outboxRepo.GetEventsByAggregateID(context.Background(), transfer["id"].(string))
+	assert.NoError(t, err)
+	for _, event := range recorded {
+		assert.NotNil(t, event.PublishedAt)
+	}
+}
+
+func TestFailedSplitPublishesOnlyFailedEvent(t *testing.T) {
+	publishedEvents := subscribeToEvents(t)
+	body := map[string]interface{}{
+		"sender_id":       "8",
+		"idempotency_key": "split-over-balance-events",
+		"legs": []map[string]interface{}{
+			{"user_id": "9", "amount": "10"},
+			{"user_id": "10", "amount": "2000000"},
+		},
+	}
+	splitTransfer(t, "8", body, 400)
+	split := splitTransfer(t, "8", body, 200) // Replays the failed split
+
+	// The events of the split and its first leg were rolled back with them
+	published := publishedEvents(split["id"].(string))
+	assert.Len(t, published, 1)
+	assert.Equal(t, events.TransferFailed, published[0].Type)
+	var payload events.TransferPayload
+	assert.NoError(t, published[0].Decode(&payload))
+	assert.Equal(t, "failed", payload.Status)
+	assert.Equal(t, "INSUFFICIENT_BALANCE", payload.ErrorCode)
+}
+
+func TestEventIsPublishedAgainWhenAHandlerFails(t *testing.T) {
+	// Earlier tests may have left events to publish, which would each fail once too
+	_, err := eventService.PublishPending(context.Background())
+	assert.NoError(t, err)
+	var mu sync.Mutex
+	deliveries := make(map[string]int)
+	unsubscribe := events.NewInProcessPublisher().Subscribe(func(ctx context.Context, event events.Event) error {
+		mu.Lock()
+		defer mu.Unlock()
+		deliveries[event.ID]++
+		if deliveries[event.ID] == 1 {
+			return fmt.Errorf("handler is down")
+		}
+		return nil
+	})
+	defer unsubscribe()
+	transfer := transferMoney(t, "1", "2", "1")
+
+	// The relay may run in between, so publishing is tried until the transfer's events are published
+	recorded := publishUntilPublished(t, transfer["id"].(string))
+	assert.Len(t, recorded, 2)
+	mu.Lock()
+	defer mu.Unlock()
+	for _, event := range recorded {
+		assert.NotNil(t, event.PublishedAt)
+		assert.Equal(t, 2, deliveries[event.ID])
+	}
+}
+
+func TestFailingEventHoldsUpOnlyItsAggregate(t *testing.T) {
+	_, err := eventService.PublishPending(context.Background())
+	assert.NoError(t, err)
+	failing := utils.MustParseMoney("7", utils.USD)
+	unsubscribe := events.NewInProcessPublisher().Subscribe(func(ctx context.Context, event events.Event) error {
+		var payload events.TransferPayload
+		if event.Decode(&payload) == nil && payload.Amount == failing {
+			return fmt.Errorf("handler is down")
+		}
+		return nil
+	})
+	held := transferMoney(t, "1", "2", "7")
+	transfer := transferMoney(t, "1", "2", "1")
+
+	// The events of the other transfer are published in the same pass
+	_, err = eventService.PublishPending(context.Background())
+	assert.Error(t, err)
+	recorded, err := outboxRepo.GetEventsByAggregateID(context.Background(), transfer["id"].(string))
+	assert.NoError(t, err)
+	assert.Len(t, recorded, 2)
+	for _, event := range recorded {
+		assert.NotNil(t, event.PublishedAt)
+	}
+	recorded, err = outboxRepo.GetEventsByAggregateID(context.Background(), held["id"].(string))
+	assert.NoError(t, err)
+	assert.Len(t, recorded, 2)
+	for _, event := range recorded {
+		assert.Nil(t, event.PublishedAt)
+	}
+
+	// Once the handler recovers the held events are published, in order
+	unsubscribe()
+	assert.Len(t, publishUntilPublished(t, held["id"].(string)), 2)
+}
+
+func TestTransferTimesOutWaitingForWalletLock(t *testing.T) {
+	transferTimesOutWaitingForWalletLock(t)
+}
+
+func TestShardedTransferTimesOutWaitingForWalletLock(t *testing.T) {
+	wallet.SetShards(4)
+	defer wallet.SetShards(wallet.DefaultShards)
+	// The final transfer only gets wallet 4 if the transfer that gave up left its queue
+	transferTimesOutWaitingForWalletLock(t)
+}
+
+func transferTimesOutWaitingForWalletLock(t *testing.T) {
+	wallet.SetLockTimeout(50 * time.Millisecond)
+	defer wallet.SetLockTimeout(wallet.DefaultLockTimeout)
+	balancesBefore := getBalances(t, "3", "4")
+
+	// Wallet 4 is locked second, so the transfer gives up holding wallet 3
+	_, err := walletService.GetWalletForUpdate(context.Background(), "4")
+	assert.NoError(t, err)
+	response, _ := tests.MakeRequestAndGetResponse(t, tests.TestData{
+		Request: tests.Request{
+			URL:    "api/transaction/transfer",
+			Method: "POST",
+			AsUser: "3",
+			Body:   map[string]interface{}{"sender_id": "3", "receiver_id": "4", "amount": "10", "currency": "USD"},
+		},
+		Response: tests.Response{Status: 503},
+	})
+	assert.Equal(t, "LOCK_TIMEOUT", response["code"])
+	_, err = walletService.GetWalletForUpdate(context.Background(), "3")
+	assert.NoError(t, err, "wallet 3 was not released")
+	walletService.ReleaseGetWalletForUpdateLock(context.Background(), "3")
+	walletService.ReleaseGetWalletForUpdateLock(context.Background(), "4")
+
+	assert.Equal(t, balancesBefore, getBalances(t, "3", "4"))
+	transferMoney(t, "3", "4", "10")
+}
+
+func TestCancelledTransferStopsWaitingForWalletLock(t *testing.T) {
+	_, err := walletService.GetWalletForUpdate(context.Background(), "4")
+	assert.NoError(t, err)
+	defer walletService.ReleaseGetWalletForUpdateLock(context.Background(), "4")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	start := time.Now()
+	_, err = transactionService.CreateTransaction(ctx, &transactions.TransferRequest{
+		SenderID:   "3",
+		ReceiverID: "4",
+		Amount:     utils.MustParseMoney("10", utils.USD),
+		Currency:   utils.USD,
+	})
+	assert.True(t, utils.IsError(err, utils.ErrLockTimeout))
+	assert.Less(t, time.Since(start), wallet.DefaultLockTimeout)
+}
+
 func TestConcurrentTransferMoney(t *testing.T) {
+	concurrentTransferMoney(t)
+}
+
+func TestConcurrentTransferMoneyOptimistic(t *testing.T) {
+	transactions.SetLockingStrategy(transactions.Optimistic)
+	defer transactions.SetLockingStrategy(transactions.Pessimistic)
+	concurrentTransferMoney(t)
+}
+
+func TestConcurrentTransferMoneySharded(t *testing.T) {
+	wallet.SetShards(8)
+	defer wallet.SetShards(wallet.DefaultShards)
+	concurrentTransferMoney(t)
+}
+
+func TestShardedBatchesAndTransfers(t *testing.T) {
+	wallet.SetShards(3)
+	defer wallet.SetShards(wallet.DefaultShards)
+	TestConcurrentBatchesAndTransfers(t)
+	validateWalletsReconcileWithLedger(t)
+}
+
+func TestOptimisticTransferRetriesWhenWalletChanges(t *testing.T) {
+	transactions.SetLockingStrategy(transactions.Optimistic)
+	defer transactions.SetLockingStrategy(transactions.Pessimistic)
+	balancesBefore := getBalances(t, "3", "4")
+
+	// Transfers in both directions keep changing the wallets the others have just read
+	wg := sync.WaitGroup{}
+	for i := 0; i < 200; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			transferMoney(t, "3", "4", "2")
+		}()
+		go func() {
+			defer wg.Done()
+			transferMoney(t, "4", "3", "1")
+		}()
+	}
+	wg.Wait()
+
+	balancesAfter := getBalances(t, "3", "4")
+	assert.Equal(t, balancesBefore["3"].Sub(utils.MustParseMoney("200", utils.USD)), balancesAfter["3"])
+	assert.Equal(t, balancesBefore["4"].Add(utils.MustParseMoney("200", utils.USD)), balancesAfter["4"])
+	validateWalletsReconcileWithLedger(t)
+}
+
+func TestOptimisticTransferRetriesAfterConflict(t *testing.T) {
+	transactions.SetLockingStrategy(transactions.Optimistic)
+	defer transactions.SetLockingStrategy(transactions.Pessimistic)
+	ctx := context.Background()
+	// Not in the ledger, so these wallets are left out of the reconciliation checks
+	for _, userID := range []string{"optimistic-1", "optimistic-2"} {
+		users.NewUserRepo().CreateUser(users.User{ID: userID, FirstName: "User " + userID, Email: userID + "@example.com", PhoneNumber: "+1234567890"})
+		_, err := walletService.CreateWallet(ctx, userID, utils.MustParseMoney("100", utils.USD))
+		assert.NoError(t, err)
+	}
+
+	// Holding the receiver's lock makes the transfer wait with the wallets it read, while the
+	// receiver's balance changes under it
+	receiverWallet, err := walletService.GetWalletForUpdate(ctx, "optimistic-2")
+	assert.NoError(t, err)
+	done := make(chan error)
+	go func() {
+		_, err := transactionService.CreateTransaction(ctx, &transactions.TransferRequest{
+			SenderID:   "optimistic-1",
+			ReceiverID: "optimistic-2",
+			Amount:     utils.MustParseMoney("30", utils.USD),
+			Currency:   utils.USD,
+		})
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	assert.NoError(t, walletRepo.UpdateWalletBalance(ctx, "optimistic-2", receiverWallet.Balance.Add(utils.MustParseMoney("10", utils.USD))))
+	walletService.ReleaseGetWalletForUpdateLock(ctx, "optimistic-2")
+	assert.NoError(t, <-done)
+
+	// The credit made against the stale read would have lost the change
+	balances := getBalances(t, "optimistic-1", "optimistic-2")
+	assert.Equal(t, utils.MustParseMoney("70", utils.USD), balances["optimistic-1"])
+	assert.Equal(t, utils.MustParseMoney("140", utils.USD), balances["optimistic-2"])
+}
+
+// concurrentTransferMoney makes many random transfers at once from fresh wallets, so the
+// locking strategies can be compared by the time each run takes.
+func concurrentTransferMoney(t *testing.T) {
+	// Thousands of transfers queue for each of the ten wallets, far longer than a request
+	// waits for a wallet in production
+	wallet.SetLockTimeout(time.Minute)
+	defer wallet.SetLockTimeout(wallet.DefaultLockTimeout)
 	setup()
 	wg := sync.WaitGroup{}
 	wg.Add(50000)
@@ -137,6 +1253,7 @@ func TestConcurrentTransferMoney(t *testing.T) {
 	validateTransactionCount(t)
 	validateTotalBalanceAcrossAllWallets(t)
 	validateEachWalletBalance(t)
+	validateWalletsReconcileWithLedger(t)
 }
 
 func transferMoneyRandomly(t *testing.T) {
@@ -150,6 +1267,7 @@ func transferMoneyRandomly(t *testing.T) {
 		Request: tests.Request{
 			URL:    "api/transaction/transfer",
 			Method: "POST",
+			AsUser: sender_id,
 			Body: map[string]interface{}{
 				"sender_id":   sender_id,
 				"receiver_id": receiver_id,
@@ -163,7 +1281,7 @@ func transferMoneyRandomly(t *testing.T) {
 			Body: map[string]interface{}{
 				"debit_user_id":  sender_id,
 				"credit_user_id": receiver_id,
-				"amount":         float64(amount),
+				"amount":         utils.NewMoney(int64(amount)*100, utils.USD).String(),
 				"currency":       "USD",
 				"description":    "Test transfer " + strconv.Itoa(amount),
 			},
@@ -180,14 +1298,221 @@ func transferMoneyRandomly(t *testing.T) {
 	}
 }
 
+func addCurrency(t *testing.T, userID string, currency string) {
+	tests.MakeRequestAndGetResponse(t, tests.TestData{
+		Request: tests.Request{
+			URL:    fmt.Sprintf("wallets/currencies?user_id=%s&currency=%s", userID, currency),
+			Method: "PUT",
+			AsUser: userID,
+		},
+		Response: tests.Response{Status: 200},
+	})
+}
+
+// createQuote quotes the USD to EUR rate to the user
+func createQuote(t *testing.T, userID string) map[string]interface{} {
+	quote, _ := tests.MakeRequestAndGetResponse(t, tests.TestData{
+		Request: tests.Request{
+			URL:    "api/fx/quotes",
+			Method: "POST",
+			AsUser: userID,
+			Body:   map[string]interface{}{"from": "USD", "to": "EUR"},
+		},
+		Response: tests.Response{Status: 201},
+	})
+	return quote
+}
+
+// convertedTransfer sends the amount in USD from the sender to user 9 at the quote
+func convertedTransfer(t *testing.T, senderID string, quoteID interface{}, amount string, status int) map[string]interface{} {
+	response, _ := tests.MakeRequestAndGetResponse(t, tests.TestData{
+		Request: tests.Request{
+			URL:    "api/transaction/transfer",
+			Method: "POST",
+			AsUser: senderID,
+			Body: map[string]interface{}{
+				"sender_id":   senderID,
+				"receiver_id": "9",
+				"amount":      amount,
+				"currency":    "USD",
+				"quote_id":    quoteID,
+			},
+		},
+		Response: tests.Response{Status: status},
+	})
+	return response
+}
+
+func transferMoney(t *testing.T, senderID string, receiverID string, amount string) map[string]interface{} {
+	response, _ := tests.MakeRequestAndGetResponse(t, tests.TestData{
+		Request: tests.Request{
+			URL:    "api/transaction/transfer",
+			Method: "POST",
+			AsUser: senderID,
+			Body: map[string]interface{}{
+				"sender_id":   senderID,
+				"receiver_id": receiverID,
+				"amount":      amount,
+				"currency":    "USD",
+			},
+		},
+		Response: tests.Response{Status: 200},
+	})
+	return response
+}
+
+// batchTransfer sends the transfers in USD from the sender in one batch
+func batchTransfer(t *testing.T, senderID string, mode string, transfers []map[string]interface{}, status int) map[string]interface{} {
+	for _, transfer := range transfers {
+		transfer["sender_id"] = senderID
+		if _, ok := transfer["currency"]; !ok {
+			transfer["currency"] = "USD"
+		}
+	}
+	response, _ := tests.MakeRequestAndGetResponse(t, tests.TestData{
+		Request: tests.Request{
+			URL:    "api/transaction/batch",
+			Method: "POST",
+			AsUser: senderID,
+			Body: map[string]interface{}{
+				"mode":      mode,
+				"transfers": transfers,
+			},
+		},
+		Response: tests.Response{Status: status},
+	})
+	return response
+}
+
+func splitTransfer(t *testing.T, asUser string, body map[string]interface{}, status int) map[string]interface{} {
+	if _, ok := body["currency"]; !ok {
+		body["currency"] = "USD"
+	}
+	response, _ := tests.MakeRequestAndGetResponse(t, tests.TestData{
+		Request: tests.Request{
+			URL:    "api/transaction/split",
+			Method: "POST",
+			AsUser: asUser,
+			Body:   body,
+		},
+		Response: tests.Response{Status: status},
+	})
+	return response
+}
+
+func getBalances(t *testing.T, userIDs ...string) map[string]utils.Money {
+	balances := make(map[string]utils.Money, len(userIDs))
+	for _, userID := range userIDs {
+		userWallet, err := walletRepo.GetWalletByUserID(context.Background(), userID)
+		assert.NoError(t, err)
+		balances[userID] = userWallet.Balance
+	}
+	return balances
+}
+
+func holdMoney(t *testing.T, senderID string, receiverID string, amount string, status int) map[string]interface{} {
+	response, _ := tests.MakeRequestAndGetResponse(t, tests.TestData{
+		Request: tests.Request{
+			URL:    "api/transaction/transfer?mode=hold",
+			Method: "POST",
+			AsUser: senderID,
+			Body: map[string]interface{}{
+				"sender_id":   senderID,
+				"receiver_id": receiverID,
+				"amount":      amount,
+				"currency":    "USD",
+			},
+		},
+		Response: tests.Response{Status: status},
+	})
+	return response
+}
+
+// settleHold captures or voids the hold
+func settleHold(t *testing.T, id string, action string, asUser string, status int) map[string]interface{} {
+	response, _ := tests.MakeRequestAndGetResponse(t, tests.TestData{
+		Request: tests.Request{
+			URL:    fmt.Sprintf("api/transaction/%s/%s", id, action),
+			Method: "POST",
+			AsUser: asUser,
+		},
+		Response: tests.Response{Status: status},
+	})
+	return response
+}
+
+func reverseTransaction(t *testing.T, id string, body map[string]interface{}, status int) map[string]interface{} {
+	// Reversals are made by the receiver of the original transfer
+	original, err := transactionRepo.GetTransaction(context.Background(), id)
+	assert.NoError(t, err)
+	response, _ := tests.MakeRequestAndGetResponse(t, tests.TestData{
+		Request: tests.Request{
+			URL:    fmt.Sprintf("api/transaction/%s/reverse", id),
+			Method: "POST",
+			AsUser: original.CreditUserID,
+			Body:   body,
+		},
+		Response: tests.Response{Status: status},
+	})
+	return response
+}
+
+// subscribeToEvents collects the events published until the test ends. The returned function
+// publishes the pending events and returns the ones about aggregateID, in publication order.
+// publishUntilPublished publishes the outbox until every event of the aggregate is published,
+// and returns its events.
+func publishUntilPublished(t *testing.T, aggregateID string) []events.Event {
+	var recorded []events.Event
+	assert.Eventually(t, func() bool {
+		eventService.PublishPending(context.Background())
+		var err error
+		recorded, err = outboxRepo.GetEventsByAggregateID(context.Background(), aggregateID)
+		if err != nil {
+			return false
+		}
+		for _, event := range recorded {
+			if event.PublishedAt == nil {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+	return recorded
+}
+
+func subscribeToEvents(t *testing.T) func(aggregateID string) []events.Event {
+	var mu sync.Mutex
+	published := make([]events.Event, 0)
+	unsubscribe := events.NewInProcessPublisher().Subscribe(func(ctx context.Context, event events.Event) error {
+		mu.Lock()
+		defer mu.Unlock()
+		published = append(published, event)
+		return nil
+	})
+	t.Cleanup(unsubscribe)
+	return func(aggregateID string) []events.Event {
+		_, err := eventService.PublishPending(context.Background())
+		assert.NoError(t, err)
+		mu.Lock()
+		defer mu.Unlock()
+		about := make([]events.Event, 0)
+		for _, event := range published {
+			if event.AggregateID == aggregateID {
+				about = append(about, event)
+			}
+		}
+		return about
+	}
+}
+
 func validateTotalBalanceAcrossAllWallets(t *testing.T) {
-	total_balance := 0
+	total_balance := utils.NewMoney(0, utils.USD)
 	for i := 1; i <= 10; i++ {
 		wallet, err := walletRepo.GetWalletByUserID(context.Background(), fmt.Sprintf("%d", i))
 		assert.NoError(t, err)
-		total_balance += int(wallet.Balance)
+		total_balance = total_balance.Add(wallet.Balance)
 	}
-	assert.Equal(t, total_balance, 10000000)
+	assert.Equal(t, total_balance, utils.MustParseMoney("10000000", utils.USD))
 }
 
 func validateTransactionCount(t *testing.T) {
@@ -200,12 +1525,12 @@ func validateEachWalletBalance(t *testing.T) {
 	for _, wallet := range wallets {
 		all_transactions, err := transactionRepo.GetTransactionsByUserID(context.Background(), wallet.UserID)
 		assert.NoError(t, err)
-		balance := float64(1000000) // starting balance
+		balance := utils.MustParseMoney("1000000", utils.USD) // starting balance
 		for _, transaction := range all_transactions {
 			if transaction.DebitUserID == wallet.UserID {
-				balance -= transaction.Amount
+				balance = balance.Sub(transaction.Amount)
 			} else {
-				balance += transaction.Amount
+				balance = balance.Add(transaction.Amount)
 			}
 			assert.Equal(t, transaction.Status, transactions.Completed)
 		}
@@ -215,3 +1540,11 @@ func validateEachWalletBalance(t *testing.T) {
 		assert.Equal(t, updatedWallet.Balance, balance)
 	}
 }
+
+func validateWalletsReconcileWithLedger(t *testing.T) {
+	for _, wallet := range wallets {
+		reconciliation, err := walletService.ReconcileWallet(context.Background(), wallet.UserID)
+		assert.NoError(t, err)
+		assert.True(t, reconciliation.Balanced, "wallet %s: %+v", wallet.ID, reconciliation.Currencies)
+	}
+}
@@ -1,9 +1,15 @@
 package user
 
 import (
+	"concurrent_money_transfer_system/internals/authz"
+	"concurrent_money_transfer_system/internals/events"
+	"concurrent_money_transfer_system/internals/users"
 	"concurrent_money_transfer_system/tests"
+	"context"
 	"os"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestMain(m *testing.M) {
@@ -49,3 +55,120 @@ func TestPasswordTooShort(t *testing.T) {
 func TestEmailIsRequired(t *testing.T) {
 	tests.MakeRequestAndValidateResponse(t, testData["TestEmailIsRequired"])
 }
+
+func TestCreateUserWithCurrency(t *testing.T) {
+	tests.MakeRequestAndValidateResponse(t, testData["TestCreateUserWithCurrency"])
+}
+
+// signupForLogin creates the user that the login test data logs in as.
+func signupForLogin(t *testing.T) {
+	test_data := testData["TestCreateUser"]
+	test_data.Request.Body["id"] = "abc4"
+	test_data.Request.Body["email"] = "ada@example.com"
+	test_data.Response.Body["id"] = "abc4"
+	test_data.Response.Body["email"] = "ada@example.com"
+	tests.MakeRequestAndValidateResponse(t, test_data)
+}
+
+func TestLogin(t *testing.T) {
+	signupForLogin(t)
+	// The password is only stored hashed
+	user, err := users.NewUserRepo().GetUser("abc4")
+	assert.NoError(t, err)
+	assert.NotEqual(t, "Password123!", user.Password)
+	assert.True(t, users.CheckPassword(user.Password, "Password123!"))
+
+	test_data := testData["TestLogin"]
+	token, _ := tests.MakeRequestAndGetResponse(t, test_data)
+	expected_response := test_data.Response.Body
+	expected_response["access_token"] = token["access_token"]
+	expected_response["expires_at"] = token["expires_at"]
+	assert.True(t, tests.SelectiveEqual(expected_response, token))
+
+	// The token authenticates requests
+	get_user := testData["TestGetUser"]
+	get_user.Request.URL = "api/user/abc4"
+	get_user.Request.AsUser = ""
+	get_user.Request.Headers = map[string]string{"Authorization": "Bearer " + token["access_token"].(string)}
+	response, _ := tests.MakeRequestAndGetResponse(t, get_user)
+	assert.Equal(t, "abc4", response["id"])
+}
+
+func TestLoginWithWrongPassword(t *testing.T) {
+	tests.MakeRequestAndValidateResponse(t, testData["TestLoginWithWrongPassword"])
+}
+
+func TestRequestWithoutToken(t *testing.T) {
+	tests.MakeRequestAndValidateResponse(t, testData["TestRequestWithoutToken"])
+
+	test_data := testData["TestRequestWithoutToken"]
+	test_data.Request.Headers = map[string]string{"Authorization": "Bearer not-a-token"}
+	test_data.Response.Body = map[string]interface{}{"code": "UNAUTHORIZED", "message": "Invalid or expired token"}
+	tests.MakeRequestAndValidateResponse(t, test_data)
+}
+
+func TestGetAnotherUsersData(t *testing.T) {
+	tests.MakeRequestAndValidateResponse(t, testData["TestGetAnotherUsersData"])
+
+	test_data := testData["TestGetAnotherUsersData"]
+	test_data.Request.URL = "wallets?user_id=abc1"
+	tests.MakeRequestAndValidateResponse(t, test_data)
+}
+
+func TestSetRole(t *testing.T) {
+	_, err := users.NewUserRepo().CreateUser(users.User{ID: "admin1", FirstName: "Ada", Email: "ada.admin@example.com", PhoneNumber: "+1234567890", Role: authz.RoleAdmin})
+	assert.NoError(t, err)
+	signup := testData["TestCreateUser"]
+	signup.Request.Body["id"] = "staff1"
+	signup.Request.Body["email"] = "sam@example.com"
+	signup.Request.Body["role"] = "admin" // Ignored, everybody signs up as a user
+	signup.Response.Body["id"] = "staff1"
+	signup.Response.Body["email"] = "sam@example.com"
+	tests.MakeRequestAndValidateResponse(t, signup)
+
+	// Only admins can change roles
+	set_role := testData["TestSetRole"]
+	set_role.Request.AsUser = "staff1"
+	tests.MakeRequestAndValidateResponse(t, tests.TestData{
+		Request:  set_role.Request,
+		Response: testData["TestGetAnotherUsersData"].Response,
+	})
+	tests.MakeRequestAndValidateResponse(t, testData["TestSetRole"])
+	tests.MakeRequestAndValidateResponse(t, testData["TestSetInvalidRole"])
+
+	// Support can read anyone's data but not change it
+	get_user := testData["TestGetAnotherUsersData"]
+	get_user.Request.AsUser = "staff1"
+	get_user.Response = tests.Response{Status: 200}
+	tests.MakeRequestAndGetResponse(t, get_user)
+	tests.MakeRequestAndValidateResponse(t, tests.TestData{
+		Request:  tests.Request{URL: "wallets/disable?user_id=abc1", Method: "PUT", AsUser: "staff1"},
+		Response: testData["TestGetAnotherUsersData"].Response,
+	})
+}
+
+func TestSignupAndDeleteRecordEvents(t *testing.T) {
+	signup := testData["TestCreateUser"]
+	signup.Request.Body["id"] = "abc6"
+	signup.Request.Body["email"] = "grace@example.com"
+	signup.Response.Body["id"] = "abc6"
+	signup.Response.Body["email"] = "grace@example.com"
+	tests.MakeRequestAndValidateResponse(t, signup)
+	tests.MakeRequestAndValidateResponse(t, tests.TestData{
+		Request:  tests.Request{URL: "api/user/abc6", Method: "DELETE", AsUser: "abc6"},
+		Response: tests.Response{Status: 200, Body: map[string]interface{}{"message": "User deleted successfully"}},
+	})
+
+	// The wallet has the ID of its user
+	recorded, err := events.NewOutboxRepo().GetEventsByAggregateID(context.Background(), "abc6")
+	assert.NoError(t, err)
+	assert.Len(t, recorded, 2)
+	assert.Equal(t, events.UserCreated, recorded[0].Type)
+	var user events.UserPayload
+	assert.NoError(t, recorded[0].Decode(&user))
+	assert.Equal(t, events.UserPayload{UserID: "abc6", Email: "grace@example.com"}, user)
+	assert.Equal(t, events.WalletDisabled, recorded[1].Type)
+	var wallet events.WalletPayload
+	assert.NoError(t, recorded[1].Decode(&wallet))
+	assert.Equal(t, events.WalletPayload{WalletID: "abc6", UserID: "abc6"}, wallet)
+}
@@ -0,0 +1,423 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"concurrent_money_transfer_system/internals/authz"
+	"concurrent_money_transfer_system/internals/events"
+	"concurrent_money_transfer_system/internals/ledger"
+	"concurrent_money_transfer_system/internals/storage"
+	"concurrent_money_transfer_system/internals/users"
+	"concurrent_money_transfer_system/internals/wallet"
+	"concurrent_money_transfer_system/internals/webhooks"
+	"concurrent_money_transfer_system/tests"
+	"concurrent_money_transfer_system/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMain(m *testing.M) {
+	tests.Setup()
+	setup()
+	code := m.Run()
+	os.Exit(code)
+}
+
+// fakeClock is moved by the tests instead of waiting for retries to be due
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+var startOfTest = time.Date(2025, 3, 3, 8, 0, 0, 0, time.UTC)
+
+var clock = &fakeClock{now: startOfTest}
+var eventService events.EventService
+var webhookService webhooks.WebhookService
+
+func setup() {
+	ledgerService := ledger.NewLedgerService(ledger.NewLedgerRepo())
+	// The router already created the services, so these return them
+	eventService = events.NewEventService(events.NewOutboxRepo(), events.NewInProcessPublisher())
+	walletService := wallet.NewWalletService(wallet.NewWalletRepo(), ledgerService, eventService, storage.NewMemoryUnitOfWork(), wallet.DefaultLockTimeout, wallet.DefaultShards)
+	webhookService = webhooks.NewWebhookService(webhooks.NewWebhookRepo(), clock, true)
+	webhooks.SetClock(clock)
+	// The partners' servers listen on localhost
+	webhooks.SetAllowPrivateEndpoints(true)
+
+	ctx := context.Background()
+	for _, id := range []string{"w1", "w2"} {
+		users.NewUserRepo().CreateUser(users.User{ID: id, FirstName: "User " + id, Email: id + "@example.com", PhoneNumber: "+1234567890"})
+		walletService.CreateWallet(ctx, id, utils.MustParseMoney("100", utils.USD))
+	}
+	users.NewUserRepo().CreateUser(users.User{ID: "webhook-admin", FirstName: "Admin", Email: "webhook-admin@example.com", PhoneNumber: "+1234567890", Role: authz.RoleAdmin})
+}
+
+// resetWebhooks puts the clock back and forgets the endpoints of the previous test, so they
+// are not sent the transfers of the next one.
+func resetWebhooks() {
+	clock.now = startOfTest
+	webhooks.Reset()
+}
+
+// receiver is a partner's server recording the webhooks it is sent.
+type receiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	status   int // Answered to every request
+	requests []receivedRequest
+}
+
+type receivedRequest struct {
+	header http.Header
+	body   []byte
+}
+
+func newReceiver(t *testing.T, status int) *receiver {
+	r := &receiver{status: status}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, request *http.Request) {
+		body, _ := io.ReadAll(request.Body)
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.requests = append(r.requests, receivedRequest{header: request.Header, body: body})
+		w.WriteHeader(r.status)
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *receiver) setStatus(status int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.status = status
+}
+
+func (r *receiver) received() []receivedRequest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]receivedRequest(nil), r.requests...)
+}
+
+func TestTransferIsDeliveredSigned(t *testing.T) {
+	defer resetWebhooks()
+	partner := newReceiver(t, http.StatusOK)
+	endpoint := registerEndpoint(t, "w1", map[string]interface{}{"user_id": "w1", "url": partner.URL}, 201)
+	secret := endpoint["secret"].(string)
+	assert.NotEmpty(t, secret)
+	assert.Equal(t, []interface{}{"transfer.created", "transfer.completed", "transfer.failed"}, endpoint["event_types"])
+
+	transfer := transferMoney(t, "w2", "w1", "5")
+	deliver(t)
+
+	// Deliveries are not guaranteed to arrive in the order of their events, e.g. after a retry
+	received := make(map[events.EventType]receivedRequest)
+	for _, request := range partner.received() {
+		received[events.EventType(request.header.Get(webhooks.EventTypeHeader))] = request
+	}
+	assert.Len(t, received, 2)
+	for _, eventType := range []events.EventType{events.TransferCreated, events.TransferCompleted} {
+		request := received[eventType]
+		timestamp, err := strconv.ParseInt(request.header.Get(webhooks.TimestampHeader), 10, 64)
+		assert.NoError(t, err)
+		assert.Equal(t, startOfTest.Unix(), timestamp)
+		assert.True(t, webhooks.VerifySignature(secret, timestamp, request.body, request.header.Get(webhooks.SignatureHeader)))
+		assert.False(t, webhooks.VerifySignature("another secret", timestamp, request.body, request.header.Get(webhooks.SignatureHeader)))
+
+		var event events.Event
+		assert.NoError(t, json.Unmarshal(request.body, &event))
+		assert.Equal(t, eventType, event.Type)
+		assert.Equal(t, transfer["id"], event.AggregateID)
+		assert.Equal(t, endpoint["id"].(string)+":"+event.ID, request.header.Get(webhooks.DeliveryIDHeader))
+	}
+
+	// The secret is only shown when the endpoint is registered
+	read := webhookRequest(t, "GET", "api/webhook/"+endpoint["id"].(string), "w1", 200)
+	assert.NotContains(t, read, "secret")
+
+	log := getDeliveries(t, endpoint["id"].(string), "w1", 200)
+	assert.Len(t, log, 2)
+	for _, delivery := range log {
+		assert.Equal(t, "delivered", delivery["status"])
+		assert.Len(t, delivery["attempts"], 1)
+		assert.NotContains(t, delivery, "next_attempt_at")
+	}
+
+	// Events published again are not delivered twice
+	deliver(t)
+	assert.Len(t, partner.received(), 2)
+}
+
+func TestFailedDeliveriesBackOffIntoDeadLetters(t *testing.T) {
+	defer resetWebhooks()
+	partner := newReceiver(t, http.StatusInternalServerError)
+	endpoint := registerEndpoint(t, "w1", map[string]interface{}{"user_id": "w1", "url": partner.URL, "event_types": []string{"transfer.completed"}}, 201)
+	endpointID := endpoint["id"].(string)
+	transferMoney(t, "w1", "w2", "1")
+	deliver(t)
+
+	// Each retry waits twice as long as the previous one
+	wait := webhooks.InitialBackoff
+	for attempt := 1; attempt < webhooks.MaxAttempts; attempt++ {
+		assert.Len(t, partner.received(), attempt)
+		delivery := getDeliveries(t, endpointID, "w1", 200)[0]
+		assert.Equal(t, "pending", delivery["status"])
+		assert.Equal(t, clock.now.Add(wait).Format(time.RFC3339), delivery["next_attempt_at"])
+
+		// Not due yet
+		clock.now = clock.now.Add(wait - time.Second)
+		deliver(t)
+		assert.Len(t, partner.received(), attempt)
+
+		clock.now = clock.now.Add(time.Second)
+		deliver(t)
+		wait = min(2*wait, webhooks.MaxBackoff)
+	}
+
+	assert.Len(t, partner.received(), webhooks.MaxAttempts)
+	deadLetters := getDeadLetters(t, "w1", "w1", 200)
+	assert.Len(t, deadLetters, 1)
+	assert.Equal(t, "dead", deadLetters[0]["status"])
+	assert.Equal(t, "transfer.completed", deadLetters[0]["event_type"])
+	assert.Len(t, deadLetters[0]["attempts"], webhooks.MaxAttempts)
+	lastAttempt := deadLetters[0]["attempts"].([]interface{})[webhooks.MaxAttempts-1].(map[string]interface{})
+	assert.Equal(t, float64(500), lastAttempt["status_code"])
+	assert.Equal(t, "Endpoint answered 500 Internal Server Error", lastAttempt["error"])
+
+	// Dead deliveries are not retried any more
+	clock.now = clock.now.Add(24 * time.Hour)
+	deliver(t)
+	assert.Len(t, partner.received(), webhooks.MaxAttempts)
+
+	deliveryID := deadLetters[0]["id"].(string)
+	redeliverURL := "api/webhook/" + endpointID + "/deliveries/" + deliveryID + "/redeliver"
+	redelivered := webhookRequest(t, "POST", redeliverURL, "w1", 200)
+	assert.Equal(t, "dead", redelivered["status"])
+
+	partner.setStatus(http.StatusNoContent)
+	redelivered = webhookRequest(t, "POST", redeliverURL, "w1", 200)
+	assert.Equal(t, "delivered", redelivered["status"])
+	attempts := redelivered["attempts"].([]interface{})
+	assert.Len(t, attempts, webhooks.MaxAttempts+2)
+	assert.Equal(t, true, attempts[len(attempts)-1].(map[string]interface{})["manual"])
+	assert.Empty(t, getDeadLetters(t, "w1", "w1", 200))
+	// Every attempt is sent with the same delivery ID
+	for _, request := range partner.received() {
+		assert.Equal(t, deliveryID, request.header.Get(webhooks.DeliveryIDHeader))
+	}
+}
+
+func TestUnreachableEndpointIsRetried(t *testing.T) {
+	defer resetWebhooks()
+	partner := newReceiver(t, http.StatusOK)
+	endpoint := registerEndpoint(t, "w2", map[string]interface{}{"user_id": "w2", "url": partner.URL, "event_types": []string{"transfer.completed"}}, 201)
+	partner.Close()
+	transferMoney(t, "w1", "w2", "1")
+	deliver(t)
+
+	delivery := getDeliveries(t, endpoint["id"].(string), "w2", 200)[0]
+	assert.Equal(t, "pending", delivery["status"])
+	attempt := delivery["attempts"].([]interface{})[0].(map[string]interface{})
+	assert.NotContains(t, attempt, "status_code")
+	assert.NotEmpty(t, attempt["error"])
+}
+
+func TestWebhookAccess(t *testing.T) {
+	defer resetWebhooks()
+	partner := newReceiver(t, http.StatusOK)
+	endpointID := registerEndpoint(t, "w1", map[string]interface{}{"user_id": "w1", "url": partner.URL}, 201)["id"].(string)
+
+	response := registerEndpoint(t, "w2", map[string]interface{}{"user_id": "w1", "url": partner.URL}, 403)
+	assert.Equal(t, "FORBIDDEN", response["code"])
+	response = registerEndpoint(t, "w1", map[string]interface{}{"user_id": "w1", "url": "ftp://example.com/hooks"}, 400)
+	assert.Equal(t, "VALIDATION_ERROR", response["code"])
+	response = registerEndpoint(t, "w1", map[string]interface{}{"user_id": "w1", "url": partner.URL, "event_types": []string{"user.created"}}, 400)
+	assert.Equal(t, "VALIDATION_ERROR", response["code"])
+
+	webhookRequest(t, "GET", "api/webhook/"+endpointID, "w2", 403)
+	getDeliveries(t, endpointID, "w2", 403)
+	getDeadLetters(t, "w1", "w2", 403)
+	webhookRequest(t, "DELETE", "api/webhook/"+endpointID, "w2", 403)
+	response = webhookRequest(t, "POST", "api/webhook/"+endpointID+"/deliveries/unknown/redeliver", "w1", 404)
+	assert.Equal(t, "WEBHOOK_DELIVERY_NOT_FOUND", response["code"])
+
+	// Admins can delete endpoints, e.g. of a closed account
+	webhookRequest(t, "DELETE", "api/webhook/"+endpointID, "webhook-admin", 200)
+	response = webhookRequest(t, "GET", "api/webhook/"+endpointID, "w1", 404)
+	assert.Equal(t, "WEBHOOK_NOT_FOUND", response["code"])
+}
+
+func TestSlowEndpointHoldsUpNothingElse(t *testing.T) {
+	defer resetWebhooks()
+	arrived, release := make(chan struct{}), make(chan struct{})
+	slowPartner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, request *http.Request) {
+		arrived <- struct{}{}
+		<-release
+	}))
+	defer slowPartner.Close()
+	defer close(release)
+	partner := newReceiver(t, http.StatusOK)
+	slow := registerEndpoint(t, "w2", map[string]interface{}{"user_id": "w2", "url": slowPartner.URL, "event_types": []string{"transfer.completed"}}, 201)
+	registerEndpoint(t, "w2", map[string]interface{}{"user_id": "w2", "url": partner.URL, "event_types": []string{"transfer.completed"}}, 201)
+	transferMoney(t, "w1", "w2", "1")
+	_, err := eventService.PublishPending(context.Background())
+	assert.NoError(t, err)
+
+	type result struct {
+		delivered int
+		err       error
+	}
+	done := make(chan result)
+	go func() {
+		delivered, err := webhookService.DeliverDue(context.Background())
+		done <- result{delivered, err}
+	}()
+	<-arrived
+
+	// The other endpoint is sent its delivery meanwhile
+	assert.Eventually(t, func() bool { return len(partner.received()) == 1 }, time.Second, 10*time.Millisecond)
+	// The delivery being sent cannot be redelivered at the same time, and its endpoint can
+	// be deleted without waiting for it
+	deliveryID := getDeliveries(t, slow["id"].(string), "w2", 200)[0]["id"].(string)
+	response := webhookRequest(t, "POST", "api/webhook/"+slow["id"].(string)+"/deliveries/"+deliveryID+"/redeliver", "w2", 409)
+	assert.Equal(t, "WEBHOOK_DELIVERY_IN_PROGRESS", response["code"])
+	webhookRequest(t, "DELETE", "api/webhook/"+slow["id"].(string), "w2", 200)
+
+	release <- struct{}{}
+	// The attempt of the deleted endpoint is dropped
+	assert.Equal(t, result{delivered: 1}, <-done)
+	_, err = webhookService.GetDelivery(context.Background(), deliveryID)
+	assert.True(t, utils.IsError(err, utils.ErrWebhookDeliveryNotFound))
+}
+
+func TestEndpointsMustBePublicHTTPS(t *testing.T) {
+	defer resetWebhooks()
+	webhooks.SetAllowPrivateEndpoints(false)
+	defer webhooks.SetAllowPrivateEndpoints(true)
+
+	for _, url := range []string{
+		"http://203.0.113.10/hooks",         // Plain http
+		"https://127.0.0.1/hooks",           // Loopback
+		"https://localhost:8080/hooks",      // Resolves to loopback
+		"https://[::1]/hooks",               // IPv6 loopback
+		"https://10.1.2.3/hooks",            // Private
+		"https://192.168.0.1/hooks",         // Private
+		"https://169.254.169.254/latest",    // Cloud metadata service
+		"https://[::ffff:169.254.169.254]/", // Metadata service mapped into IPv6
+		"https://100.100.100.200/latest",    // Metadata service in shared address space
+		"https://[fe80::1]/hooks",           // IPv6 link-local
+		"https://0.0.0.0/hooks",             // Unspecified
+	} {
+		response := registerEndpoint(t, "w1", map[string]interface{}{"user_id": "w1", "url": url}, 400)
+		assert.Equal(t, "VALIDATION_ERROR", response["code"], url)
+	}
+	registerEndpoint(t, "w1", map[string]interface{}{"user_id": "w1", "url": "https://203.0.113.10/hooks"}, 201)
+}
+
+func TestDeliveriesOnlyReachPublicAddresses(t *testing.T) {
+	defer resetWebhooks()
+	partner := newReceiver(t, http.StatusOK)
+	endpoint := registerEndpoint(t, "w2", map[string]interface{}{"user_id": "w2", "url": partner.URL, "event_types": []string{"transfer.completed"}}, 201)
+
+	// The endpoint's host can resolve to a private address after it was registered
+	webhooks.SetAllowPrivateEndpoints(false)
+	transferMoney(t, "w1", "w2", "1")
+	deliver(t)
+	webhooks.SetAllowPrivateEndpoints(true)
+
+	assert.Empty(t, partner.received())
+	attempt := getDeliveries(t, endpoint["id"].(string), "w2", 200)[0]["attempts"].([]interface{})[0].(map[string]interface{})
+	assert.NotContains(t, attempt, "status_code")
+	assert.Contains(t, attempt["error"], "127.0.0.1 is not a public address")
+}
+
+func TestDeliveriesDoNotFollowRedirects(t *testing.T) {
+	defer resetWebhooks()
+	internal := newReceiver(t, http.StatusOK)
+	redirector := httptest.NewServer(http.RedirectHandler(internal.URL, http.StatusTemporaryRedirect))
+	defer redirector.Close()
+	endpoint := registerEndpoint(t, "w2", map[string]interface{}{"user_id": "w2", "url": redirector.URL, "event_types": []string{"transfer.completed"}}, 201)
+	transferMoney(t, "w1", "w2", "1")
+	deliver(t)
+
+	assert.Empty(t, internal.received())
+	delivery := getDeliveries(t, endpoint["id"].(string), "w2", 200)[0]
+	assert.Equal(t, "pending", delivery["status"])
+	attempt := delivery["attempts"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, float64(http.StatusTemporaryRedirect), attempt["status_code"])
+}
+
+// deliver publishes the pending events and attempts the due deliveries.
+func deliver(t *testing.T) {
+	_, err := eventService.PublishPending(context.Background())
+	assert.NoError(t, err)
+	_, err = webhookService.DeliverDue(context.Background())
+	assert.NoError(t, err)
+}
+
+func registerEndpoint(t *testing.T, asUser string, body map[string]interface{}, status int) map[string]interface{} {
+	response, _ := tests.MakeRequestAndGetResponse(t, tests.TestData{
+		Request:  tests.Request{URL: "api/webhook", Method: "POST", AsUser: asUser, Body: body},
+		Response: tests.Response{Status: status},
+	})
+	return response
+}
+
+func webhookRequest(t *testing.T, method string, url string, asUser string, status int) map[string]interface{} {
+	response, _ := tests.MakeRequestAndGetResponse(t, tests.TestData{
+		Request:  tests.Request{URL: url, Method: method, AsUser: asUser},
+		Response: tests.Response{Status: status},
+	})
+	return response
+}
+
+// getDeliveries returns the delivery log of the endpoint, or nil when the request fails.
+func getDeliveries(t *testing.T, endpointID string, asUser string, status int) []map[string]interface{} {
+	return getList(t, "api/webhook/"+endpointID+"/deliveries", asUser, status)
+}
+
+// getDeadLetters returns the dead deliveries of the user, or nil when the request fails.
+func getDeadLetters(t *testing.T, userID string, asUser string, status int) []map[string]interface{} {
+	return getList(t, "api/webhook/user/"+userID+"/dead-letters", asUser, status)
+}
+
+func getList(t *testing.T, url string, asUser string, status int) []map[string]interface{} {
+	testData := tests.TestData{
+		Request:  tests.Request{URL: url, Method: "GET", AsUser: asUser},
+		Response: tests.Response{Status: status},
+	}
+	if status != 200 {
+		tests.MakeRequestAndGetResponse(t, testData)
+		return nil
+	}
+	list, _ := tests.MakeRequestAndGetListResponse(t, testData)
+	return list
+}
+
+func transferMoney(t *testing.T, senderID string, receiverID string, amount string) map[string]interface{} {
+	response, _ := tests.MakeRequestAndGetResponse(t, tests.TestData{
+		Request: tests.Request{
+			URL:    "api/transaction/transfer",
+			Method: "POST",
+			AsUser: senderID,
+			Body: map[string]interface{}{
+				"sender_id":   senderID,
+				"receiver_id": receiverID,
+				"amount":      amount,
+				"currency":    "USD",
+			},
+		},
+		Response: tests.Response{Status: 200},
+	})
+	return response
+}
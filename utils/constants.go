@@ -5,6 +5,22 @@ type Currency string
 const (
 	USD Currency = "USD"
 	EUR Currency = "EUR"
+	JPY Currency = "JPY"
 )
 
+// currencyExponents is the number of decimal places (minor unit digits) of each supported currency
+var currencyExponents = map[Currency]int{
+	USD: 2,
+	EUR: 2,
+	JPY: 0,
+}
+
+// Exponent returns the number of decimal places of the currency and whether it is supported.
+func (c Currency) Exponent() (int, bool) {
+	exponent, ok := currencyExponents[c]
+	return exponent, ok
+}
+
 type EntityId int
+
+const IdempotencyKeyHeader = "Idempotency-Key"
@@ -28,7 +28,36 @@ const (
 	ErrWalletNotFound      ErrorCode = "WALLET_NOT_FOUND"
 	ErrWalletInactive      ErrorCode = "WALLET_INACTIVE"
 	ErrInsufficientBalance ErrorCode = "INSUFFICIENT_BALANCE"
+	ErrCurrencyMismatch    ErrorCode = "CURRENCY_MISMATCH"
+	ErrAmountOutOfRange    ErrorCode = "AMOUNT_OUT_OF_RANGE"
+	ErrLockTimeout         ErrorCode = "LOCK_TIMEOUT"
+	ErrVersionConflict     ErrorCode = "VERSION_CONFLICT"
 	ErrUserAlreadyExists   ErrorCode = "USER_ALREADY_EXISTS"
+
+	ErrTransactionNotReversible ErrorCode = "TRANSACTION_NOT_REVERSIBLE"
+	ErrRefundExceedsRemaining   ErrorCode = "REFUND_EXCEEDS_REMAINING_AMOUNT"
+	ErrHoldNotPending           ErrorCode = "HOLD_NOT_PENDING"
+
+	ErrIdempotencyKeyReused ErrorCode = "IDEMPOTENCY_KEY_REUSED"
+
+	ErrLimitExceeded ErrorCode = "LIMIT_EXCEEDED"
+
+	ErrScheduleNotFound ErrorCode = "SCHEDULE_NOT_FOUND"
+
+	ErrWebhookNotFound         ErrorCode = "WEBHOOK_NOT_FOUND"
+	ErrWebhookDeliveryNotFound ErrorCode = "WEBHOOK_DELIVERY_NOT_FOUND"
+	ErrWebhookDeliveryBusy     ErrorCode = "WEBHOOK_DELIVERY_IN_PROGRESS"
+
+	ErrLedgerEntryUnbalanced ErrorCode = "LEDGER_ENTRY_UNBALANCED"
+
+	ErrUnauthorized       ErrorCode = "UNAUTHORIZED"
+	ErrInvalidCredentials ErrorCode = "INVALID_CREDENTIALS"
+	ErrForbidden          ErrorCode = "FORBIDDEN"
+
+	ErrQuoteNotFound     ErrorCode = "QUOTE_NOT_FOUND"
+	ErrQuoteExpired      ErrorCode = "QUOTE_EXPIRED"
+	ErrQuoteUsed         ErrorCode = "QUOTE_ALREADY_USED"
+	ErrFXRateUnavailable ErrorCode = "FX_RATE_UNAVAILABLE"
 )
 
 var errorMessages = map[ErrorCode]ErrorDetails{
@@ -60,10 +89,94 @@ var errorMessages = map[ErrorCode]ErrorDetails{
 		Message:    "Insufficient Balance",
 		StatusCode: http.StatusBadRequest,
 	},
+	ErrCurrencyMismatch: {
+		Message:    "Wallet Does Not Hold This Currency",
+		StatusCode: http.StatusBadRequest,
+	},
+	ErrAmountOutOfRange: {
+		Message:    "Amount Is Out Of Range",
+		StatusCode: http.StatusUnprocessableEntity,
+	},
+	ErrLockTimeout: {
+		Message:    "Timed Out Waiting For A Wallet Lock",
+		StatusCode: http.StatusServiceUnavailable,
+	},
+	ErrVersionConflict: {
+		Message:    "Wallet Changed Concurrently, Try Again",
+		StatusCode: http.StatusConflict,
+	},
 	ErrUserAlreadyExists: {
 		Message:    "User Already Exists",
 		StatusCode: http.StatusBadRequest,
 	},
+	ErrIdempotencyKeyReused: {
+		Message:    "Idempotency Key Was Already Used With A Different Request",
+		StatusCode: http.StatusUnprocessableEntity,
+	},
+	ErrLimitExceeded: {
+		Message:    "Transfer Limit Exceeded",
+		StatusCode: http.StatusUnprocessableEntity,
+	},
+	ErrScheduleNotFound: {
+		Message:    "Schedule Not Found",
+		StatusCode: http.StatusNotFound,
+	},
+	ErrWebhookNotFound: {
+		Message:    "Webhook Endpoint Not Found",
+		StatusCode: http.StatusNotFound,
+	},
+	ErrWebhookDeliveryNotFound: {
+		Message:    "Webhook Delivery Not Found",
+		StatusCode: http.StatusNotFound,
+	},
+	ErrWebhookDeliveryBusy: {
+		Message:    "Webhook Delivery Is Being Attempted",
+		StatusCode: http.StatusConflict,
+	},
+	ErrLedgerEntryUnbalanced: {
+		Message:    "Ledger Entry Is Not Balanced",
+		StatusCode: http.StatusInternalServerError,
+	},
+	ErrTransactionNotReversible: {
+		Message:    "Transaction Cannot Be Reversed",
+		StatusCode: http.StatusBadRequest,
+	},
+	ErrRefundExceedsRemaining: {
+		Message:    "Refund Amount Exceeds The Amount Not Yet Refunded",
+		StatusCode: http.StatusBadRequest,
+	},
+	ErrHoldNotPending: {
+		Message:    "Transaction Is Not A Pending Hold",
+		StatusCode: http.StatusBadRequest,
+	},
+	ErrUnauthorized: {
+		Message:    "Unauthorized",
+		StatusCode: http.StatusUnauthorized,
+	},
+	ErrInvalidCredentials: {
+		Message:    "Invalid Email Or Password",
+		StatusCode: http.StatusUnauthorized,
+	},
+	ErrForbidden: {
+		Message:    "You Are Not Allowed To Access This Resource",
+		StatusCode: http.StatusForbidden,
+	},
+	ErrQuoteNotFound: {
+		Message:    "Quote Not Found",
+		StatusCode: http.StatusNotFound,
+	},
+	ErrQuoteExpired: {
+		Message:    "Quote Has Expired",
+		StatusCode: http.StatusBadRequest,
+	},
+	ErrQuoteUsed: {
+		Message:    "Quote Was Already Used By Another Transfer",
+		StatusCode: http.StatusConflict,
+	},
+	ErrFXRateUnavailable: {
+		Message:    "Exchange Rate Unavailable",
+		StatusCode: http.StatusBadRequest,
+	},
 	ErrValidationError: {
 		Message:    "Validation Error",
 		StatusCode: http.StatusBadRequest,
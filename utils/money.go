@@ -0,0 +1,275 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// unboundExponent is the precision used for amounts decoded before their currency is
+// known (e.g. the "amount" field of a request, whose "currency" is a sibling field).
+// It must be at least the largest currency exponent so no precision is lost; the
+// amount is rescaled to the currency's exponent by WithCurrency.
+const unboundExponent = 4
+
+// Money is an amount held as an integer number of minor units (e.g. cents) of a
+// currency, so arithmetic and comparisons are exact.
+// In JSON it is a decimal string ("100.25"); decimal numbers are accepted as input too.
+type Money struct {
+	MinorUnits int64
+	Currency   Currency
+}
+
+func NewMoney(minorUnits int64, currency Currency) Money {
+	return Money{MinorUnits: minorUnits, Currency: currency}
+}
+
+// ParseMoney parses a decimal string such as "100.25" into an amount of the given currency.
+// An empty currency returns an unbound amount that must be bound with WithCurrency.
+func ParseMoney(value string, currency Currency) (Money, error) {
+	exponent := unboundExponent
+	if currency != "" {
+		var ok bool
+		exponent, ok = currency.Exponent()
+		if !ok {
+			return Money{}, NewErrorWithMessage(ErrValidationError, fmt.Sprintf("Currency %s is not supported", currency))
+		}
+	}
+	minorUnits, err := parseDecimal(value, exponent)
+	if err != nil {
+		return Money{}, err
+	}
+	return Money{MinorUnits: minorUnits, Currency: currency}, nil
+}
+
+// MustParseMoney is like ParseMoney but panics on error. It is meant for constants and tests.
+func MustParseMoney(value string, currency Currency) Money {
+	money, err := ParseMoney(value, currency)
+	if err != nil {
+		panic(err)
+	}
+	return money
+}
+
+func parseDecimal(value string, exponent int) (int64, error) {
+	invalid := NewErrorWithMessage(ErrValidationError, fmt.Sprintf("%q is not a valid amount", value))
+
+	negative := strings.HasPrefix(value, "-")
+	value = strings.TrimPrefix(value, "-")
+	whole, fraction, hasPoint := strings.Cut(value, ".")
+	if whole == "" || (hasPoint && fraction == "") {
+		return 0, invalid
+	}
+	if len(fraction) > exponent {
+		// Trailing zeros beyond the currency precision carry no value, e.g. "1.500" USD
+		trimmed := strings.TrimRight(fraction[exponent:], "0")
+		if trimmed != "" {
+			return 0, NewErrorWithMessage(ErrValidationError, fmt.Sprintf("%q has more than %d decimal places", value, exponent))
+		}
+		fraction = fraction[:exponent]
+	}
+	fraction += strings.Repeat("0", exponent-len(fraction))
+
+	digits := whole + fraction
+	for _, r := range digits {
+		if r < '0' || r > '9' {
+			return 0, invalid
+		}
+	}
+	minorUnits, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil {
+		return 0, NewErrorWithMessage(ErrValidationError, fmt.Sprintf("%q is out of range", value))
+	}
+	if negative {
+		minorUnits = -minorUnits
+	}
+	return minorUnits, nil
+}
+
+// IsBound reports whether the amount has been assigned a currency.
+func (m Money) IsBound() bool {
+	return m.Currency != ""
+}
+
+// WithCurrency binds an amount decoded without a currency to the given currency,
+// rescaling it to the currency's exponent. Amounts already in the currency are
+// returned unchanged, and amounts in another currency are rejected.
+func (m Money) WithCurrency(currency Currency) (Money, error) {
+	if m.Currency == currency {
+		return m, nil
+	}
+	if m.IsBound() {
+		return Money{}, NewErrorWithMessage(ErrValidationError, fmt.Sprintf("Amount is in %s, expected %s", m.Currency, currency))
+	}
+	exponent, ok := currency.Exponent()
+	if !ok {
+		return Money{}, NewErrorWithMessage(ErrValidationError, fmt.Sprintf("Currency %s is not supported", currency))
+	}
+	scale := pow10(unboundExponent - exponent)
+	if m.MinorUnits%scale != 0 {
+		return Money{}, NewErrorWithMessage(ErrValidationError, fmt.Sprintf("%s has more than %d decimal places for %s", m.String(), exponent, currency))
+	}
+	return Money{MinorUnits: m.MinorUnits / scale, Currency: currency}, nil
+}
+
+func (m Money) exponent() int {
+	if !m.IsBound() {
+		return unboundExponent
+	}
+	exponent, ok := m.Currency.Exponent()
+	if !ok {
+		return 0
+	}
+	return exponent
+}
+
+// Add returns m + other. Both amounts must be in the same currency. It panics if the sum is
+// out of range, so amounts that come from requests should be added with CheckedAdd.
+func (m Money) Add(other Money) Money {
+	sum, err := m.CheckedAdd(other)
+	if err != nil {
+		panic("money: " + err.Error())
+	}
+	return sum
+}
+
+// Sub returns m - other. Both amounts must be in the same currency. It panics if the
+// difference is out of range, so amounts that come from requests should be subtracted with
+// CheckedSub.
+func (m Money) Sub(other Money) Money {
+	difference, err := m.CheckedSub(other)
+	if err != nil {
+		panic("money: " + err.Error())
+	}
+	return difference
+}
+
+// CheckedAdd returns m + other, failing with AMOUNT_OUT_OF_RANGE instead of overflowing.
+func (m Money) CheckedAdd(other Money) (Money, error) {
+	currency := m.currencyWith(other)
+	sum := m.MinorUnits + other.MinorUnits
+	if (other.MinorUnits > 0 && sum < m.MinorUnits) || (other.MinorUnits < 0 && sum > m.MinorUnits) {
+		return Money{}, outOfRange(m, "+", other)
+	}
+	return Money{MinorUnits: sum, Currency: currency}, nil
+}
+
+// CheckedSub returns m - other, failing with AMOUNT_OUT_OF_RANGE instead of overflowing.
+func (m Money) CheckedSub(other Money) (Money, error) {
+	currency := m.currencyWith(other)
+	difference := m.MinorUnits - other.MinorUnits
+	if (other.MinorUnits > 0 && difference > m.MinorUnits) || (other.MinorUnits < 0 && difference < m.MinorUnits) {
+		return Money{}, outOfRange(m, "-", other)
+	}
+	return Money{MinorUnits: difference, Currency: currency}, nil
+}
+
+func outOfRange(m Money, operator string, other Money) error {
+	return NewErrorWithMessage(ErrAmountOutOfRange, fmt.Sprintf("%s %s %s is out of range", m, operator, other))
+}
+
+func (m Money) currencyWith(other Money) Currency {
+	if m.IsBound() && other.IsBound() && m.Currency != other.Currency {
+		panic(fmt.Sprintf("money: mixing currencies %s and %s", m.Currency, other.Currency))
+	}
+	// An unbound amount has a different scale, so only its zero value mixes with a bound amount
+	if m.IsBound() != other.IsBound() && !m.IsZero() && !other.IsZero() {
+		panic("money: mixing a bound and an unbound amount")
+	}
+	if m.IsBound() {
+		return m.Currency
+	}
+	return other.Currency
+}
+
+// Cmp compares two amounts of the same currency, returning -1, 0 or +1.
+func (m Money) Cmp(other Money) int {
+	m.currencyWith(other)
+	switch {
+	case m.MinorUnits < other.MinorUnits:
+		return -1
+	case m.MinorUnits > other.MinorUnits:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func (m Money) LessThan(other Money) bool {
+	return m.Cmp(other) < 0
+}
+
+func (m Money) IsZero() bool {
+	return m.MinorUnits == 0
+}
+
+func (m Money) IsPositive() bool {
+	return m.MinorUnits > 0
+}
+
+func (m Money) IsNegative() bool {
+	return m.MinorUnits < 0
+}
+
+// String formats the amount as a decimal string with the currency's number of decimal places.
+func (m Money) String() string {
+	exponent := m.exponent()
+	minorUnits := m.MinorUnits
+	sign := ""
+	if minorUnits < 0 {
+		sign = "-"
+	}
+	abs := uint64(minorUnits)
+	if minorUnits < 0 {
+		abs = uint64(-(minorUnits + 1)) + 1 // avoids overflow for math.MinInt64
+	}
+	digits := strconv.FormatUint(abs, 10)
+	if exponent == 0 {
+		return sign + digits
+	}
+	if len(digits) <= exponent {
+		digits = strings.Repeat("0", exponent-len(digits)+1) + digits
+	}
+	whole, fraction := digits[:len(digits)-exponent], digits[len(digits)-exponent:]
+	if !m.IsBound() {
+		// Without a currency there is no fixed number of decimal places to show
+		fraction = strings.TrimRight(fraction, "0")
+		if fraction == "" {
+			return sign + whole
+		}
+	}
+	return sign + whole + "." + fraction
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(m.String())), nil
+}
+
+// UnmarshalJSON accepts a decimal string or a JSON number. The amount stays unbound
+// unless the Money already carries a currency.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if bytes.Equal(data, []byte("null")) {
+		return nil
+	}
+	value := string(data)
+	if strings.HasPrefix(value, `"`) {
+		unquoted, err := strconv.Unquote(value)
+		if err != nil {
+			return err
+		}
+		value = strings.TrimSpace(unquoted)
+	}
+	money, err := ParseMoney(value, m.Currency)
+	if err != nil {
+		return err
+	}
+	*m = money
+	return nil
+}
+
+func pow10(n int) int64 {
+	return int64(math.Pow10(n))
+}
@@ -3,12 +3,22 @@ package utils
 import (
 	"fmt"
 	"net/http"
+	"reflect"
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/validator/v10"
 )
 
-var validate = validator.New()
+var validate = newValidator()
+
+func newValidator() *validator.Validate {
+	v := validator.New()
+	// Money is validated by its minor units, so tags like required and min=0 apply to the amount
+	v.RegisterCustomTypeFunc(func(field reflect.Value) interface{} {
+		return field.Interface().(Money).MinorUnits
+	}, Money{})
+	return v
+}
 
 func BindAndValidateRequest(c *gin.Context, request interface{}) error {
 	err := c.ShouldBindJSON(request)